@@ -16,9 +16,12 @@ import (
 	"time"
 
 	"github.com/MakeNowJust/heredoc/v2"
+
+	"chainguard.dev/apko/pkg/apk/expandapk"
 )
 
 const apkIndexFilename = "APKINDEX"
+
 const descriptionFilename = "DESCRIPTION"
 
 // Go template for generating the APKINDEX file from an ApkIndex struct
@@ -63,14 +66,20 @@ var apkIndexTemplate = template.Must(template.New(apkIndexFilename).Funcs(
 		D:{{join .Dependencies}}
 		{{- end}}
 		{{- if .InstallIf}}
-		i:{{.InstallIf}}
+		i:{{join .InstallIf}}
 		{{- end}}
 		{{- if .Provides}}
 		p:{{join .Provides}}
 		{{- end}}
+		{{- if .Replaces}}
+		r:{{join .Replaces}}
+		{{- end}}
 		{{- if .ProviderPriority}}
 		k:{{.ProviderPriority}}
 		{{- end}}
+		{{- if .DataHash}}
+		H:{{.DataHash}}
+		{{- end}}
 
 	`)))
 
@@ -80,6 +89,33 @@ type APKIndex struct { //nolint:revive
 	Packages    []*Package
 }
 
+// IndexMetadata describes an index as a whole, rather than the packages in it.
+type IndexMetadata struct {
+	// Description is the content of the DESCRIPTION member, usually the version of the
+	// repository, without surrounding whitespace. It is empty if the index has none.
+	Description string
+	// Arch is the architecture that the packages in the index are built for, if they are all
+	// built for the same one, not counting noarch packages. It is empty otherwise.
+	Arch string
+	// Count is the number of packages in the index.
+	Count int
+}
+
+// Metadata returns the metadata of the index.
+func (i *APKIndex) Metadata() IndexMetadata {
+	m := IndexMetadata{Description: strings.TrimSpace(i.Description), Count: len(i.Packages)}
+	for _, pkg := range i.Packages {
+		switch {
+		case pkg.Arch == "" || pkg.Arch == "noarch":
+		case m.Arch == "":
+			m.Arch = pkg.Arch
+		case m.Arch != pkg.Arch:
+			return IndexMetadata{Description: m.Description, Count: m.Count}
+		}
+	}
+	return m
+}
+
 // Splitting empty string results in single element array with one empty string, which would
 // be treated as package with empty name.
 func splitRepeatedField(val string) []string {
@@ -96,7 +132,28 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 		defer closer.Close()
 	}
 
-	indexScanner := bufio.NewScanner(apkIndexUnpacked)
+	packages := []*Package{}
+	err := NewIndexReader(apkIndexUnpacked).ForEach(func(pkg *Package) error {
+		packages = append(packages, pkg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
+// IndexReader parses a plain (uncompressed) APKINDEX file one package at a time, so
+// callers can filter packages without holding the whole index in memory.
+type IndexReader struct {
+	scanner *bufio.Scanner
+	linenr  int
+}
+
+// NewIndexReader returns an IndexReader that reads the index from r.
+func NewIndexReader(r io.Reader) *IndexReader {
+	indexScanner := bufio.NewScanner(r)
 
 	// We have seen alpine's community/coq package a provides line with 72KB of data in it.
 	// The default MaxScanTokenSize for bufio.Scanner is 64KB. We allow buf to allocate up
@@ -107,22 +164,27 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 	meg := 1024 * 1024
 	indexScanner.Buffer(buf, meg)
 
-	pkg := &Package{}
-	linenr := 1
+	return &IndexReader{
+		scanner: indexScanner,
+		linenr:  1,
+	}
+}
 
-	packages := []*Package{}
-	for indexScanner.Scan() {
-		line := indexScanner.Text()
+// Next returns the next package in the index, or io.EOF when there are no more.
+func (r *IndexReader) Next() (*Package, error) {
+	pkg := &Package{}
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
 		if len(line) == 0 {
 			if pkg.Name != "" {
-				packages = append(packages, pkg)
+				return pkg, nil
 			}
 			pkg = &Package{}
 			continue
 		}
 
 		if len(line) > 1 && line[1:2] != ":" {
-			return nil, fmt.Errorf("cannot parse line %d: expected \":\" in not found", linenr)
+			return nil, fmt.Errorf("cannot parse line %d: expected \":\" in not found", r.linenr)
 		}
 
 		token := line[:1]
@@ -149,15 +211,16 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 			pkg.Dependencies = splitRepeatedField(val)
 		case "p":
 			pkg.Provides = splitRepeatedField(val)
+		case "r":
+			pkg.Replaces = splitRepeatedField(val)
 		case "c":
 			pkg.RepoCommit = val
 		case "t":
-			i, err := strconv.ParseInt(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse build time %s: %w", val, err)
+			// A build time that cannot be parsed is treated as unknown.
+			if i, err := strconv.ParseInt(val, 10, 64); err == nil {
+				pkg.BuildDate = i
+				pkg.BuildTime = buildTime(i)
 			}
-			pkg.BuildDate = i
-			pkg.BuildTime = time.Unix(i, 0).UTC()
 		case "i":
 			pkg.InstallIf = splitRepeatedField(val)
 		case "S":
@@ -187,23 +250,45 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 				}
 				pkg.Checksum = checksum
 			}
+		case "H":
+			// sha256 of the data section, hex-encoded like the .PKGINFO datahash.
+			pkg.DataHash = val
 		}
 
-		linenr++
+		r.linenr++
 	}
 
-	return packages, indexScanner.Err()
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// ForEach calls fn for each remaining package in the index, stopping at the first error.
+func (r *IndexReader) ForEach(fn func(*Package) error) error {
+	for {
+		pkg, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(pkg); err != nil {
+			return err
+		}
+	}
 }
 
 func IndexFromArchive(archive io.ReadCloser) (*APKIndex, error) {
-	gzipReader, err := gzip.NewReader(archive)
+	decompressed, err := expandapk.NewDecompressor(archive)
 	if err != nil {
 		return nil, err
 	}
 
-	defer gzipReader.Close()
+	defer decompressed.Close()
 
-	tarReader := tar.NewReader(gzipReader)
+	tarReader := tar.NewReader(decompressed)
 	apkindex := &APKIndex{}
 
 	for {
@@ -2,6 +2,7 @@ package apk
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
@@ -33,6 +34,7 @@ func TestSinglePackage(t *testing.T) {
 		c:af13bd168c9d86ede4ad1be5c4ceac79253a7e26
 		D:so:libc.musl-x86_64.so.1
 		p:thing1 thing2
+		r:old-pkg
 		i:abc xyz
 		k:9001
 
@@ -55,6 +57,7 @@ func TestSinglePackage(t *testing.T) {
 	assert.Equal("http://a.package.org", pkg.URL)
 	assert.Equal([]string{"so:libc.musl-x86_64.so.1"}, pkg.Dependencies)
 	assert.Equal([]string{"thing1", "thing2"}, pkg.Provides)
+	assert.Equal([]string{"old-pkg"}, pkg.Replaces)
 	assert.Equal([]string{"abc", "xyz"}, pkg.InstallIf)
 	assert.EqualValues(9180, pkg.Size)
 	assert.EqualValues(40960, pkg.InstalledSize)
@@ -135,6 +138,43 @@ func TestParseFromArchive(t *testing.T) {
 	assert.Len(apkIndex.Packages, 2)
 }
 
+func TestIndexMetadata(t *testing.T) {
+	file, err := os.Open("testdata/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	apkIndex, err := IndexFromArchive(file)
+	require.NoError(t, err)
+	require.Equal(t, IndexMetadata{Description: "v20210402-2123-gabcdef", Arch: "x86_64", Count: 2}, apkIndex.Metadata())
+
+	t.Run("no description", func(t *testing.T) {
+		index := "P:a-pkg\nV:1.0.0-r0\nA:noarch\n\nP:b-pkg\nV:1.0.0-r0\nA:aarch64\n\n"
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: apkIndexFilename, Mode: 0o644, Size: int64(len(index))}))
+		_, err := io.WriteString(tw, index)
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		require.NoError(t, gw.Close())
+
+		apkIndex, err := IndexFromArchive(io.NopCloser(&buf))
+		require.NoError(t, err)
+		require.Equal(t, IndexMetadata{Arch: "aarch64", Count: 2}, apkIndex.Metadata())
+	})
+
+	t.Run("mixed architectures", func(t *testing.T) {
+		apkIndex := &APKIndex{Packages: []*Package{{Name: "a", Arch: "x86_64"}, {Name: "b", Arch: "aarch64"}}}
+		require.Equal(t, IndexMetadata{Count: 2}, apkIndex.Metadata())
+	})
+
+	t.Run("named index", func(t *testing.T) {
+		repo := Repository{URI: "https://example.com/main/x86_64"}
+		named := NewNamedRepositoryWithIndex("", repo.WithIndex(apkIndex))
+		withMetadata, ok := named.(IndexWithMetadata)
+		require.True(t, ok, "named index should have metadata")
+		require.Equal(t, apkIndex.Metadata(), withMetadata.Metadata())
+	})
+}
+
 // Test reading from io.Reader that doesn't implement io.Closer
 func TestSinglePackageOnlyReader(t *testing.T) {
 	apkIndexFile := strings.NewReader(heredoc.Doc(`
@@ -243,3 +283,103 @@ func TestEmptyRepeatedFields(t *testing.T) {
 	require.Len(t, pkg.Provides, 0, "Expected no provides")
 	require.Len(t, pkg.Dependencies, 0, "Expected no dependencies")
 }
+
+func TestIndexReader(t *testing.T) {
+	const count = 50000
+
+	// Generate the index as it is read so that it never exists in memory in full.
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < count; i++ {
+			if _, err := fmt.Fprintf(pw, "P:pkg-%d\nV:1.0.%d-r0\nA:x86_64\nD:so:libc.musl-x86_64.so.1\n\n", i, i); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	seen, matched := 0, 0
+	err := NewIndexReader(pr).ForEach(func(pkg *Package) error {
+		require.Equal(t, fmt.Sprintf("pkg-%d", seen), pkg.Name)
+		require.Equal(t, fmt.Sprintf("1.0.%d-r0", seen), pkg.Version)
+		if strings.HasSuffix(pkg.Name, "0") {
+			matched++
+		}
+		seen++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, count, seen)
+	require.Equal(t, count/10, matched)
+
+	t.Run("next", func(t *testing.T) {
+		r := NewIndexReader(strings.NewReader("P:a\nV:1\n\nP:b\nV:2\n\n"))
+		for _, want := range []string{"a", "b"} {
+			pkg, err := r.Next()
+			require.NoError(t, err)
+			require.Equal(t, want, pkg.Name)
+		}
+		_, err := r.Next()
+		require.ErrorIs(t, err, io.EOF)
+	})
+	t.Run("callback error stops reading", func(t *testing.T) {
+		stop := fmt.Errorf("stop")
+		calls := 0
+		err := NewIndexReader(strings.NewReader("P:a\nV:1\n\nP:b\nV:2\n\n")).ForEach(func(*Package) error {
+			calls++
+			return stop
+		})
+		require.ErrorIs(t, err, stop)
+		require.Equal(t, 1, calls)
+	})
+}
+
+func TestFindPackages(t *testing.T) {
+	names := []string{"py3-pip", "python3", "py3-setuptools", "py3", "libpy3-dev", "busybox", "py3-pip-doc"}
+	var raw strings.Builder
+	idx := &APKIndex{}
+	for _, name := range names {
+		fmt.Fprintf(&raw, "P:%s\nV:1.0.0-r0\n\n", name)
+		idx.Packages = append(idx.Packages, &Package{Name: name, Version: "1.0.0-r0"})
+	}
+
+	for _, tt := range []struct {
+		pattern string
+		options []FindOption
+		want    []string
+	}{
+		{pattern: "py3-*", want: []string{"py3-pip", "py3-setuptools", "py3-pip-doc"}},
+		{pattern: "py3-pip", want: []string{"py3-pip"}},
+		{pattern: "*-doc", want: []string{"py3-pip-doc"}},
+		{pattern: "py?hon3", want: []string{"python3"}},
+		{pattern: "nothing*", want: []string{}},
+		{pattern: "^py(3|thon3)$", options: []FindOption{WithRegexp(true)}, want: []string{"python3", "py3"}},
+		{pattern: "py3-", options: []FindOption{WithRegexp(true)}, want: []string{"py3-pip", "py3-setuptools", "libpy3-dev", "py3-pip-doc"}},
+	} {
+		t.Run(tt.pattern, func(t *testing.T) {
+			packageNames := func(pkgs []*Package) []string {
+				names := []string{}
+				for _, pkg := range pkgs {
+					names = append(names, pkg.Name)
+				}
+				return names
+			}
+
+			found, err := idx.FindPackages(tt.pattern, tt.options...)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, packageNames(found))
+
+			streamed, err := NewIndexReader(strings.NewReader(raw.String())).FindPackages(tt.pattern, tt.options...)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, packageNames(streamed))
+		})
+	}
+
+	t.Run("invalid patterns", func(t *testing.T) {
+		_, err := idx.FindPackages("py3-[")
+		require.Error(t, err)
+		_, err = idx.FindPackages("py3-(", WithRegexp(true))
+		require.Error(t, err)
+	})
+}
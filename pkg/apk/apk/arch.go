@@ -13,6 +13,24 @@
 // limitations under the License.
 package apk
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.lsp.dev/uri"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+)
+
+// knownArchs are the architectures DiscoverArchitectures probes for, as Go architecture names.
+var knownArchs = []string{"386", "amd64", "arm64", "arm/v6", "arm/v7", "ppc64le", "s390x", "riscv64", "loongarch64"}
+
 func ArchToAPK(in string) string {
 	switch in {
 	case "i386", "386":
@@ -29,3 +47,84 @@ func ArchToAPK(in string) string {
 		return in
 	}
 }
+
+// SupportedArchs returns the apk architectures that APKToGoArch knows, in the order of knownArchs.
+func SupportedArchs() []string {
+	archs := make([]string, 0, len(knownArchs))
+	for _, arch := range knownArchs {
+		archs = append(archs, ArchToAPK(arch))
+	}
+	return archs
+}
+
+// APKToGoArch is the inverse of ArchToAPK: it returns the Go architecture, as used in OCI image
+// platforms, for an apk architecture. Go names and their aliases, such as "386" or "i386" for
+// "x86", are accepted as well. It returns an error for architectures not in SupportedArchs.
+func APKToGoArch(apkArch string) (string, error) {
+	apkArch = ArchToAPK(apkArch)
+	for _, arch := range knownArchs {
+		if ArchToAPK(arch) == apkArch {
+			return arch, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported architecture %q", apkArch)
+}
+
+// DiscoverArchitectures returns the apk architectures for which the repository at repoURI
+// publishes an APKINDEX.tar.gz, in the order of knownArchs. Local repositories are checked
+// on disk, remote ones with a HEAD request using client.
+func DiscoverArchitectures(ctx context.Context, repoURI string, client *http.Client) ([]string, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "DiscoverArchitectures")
+	defer span.End()
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	repoURI = strings.TrimSuffix(repoURI, "/")
+	remote := strings.HasPrefix(repoURI, "https://") || strings.HasPrefix(repoURI, "http://")
+
+	found := make([]bool, len(knownArchs))
+	var g errgroup.Group
+	for i, goarch := range knownArchs {
+		g.Go(func() error {
+			u := IndexURL(repoURI, ArchToAPK(goarch))
+			if !remote {
+				asURL, err := url.Parse(string(uri.New(u)))
+				if err != nil {
+					return fmt.Errorf("failed to parse repo as URI: %w", err)
+				}
+				if _, err := os.Stat(asURL.Path); err != nil {
+					if errors.Is(err, fs.ErrNotExist) {
+						return nil
+					}
+					return err
+				}
+				found[i] = true
+				return nil
+			}
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return fmt.Errorf("probing %s: %w", u, err)
+			}
+			resp.Body.Close()
+			found[i] = resp.StatusCode == http.StatusOK
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	archs := []string{}
+	for i, goarch := range knownArchs {
+		if found[i] {
+			archs = append(archs, ArchToAPK(goarch))
+		}
+	}
+	return archs, nil
+}
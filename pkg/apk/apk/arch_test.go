@@ -0,0 +1,97 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverArchitectures(t *testing.T) {
+	ctx := context.Background()
+
+	// Lay out a repository that only publishes x86_64 and aarch64.
+	repo := t.TempDir()
+	for _, arch := range []string{"x86_64", "aarch64"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(repo, arch), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(repo, arch, indexFilename), nil, 0o644)) //nolint:gosec // we're writing a test file
+	}
+
+	t.Run("remote", func(t *testing.T) {
+		client := &http.Client{Transport: &testLocalTransport{root: repo}}
+		archs, err := DiscoverArchitectures(ctx, "https://example.com", client)
+		require.NoError(t, err)
+		require.Equal(t, []string{"x86_64", "aarch64"}, archs)
+	})
+	t.Run("local", func(t *testing.T) {
+		archs, err := DiscoverArchitectures(ctx, repo, nil)
+		require.NoError(t, err)
+		require.Equal(t, []string{"x86_64", "aarch64"}, archs)
+	})
+	t.Run("none", func(t *testing.T) {
+		client := &http.Client{Transport: &testLocalTransport{fail: true}}
+		archs, err := DiscoverArchitectures(ctx, "https://example.com", client)
+		require.NoError(t, err)
+		require.Empty(t, archs)
+	})
+}
+
+func TestAPKToGoArch(t *testing.T) {
+	for _, tt := range []struct {
+		goArch, apkArch string
+	}{
+		{"386", "x86"},
+		{"amd64", "x86_64"},
+		{"arm64", "aarch64"},
+		{"arm/v6", "armhf"},
+		{"arm/v7", "armv7"},
+		{"ppc64le", "ppc64le"},
+		{"s390x", "s390x"},
+		{"riscv64", "riscv64"},
+		{"loongarch64", "loongarch64"},
+	} {
+		t.Run(tt.apkArch, func(t *testing.T) {
+			require.Equal(t, tt.apkArch, ArchToAPK(tt.goArch))
+			goArch, err := APKToGoArch(tt.apkArch)
+			require.NoError(t, err)
+			require.Equal(t, tt.goArch, goArch)
+			require.Contains(t, SupportedArchs(), tt.apkArch)
+		})
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, apkArch := range SupportedArchs() {
+			goArch, err := APKToGoArch(apkArch)
+			require.NoError(t, err)
+			require.Equal(t, apkArch, ArchToAPK(goArch))
+		}
+	})
+	t.Run("aliases", func(t *testing.T) {
+		for alias, want := range map[string]string{"i386": "386", "386": "386", "amd64": "amd64"} {
+			goArch, err := APKToGoArch(alias)
+			require.NoError(t, err)
+			require.Equal(t, want, goArch)
+		}
+	})
+	t.Run("unknown", func(t *testing.T) {
+		_, err := APKToGoArch("pdp11")
+		require.ErrorContains(t, err, `unsupported architecture "pdp11"`)
+	})
+}
@@ -15,14 +15,22 @@
 package apk
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
 )
 
 // This is terrible but simpler than plumbing around a cache for now.
@@ -31,9 +39,11 @@ import (
 var globalEtagCache = &etagCache{}
 
 type etagResp struct {
-	resp      *http.Response
-	err       error
-	cacheFile string
+	resp *http.Response
+	err  error
+	// where the file is in the cache, if it was cached
+	key    CacheKey
+	cached bool
 }
 
 type etagCache struct {
@@ -48,13 +58,14 @@ type etagCache struct {
 // in a sync.Map[string]etagResp. If we request the same URL multiple times, we will only ever reach out to
 // the internet for the first once and reuse the results for all subsequent calls (unless the response does
 // not have an etag).
-func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile string) (*http.Response, error) {
+func (e *etagCache) get(t *cacheTransport, request *http.Request, key CacheKey) (*http.Response, error) {
+	ctx := request.Context()
 	url := request.URL.String()
 
 	// Do all the expensive things inside the once.
 	once, _ := e.etags.LoadOrStore(url, &sync.Once{})
 	once.(*sync.Once).Do(func() {
-		req := request.Clone(request.Context())
+		req := request.Clone(ctx)
 		req.Method = http.MethodHead
 		resp, rerr := t.wrapped.Do(req)
 		if resp != nil {
@@ -71,33 +82,41 @@ func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile stri
 
 		initialEtag, ok := etagFromResponse(resp)
 		if !ok {
+			// Without an etag, fall back to revalidating with Last-Modified if the server sends it.
+			if resp.Header.Get("Last-Modified") != "" {
+				err := t.revalidateLastModified(request, key)
+				e.resps.Store(url, etagResp{
+					err:    err,
+					key:    key,
+					cached: err == nil,
+				})
+			}
 			return
 		}
 
-		// We simulate content-based addressing with the etag values using an .etag
-		// file extension.
-		etagFile := cacheFileFromEtag(cacheFile, initialEtag)
-		if _, err := os.Stat(etagFile); err == nil {
+		// We simulate content-based addressing with the etag values.
+		etagKey := key
+		etagKey.Etag = initialEtag
+		if ok, err := t.cache.Has(ctx, etagKey); err == nil && ok {
+			t.touch(etagKey)
 			e.resps.Store(url, etagResp{
-				cacheFile: etagFile,
+				key:    etagKey,
+				cached: true,
 			})
 			return
 		}
 
 		// Only download the index once.
-		etagFile, err := t.retrieveAndSaveFile(request, func(r *http.Response) (string, error) {
-			// On the etag path, use the etag from the actual response to
-			// compute the final file name.
-			finalEtag, ok := etagFromResponse(r)
-			if !ok {
-				return "", fmt.Errorf("GET response did not contain an etag, but HEAD returned %q", initialEtag)
-			}
-
-			return cacheFileFromEtag(cacheFile, finalEtag), nil
-		})
+		etagKey, resp, err := t.saveByEtag(request, etagKey)
+		if err == nil && resp == nil {
+			// The server sends etags now, so a copy revalidated with Last-Modified is stale.
+			t.forget(ctx, lastmodKey(key))
+		}
 		e.resps.Store(url, etagResp{
-			err:       err,
-			cacheFile: etagFile,
+			resp:   resp,
+			err:    err,
+			key:    etagKey,
+			cached: err == nil && resp == nil,
 		})
 	})
 
@@ -110,51 +129,216 @@ func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile stri
 	resp := v.(etagResp)
 
 	// If we didn't manage to cache it, return the response and/or error.
-	if resp.cacheFile == "" {
+	if !resp.cached {
 		return resp.resp, resp.err
 	}
 
-	f, err := os.Open(resp.cacheFile)
-	if err != nil {
-		return nil, fmt.Errorf("open(%q): %w", resp.cacheFile, err)
+	rc, err := t.cache.Get(ctx, resp.key)
+	if errors.Is(err, fs.ErrNotExist) {
+		// It was cached by another APK, in a Cache of its own, so store it in this one too.
+		var saved *http.Response
+		if resp.key.Etag != "" {
+			resp.key, saved, err = t.saveByEtag(request, resp.key)
+		} else {
+			err = t.revalidateLastModified(request, resp.key)
+		}
+		if err != nil || saved != nil {
+			return saved, err
+		}
+		rc, err = t.cache.Get(ctx, resp.key)
 	}
-
-	fi, err := f.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("stat(%q): %w", resp.cacheFile, err)
+		return nil, fmt.Errorf("reading %s from cache: %w", request.URL.Redacted(), err)
 	}
+	return cachedResponse(rc), nil
+}
 
+// cachedResponse returns a response serving the contents of rc, read from the cache.
+func cachedResponse(rc io.ReadCloser) *http.Response {
+	size := int64(-1)
+	if f, ok := rc.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if fi, err := f.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
 	return &http.Response{
 		StatusCode:    http.StatusOK,
-		Body:          f,
-		ContentLength: fi.Size(),
-	}, nil
+		Body:          rc,
+		ContentLength: size,
+	}
 }
 
-// cache
+// CacheKey identifies a file downloaded from a repository.
+type CacheKey struct {
+	// Repo is the repository URL without the architecture, e.g. https://dl-cdn.alpinelinux.org/alpine/v3.16/main.
+	Repo string
+	// Arch is the architecture directory within the repository.
+	Arch string
+	// Filename is the name of the file, such as an .apk or APKINDEX.tar.gz.
+	Filename string
+	// Etag is the etag the server returned for the file, if any.
+	// Files that can change in place, like indexes, are only cached with an etag.
+	Etag string
+}
+
+// Cache stores files downloaded from repositories. The cache directory set with WithCache is one,
+// and WithCacheBackend sets another.
+type Cache interface {
+	// Get returns the contents stored for key, which the caller must close.
+	// It returns an error wrapping fs.ErrNotExist if the key is not present.
+	Get(ctx context.Context, key CacheKey) (io.ReadCloser, error)
+	// Put stores the contents of r for key. Packages are stored as they are downloaded, so if
+	// reading r fails, Put must return an error and store nothing.
+	Put(ctx context.Context, key CacheKey, r io.Reader) error
+	// Has reports whether key is present.
+	Has(ctx context.Context, key CacheKey) (bool, error)
+}
+
+// cacheKeyFromURL returns the key for a file within a repository. The last two path elements of
+// the URL are the architecture and filename, everything before that is the repository.
+func cacheKeyFromURL(u url.URL) CacheKey {
+	u.ForceQuery = false
+	u.RawFragment = ""
+	u.RawQuery = ""
+	filename := filepath.Base(u.Path)
+	archDir := filepath.Dir(u.Path)
+	arch := filepath.Base(archDir)
+	// include the hostname
+	u.Path = filepath.Dir(archDir)
+
+	return CacheKey{
+		Repo:     u.String(),
+		Arch:     arch,
+		Filename: filename,
+	}
+}
+
+// cache is the Cache implementation backed by a local directory, set with WithCache. In addition
+// to the files downloaded from repositories, it also holds expanded packages.
 type cache struct {
 	dir     string
 	offline bool
+
+	// entries currently being fetched or expanded, which PurgeCache must not evict
+	inUseMu sync.Mutex
+	inUse   map[string]int
 }
 
-// client return an http.Client that knows how to read from and write to the cache
-// key is in the implementation of https://pkg.go.dev/net/http#RoundTripper
-func (c cache) client(wrapped *http.Client, etagRequired bool) *http.Client {
-	return &http.Client{
-		Transport: &cacheTransport{
-			wrapped:      wrapped,
-			root:         c.dir,
-			offline:      c.offline,
-			etagRequired: etagRequired,
-		},
+var (
+	_ Cache            = (*cache)(nil)
+	_ revalidatedCache = (*cache)(nil)
+)
+
+// path returns where key is stored within the cache directory.
+func (c *cache) path(key CacheKey) (string, error) {
+	// url encode it so it can be a single directory
+	cacheFile := filepath.Join(c.dir, url.QueryEscape(key.Repo), key.Arch, key.Filename)
+	// validate it is within root
+	cacheFile = filepath.Clean(cacheFile)
+	cleanroot := filepath.Clean(c.dir)
+	if !strings.HasPrefix(cacheFile, cleanroot) {
+		return "", fmt.Errorf("cache file %s is not within root %s", cacheFile, cleanroot)
+	}
+	if key.Etag != "" {
+		cacheFile = cacheFileFromEtag(cacheFile, key.Etag)
+	}
+	return cacheFile, nil
+}
+
+func (c *cache) Get(_ context.Context, key CacheKey) (io.ReadCloser, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (c *cache) Put(_ context.Context, key CacheKey, r io.Reader) error {
+	p, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	// Keep PurgeCache away from the file until it is written.
+	release := c.acquire(p)
+	defer release()
+	return writeCacheFile(p, r)
+}
+
+func (c *cache) Has(_ context.Context, key CacheKey) (bool, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// revalidatedCache is implemented by Caches that keep the time each file was stored or last
+// revalidated with its repository, as the cache directory does with modification times.
+// WithOffline, WithIndexCacheTTL and IndexAge need it to find the newest copy of an index,
+// whatever its etag. With other Caches, indexes are always revalidated, so they are not
+// available offline.
+type revalidatedCache interface {
+	// newest opens the newest copy of the file for key, which has no etag, and returns the
+	// time it was stored or last revalidated.
+	newest(key CacheKey) (io.ReadCloser, time.Time, error)
+	// touch records that the copy for key was revalidated now.
+	touch(key CacheKey)
+	// remove removes key, if it is present.
+	remove(key CacheKey) error
+}
+
+func (c *cache) newest(key CacheKey) (io.ReadCloser, time.Time, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	newest, fi, err := newestCachedIndex(p)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	f, err := os.Open(newest)
+	if err != nil {
+		return nil, time.Time{}, err
 	}
+	return f, fi.ModTime(), nil
 }
 
+func (c *cache) touch(key CacheKey) {
+	if p, err := c.path(key); err == nil {
+		touchCached(p)
+	}
+}
+
+func (c *cache) remove(key CacheKey) error {
+	p, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// cacheTransport serves files from a Cache and stores files downloaded from repositories in it.
+// Files that do not change once published, like packages, are only downloaded if they are not
+// in the cache, and are stored as they are read, see APK.readThrough. If etagRequired is set,
+// files are instead revalidated with the repository, and stored under the etag it returns, or
+// with their Last-Modified value.
 type cacheTransport struct {
 	wrapped      *http.Client
-	root         string
-	offline      bool
+	cache        Cache
 	etagRequired bool
+	// only read from the cache, set by WithOffline
+	offline bool
+	// how long a cached index is used without revalidating it, set by WithIndexCacheTTL
+	indexTTL time.Duration
 }
 
 func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error) {
@@ -162,75 +346,57 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 	if request.URL == nil {
 		return nil, fmt.Errorf("no URL in request")
 	}
-	cacheFile, err := cachePathFromURL(t.root, *request.URL)
-	if err != nil {
-		return nil, fmt.Errorf("invalid cache path based on URL: %w", err)
-	}
+	ctx := request.Context()
+	key := cacheKeyFromURL(*request.URL)
 
 	if !t.etagRequired {
-		// We don't cache the response for these because they get cached later in cachePackage.
-
 		// Try to open the file in the cache.
 		// If we hit an error, just send the request.
-		f, err := os.Open(cacheFile)
+		rc, err := t.cache.Get(ctx, key)
 		if err != nil {
 			if t.offline {
-				return nil, fmt.Errorf("failed to read %q in offline cache: %w", cacheFile, err)
+				return nil, fmt.Errorf("%w: failed to read %s in offline cache: %w", ErrOffline, request.URL.Redacted(), err)
 			}
 			return t.wrapped.Do(request)
 		}
-
-		return &http.Response{
-			StatusCode: http.StatusOK,
-			Body:       f,
-		}, nil
+		return cachedResponse(rc), nil
 	}
 
+	revalidated, ok := t.cache.(revalidatedCache)
 	if t.offline {
-		cacheDir := cacheDirFromFile(cacheFile)
-		des, err := os.ReadDir(cacheDir)
-		if err != nil {
-			return nil, fmt.Errorf("listing %q for offline cache: %w", cacheDir, err)
-		}
-
-		if len(des) == 0 {
-			return nil, fmt.Errorf("no offline cached entries for %s", cacheDir)
+		if !ok {
+			return nil, fmt.Errorf("%w: the cache cannot serve %s without revalidating it", ErrOffline, request.URL.Redacted())
 		}
-
-		newest, err := des[0].Info()
+		rc, _, err := revalidated.newest(key)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: no offline cached entries for %s: %w", ErrOffline, request.URL.Redacted(), err)
 		}
+		return cachedResponse(rc), nil
+	}
 
-		for _, de := range des[1:] {
-			fi, err := de.Info()
-			if err != nil {
-				return nil, err
-			}
-
-			if fi.ModTime().After(newest.ModTime()) {
-				newest = fi
+	if t.indexTTL > 0 && ok {
+		// A copy that was revalidated recently enough is used without asking the server.
+		if rc, modTime, err := revalidated.newest(key); err == nil {
+			if time.Since(modTime) <= t.indexTTL {
+				return cachedResponse(rc), nil
 			}
+			rc.Close()
 		}
-
-		f, err := os.Open(filepath.Join(cacheDir, newest.Name()))
-		if err != nil {
-			return nil, err
-		}
-
-		return &http.Response{
-			StatusCode:    http.StatusOK,
-			Body:          f,
-			ContentLength: newest.Size(),
-		}, nil
 	}
 
-	return globalEtagCache.get(t, request, cacheFile)
+	return globalEtagCache.get(t, request, key)
+}
+
+// indexCacheDirs are the directories that the etag-addressed copies of each index file are kept
+// in, and the extension they are given.
+var indexCacheDirs = map[string]struct{ dir, ext string }{
+	"APKINDEX.tar.gz":  {"APKINDEX", ".tar.gz"},
+	"APKINDEX.tar.zst": {"APKINDEX.zst", ".tar.zst"},
 }
 
 func cacheDirFromFile(cacheFile string) string {
-	if strings.HasSuffix(cacheFile, "APKINDEX.tar.gz") {
-		return filepath.Join(filepath.Dir(cacheFile), "APKINDEX")
+	if d, ok := indexCacheDirs[filepath.Base(cacheFile)]; ok {
+		return filepath.Join(filepath.Dir(cacheFile), d.dir)
 	}
 
 	return filepath.Dir(cacheFile)
@@ -241,14 +407,90 @@ func cacheFileFromEtag(cacheFile, etag string) string {
 	ext := ".etag"
 
 	// Keep all the index files under APKINDEX/ with appropriate file extension.
-	if strings.HasSuffix(cacheFile, "APKINDEX.tar.gz") {
-		cacheDir = filepath.Join(cacheDir, "APKINDEX")
-		ext = ".tar.gz"
+	if d, ok := indexCacheDirs[filepath.Base(cacheFile)]; ok {
+		cacheDir = filepath.Join(cacheDir, d.dir)
+		ext = d.ext
 	}
 
 	return filepath.Join(cacheDir, etag+ext)
 }
 
+// lastmodFile returns the sidecar file holding the Last-Modified value for cacheFile.
+func lastmodFile(cacheFile string) string {
+	return cacheFile + ".lastmod"
+}
+
+// lastmodKey returns the key of the sidecar file holding the Last-Modified value for key.
+func lastmodKey(key CacheKey) CacheKey {
+	key.Filename += ".lastmod"
+	key.Etag = ""
+	return key
+}
+
+// touch records that the copy for key was revalidated, if the cache keeps track of that.
+func (t *cacheTransport) touch(key CacheKey) {
+	if c, ok := t.cache.(revalidatedCache); ok {
+		c.touch(key)
+	}
+}
+
+// forget removes key from the cache. Caches that cannot remove entries get an empty one instead.
+func (t *cacheTransport) forget(ctx context.Context, key CacheKey) error {
+	if c, ok := t.cache.(revalidatedCache); ok {
+		return c.remove(key)
+	}
+	return t.cache.Put(ctx, key, strings.NewReader(""))
+}
+
+// revalidateLastModified downloads request to key. If an earlier copy was stored along with
+// its Last-Modified value, the request carries If-Modified-Since and a 304 reuses that copy.
+func (t *cacheTransport) revalidateLastModified(request *http.Request, key CacheKey) error {
+	ctx := request.Context()
+	req := request.Clone(ctx)
+	if lastmod, err := t.readLastModified(ctx, key); err == nil && lastmod != "" {
+		if ok, err := t.cache.Has(ctx, key); err == nil && ok {
+			req.Header.Set("If-Modified-Since", lastmod)
+		}
+	}
+
+	resp, err := t.wrapped.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		t.touch(key)
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("GET %s: unexpected status code %d", request.URL.Redacted(), resp.StatusCode)
+	}
+
+	if err := t.cache.Put(ctx, key, resp.Body); err != nil {
+		return err
+	}
+	if lastmod := resp.Header.Get("Last-Modified"); lastmod != "" {
+		return t.cache.Put(ctx, lastmodKey(key), strings.NewReader(lastmod))
+	}
+	return t.forget(ctx, lastmodKey(key))
+}
+
+// readLastModified returns the Last-Modified value stored along with key, if any.
+func (t *cacheTransport) readLastModified(ctx context.Context, key CacheKey) (string, error) {
+	rc, err := t.cache.Get(ctx, lastmodKey(key))
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
 func etagFromResponse(resp *http.Response) (string, bool) {
 	remoteEtag, ok := resp.Header[http.CanonicalHeaderKey("etag")]
 	if !ok || len(remoteEtag) == 0 || remoteEtag[0] == "" {
@@ -259,51 +501,141 @@ func etagFromResponse(resp *http.Response) (string, bool) {
 	return etag, etag != ""
 }
 
-type cachePlacer func(*http.Response) (string, error)
-
-func (t *cacheTransport) retrieveAndSaveFile(request *http.Request, cp cachePlacer) (string, error) {
+// saveByEtag downloads request and stores it under the etag of the response, which becomes the
+// Etag of the returned key. If the server does not reply with 200, its response is returned with
+// the body closed instead.
+func (t *cacheTransport) saveByEtag(request *http.Request, key CacheKey) (CacheKey, *http.Response, error) {
 	if t.wrapped == nil {
-		return "", fmt.Errorf("wrapped client is nil")
+		return key, nil, fmt.Errorf("wrapped client is nil")
 	}
 	resp, err := t.wrapped.Do(request)
-	if err != nil || resp.StatusCode != 200 {
-		return "", err
+	if err != nil {
+		return key, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return key, resp, nil
 	}
 
-	// Determine the file we will caching stuff in based on the URL/response
-	cacheFile, err := cp(resp)
-	if err != nil {
-		return "", err
+	// Use the etag from the actual response, in case it changed since the HEAD.
+	finalEtag, ok := etagFromResponse(resp)
+	if !ok {
+		return key, nil, fmt.Errorf("GET response did not contain an etag, but HEAD returned %q", key.Etag)
+	}
+	key.Etag = finalEtag
+	if err := t.cache.Put(request.Context(), key, resp.Body); err != nil {
+		return key, nil, err
+	}
+	return key, nil, nil
+}
+
+// readThrough stores the package that rc downloads in the cache, if there is one and the package
+// is not already there. The package is passed to Cache.Put as it is read, and is only stored if
+// all of it was read, and it is as large as its index declares, so that readers never see part
+// of it. For the cache directory, concurrent
+// downloads of the same package each write their own temporary file, and the last one to finish
+// wins, even across processes.
+func (a *APK) readThrough(ctx context.Context, pkg InstallablePackage, rc io.ReadCloser) (io.ReadCloser, error) {
+	c := a.fileCache()
+	if c == nil || a.offline {
+		return rc, nil
+	}
+	u, err := packageAsURL(pkg)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return rc, nil
+	}
+	key := cacheKeyFromURL(*u)
+	if ok, err := c.Has(ctx, key); err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("checking cache for %s: %w", u.Redacted(), err)
+	} else if ok {
+		// It was served from the cache.
+		return rc, nil
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := c.Put(ctx, key, &sizedReader{Reader: pr, pkg: pkg.PackageName(), size: int64(declaredSize(pkg))})
+		// Unblock reads of rc if Put stopped early.
+		pr.CloseWithError(errors.Join(err, errCachePutDone))
+		done <- err
+	}()
+	return &readThroughCloser{ReadCloser: rc, pw: pw, done: done}, nil
+}
+
+// errCachePutDone is what writes to the pipe of a readThroughCloser fail with once Cache.Put
+// returned.
+var errCachePutDone = errors.New("cache stopped reading")
+
+// readThroughCloser copies what is read into pw, for Cache.Put to read, and lets Put know on
+// Close whether it was read to the end.
+type readThroughCloser struct {
+	io.ReadCloser
+	pw       *io.PipeWriter
+	done     <-chan error
+	complete bool
+	// Put stopped reading, so the rest is not copied
+	stopped bool
+}
+
+func (r *readThroughCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.stopped {
+		if _, werr := r.pw.Write(p[:n]); werr != nil {
+			r.stopped = true
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		r.complete = true
 	}
+	return n, err
+}
+
+func (r *readThroughCloser) Close() error {
+	err := r.ReadCloser.Close()
+	if r.complete && err == nil {
+		r.pw.Close()
+	} else {
+		r.pw.CloseWithError(io.ErrUnexpectedEOF)
+	}
+	if perr := <-r.done; perr != nil && r.complete && err == nil {
+		return fmt.Errorf("unable to populate cache: %w", perr)
+	}
+	return err
+}
+
+// writeCacheFile atomically writes the contents of r to cacheFile.
+func writeCacheFile(cacheFile string, r io.Reader) error {
 	cacheDir := filepath.Dir(cacheFile)
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return "", fmt.Errorf("unable to create cache directory: %w", err)
+		return fmt.Errorf("unable to create cache directory: %w", err)
 	}
 
-	// Stream the request response to a temporary file within the final cache
+	// Stream the contents to a temporary file within the final cache
 	// directory
 	tmp, err := os.CreateTemp(cacheDir, "*.tmp")
 	if err != nil {
-		return "", fmt.Errorf("unable to create a temporary cache file: %w", err)
+		return fmt.Errorf("unable to create a temporary cache file: %w", err)
 	}
 	if err := func() error {
 		defer tmp.Close()
-		defer resp.Body.Close()
-		if _, err := io.Copy(tmp, resp.Body); err != nil {
+		if _, err := io.Copy(tmp, r); err != nil {
 			return fmt.Errorf("unable to write to cache file: %w", err)
 		}
 		return nil
 	}(); err != nil {
-		return "", err
+		os.Remove(tmp.Name())
+		return err
 	}
 
 	// Now that we have the file has been written, rename to atomically populate
 	// the cache
 	if err := os.Rename(tmp.Name(), cacheFile); err != nil {
-		return "", fmt.Errorf("unable to populate cache: %w", err)
+		return fmt.Errorf("unable to populate cache: %w", err)
 	}
 
-	return cacheFile, nil
+	return nil
 }
 
 func cacheDirForPackage(root string, pkg InstallablePackage) (string, error) {
@@ -328,25 +660,223 @@ func cacheDirForPackage(root string, pkg InstallablePackage) (string, error) {
 func cachePathFromURL(root string, u url.URL) (string, error) {
 	// the last two levels are what we append. For example https://example.com/foo/bar/x86_64/baz.apk
 	// means we want to append x86_64/baz.apk to our cache root
-	u2 := u
-	u2.ForceQuery = false
-	u2.RawFragment = ""
-	u2.RawQuery = ""
-	filename := filepath.Base(u2.Path)
-	archDir := filepath.Dir(u2.Path)
-	dir := filepath.Base(archDir)
-	repoDir := filepath.Dir(archDir)
-	// include the hostname
-	u2.Path = repoDir
+	c := cache{dir: root}
+	return c.path(cacheKeyFromURL(u))
+}
 
-	// url encode it so it can be a single directory
-	repoDir = url.QueryEscape(u2.String())
-	cacheFile := filepath.Join(root, repoDir, dir, filename)
-	// validate it is within root
-	cacheFile = filepath.Clean(cacheFile)
-	cleanroot := filepath.Clean(root)
-	if !strings.HasPrefix(cacheFile, cleanroot) {
-		return "", fmt.Errorf("cache file %s is not within root %s", cacheFile, cleanroot)
+// CachePolicy describes which entries PurgeCache evicts from the cache directory.
+// An entry is a downloaded file together with its sidecar files and expanded directory.
+type CachePolicy struct {
+	// MaxAge evicts entries that were not written within this duration. Zero means no limit.
+	MaxAge time.Duration
+	// MaxSize evicts the least recently written entries until the cache holds at most this many
+	// bytes. Zero means no limit.
+	MaxSize int64
+}
+
+// acquire marks the cache entry at path as in use until the returned func is called.
+func (c *cache) acquire(path string) func() {
+	key := cacheEntryPath(path)
+	c.inUseMu.Lock()
+	defer c.inUseMu.Unlock()
+	if c.inUse == nil {
+		c.inUse = map[string]int{}
 	}
-	return cacheFile, nil
+	c.inUse[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.inUseMu.Lock()
+			defer c.inUseMu.Unlock()
+			if c.inUse[key]--; c.inUse[key] == 0 {
+				delete(c.inUse, key)
+			}
+		})
+	}
+}
+
+func (c *cache) isInUse(path string) bool {
+	c.inUseMu.Lock()
+	defer c.inUseMu.Unlock()
+	return c.inUse[path] > 0
+}
+
+// cacheEntryPath returns the path that identifies the entry a cache file belongs to, so that
+// foo-1.0.apk, foo-1.0.apk.lastmod and the expanded foo-1.0/ are evicted together,
+// as are APKINDEX.tar.gz and the etag-addressed copies in APKINDEX/. It is used both to list
+// the entries and to mark them in use, so that a file being written keeps its whole entry.
+func cacheEntryPath(path string) string {
+	dir, base := filepath.Split(filepath.Clean(path))
+	dir = filepath.Clean(dir)
+	for file, d := range indexCacheDirs {
+		switch {
+		case base == d.dir:
+			// the directory of etag-addressed copies itself
+			path = filepath.Join(dir, file)
+		case filepath.Base(dir) == d.dir:
+			// an etag-addressed copy
+			path = filepath.Join(filepath.Dir(dir), file)
+		default:
+			continue
+		}
+		break
+	}
+	for _, ext := range []string{".lastmod", ".etag", ".apk", ".tar.gz", ".tar.zst"} {
+		path = strings.TrimSuffix(path, ext)
+	}
+	return path
+}
+
+type cacheEntry struct {
+	paths   []string
+	size    int64
+	modTime time.Time
+}
+
+// PurgeCache evicts entries from the cache directory according to policy. Entries that are
+// being fetched or expanded by this APK are left alone, as are partially written files.
+func (a *APK) PurgeCache(ctx context.Context, policy CachePolicy) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "PurgeCache")
+	defer span.End()
+
+	if a.cache == nil {
+		return errors.New("no cache directory configured")
+	}
+	return a.cache.purge(a.log(ctx), policy, time.Now())
+}
+
+func (c *cache) purge(log *clog.Logger, policy CachePolicy, now time.Time) error {
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+
+	// Oldest first, so that size-based eviction removes the least recently written entries.
+	slices.SortFunc(entries, func(a, b *cacheEntry) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+
+	for _, e := range entries {
+		expired := policy.MaxAge > 0 && now.Sub(e.modTime) > policy.MaxAge
+		oversized := policy.MaxSize > 0 && total > policy.MaxSize
+		if !expired && !oversized {
+			continue
+		}
+		if c.isInUse(cacheEntryPath(e.paths[0])) {
+			continue
+		}
+
+		log.Debugf("evicting %s from cache", cacheEntryPath(e.paths[0]))
+		if err := c.evict(e); err != nil {
+			return err
+		}
+		total -= e.size
+	}
+
+	return nil
+}
+
+// entries lists the entries in the cache directory, which has a directory per repository
+// and then per architecture.
+func (c *cache) entries() ([]*cacheEntry, error) {
+	byPath := map[string]*cacheEntry{}
+	repos, err := os.ReadDir(c.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, repo := range repos {
+		if !repo.IsDir() {
+			continue
+		}
+		archs, err := os.ReadDir(filepath.Join(c.dir, repo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, arch := range archs {
+			if !arch.IsDir() {
+				continue
+			}
+			archDir := filepath.Join(c.dir, repo.Name(), arch.Name())
+			files, err := os.ReadDir(archDir)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				// These are still being written.
+				if strings.HasSuffix(f.Name(), ".tmp") {
+					continue
+				}
+				path := filepath.Join(archDir, f.Name())
+				size, modTime, err := diskUsage(path)
+				if err != nil {
+					return nil, err
+				}
+
+				key := cacheEntryPath(path)
+				e, ok := byPath[key]
+				if !ok {
+					e = &cacheEntry{}
+					byPath[key] = e
+				}
+				e.paths = append(e.paths, path)
+				e.size += size
+				if modTime.After(e.modTime) {
+					e.modTime = modTime
+				}
+			}
+		}
+	}
+
+	entries := make([]*cacheEntry, 0, len(byPath))
+	for _, e := range byPath {
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// diskUsage returns the total size and newest modification time of the files under path.
+func diskUsage(path string) (size int64, modTime time.Time, err error) {
+	err = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			size += info.Size()
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		return nil
+	})
+	return size, modTime, err
+}
+
+// evict removes all the files of an entry. They are first moved together into a temporary
+// directory, so that readers never see an entry with only some of its files.
+func (c *cache) evict(e *cacheEntry) error {
+	tmp, err := os.MkdirTemp(filepath.Dir(e.paths[0]), "purge-*.tmp")
+	if err != nil {
+		return fmt.Errorf("evicting %s: %w", cacheEntryPath(e.paths[0]), err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, p := range e.paths {
+		if err := os.Rename(p, filepath.Join(tmp, filepath.Base(p))); err != nil {
+			return fmt.Errorf("evicting %s: %w", p, err)
+		}
+	}
+	return nil
 }
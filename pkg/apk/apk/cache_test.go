@@ -0,0 +1,383 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+)
+
+// testLastModifiedTransport serves body with the given headers and answers conditional
+// requests for lastmod with a 304.
+type testLastModifiedTransport struct {
+	body    []byte
+	lastmod string
+	etag    string
+
+	mu              sync.Mutex
+	ifModifiedSince []string
+}
+
+func (t *testLastModifiedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	header := http.Header{}
+	if t.lastmod != "" {
+		header.Set("Last-Modified", t.lastmod)
+	}
+	if t.etag != "" {
+		header.Set("Etag", t.etag)
+	}
+
+	if request.Method == http.MethodGet {
+		t.mu.Lock()
+		t.ifModifiedSince = append(t.ifModifiedSince, request.Header.Get("If-Modified-Since"))
+		t.mu.Unlock()
+
+		if since := request.Header.Get("If-Modified-Since"); since != "" && since == t.lastmod {
+			return &http.Response{StatusCode: http.StatusNotModified, Header: header, Body: http.NoBody}, nil
+		}
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(t.body)),
+	}, nil
+}
+
+func TestCacheLastModified(t *testing.T) {
+	const (
+		repo    = "https://example.com/alpine/main"
+		lastmod = "Wed, 21 Oct 2015 07:28:00 GMT"
+	)
+	ctx := context.Background()
+	u := IndexURL(repo, testArch)
+
+	get := func(t *testing.T, c *cache, transport http.RoundTripper) []byte {
+		t.Helper()
+		// Each get stands in for a new process, which does not share etag results.
+		globalEtagCache = &etagCache{}
+
+		client := &http.Client{Transport: &cacheTransport{
+			wrapped:      &http.Client{Transport: transport},
+			cache:        c,
+			etagRequired: true,
+			offline:      c.offline,
+		}}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return b
+	}
+	cacheFile := func(c *cache) string {
+		return filepath.Join(c.dir, url.QueryEscape(repo), testArch, indexFilename)
+	}
+
+	t.Run("not modified", func(t *testing.T) {
+		c := &cache{dir: t.TempDir()}
+		transport := &testLastModifiedTransport{body: []byte("first"), lastmod: lastmod}
+		require.Equal(t, "first", string(get(t, c, transport)))
+
+		stored, err := os.ReadFile(lastmodFile(cacheFile(c)))
+		require.NoError(t, err)
+		require.Equal(t, lastmod, string(stored))
+
+		// The server would now send other bytes, but says they haven't changed.
+		transport.body = []byte("second")
+		require.Equal(t, "first", string(get(t, c, transport)))
+		require.Equal(t, []string{"", lastmod}, transport.ifModifiedSince)
+
+		t.Run("offline", func(t *testing.T) {
+			offline := &cache{dir: c.dir, offline: true}
+			require.Equal(t, "first", string(get(t, offline, &testLocalTransport{fail: true})))
+		})
+	})
+	t.Run("modified", func(t *testing.T) {
+		c := &cache{dir: t.TempDir()}
+		transport := &testLastModifiedTransport{body: []byte("first"), lastmod: lastmod}
+		require.Equal(t, "first", string(get(t, c, transport)))
+
+		transport.body = []byte("second")
+		transport.lastmod = "Thu, 22 Oct 2015 07:28:00 GMT"
+		require.Equal(t, "second", string(get(t, c, transport)))
+
+		stored, err := os.ReadFile(lastmodFile(cacheFile(c)))
+		require.NoError(t, err)
+		require.Equal(t, transport.lastmod, string(stored))
+	})
+	t.Run("etag preferred", func(t *testing.T) {
+		c := &cache{dir: t.TempDir()}
+		transport := &testLastModifiedTransport{body: []byte("first"), lastmod: lastmod, etag: `"testetag"`}
+		require.Equal(t, "first", string(get(t, c, transport)))
+
+		_, err := os.Stat(cacheFileFromEtag(cacheFile(c), "testetag"))
+		require.NoError(t, err, "file should be cached under its etag")
+		_, err = os.Stat(lastmodFile(cacheFile(c)))
+		require.True(t, os.IsNotExist(err), "no last-modified sidecar expected")
+		require.Equal(t, []string{""}, transport.ifModifiedSince)
+	})
+}
+
+func TestPurgeCache(t *testing.T) {
+	now := time.Now()
+	log := clog.FromContext(context.Background())
+	writeEntry := func(t *testing.T, dir, name string, size int, age time.Duration) {
+		archDir := filepath.Join(dir, url.QueryEscape("https://example.com/repo"), testArch)
+		expanded := filepath.Join(archDir, name)
+		require.NoError(t, os.MkdirAll(expanded, 0o755))
+		files := []string{
+			filepath.Join(archDir, name+".apk"),
+			filepath.Join(archDir, name+".apk.lastmod"),
+			filepath.Join(expanded, "data.dat.tar.gz"),
+		}
+		for _, f := range files {
+			require.NoError(t, os.WriteFile(f, bytes.Repeat([]byte("x"), size), 0o644))
+			require.NoError(t, os.Chtimes(f, now.Add(-age), now.Add(-age)))
+		}
+		require.NoError(t, os.Chtimes(expanded, now.Add(-age), now.Add(-age)))
+	}
+	exists := func(t *testing.T, dir, name string) bool {
+		archDir := filepath.Join(dir, url.QueryEscape("https://example.com/repo"), testArch)
+		_, apkErr := os.Stat(filepath.Join(archDir, name+".apk"))
+		_, dirErr := os.Stat(filepath.Join(archDir, name))
+		require.Equal(t, apkErr == nil, dirErr == nil, "entry %s only partially evicted", name)
+		return apkErr == nil
+	}
+	setup := func(t *testing.T) *cache {
+		c := &cache{dir: t.TempDir()}
+		writeEntry(t, c.dir, "old-1.0", 100, 48*time.Hour)
+		writeEntry(t, c.dir, "mid-1.0", 100, 2*time.Hour)
+		writeEntry(t, c.dir, "new-1.0", 100, time.Minute)
+		return c
+	}
+
+	t.Run("max age", func(t *testing.T) {
+		c := setup(t)
+		require.NoError(t, c.purge(log, CachePolicy{MaxAge: 24 * time.Hour}, now))
+		require.False(t, exists(t, c.dir, "old-1.0"))
+		require.True(t, exists(t, c.dir, "mid-1.0"))
+		require.True(t, exists(t, c.dir, "new-1.0"))
+	})
+	t.Run("max size", func(t *testing.T) {
+		c := setup(t)
+		// each entry holds 300 bytes
+		require.NoError(t, c.purge(log, CachePolicy{MaxSize: 400}, now))
+		require.False(t, exists(t, c.dir, "old-1.0"))
+		require.False(t, exists(t, c.dir, "mid-1.0"))
+		require.True(t, exists(t, c.dir, "new-1.0"))
+	})
+	t.Run("in use", func(t *testing.T) {
+		c := setup(t)
+		archDir := filepath.Join(c.dir, url.QueryEscape("https://example.com/repo"), testArch)
+		release := c.acquire(filepath.Join(archDir, "old-1.0"))
+		require.NoError(t, c.purge(log, CachePolicy{MaxAge: time.Hour}, now))
+		require.True(t, exists(t, c.dir, "old-1.0"))
+		require.False(t, exists(t, c.dir, "mid-1.0"))
+
+		release()
+		require.NoError(t, c.purge(log, CachePolicy{MaxAge: time.Hour}, now))
+		require.False(t, exists(t, c.dir, "old-1.0"))
+	})
+	t.Run("index being written", func(t *testing.T) {
+		c := setup(t)
+		archDir := filepath.Join(c.dir, url.QueryEscape("https://example.com/repo"), testArch)
+		old := cacheFileFromEtag(filepath.Join(archDir, indexFilename), "old")
+		require.NoError(t, os.MkdirAll(filepath.Dir(old), 0o755))
+		require.NoError(t, os.WriteFile(old, []byte("old"), 0o644))
+		require.NoError(t, os.Chtimes(old, now.Add(-48*time.Hour), now.Add(-48*time.Hour)))
+		require.NoError(t, os.Chtimes(filepath.Dir(old), now.Add(-48*time.Hour), now.Add(-48*time.Hour)))
+
+		// Put writes the new copy as it is read, and is blocked until the pipe is closed.
+		pr, pw := io.Pipe()
+		key := CacheKey{Repo: "https://example.com/repo", Arch: testArch, Filename: indexFilename, Etag: "new"}
+		done := make(chan error, 1)
+		go func() { done <- c.Put(context.Background(), key, pr) }()
+		_, err := pw.Write([]byte("new"))
+		require.NoError(t, err)
+
+		// Small enough to evict every entry that is not in use.
+		require.NoError(t, c.purge(log, CachePolicy{MaxSize: 1}, now))
+		_, err = os.Stat(old)
+		require.NoError(t, err, "the index should not be evicted while it is written")
+		require.False(t, exists(t, c.dir, "old-1.0"))
+
+		require.NoError(t, pw.Close())
+		require.NoError(t, <-done)
+		b, err := os.ReadFile(cacheFileFromEtag(filepath.Join(archDir, indexFilename), "new"))
+		require.NoError(t, err)
+		require.Equal(t, "new", string(b))
+	})
+	t.Run("partial download", func(t *testing.T) {
+		c := setup(t)
+		archDir := filepath.Join(c.dir, url.QueryEscape("https://example.com/repo"), testArch)
+		tmp := filepath.Join(archDir, "old-1.0.apk.1234.tmp")
+		require.NoError(t, os.WriteFile(tmp, []byte("partial"), 0o644))
+		require.NoError(t, os.Chtimes(tmp, now.Add(-72*time.Hour), now.Add(-72*time.Hour)))
+		require.NoError(t, c.purge(log, CachePolicy{MaxAge: 24 * time.Hour}, now))
+		_, err := os.Stat(tmp)
+		require.NoError(t, err)
+	})
+}
+
+func TestOffline(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+
+	for _, tt := range []struct {
+		name    string
+		options []Option
+	}{
+		{"empty cache", []Option{WithCache(t.TempDir(), false)}},
+		{"no cache", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// Don't leak the failed lookups into other tests.
+			globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+			t.Cleanup(func() { globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{} })
+
+			a, src := testAPKWithRepos(t, nil, append(tt.options, WithOffline(true))...)
+			require.NoError(t, src.WriteFile(reposFilePath, []byte(testAlpineRepos+"\n"), 0o644))
+			// If anything reached the client, it would be answered from local testdata.
+			transport := &testCountingTransport{wrapped: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}}
+			a.SetClient(&http.Client{Transport: transport})
+
+			_, err := a.FetchPackage(ctx, pkg)
+			require.ErrorIs(t, err, ErrOffline)
+
+			_, err = a.GetRepositoryIndexes(ctx, true)
+			require.ErrorIs(t, err, ErrOffline)
+
+			require.Zero(t, transport.max, "no requests should be made when offline")
+		})
+	}
+}
+
+// testBarrierTransport holds every response until as many requests as were added to arrived
+// were made, or a second passed.
+type testBarrierTransport struct {
+	wrapped http.RoundTripper
+	arrived sync.WaitGroup
+}
+
+func (t *testBarrierTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.arrived.Done()
+	done := make(chan struct{})
+	go func() {
+		t.arrived.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+	return t.wrapped.RoundTrip(request)
+}
+
+func TestFetchPackageReadThrough(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+	want, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, testPkgFilename))
+	require.NoError(t, err)
+
+	newAPK := func(t *testing.T, cacheDir string, transport http.RoundTripper) *APK {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithCache(cacheDir, false))
+		require.NoError(t, err)
+		a.SetClient(&http.Client{Transport: transport})
+		return a
+	}
+	cachedFiles := func(t *testing.T, cacheDir string) []string {
+		entries, err := os.ReadDir(filepath.Join(cacheDir, url.QueryEscape(testAlpineRepos), testArch))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		require.NoError(t, err)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		transport := &testBarrierTransport{wrapped: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}}
+		transport.arrived.Add(2)
+
+		// Each APK stands in for a separate process sharing the cache directory.
+		var g errgroup.Group
+		for range 2 {
+			a := newAPK(t, cacheDir, transport)
+			g.Go(func() error {
+				rc, err := a.FetchPackage(ctx, pkg)
+				if err != nil {
+					return err
+				}
+				got, err := io.ReadAll(rc)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(want, got) {
+					return fmt.Errorf("fetched %d bytes, want %d", len(got), len(want))
+				}
+				return rc.Close()
+			})
+		}
+		require.NoError(t, g.Wait())
+
+		require.Equal(t, []string{testPkgFilename}, cachedFiles(t, cacheDir))
+		cached, err := os.ReadFile(filepath.Join(cacheDir, url.QueryEscape(testAlpineRepos), testArch, testPkgFilename))
+		require.NoError(t, err)
+		require.Equal(t, want, cached)
+
+		// Later fetches are served from the cache.
+		rc, err := newAPK(t, cacheDir, &testLocalTransport{fail: true}).FetchPackage(ctx, pkg)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, want, got)
+	})
+
+	t.Run("partial read", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		rc, err := newAPK(t, cacheDir, &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}).FetchPackage(ctx, pkg)
+		require.NoError(t, err)
+		_, err = io.ReadFull(rc, make([]byte, 10))
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Empty(t, cachedFiles(t, cacheDir), "a partial download must not be cached")
+	})
+}
@@ -0,0 +1,226 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// ExportCache writes the cache directory to w as a tar archive, for ImportCache to restore
+// elsewhere. The downloaded packages, indexes and keys are included with their etag and
+// Last-Modified sidecars, while the directories that packages are expanded into are left out,
+// as they are made again from the packages. A package that was only kept expanded is put back
+// together and exported as the package file. Partial downloads are left out.
+func (a *APK) ExportCache(ctx context.Context, w io.Writer) error {
+	_, span := otel.Tracer("go-apk").Start(ctx, "ExportCache")
+	defer span.End()
+
+	if a.cache == nil {
+		return errors.New("no cache configured")
+	}
+
+	tw := tar.NewWriter(w)
+	// The schema version goes first, so that ImportCache refuses an archive before writing any of it.
+	schema := strconv.Itoa(cacheSchemaVersion) + "\n"
+	if err := tw.WriteHeader(&tar.Header{Name: cacheSchemaFile, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(schema))}); err != nil {
+		return fmt.Errorf("exporting cache: %w", err)
+	}
+	if _, err := io.WriteString(tw, schema); err != nil {
+		return fmt.Errorf("exporting cache: %w", err)
+	}
+
+	err := filepath.WalkDir(a.cache.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == a.cache.dir || path == filepath.Join(a.cache.dir, cacheSchemaFile) {
+			return nil
+		}
+		if d.IsDir() {
+			if _, err := os.Stat(path + ".apk"); err == nil {
+				// an expanded package
+				return filepath.SkipDir
+			}
+			if parts := expandedAPKParts(path); parts != nil {
+				if err := exportExpandedAPK(tw, a.cache.dir, path, parts); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+		} else if !d.Type().IsRegular() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(a.cache.dir, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		return copyFile(tw, path)
+	})
+	if err != nil {
+		return fmt.Errorf("exporting cache: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("exporting cache: %w", err)
+	}
+	return nil
+}
+
+// expandedAPKParts returns the signature, control and data sections of the package expanded
+// into dir, in the order they make up the package, or nil if dir does not hold exactly one.
+func expandedAPKParts(dir string) []string {
+	ctls, _ := filepath.Glob(filepath.Join(dir, "*.ctl.tar.gz"))
+	dats, _ := filepath.Glob(filepath.Join(dir, "*.dat.tar.gz"))
+	if len(ctls) != 1 || len(dats) != 1 {
+		return nil
+	}
+	sig := strings.TrimSuffix(ctls[0], ".ctl.tar.gz") + ".sig.tar.gz"
+	if _, err := os.Stat(sig); err != nil {
+		return []string{ctls[0], dats[0]}
+	}
+	return []string{sig, ctls[0], dats[0]}
+}
+
+// exportExpandedAPK writes the package expanded into dir from its parts, as the package file
+// that it was expanded from.
+func exportExpandedAPK(tw *tar.Writer, root, dir string, parts []string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, part := range parts {
+		pi, err := os.Stat(part)
+		if err != nil {
+			return err
+		}
+		size += pi.Size()
+	}
+	rel, err := filepath.Rel(root, dir+".apk")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     filepath.ToSlash(rel),
+		Typeflag: tar.TypeReg,
+		Mode:     0o644,
+		Size:     size,
+		ModTime:  fi.ModTime(),
+	}); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if err := copyFile(tw, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// ImportCache restores a cache written by ExportCache into the cache directory, replacing
+// entries of the same name. Modification times are kept, as offline lookups use the newest
+// copy of each index. An archive of another cache schema version is refused.
+func (a *APK) ImportCache(ctx context.Context, r io.Reader) error {
+	_, span := otel.Tracer("go-apk").Start(ctx, "ImportCache")
+	defer span.End()
+
+	if a.cache == nil {
+		return errors.New("no cache configured")
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading cache archive: %w", err)
+		}
+		name := filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid path %q in cache archive", hdr.Name)
+		}
+		path := filepath.Join(a.cache.dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return fmt.Errorf("unable to create cache directory: %w", err)
+			}
+			continue
+		case tar.TypeReg:
+		default:
+			return fmt.Errorf("unexpected type %q of %s in cache archive", hdr.Typeflag, hdr.Name)
+		}
+
+		if name == cacheSchemaFile {
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				return fmt.Errorf("reading cache archive: %w", err)
+			}
+			if version := strings.TrimSpace(string(b)); version != strconv.Itoa(cacheSchemaVersion) {
+				return fmt.Errorf("cache archive has schema version %q, want %d", version, cacheSchemaVersion)
+			}
+			continue
+		}
+		if err := writeCacheFile(path, tr); err != nil {
+			return fmt.Errorf("importing %s: %w", hdr.Name, err)
+		}
+		if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			return fmt.Errorf("importing %s: %w", hdr.Name, err)
+		}
+	}
+	return nil
+}
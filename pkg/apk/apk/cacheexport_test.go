@@ -0,0 +1,111 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportCache(t *testing.T) {
+	ctx := context.Background()
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	t.Cleanup(func() { globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{} })
+
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0", Arch: testArch, Dependencies: []string{"bar"}},
+		{Name: "bar", Version: "1.0.0", Arch: testArch},
+	}
+	entries := map[string][]testDirEntry{}
+	for _, pkg := range packages {
+		entries[pkg.Name] = []testDirEntry{{path: "usr", dir: true, perms: 0o755}, {path: "usr/" + pkg.Name, perms: 0o755, content: []byte(pkg.Name)}}
+	}
+	dir := testLocalRepoWithFiles(t, testArch, packages, entries)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(dir, r.URL.Path))
+	}))
+	defer s.Close()
+
+	// Warm the cache with an install, which also expands the packages into it.
+	cacheDir := t.TempDir()
+	a, _ := testAPKWithRepos(t, []string{s.URL}, WithCache(cacheDir, false))
+	require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	var archive bytes.Buffer
+	require.NoError(t, a.ExportCache(ctx, &archive))
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.Equal(t, cacheSchemaFile, names[0])
+	for _, name := range names {
+		require.False(t, strings.HasSuffix(name, ".ctl.tar.gz") || strings.HasSuffix(name, ".dat.tar.gz"), "expanded %s was exported", name)
+	}
+
+	// Restore it into an empty cache, with the repository gone.
+	s.Close()
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	importDir := t.TempDir()
+	imported, err := New(WithCache(importDir, true))
+	require.NoError(t, err)
+	require.NoError(t, imported.ImportCache(ctx, bytes.NewReader(archive.Bytes())))
+
+	offline, src := testAPKWithRepos(t, []string{s.URL}, WithCache(importDir, true))
+	require.NoError(t, offline.SetWorld(ctx, []string{"foo"}))
+	require.NoError(t, offline.FixateWorld(ctx, nil))
+	for _, name := range []string{"foo", "bar"} {
+		b, err := src.ReadFile("usr/" + name)
+		require.NoError(t, err)
+		require.Equal(t, name, string(b))
+	}
+
+	t.Run("other schema", func(t *testing.T) {
+		var other bytes.Buffer
+		tw := tar.NewWriter(&other)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: cacheSchemaFile, Typeflag: tar.TypeReg, Mode: 0o644, Size: 2}))
+		_, err := tw.Write([]byte("0\n"))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		require.ErrorContains(t, imported.ImportCache(ctx, &other), "schema version")
+	})
+	t.Run("outside the cache", func(t *testing.T) {
+		var escape bytes.Buffer
+		tw := tar.NewWriter(&escape)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0o644}))
+		require.NoError(t, tw.Close())
+		require.ErrorContains(t, imported.ImportCache(ctx, &escape), "invalid path")
+		_, err := os.Stat(filepath.Join(filepath.Dir(importDir), "escape"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
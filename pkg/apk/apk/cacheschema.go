@@ -0,0 +1,77 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cacheSchemaVersion is the layout of the cache directory. Bump it whenever entries written
+// before a change would be misread after it.
+const cacheSchemaVersion = 1
+
+// cacheSchemaFile records the cacheSchemaVersion of the entries in the cache directory. A cache
+// directory without one predates it, and has the layout of version 1.
+const cacheSchemaFile = "SCHEMA_VERSION"
+
+// checkSchema makes sure the entries in the cache directory have the current layout, removing
+// them if the schema file says otherwise, so that they are fetched again instead of misread.
+func (c *cache) checkSchema() error {
+	b, err := os.ReadFile(filepath.Join(c.dir, cacheSchemaFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		// Unversioned, which is the first layout. Record it if the directory can be written to,
+		// a cache that is only read from is fine as it is.
+		_ = c.writeSchema()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading cache schema version: %w", err)
+	}
+	version := strings.TrimSpace(string(b))
+	if version == strconv.Itoa(cacheSchemaVersion) {
+		return nil
+	}
+	if err := c.removeEntries(); err != nil {
+		return fmt.Errorf("removing entries of cache schema %q: %w", version, err)
+	}
+	return c.writeSchema()
+}
+
+func (c *cache) writeSchema() error {
+	return writeCacheFile(filepath.Join(c.dir, cacheSchemaFile), strings.NewReader(strconv.Itoa(cacheSchemaVersion)+"\n"))
+}
+
+// removeEntries removes everything in the cache directory except the schema file.
+func (c *cache) removeEntries() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == cacheSchemaFile {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(c.dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	foo := func(content string) string {
+		return testLocalRepoWithFiles(t, testArch, []*Package{{Name: "foo", Version: "1.0.0-r0", Arch: testArch}}, map[string][]testDirEntry{
+			"foo": {{"usr", 0o755, true, nil, nil}, {"usr/foo", 0o644, false, []byte(content), nil}},
+		})
+	}
+	repo := foo("fresh")
+	install := func(cacheDir, repo string) string {
+		// Make sure the package is taken from the cache directory, rather than reused from before.
+		globalApkCache = &apkCache{}
+		t.Cleanup(func() { globalApkCache = &apkCache{} })
+
+		a, src := testAPKWithRepos(t, []string{repo}, WithCache(cacheDir, false))
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+		b, err := src.ReadFile("usr/foo")
+		require.NoError(t, err)
+		return string(b)
+	}
+	dataFile := func(cacheDir string) string {
+		data, err := filepath.Glob(filepath.Join(cacheDir, "*", testArch, "foo-1.0.0-r0", "*.dat.tar.gz"))
+		require.NoError(t, err)
+		require.Len(t, data, 1)
+		return data[0]
+	}
+	// poisoned returns a cache directory whose entry for foo in repo holds other contents.
+	poisoned := func(t *testing.T) string {
+		cacheDir := t.TempDir()
+		require.Equal(t, "fresh", install(cacheDir, repo))
+		b, err := os.ReadFile(filepath.Join(cacheDir, cacheSchemaFile))
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(cacheSchemaVersion)+"\n", string(b))
+
+		other := t.TempDir()
+		require.Equal(t, "stale", install(other, foo("stale")))
+		stale, err := os.ReadFile(dataFile(other))
+		require.NoError(t, err)
+		data := dataFile(cacheDir)
+		require.NoError(t, os.WriteFile(data, stale, 0o644))
+		require.NoError(t, os.Remove(data[:len(data)-len(".gz")]))
+		return cacheDir
+	}
+
+	t.Run("current schema", func(t *testing.T) {
+		cacheDir := poisoned(t)
+		require.Equal(t, "stale", install(cacheDir, repo), "entries of the current schema are used")
+	})
+
+	t.Run("unversioned", func(t *testing.T) {
+		cacheDir := poisoned(t)
+		require.NoError(t, os.Remove(filepath.Join(cacheDir, cacheSchemaFile)))
+		require.Equal(t, "stale", install(cacheDir, repo), "an unversioned cache has the first layout")
+		_, err := os.Stat(filepath.Join(cacheDir, cacheSchemaFile))
+		require.NoError(t, err)
+	})
+
+	t.Run("old schema", func(t *testing.T) {
+		cacheDir := poisoned(t)
+		require.NoError(t, os.WriteFile(filepath.Join(cacheDir, cacheSchemaFile), []byte("0\n"), 0o644))
+		require.Equal(t, "fresh", install(cacheDir, repo), "entries of another schema are a miss")
+		b, err := os.ReadFile(filepath.Join(cacheDir, cacheSchemaFile))
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(cacheSchemaVersion)+"\n", string(b))
+	})
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"chainguard.dev/apko/pkg/apk/expandapk"
+)
+
+// ChecksumMismatchPolicy is what to do with a package that does not match the checksums of its
+// index entry.
+type ChecksumMismatchPolicy int
+
+const (
+	// ChecksumMismatchFail fails the install. This is the default.
+	ChecksumMismatchFail ChecksumMismatchPolicy = iota
+	// ChecksumMismatchRedownload discards the cached copy of the package and downloads it
+	// again, and only fails if that does not match either.
+	ChecksumMismatchRedownload
+	// ChecksumMismatchWarn logs the mismatch and installs the package anyway.
+	ChecksumMismatchWarn
+)
+
+func (p ChecksumMismatchPolicy) String() string {
+	switch p {
+	case ChecksumMismatchFail:
+		return "fail"
+	case ChecksumMismatchRedownload:
+		return "redownload"
+	case ChecksumMismatchWarn:
+		return "warn"
+	}
+	return fmt.Sprintf("ChecksumMismatchPolicy(%d)", int(p))
+}
+
+// verifyCachedPackage checks that the cached sections of exp still hash to the checksums they
+// are stored under, that is, the control checksum of the index and the data hash of .PKGINFO.
+func verifyCachedPackage(exp *expandapk.APKExpanded) error {
+	if err := verifyFileHash(exp.ControlFile, sha1.New(), exp.ControlHash); err != nil { //nolint:gosec
+		return fmt.Errorf("control checksum mismatch: %w", err)
+	}
+	if err := verifyFileHash(exp.PackageFile, sha256.New(), exp.PackageHash); err != nil {
+		return fmt.Errorf("data hash mismatch: %w", err)
+	}
+	return nil
+}
+
+func verifyFileHash(name string, h hash.Hash, want []byte) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("%s: expected %s, got %s", name, hexOrBase64(want), hexOrBase64(got))
+	}
+	return nil
+}
+
+// hexOrBase64 formats sha1 checksums as apk does, and other hashes as hex.
+func hexOrBase64(sum []byte) string {
+	if len(sum) == sha1.Size {
+		return "Q1" + base64.StdEncoding.EncodeToString(sum)
+	}
+	return hex.EncodeToString(sum)
+}
+
+// invalidateCachedPackage removes the cached copies of the package cached in cacheDir, so that
+// it is fetched again.
+func invalidateCachedPackage(cacheDir string) error {
+	for _, name := range []string{cacheDir, cacheDir + ".apk"} {
+		if err := os.RemoveAll(name); err != nil {
+			return fmt.Errorf("invalidating cache entry %s: %w", name, err)
+		}
+	}
+	return nil
+}
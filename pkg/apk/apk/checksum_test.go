@@ -0,0 +1,78 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumMismatchPolicy(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		policy  ChecksumMismatchPolicy
+		wantErr string
+		healed  bool
+	}{
+		{policy: ChecksumMismatchFail, wantErr: "data hash mismatch"},
+		{policy: ChecksumMismatchWarn},
+		{policy: ChecksumMismatchRedownload, healed: true},
+	} {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			repo := testLocalRepoWithFiles(t, testArch, []*Package{{Name: "foo", Version: "1.0.0-r0", Arch: testArch}}, map[string][]testDirEntry{
+				"foo": {{"usr", 0o755, true, nil, nil}, {"usr/bin", 0o755, true, nil, nil}, {"usr/bin/foo", 0o755, false, []byte("foo"), nil}},
+			})
+			cacheDir := t.TempDir()
+			install := func(options ...Option) error {
+				// Make sure the package is taken from the cache directory, rather than reused from before.
+				globalApkCache = &apkCache{}
+				t.Cleanup(func() { globalApkCache = &apkCache{} })
+
+				a, _ := testAPKWithRepos(t, []string{repo}, append([]Option{WithCache(cacheDir, false)}, options...)...)
+				require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+				return a.FixateWorld(ctx, nil)
+			}
+			require.NoError(t, install())
+
+			data, err := filepath.Glob(filepath.Join(cacheDir, "*", testArch, "foo-1.0.0-r0", "*.dat.tar.gz"))
+			require.NoError(t, err)
+			require.Len(t, data, 1)
+			f, err := os.OpenFile(data[0], os.O_APPEND|os.O_WRONLY, 0)
+			require.NoError(t, err)
+			_, err = f.WriteString("corrupted")
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			err = install(WithChecksumMismatchPolicy(tt.policy))
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			b, err := os.ReadFile(data[0])
+			require.NoError(t, err)
+			sum := sha256.Sum256(b)
+			require.Equal(t, tt.healed, strings.HasPrefix(filepath.Base(data[0]), hex.EncodeToString(sum[:])))
+		})
+	}
+}
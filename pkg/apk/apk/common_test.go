@@ -15,11 +15,16 @@ package apk
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"io"
 	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
 
 	apkfs "chainguard.dev/apko/pkg/apk/fs"
 )
@@ -103,3 +108,60 @@ func testGetTestAPK() (*APK, apkfs.FullFS, error) {
 	}
 	return apk, src, err
 }
+
+// testLocalRepo writes an unsigned APKINDEX.tar.gz for the given packages into a new local
+// repository directory and returns the path to that repository.
+func testLocalRepo(t *testing.T, arch string, packages []*Package) string {
+	t.Helper()
+
+	repo := t.TempDir()
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: packages})
+	require.NoError(t, err)
+	b, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, arch), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(repo, arch, indexFilename), b, 0o644)) //nolint:gosec // we're writing a test file
+
+	return repo
+}
+
+// testLocalRepoWithFiles is like testLocalRepo, but also writes an .apk for each package holding
+// the entries listed for its name, and fills in the package checksums to match.
+func testLocalRepoWithFiles(t *testing.T, arch string, packages []*Package, entries map[string][]testDirEntry) string {
+	t.Helper()
+
+	apks := make([]*testPackage, 0, len(packages))
+	for _, pkg := range packages {
+		fake, ok := fakePackage(t, pkg, entries[pkg.Name]).(*testPackage)
+		require.True(t, ok)
+		checksum, err := base64.StdEncoding.DecodeString(fake.checksum)
+		require.NoError(t, err)
+		pkg.Checksum = checksum
+		apks = append(apks, fake)
+	}
+
+	repo := testLocalRepo(t, arch, packages)
+	for _, fake := range apks {
+		b, err := os.ReadFile(fake.file)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(repo, arch, fake.pkg.Filename()), b, 0o644)) //nolint:gosec // we're writing a test file
+	}
+
+	return repo
+}
+
+// testAPKWithRepos returns an APK on an initialized MemFS that uses the given unsigned repositories, if any.
+func testAPKWithRepos(t *testing.T, repos []string, options ...Option) (*APK, apkfs.FullFS) {
+	t.Helper()
+
+	src := apkfs.NewMemFS()
+	options = append([]Option{WithFS(src), WithArch(testArch), WithIgnoreMknodErrors(ignoreMknodErrors), WithNoSignatureIndexes(repos...)}, options...)
+	a, err := New(options...)
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(context.Background()))
+	if len(repos) > 0 {
+		require.NoError(t, a.SetRepositories(context.Background(), repos))
+	}
+
+	return a, src
+}
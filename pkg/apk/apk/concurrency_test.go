@@ -0,0 +1,92 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+// TestConcurrentUse is best run with -race, which checks that a single APK can be shared by
+// goroutines fetching packages and reading its state.
+func TestConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	t.Cleanup(func() { globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{} })
+
+	var packages []*Package
+	entries := map[string][]testDirEntry{}
+	for i := range 4 {
+		pkg := &Package{Name: fmt.Sprintf("pkg%d", i), Version: "1.0.0-r0", Arch: testArch}
+		packages = append(packages, pkg)
+		entries[pkg.Name] = []testDirEntry{{path: "usr", dir: true, perms: 0o755}, {path: "usr/" + pkg.Name, perms: 0o644, content: []byte(pkg.Name)}}
+	}
+	dir := testLocalRepoWithFiles(t, testArch, packages, entries)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(dir, r.URL.Path))
+	}))
+	defer s.Close()
+
+	a, _ := testAPKWithRepos(t, []string{s.URL}, WithCache(t.TempDir(), false), WithParallelFetch(3))
+	require.NoError(t, a.SetWorld(ctx, []string{"pkg0", "pkg1", "pkg2", "pkg3"}))
+	resolved, _, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+	require.Len(t, resolved, len(packages))
+
+	var g errgroup.Group
+	for i := range 8 {
+		g.Go(func() error {
+			for _, pkg := range resolved {
+				rc, err := a.FetchPackage(ctx, pkg)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(io.Discard, rc)
+				rc.Close()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		g.Go(func() error {
+			if _, _, err := a.ResolveWorld(ctx); err != nil {
+				return err
+			}
+			if _, err := a.GetInstalled(); err != nil {
+				return err
+			}
+			if _, err := a.GetRepositories(ctx); err != nil {
+				return err
+			}
+			_ = a.TimingReport()
+			return a.SetWorld(ctx, []string{"pkg0", "pkg1", "pkg2", fmt.Sprintf("pkg%d", 3-i%2)})
+		})
+		g.Go(func() error {
+			a.SetClient(&http.Client{})
+			_, err := a.GetWorld(ctx)
+			return err
+		})
+	}
+	require.NoError(t, g.Wait())
+}
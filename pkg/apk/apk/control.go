@@ -0,0 +1,220 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"chainguard.dev/apko/pkg/apk/expandapk"
+)
+
+// controlChunkSize is how many bytes of a package FetchControl asks for at a time. The signature
+// and control sections usually fit in the first chunk.
+const controlChunkSize = 32 << 10
+
+// FetchControl returns the metadata in the control section (.PKGINFO and install scripts) of pkg
+// without downloading the data section. From servers that support Range requests, only the
+// leading bytes of the package holding the control section are fetched. Otherwise the download
+// is stopped once the control section is read. The control section is verified against the
+// checksum in the index and kept in the cache, if one is configured, so that later calls do not
+// fetch it again. Size and Checksum are set as for ParsePackage.
+func (a *APK) FetchControl(ctx context.Context, pkg *RepositoryPackage) (*Package, error) {
+	log := a.log(ctx)
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "FetchControl", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
+	defer span.End()
+
+	var cacheFile string
+	if a.cache != nil && len(pkg.Checksum) > 0 {
+		cacheDir, err := cacheDirForPackage(a.cache.dir, pkg)
+		if err != nil {
+			return nil, err
+		}
+		// The same place an expanded package keeps its control section.
+		cacheFile = filepath.Join(cacheDir, hex.EncodeToString(pkg.Checksum)+".ctl.tar.gz")
+		if f, err := os.Open(cacheFile); err == nil {
+			defer f.Close()
+			log.Debugf("control cache hit (%s)", pkg.PackageName())
+			return ParsePackage(ctx, f, pkg.Size)
+		}
+	}
+
+	rc, err := a.openControl(ctx, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("fetching control section of %s: %w", pkg.PackageName(), err)
+	}
+	defer rc.Close()
+
+	parts, err := expandapk.Split(rc)
+	if err != nil {
+		return nil, fmt.Errorf("reading control section of %s: %w", pkg.PackageName(), err)
+	}
+	control, err := io.ReadAll(parts[len(parts)-2])
+	if err != nil {
+		return nil, fmt.Errorf("reading control section of %s: %w", pkg.PackageName(), err)
+	}
+	if len(pkg.Checksum) > 0 {
+		if got := sha1.Sum(control); !bytes.Equal(got[:], pkg.Checksum) { //nolint:gosec
+			return nil, fmt.Errorf("control checksum mismatch for %s: expected %s, got Q1%s", pkg.PackageName(), pkg.ChecksumString(), base64.StdEncoding.EncodeToString(got[:]))
+		}
+	}
+
+	if cacheFile != "" {
+		if err := writeCacheFile(cacheFile, bytes.NewReader(control)); err != nil {
+			return nil, err
+		}
+	}
+	return ParsePackage(ctx, bytes.NewReader(control), pkg.Size)
+}
+
+// openControl opens pkg to read as little of it as possible. Packages in HTTP repositories are
+// read with Range requests, a chunk at a time, see rangeChunkReader.
+func (a *APK) openControl(ctx context.Context, pkg *RepositoryPackage) (io.ReadCloser, error) {
+	u := pkg.URL()
+	if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		return a.fetchPackage(ctx, pkg)
+	}
+
+	if a.cache != nil {
+		// A package that was downloaded in full is read from the cache.
+		asURL, err := packageAsURL(pkg)
+		if err != nil {
+			return nil, err
+		}
+		cacheFile, err := cachePathFromURL(a.cache.dir, *asURL)
+		if err != nil {
+			return nil, err
+		}
+		if f, err := os.Open(cacheFile); err == nil {
+			return f, nil
+		}
+	}
+	if a.offline {
+		return nil, fmt.Errorf("%w: %s", ErrOffline, redactURL(u))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth, ok := a.auth[req.URL.Host]; ok && auth.user != "" && auth.pass != "" {
+		req.SetBasicAuth(auth.user, auth.pass)
+	}
+	if err := authenticate(ctx, req, a.authenticator); err != nil {
+		return nil, err
+	}
+	// Partial responses must not end up in a cache, so this goes around it.
+	return &rangeChunkReader{client: a.fetchRetry.client(a.httpClient()), req: req, size: -1}, nil
+}
+
+// rangeChunkReader reads the file at req with a Range request for each chunk of
+// controlChunkSize bytes, as far as it is read. If the server ignores the Range header, the
+// whole response is read instead, up to where reading stops.
+type rangeChunkReader struct {
+	client *http.Client
+	req    *http.Request
+
+	body   io.ReadCloser
+	offset int64
+	// size is the size of the file, or -1 until a response tells it.
+	size int64
+	// whole is set when the server ignored the Range header.
+	whole bool
+}
+
+func (r *rangeChunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			if r.whole || (r.size >= 0 && r.offset >= r.size) {
+				return 0, io.EOF
+			}
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if errors.Is(err, io.EOF) {
+			r.body.Close()
+			r.body = nil
+			if r.whole {
+				return n, io.EOF
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// next requests the chunk at the current offset.
+func (r *rangeChunkReader) next() error {
+	req := r.req.Clone(r.req.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, r.offset+controlChunkSize-1))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range is "bytes first-last/size", where size may be *.
+		if _, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/"); ok {
+			if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+				r.size = size
+			}
+		}
+		r.body = resp.Body
+	case http.StatusOK:
+		if r.offset != 0 {
+			resp.Body.Close()
+			return fmt.Errorf("GET %s: server stopped serving Range requests", r.req.URL.Redacted())
+		}
+		r.whole = true
+		r.body = resp.Body
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		r.size = r.offset
+		return io.EOF
+	default:
+		resp.Body.Close()
+		return fmt.Errorf("GET %s: unexpected status %s", r.req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
+
+func (r *rangeChunkReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
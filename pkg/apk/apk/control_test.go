@@ -0,0 +1,125 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testCountingWriter counts the bytes of response bodies.
+type testCountingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w testCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+func TestFetchControl(t *testing.T) {
+	ctx := context.Background()
+
+	// Random bytes do not compress, so the data section is as large as its contents.
+	payload := make([]byte, 4<<20)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+	want := &Package{
+		Name:         "big",
+		Version:      "1.0.0-r0",
+		Arch:         testArch,
+		Description:  "a large package",
+		Origin:       "big",
+		Dependencies: []string{"so:libc.so.6", "busybox"},
+		Scripts:      map[string][]byte{".post-install": []byte("#!/bin/sh\n")},
+	}
+	dir := testLocalRepoWithFiles(t, testArch, []*Package{want}, map[string][]testDirEntry{
+		"big": {{path: "usr", dir: true, perms: 0o755}, {path: "usr/payload", perms: 0o644, content: payload}},
+	})
+	apkFile := filepath.Join(dir, testArch, want.Filename())
+	fi, err := os.Stat(apkFile)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name   string
+		ranges bool
+	}{
+		{"range requests", true},
+		{"no range support", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var served, packageRequests atomic.Int64
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if filepath.Ext(r.URL.Path) == ".apk" {
+					packageRequests.Add(1)
+					w = testCountingWriter{ResponseWriter: w, n: &served}
+				}
+				if tt.ranges || filepath.Ext(r.URL.Path) != ".apk" {
+					http.ServeFile(w, r, filepath.Join(dir, r.URL.Path))
+					return
+				}
+				f, err := os.Open(filepath.Join(dir, r.URL.Path))
+				if err != nil {
+					http.NotFound(w, r)
+					return
+				}
+				defer f.Close()
+				_, _ = io.Copy(w, f)
+			}))
+			defer s.Close()
+
+			a, _ := testAPKWithRepos(t, []string{s.URL}, WithCache(t.TempDir(), false))
+			// The dependencies are not in the repository, so take the package from the index.
+			indexes, err := a.GetRepositoryIndexes(ctx, true)
+			require.NoError(t, err)
+			require.Len(t, indexes, 1)
+			require.Len(t, indexes[0].Packages(), 1)
+			pkg := indexes[0].Packages()[0]
+
+			got, err := a.FetchControl(ctx, pkg)
+			require.NoError(t, err)
+			require.Equal(t, want.Name, got.Name)
+			require.Equal(t, want.Version, got.Version)
+			require.Equal(t, want.Description, got.Description)
+			require.Equal(t, want.Origin, got.Origin)
+			require.Equal(t, want.Dependencies, got.Dependencies)
+			require.Equal(t, want.DataHash, got.DataHash)
+			require.Equal(t, want.Scripts, got.Scripts)
+			require.Equal(t, pkg.Checksum, got.Checksum)
+			if tt.ranges {
+				require.Less(t, served.Load(), int64(controlChunkSize)*2, "more than the control section was served")
+				require.Less(t, served.Load(), fi.Size()/100, "the package was downloaded in full")
+			}
+
+			// The second time, the control section comes from the cache.
+			requests := packageRequests.Load()
+			again, err := a.FetchControl(ctx, pkg)
+			require.NoError(t, err)
+			require.Equal(t, got, again)
+			require.Equal(t, requests, packageRequests.Load())
+		})
+	}
+}
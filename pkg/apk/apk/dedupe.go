@@ -0,0 +1,124 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fileDeduper remembers where the first copy of each distinct regular file was installed, so
+// that later identical files can be hardlinked to it.
+type fileDeduper struct {
+	mu sync.Mutex
+	// disabled once the filesystem fails to create a hardlink
+	disabled bool
+	// content and metadata key to the path of the first file installed with it
+	paths map[string]string
+	// path to its key, to forget paths that are overwritten
+	keys map[string]string
+}
+
+func newFileDeduper() *fileDeduper {
+	return &fileDeduper{paths: map[string]string{}, keys: map[string]string{}}
+}
+
+// dedupeKey identifies a regular file by its checksum and everything its hardlinks would share,
+// or returns "" if the header carries no checksum.
+func dedupeKey(header *tar.Header, checksum []byte) string {
+	if checksum == nil {
+		return ""
+	}
+	var xattrs []string
+	for k, v := range header.PAXRecords {
+		if strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
+			xattrs = append(xattrs, k+"="+v)
+		}
+	}
+	sort.Strings(xattrs)
+	return fmt.Sprintf("%x %o %d %d %s", checksum, header.Mode, header.Uid, header.Gid, strings.Join(xattrs, "\x00"))
+}
+
+// linkDuplicate hardlinks header.Name to an earlier identical file, and reports whether it did.
+// Nothing is linked if the path already exists, so that the usual conflict handling applies.
+func (a *APK) linkDuplicate(header *tar.Header) (bool, error) {
+	d := a.dedupe
+	checksum, err := checksumFromHeader(header)
+	if err != nil {
+		return false, err
+	}
+	key := dedupeKey(header, checksum)
+	if key == "" {
+		return false, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	first, ok := d.paths[key]
+	if d.disabled || !ok {
+		return false, nil
+	}
+	if _, err := a.fs.Stat(header.Name); err == nil {
+		return false, nil
+	}
+	if err := a.fs.Link(first, header.Name); err != nil {
+		// Not every filesystem supports hardlinks, fall back to writing files out.
+		d.disabled = true
+		return false, nil
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[paxRecordsChecksumKey] = fmt.Sprintf("Q1%s", base64.StdEncoding.EncodeToString(checksum))
+	return true, nil
+}
+
+// record notes that the file for header was written out, making it the one that later identical
+// files are linked to unless an identical file is already known.
+func (d *fileDeduper) record(header *tar.Header) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.forgetLocked(header.Name)
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	checksum, err := checksumFromHeader(header)
+	if err != nil {
+		return err
+	}
+	key := dedupeKey(header, checksum)
+	if key == "" {
+		return nil
+	}
+	if _, ok := d.paths[key]; !ok {
+		d.paths[key] = header.Name
+		d.keys[header.Name] = key
+	}
+	return nil
+}
+
+func (d *fileDeduper) forgetLocked(path string) {
+	if key, ok := d.keys[path]; ok {
+		delete(d.paths, key)
+		delete(d.keys, path)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+)
+
+// testNoLinkFS is a filesystem that does not support hardlinks.
+type testNoLinkFS struct {
+	apkfs.FullFS
+}
+
+func (testNoLinkFS) Link(string, string) error {
+	return errors.New("hardlinks not supported")
+}
+
+// testChecksummedTar returns a data section with the given files, each with an
+// APK-TOOLS.checksum.SHA1 header like real packages have.
+func testChecksummedTar(t *testing.T, files map[string]string) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "usr", Typeflag: tar.TypeDir, Mode: 0o755}))
+	for name, content := range files {
+		sum := sha1.Sum([]byte(content)) //nolint:gosec // this is what apk tools is using
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:       name,
+			Typeflag:   tar.TypeReg,
+			Mode:       0o644,
+			Size:       int64(len(content)),
+			PAXRecords: map[string]string{paxRecordsChecksumKey: hex.EncodeToString(sum[:])},
+		}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return &buf
+}
+
+func TestDedupeFiles(t *testing.T) {
+	ctx := context.Background()
+	install := func(t *testing.T, a *APK) {
+		t.Helper()
+		_, err := a.installAPKFiles(ctx, testChecksummedTar(t, map[string]string{
+			"usr/LICENSE-foo": "license",
+			"usr/foo":         "foo",
+		}), &Package{Name: "foo"})
+		require.NoError(t, err)
+		_, err = a.installAPKFiles(ctx, testChecksummedTar(t, map[string]string{
+			"usr/LICENSE-bar": "license",
+			"usr/bar":         "bar",
+		}), &Package{Name: "bar"})
+		require.NoError(t, err)
+	}
+
+	t.Run("hardlinks", func(t *testing.T) {
+		a, src := testAPKWithRepos(t, nil, WithDedupeFiles(true))
+		install(t, a)
+
+		for name, content := range map[string]string{"usr/LICENSE-foo": "license", "usr/LICENSE-bar": "license", "usr/foo": "foo", "usr/bar": "bar"} {
+			b, err := src.ReadFile(name)
+			require.NoError(t, err)
+			require.Equal(t, content, string(b))
+		}
+
+		// Hardlinks share an inode, so changing the mode of one changes the other.
+		require.NoError(t, src.Chmod("usr/LICENSE-foo", 0o600))
+		fi, err := src.Stat("usr/LICENSE-bar")
+		require.NoError(t, err)
+		require.Equal(t, "-rw-------", fi.Mode().String(), "identical files should be hardlinked")
+
+		require.NoError(t, src.Chmod("usr/foo", 0o600))
+		fi, err = src.Stat("usr/bar")
+		require.NoError(t, err)
+		require.Equal(t, "-rw-r--r--", fi.Mode().String(), "distinct files should not be hardlinked")
+	})
+	t.Run("no hardlink support", func(t *testing.T) {
+		a, src := testAPKWithRepos(t, nil, WithDedupeFiles(true))
+		a.fs = testNoLinkFS{src}
+		install(t, a)
+
+		b, err := src.ReadFile("usr/LICENSE-bar")
+		require.NoError(t, err)
+		require.Equal(t, "license", string(b))
+
+		require.NoError(t, src.Chmod("usr/LICENSE-foo", 0o600))
+		fi, err := src.Stat("usr/LICENSE-bar")
+		require.NoError(t, err)
+		require.Equal(t, "-rw-r--r--", fi.Mode().String())
+	})
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1" //nolint:gosec // the keys of the keyring sign SHA1 digests
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"chainguard.dev/apko/pkg/apk/expandapk"
+	sign "chainguard.dev/apko/pkg/apk/signature"
+)
+
+// detachedSignatures is the signature manifest given by WithDetachedSignatures, loaded on
+// first use.
+type detachedSignatures struct {
+	url string
+
+	once sync.Once
+	sigs map[string][]byte
+	err  error
+}
+
+// parseDetachedSignatures parses a signature manifest. Each line holds the filename of a
+// package and the base64 of its signature, separated by whitespace. Empty lines and lines
+// starting with # are skipped.
+func parseDetachedSignatures(r io.Reader) (map[string][]byte, error) {
+	sigs := map[string][]byte{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a filename and a signature", n)
+		}
+		sig, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: decoding signature of %s: %w", n, fields[0], err)
+		}
+		sigs[fields[0]] = sig
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sigs, nil
+}
+
+// detachedSignatureMap returns the signatures of the manifest by package filename.
+func (a *APK) detachedSignatureMap(ctx context.Context) (map[string][]byte, error) {
+	d := a.detachedSignatures
+	d.once.Do(func() {
+		rc, err := a.openDetachedSignatures(ctx, d.url)
+		if err != nil {
+			d.err = err
+			return
+		}
+		defer rc.Close()
+		if d.sigs, err = parseDetachedSignatures(rc); err != nil {
+			d.err = fmt.Errorf("reading detached signatures at %s: %w", d.url, err)
+		}
+	})
+	return d.sigs, d.err
+}
+
+func (a *APK) openDetachedSignatures(ctx context.Context, u string) (io.ReadCloser, error) {
+	asURL, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("parsing detached signatures URL %s: %w", u, err)
+	}
+	switch asURL.Scheme {
+	case "", "file":
+		f, err := os.Open(localPath(u))
+		if err != nil {
+			return nil, fmt.Errorf("opening detached signatures: %w", err)
+		}
+		return f, nil
+	case "https", "http":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if a, ok := a.auth[asURL.Host]; ok && a.user != "" && a.pass != "" {
+			req.SetBasicAuth(a.user, a.pass)
+		}
+		if err := authenticate(ctx, req, a.authenticator); err != nil {
+			return nil, err
+		}
+		res, err := a.fetchRetry.client(a.httpClient()).Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get detached signatures at %s: %w", asURL.Redacted(), err)
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, statusError(asURL.Redacted(), res.StatusCode, fmt.Errorf("unable to get detached signatures at %s: %v", asURL.Redacted(), res.Status))
+		}
+		return res.Body, nil
+	default:
+		return nil, fmt.Errorf("detached signatures scheme %s not supported", asURL.Scheme)
+	}
+}
+
+// verifyDetachedSignature checks the .apk that exp was expanded from against its signature in
+// the manifest, which is over the SHA1 digest of the whole file.
+func (a *APK) verifyDetachedSignature(ctx context.Context, pkg InstallablePackage, exp *expandapk.APKExpanded) error {
+	sigs, err := a.detachedSignatureMap(ctx)
+	if err != nil {
+		return err
+	}
+	filename := path.Base(pkg.URL())
+	sig, ok := sigs[filename]
+	if !ok {
+		return &SignatureError{Name: filename, Err: fmt.Errorf("no detached signature for %s", filename)}
+	}
+
+	rc, err := exp.APK()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", filename, err)
+	}
+	defer rc.Close()
+	digest := sha1.New() //nolint:gosec
+	if _, err := io.Copy(digest, rc); err != nil {
+		return fmt.Errorf("hashing %s: %w", filename, err)
+	}
+	sum := digest.Sum(nil)
+
+	keys, err := a.keyring()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for name, key := range keys {
+		err := sign.RSAVerifySHA1Digest(sum, sig, key)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	if len(errs) == 0 {
+		return &SignatureError{Name: filename, Err: fmt.Errorf("no keys to verify the detached signature of %s", filename)}
+	}
+	return &SignatureError{Name: filename, Err: fmt.Errorf("no key verifies the detached signature of %s: %w", filename, errors.Join(errs...))}
+}
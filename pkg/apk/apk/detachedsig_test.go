@@ -0,0 +1,107 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	sign "chainguard.dev/apko/pkg/apk/signature"
+)
+
+func TestDetachedSignatures(t *testing.T) {
+	ctx := context.Background()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "test.rsa")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	extraKeys := map[string][]byte{"test.rsa.pub": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})}
+
+	names := []string{"good", "bad", "missing"}
+	var packages []*Package
+	entries := map[string][]testDirEntry{}
+	for _, name := range names {
+		packages = append(packages, &Package{Name: name, Version: "1.0.0-r0", Arch: testArch})
+		entries[name] = []testDirEntry{{"usr", 0o755, true, nil, nil}, {"usr/" + name, 0o644, false, []byte(name), nil}}
+	}
+	repo := testLocalRepoWithFiles(t, testArch, packages, entries)
+
+	signFile := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(repo, testArch, name))
+		require.NoError(t, err)
+		digest, err := sign.HashData(b)
+		require.NoError(t, err)
+		sig, err := sign.RSASignSHA1Digest(digest, keyFile, "")
+		require.NoError(t, err)
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	manifest := strings.Join([]string{
+		"# detached signatures",
+		"good-1.0.0-r0.apk " + signFile("good-1.0.0-r0.apk"),
+		"",
+		// a valid signature, but of another package
+		"bad-1.0.0-r0.apk " + signFile("good-1.0.0-r0.apk"),
+	}, "\n")
+	manifestPath := filepath.Join(t.TempDir(), "signatures")
+	require.NoError(t, os.WriteFile(manifestPath, []byte(manifest), 0o644))
+
+	for _, tt := range []struct {
+		name    string
+		wantErr string
+	}{
+		{"good", ""},
+		{"bad", "no key verifies the detached signature of bad-1.0.0-r0.apk"},
+		{"missing", "no detached signature for missing-1.0.0-r0.apk"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, src := testAPKWithRepos(t, []string{repo}, WithExtraKeys(extraKeys), WithDetachedSignatures(manifestPath))
+			require.NoError(t, a.SetWorld(ctx, []string{tt.name}))
+			err := a.FixateWorld(ctx, nil)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			b, err := src.ReadFile(fmt.Sprintf("usr/%s", tt.name))
+			require.NoError(t, err)
+			require.Equal(t, tt.name, string(b))
+		})
+	}
+
+	t.Run("unknown key", func(t *testing.T) {
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		pub, err := x509.MarshalPKIXPublicKey(&other.PublicKey)
+		require.NoError(t, err)
+		a, _ := testAPKWithRepos(t, []string{repo},
+			WithExtraKeys(map[string][]byte{"other.rsa.pub": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})}),
+			WithDetachedSignatures(manifestPath))
+		require.NoError(t, a.SetWorld(ctx, []string{"good"}))
+		require.ErrorContains(t, a.FixateWorld(ctx, nil), "no key verifies the detached signature of good-1.0.0-r0.apk")
+	})
+}
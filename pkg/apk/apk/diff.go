@@ -0,0 +1,85 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go.opentelemetry.io/otel"
+)
+
+// WorldDiff is the difference between the packages two worlds resolve to, each sorted by name.
+type WorldDiff struct {
+	// Added are the packages only the new world resolves to.
+	Added []*RepositoryPackage
+	// Removed are the packages only the old world resolves to.
+	Removed []*RepositoryPackage
+	// Changed are the packages both worlds resolve to, but at different versions.
+	Changed []PackageChange
+}
+
+// PackageChange is a package that resolves to a different version in the new world.
+type PackageChange struct {
+	Old *RepositoryPackage
+	New *RepositoryPackage
+}
+
+// Empty reports whether both worlds resolve to the same packages.
+func (d *WorldDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffWorlds resolves oldWorld and newWorld against the configured repositories and returns how
+// the resolved packages differ. Neither world is written, and nothing is installed.
+func (a *APK) DiffWorlds(ctx context.Context, oldWorld, newWorld []string) (*WorldDiff, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "DiffWorlds")
+	defer span.End()
+
+	oldPkgs, _, err := a.resolvePackages(ctx, oldWorld)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving old world: %w", err)
+	}
+	newPkgs, _, err := a.resolvePackages(ctx, newWorld)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving new world: %w", err)
+	}
+
+	old := make(map[string]*RepositoryPackage, len(oldPkgs))
+	for _, pkg := range oldPkgs {
+		old[pkg.Name] = pkg
+	}
+
+	diff := &WorldDiff{}
+	for _, pkg := range newPkgs {
+		prev, ok := old[pkg.Name]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, pkg)
+		case prev.Version != pkg.Version:
+			diff.Changed = append(diff.Changed, PackageChange{Old: prev, New: pkg})
+		}
+		delete(old, pkg.Name)
+	}
+	for _, pkg := range old {
+		diff.Removed = append(diff.Removed, pkg)
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Name < diff.Added[j].Name })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Name < diff.Removed[j].Name })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].New.Name < diff.Changed[j].New.Name })
+	return diff, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffWorlds(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepo(t, testArch, []*Package{
+		{Name: "foo", Version: "1.0.0-r0", Arch: testArch, Dependencies: []string{"libfoo"}},
+		{Name: "foo", Version: "2.0.0-r0", Arch: testArch, Dependencies: []string{"libfoo", "libbar"}},
+		{Name: "libfoo", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "libbar", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "old", Version: "1.0.0-r0", Arch: testArch},
+	})
+	a, _ := testAPKWithRepos(t, []string{repo})
+	require.NoError(t, a.SetWorld(ctx, []string{"libfoo"}))
+
+	diff, err := a.DiffWorlds(ctx, []string{"foo=1.0.0-r0", "old"}, []string{"foo=2.0.0-r0"})
+	require.NoError(t, err)
+	require.False(t, diff.Empty())
+
+	require.Len(t, diff.Added, 1)
+	require.Equal(t, "libbar", diff.Added[0].Name)
+	require.Len(t, diff.Removed, 1)
+	require.Equal(t, "old", diff.Removed[0].Name)
+	require.Len(t, diff.Changed, 1)
+	require.Equal(t, "foo", diff.Changed[0].New.Name)
+	require.Equal(t, "1.0.0-r0", diff.Changed[0].Old.Version)
+	require.Equal(t, "2.0.0-r0", diff.Changed[0].New.Version)
+
+	same, err := a.DiffWorlds(ctx, []string{"foo"}, []string{"foo=2.0.0-r0"})
+	require.NoError(t, err)
+	require.True(t, same.Empty())
+
+	world, err := a.GetWorld(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"libfoo"}, world, "diffing should not change the world")
+
+	_, err = a.DiffWorlds(ctx, []string{"foo"}, []string{"missing"})
+	require.Error(t, err)
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"io"
+	"net/http"
+)
+
+// downloadLimit returns the most bytes that may be downloaded for pkg, or 0 for no limit. With a
+// maximum download size set, a package may also not be larger than the size in its index.
+func (a *APK) downloadLimit(pkg InstallablePackage) int64 {
+	if a.maxDownloadSize <= 0 {
+		return 0
+	}
+	limit := a.maxDownloadSize
+	if p, ok := pkg.(*RepositoryPackage); ok && p.Package != nil && p.Size > 0 && int64(p.Size) < limit {
+		limit = int64(p.Size)
+	}
+	return limit
+}
+
+// limitedReadCloser fails reads with a DownloadSizeError once more than limit bytes were read.
+type limitedReadCloser struct {
+	io.ReadCloser
+	pkg   string
+	limit int64
+	read  int64
+}
+
+func limitDownload(rc io.ReadCloser, pkg string, limit int64) io.ReadCloser {
+	if limit <= 0 {
+		return rc
+	}
+	return &limitedReadCloser{ReadCloser: rc, pkg: pkg, limit: limit}
+}
+
+func (r *limitedReadCloser) Read(p []byte) (int, error) {
+	if r.read > r.limit {
+		return 0, &DownloadSizeError{Package: r.pkg, Limit: r.limit}
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if over := r.read - r.limit; over > 0 {
+		return n - int(min(over, int64(n))), &DownloadSizeError{Package: r.pkg, Limit: r.limit}
+	}
+	return n, err
+}
+
+// limitTransport applies a download limit to every response, so that an oversized package
+// fails before any of it is written to the cache.
+type limitTransport struct {
+	wrapped *http.Client
+	pkg     string
+	limit   int64
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.wrapped.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength > t.limit {
+		resp.Body.Close()
+		return nil, &DownloadSizeError{Package: t.pkg, Limit: t.limit, Size: resp.ContentLength}
+	}
+	resp.Body = limitDownload(resp.Body, t.pkg, t.limit)
+	return resp, nil
+}
@@ -17,8 +17,12 @@ package apk
 import (
 	"errors"
 	"fmt"
+	"net/http"
 )
 
+// ErrOffline is returned when running offline and something is not in the cache.
+var ErrOffline = errors.New("offline and not cached")
+
 type FileExistsError struct {
 	Path string
 	Sha1 []byte
@@ -32,3 +36,187 @@ func (f FileExistsError) Is(target error) bool {
 	var targetError FileExistsError
 	return errors.As(target, &targetError)
 }
+
+// DowngradeError is returned when resolution selects an older version of an installed package
+// and downgrades are forbidden.
+type DowngradeError struct {
+	Package   string
+	Installed string
+	Resolved  string
+}
+
+func (d *DowngradeError) Error() string {
+	return fmt.Sprintf("package %s would be downgraded from %s to %s", d.Package, d.Installed, d.Resolved)
+}
+
+func (d *DowngradeError) Is(target error) bool {
+	_, ok := target.(*DowngradeError)
+	return ok
+}
+
+// FileConflictError is returned when a package would overwrite a regular file owned by another
+// package with different contents, and neither package replaces the other.
+type FileConflictError struct {
+	Path     string
+	Owner    string
+	Conflict string
+}
+
+func (f *FileConflictError) Error() string {
+	return fmt.Sprintf("file %s from package %s conflicts with the one installed by %s", f.Path, f.Conflict, f.Owner)
+}
+
+func (f *FileConflictError) Is(target error) bool {
+	_, ok := target.(*FileConflictError)
+	return ok
+}
+
+// LicensePolicyError is returned when a resolved package carries a license that the license
+// policy does not permit.
+type LicensePolicyError struct {
+	Package string
+	License string
+}
+
+func (l *LicensePolicyError) Error() string {
+	if l.License == "" {
+		return fmt.Sprintf("package %s has no license, which the license policy does not permit", l.Package)
+	}
+	return fmt.Sprintf("package %s has license %q, which the license policy does not permit", l.Package, l.License)
+}
+
+func (l *LicensePolicyError) Is(target error) bool {
+	_, ok := target.(*LicensePolicyError)
+	return ok
+}
+
+// UntrustedRepositoryError is returned when a package resolves only from a repository that
+// is not on a host allowed by WithTrustedRepositories.
+type UntrustedRepositoryError struct {
+	Package    string
+	Repository string
+}
+
+func (u *UntrustedRepositoryError) Error() string {
+	return fmt.Sprintf("package %s is only available from repository %s, which is not trusted", u.Package, u.Repository)
+}
+
+func (u *UntrustedRepositoryError) Is(target error) bool {
+	_, ok := target.(*UntrustedRepositoryError)
+	return ok
+}
+
+// DownloadSizeError is returned when a package download is larger than the maximum download
+// size, or than the size its index declares.
+type DownloadSizeError struct {
+	Package string
+	Limit   int64
+	// Size is the announced size of the download, or 0 if it was cut off while reading.
+	Size int64
+}
+
+func (d *DownloadSizeError) Error() string {
+	if d.Size > 0 {
+		return fmt.Sprintf("package %s is %d bytes, which exceeds the download size limit of %d bytes", d.Package, d.Size, d.Limit)
+	}
+	return fmt.Sprintf("package %s exceeds the download size limit of %d bytes", d.Package, d.Limit)
+}
+
+func (d *DownloadSizeError) Is(target error) bool {
+	_, ok := target.(*DownloadSizeError)
+	return ok
+}
+
+// AuthError is returned when a repository refuses a request because its credentials are
+// missing or not accepted, that is, with a 401 or 403 status.
+type AuthError struct {
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+func (e *AuthError) Is(target error) bool {
+	_, ok := target.(*AuthError)
+	return ok
+}
+
+// NotFoundError is returned when a repository does not have a package, index or key that was
+// requested, that is, answers with a 404 or 410 status.
+type NotFoundError struct {
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return e.Err
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	_, ok := target.(*NotFoundError)
+	return ok
+}
+
+// SignatureError is returned when an index, a package or a key cannot be verified against the
+// trusted keys.
+type SignatureError struct {
+	// Name is what failed verification, such as the URL of an index or the name of a package.
+	Name string
+	Err  error
+}
+
+func (e *SignatureError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SignatureError) Is(target error) bool {
+	_, ok := target.(*SignatureError)
+	return ok
+}
+
+// ResolutionError is returned when the requested packages cannot be resolved against the
+// indexes. Err is the reason, such as an UnsatisfiedError or a ConstraintError.
+type ResolutionError struct {
+	Err error
+}
+
+func (e *ResolutionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ResolutionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ResolutionError) Is(target error) bool {
+	_, ok := target.(*ResolutionError)
+	return ok
+}
+
+// statusError returns err as an AuthError or a NotFoundError if statusCode, from a request for
+// u, is one of theirs, and err as it is otherwise.
+func statusError(u string, statusCode int, err error) error {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &AuthError{URL: u, StatusCode: statusCode, Err: err}
+	case http.StatusNotFound, http.StatusGone:
+		return &NotFoundError{URL: u, StatusCode: statusCode, Err: err}
+	}
+	return err
+}
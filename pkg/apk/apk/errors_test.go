@@ -0,0 +1,91 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTypedErrors(t *testing.T) {
+	ctx := context.Background()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/private/"):
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	fetch := func(t *testing.T, repo string) error {
+		a, _ := testAPKWithRepos(t, nil)
+		r := &Repository{URI: s.URL + "/" + repo + "/" + testArch}
+		pkg := NewRepositoryPackage(&Package{Name: "foo", Version: "1.0.0-r0"}, r.WithIndex(&APKIndex{}))
+		_, err := a.FetchPackage(ctx, pkg)
+		return err
+	}
+
+	t.Run("forbidden", func(t *testing.T) {
+		err := fetch(t, "private")
+		var authErr *AuthError
+		require.True(t, errors.As(err, &authErr), "got %v", err)
+		require.Equal(t, http.StatusForbidden, authErr.StatusCode)
+		require.ErrorIs(t, err, &AuthError{})
+		require.NotErrorIs(t, err, &NotFoundError{})
+		require.ErrorContains(t, err, "unable to get package apk at "+s.URL+"/private/"+testArch+"/foo-1.0.0-r0.apk: 403 Forbidden")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		err := fetch(t, "public")
+		var notFound *NotFoundError
+		require.True(t, errors.As(err, &notFound), "got %v", err)
+		require.Equal(t, http.StatusNotFound, notFound.StatusCode)
+		require.Equal(t, s.URL+"/public/"+testArch+"/foo-1.0.0-r0.apk", notFound.URL)
+		require.NotErrorIs(t, err, &AuthError{})
+	})
+
+	t.Run("keyring", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, nil)
+		err := a.InitKeyring(ctx, []string{s.URL + "/private/key.rsa.pub"}, nil)
+		var authErr *AuthError
+		require.True(t, errors.As(err, &authErr), "got %v", err)
+		require.ErrorContains(t, err, "http response indicated error code: 403")
+	})
+
+	t.Run("index", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, []string{s.URL + "/private"})
+		_, err := a.GetRepositoryIndexes(ctx, true)
+		require.ErrorIs(t, err, &AuthError{})
+	})
+
+	t.Run("resolution", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, []string{testLocalRepo(t, testArch, []*Package{{Name: "foo", Version: "1.0.0-r0"}})})
+		require.NoError(t, a.SetWorld(ctx, []string{"missing"}))
+		_, _, err := a.ResolveWorld(ctx)
+		var resolutionErr *ResolutionError
+		require.True(t, errors.As(err, &resolutionErr), "got %v", err)
+		var unsatisfied *UnsatisfiedError
+		require.True(t, errors.As(err, &unsatisfied))
+		require.Equal(t, unsatisfied.Error(), err.Error())
+	})
+}
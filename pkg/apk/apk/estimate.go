@@ -0,0 +1,98 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// EstimateDownloadSize resolves the world and returns the number of bytes that installing it
+// would download, according to the size each package has in its index. Packages that are in
+// the cache, already installed at the resolved version, or in a local repository are not
+// downloaded and so not counted.
+func (a *APK) EstimateDownloadSize(ctx context.Context) (int64, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "EstimateDownloadSize")
+	defer span.End()
+
+	toInstall, _, err := a.ResolveWorld(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error getting package dependencies: %w", err)
+	}
+	installed, err := a.installedByName()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, pkg := range toInstall {
+		u := pkg.URL()
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			continue
+		}
+		if alreadyInstalled(installed, pkg) || a.packageCached(pkg) {
+			continue
+		}
+		total += int64(pkg.Size)
+	}
+	return total, nil
+}
+
+// packageCached reports whether fetching pkg would be served from the cache, either as the
+// downloaded .apk or as an expanded package.
+func (a *APK) packageCached(pkg InstallablePackage) bool {
+	if a.cache == nil {
+		return false
+	}
+
+	if u, err := packageAsURL(pkg); err == nil {
+		if p, err := cachePathFromURL(a.cache.dir, *u); err == nil {
+			if _, err := os.Stat(p); err == nil {
+				return true
+			}
+		}
+	}
+
+	cacheDir, err := cacheDirForPackage(a.cache.dir, pkg)
+	if err != nil {
+		return false
+	}
+	chk := pkg.ChecksumString()
+	if !strings.HasPrefix(chk, "Q1") {
+		return false
+	}
+	checksum, err := base64.StdEncoding.DecodeString(chk[2:])
+	if err != nil {
+		return false
+	}
+	f, err := os.Open(filepath.Join(cacheDir, hex.EncodeToString(checksum)+".ctl.tar.gz"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	datahash, err := a.datahash(f)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(cacheDir, datahash+".dat.tar.gz"))
+	return err == nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateDownloadSize(t *testing.T) {
+	ctx := context.Background()
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0", Arch: testArch, Size: 1000, Dependencies: []string{"bar"}},
+		{Name: "bar", Version: "1.0.0", Arch: testArch, Size: 2000},
+		{Name: "baz", Version: "1.0.0", Arch: testArch, Size: 4000},
+		{Name: "unused", Version: "1.0.0", Arch: testArch, Size: 8000},
+	}
+	entries := map[string][]testDirEntry{}
+	for _, pkg := range packages {
+		entries[pkg.Name] = []testDirEntry{{path: "usr", dir: true, perms: 0o755}, {path: "usr/" + pkg.Name, perms: 0o755, content: []byte(pkg.Name)}}
+	}
+	dir := testLocalRepoWithFiles(t, testArch, packages, entries)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(dir, r.URL.Path))
+	}))
+	defer s.Close()
+
+	cacheDir := t.TempDir()
+	a, _ := testAPKWithRepos(t, []string{s.URL}, WithCache(cacheDir, false))
+	require.NoError(t, a.SetWorld(ctx, []string{"foo", "baz"}))
+
+	size, err := a.EstimateDownloadSize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000+2000+4000), size)
+
+	// Fill the cache with bar through another root, so it is cached but not installed here.
+	other, _ := testAPKWithRepos(t, []string{s.URL}, WithCache(cacheDir, false))
+	require.NoError(t, other.SetWorld(ctx, []string{"bar"}))
+	require.NoError(t, other.FixateWorld(ctx, nil))
+
+	size, err = a.EstimateDownloadSize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000+4000), size, "bar is cached")
+
+	t.Run("local repository", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, []string{dir})
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		size, err := a.EstimateDownloadSize(ctx)
+		require.NoError(t, err)
+		require.Zero(t, size)
+	})
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// validatePathExcludes checks that each of patterns is a valid path.Match pattern.
+func validatePathExcludes(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid path exclude %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// excluded returns whether name, or any directory it is in, matches one of the patterns set
+// with WithPathExcludes.
+func (a *APK) excluded(name string) bool {
+	if len(a.pathExcludes) == 0 {
+		return false
+	}
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "./"), "/")
+	for p := name; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		for _, pattern := range a.pathExcludes {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// excludeTracker records what installing a package left out, so that directories left empty
+// by it can be pruned.
+type excludeTracker struct {
+	// parents holds every directory that an excluded entry is in.
+	parents map[string]bool
+	// created holds the directories that did not exist before the package was installed.
+	created map[string]bool
+}
+
+func newExcludeTracker() *excludeTracker {
+	return &excludeTracker{parents: map[string]bool{}, created: map[string]bool{}}
+}
+
+// exclude records that name was left out.
+func (e *excludeTracker) exclude(name string) {
+	name = strings.TrimSuffix(name, "/")
+	for p := path.Dir(name); p != "." && p != "/"; p = path.Dir(p) {
+		e.parents[p] = true
+	}
+}
+
+// trackCreatedDir records in e that the directory name is new, if it does not exist yet.
+func (a *APK) trackCreatedDir(e *excludeTracker, name string) {
+	if _, err := a.fs.Stat(name); err != nil {
+		e.created[strings.TrimSuffix(name, "/")] = true
+	}
+}
+
+// pruneExcluded removes the directories that the package created and that are empty because
+// their contents were excluded, deepest first, and drops them from files. It does nothing unless
+// WithPruneExcludedDirs is set.
+func (a *APK) pruneExcluded(e *excludeTracker, files []tar.Header) ([]tar.Header, error) {
+	if !a.pruneExcludedDirs || len(e.parents) == 0 {
+		return files, nil
+	}
+
+	var dirs []string
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name, "/")
+		if f.Typeflag == tar.TypeDir && e.parents[name] && e.created[name] {
+			dirs = append(dirs, name)
+		}
+	}
+	// Children sort after their parents, so the reverse order goes deepest first.
+	slices.Sort(dirs)
+	slices.Reverse(dirs)
+
+	pruned := map[string]bool{}
+	for _, dir := range dirs {
+		entries, err := a.fs.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("reading directory %s: %w", dir, err)
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		if err := a.fs.Remove(dir); err != nil {
+			return nil, fmt.Errorf("removing empty directory %s: %w", dir, err)
+		}
+		pruned[dir] = true
+	}
+	if len(pruned) == 0 {
+		return files, nil
+	}
+	return slices.DeleteFunc(files, func(f tar.Header) bool {
+		return f.Typeflag == tar.TypeDir && pruned[strings.TrimSuffix(f.Name, "/")]
+	}), nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathExcludes(t *testing.T) {
+	ctx := context.Background()
+
+	pkg := &Package{Name: "foo", Version: "1.0.0", Arch: testArch}
+	dir := testLocalRepoWithFiles(t, testArch, []*Package{pkg}, map[string][]testDirEntry{
+		"foo": {
+			{path: "usr", dir: true, perms: 0o755},
+			{path: "usr/bin", dir: true, perms: 0o755},
+			{path: "usr/bin/foo", perms: 0o755, content: []byte("foo")},
+			{path: "usr/share", dir: true, perms: 0o755},
+			{path: "usr/share/doc", dir: true, perms: 0o755},
+			{path: "usr/share/doc/README", perms: 0o644, content: []byte("readme")},
+			{path: "usr/share/man", dir: true, perms: 0o755},
+			{path: "usr/share/man/man1", dir: true, perms: 0o755},
+			{path: "usr/share/man/man1/foo.1", perms: 0o644, content: []byte("man page")},
+			{path: "usr/share/man/foo.txt", perms: 0o644, content: []byte("top-level man file")},
+		},
+	})
+
+	for _, tt := range []struct {
+		name  string
+		prune bool
+	}{
+		{"keep directories", false},
+		{"prune directories", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, src := testAPKWithRepos(t, []string{dir}, WithPathExcludes([]string{"usr/share/man/*"}), WithPruneExcludedDirs(tt.prune))
+			require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+			require.NoError(t, a.FixateWorld(ctx, nil))
+
+			for _, name := range []string{"usr/share/man/man1/foo.1", "usr/share/man/man1", "usr/share/man/foo.txt"} {
+				_, err := src.Stat(name)
+				require.ErrorIs(t, err, os.ErrNotExist, "%s was installed", name)
+			}
+			for _, name := range []string{"usr/bin/foo", "usr/share/doc/README"} {
+				_, err := src.Stat(name)
+				require.NoError(t, err)
+			}
+			_, err := src.Stat("usr/share/man")
+			if tt.prune {
+				require.ErrorIs(t, err, os.ErrNotExist)
+			} else {
+				require.NoError(t, err)
+			}
+			// usr/share still holds doc, so it is kept either way.
+			_, err = src.Stat("usr/share")
+			require.NoError(t, err)
+
+			owned, err := a.OwnedFiles(ctx, "foo")
+			require.NoError(t, err)
+			require.ElementsMatch(t, []string{"usr/bin/foo", "usr/share/doc/README"}, owned)
+
+			installed, err := a.GetInstalled()
+			require.NoError(t, err)
+			require.Len(t, installed, 1)
+			var dirs []string
+			for _, f := range installed[0].Files {
+				if f.Typeflag == tar.TypeDir {
+					dirs = append(dirs, f.Name)
+				}
+			}
+			require.NotContains(t, dirs, "usr/share/man/man1")
+			if tt.prune {
+				require.NotContains(t, dirs, "usr/share/man")
+			} else {
+				require.Contains(t, dirs, "usr/share/man")
+			}
+		})
+	}
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		_, err := New(WithPathExcludes([]string{"usr/["}))
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+type findOpts struct {
+	regex bool
+}
+
+// FindOption changes how FindPackages matches package names.
+type FindOption func(*findOpts)
+
+// WithRegexp makes FindPackages treat the pattern as a regular expression, in the syntax of the
+// regexp package, instead of a glob. The expression matches if it matches any part of the name,
+// anchor it with ^ and $ to match whole names.
+func WithRegexp(regex bool) FindOption {
+	return func(o *findOpts) {
+		o.regex = regex
+	}
+}
+
+// nameMatcher returns a func that reports whether a package name matches pattern, which is a
+// glob in the syntax of path.Match unless WithRegexp is given.
+func nameMatcher(pattern string, options ...FindOption) (func(string) bool, error) {
+	o := &findOpts{}
+	for _, opt := range options {
+		opt(o)
+	}
+
+	if o.regex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid package name pattern %q: %w", pattern, err)
+		}
+		return re.MatchString, nil
+	}
+	// Match only reports a bad pattern once it gets to it, so check the whole pattern up front.
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid package name pattern %q: %w", pattern, err)
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}, nil
+}
+
+// FindPackages returns the packages in the index whose names match pattern, a glob such as
+// py3-*, in index order. See WithRegexp to match a regular expression instead.
+func (idx *APKIndex) FindPackages(pattern string, options ...FindOption) ([]*Package, error) {
+	matches, err := nameMatcher(pattern, options...)
+	if err != nil {
+		return nil, err
+	}
+	found := []*Package{}
+	for _, pkg := range idx.Packages {
+		if matches(pkg.Name) {
+			found = append(found, pkg)
+		}
+	}
+	return found, nil
+}
+
+// FindPackages reads the remaining packages in the index and returns those whose names match
+// pattern, like APKIndex.FindPackages. Only the matching packages are kept in memory, which
+// makes it suited to large indexes.
+func (r *IndexReader) FindPackages(pattern string, options ...FindOption) ([]*Package, error) {
+	matches, err := nameMatcher(pattern, options...)
+	if err != nil {
+		return nil, err
+	}
+	found := []*Package{}
+	err = r.ForEach(func(pkg *Package) error {
+		if matches(pkg.Name) {
+			found = append(found, pkg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"go.opentelemetry.io/otel"
+)
+
+// GraphEdge records that package From pulled in package To because of Constraint, which is
+// the dependency of From that To satisfied. For packages pulled in by install_if, From is a
+// package matching one of To's install_if entries, and Constraint is that entry.
+type GraphEdge struct {
+	From       string
+	To         string
+	Constraint string
+}
+
+// Graph is the dependency graph of a resolved set of packages.
+type Graph struct {
+	// Roots are the names of the packages the requested constraints resolved to, in order.
+	Roots []string
+	// Nodes are the packages to install, by name.
+	Nodes map[string]*RepositoryPackage
+	// Edges are the dependencies between Nodes, in the order they were resolved.
+	Edges []GraphEdge
+
+	seen map[GraphEdge]bool
+}
+
+func newGraph() *Graph {
+	return &Graph{
+		Nodes: map[string]*RepositoryPackage{},
+		seen:  map[GraphEdge]bool{},
+	}
+}
+
+// addRoot and addEdge do nothing on a nil Graph, so the resolver can call them unconditionally.
+func (g *Graph) addRoot(name string) {
+	if g == nil || slices.Contains(g.Roots, name) {
+		return
+	}
+	g.Roots = append(g.Roots, name)
+}
+
+func (g *Graph) addEdge(from, to, constraint string) {
+	if g == nil {
+		return
+	}
+	e := GraphEdge{From: from, To: to, Constraint: constraint}
+	if g.seen[e] {
+		return
+	}
+	g.seen[e] = true
+	g.Edges = append(g.Edges, e)
+}
+
+// prune drops edges to or from packages that did not end up in toInstall.
+func (g *Graph) prune(toInstall []*RepositoryPackage) {
+	for _, pkg := range toInstall {
+		g.Nodes[pkg.Name] = pkg
+	}
+	g.Edges = slices.DeleteFunc(g.Edges, func(e GraphEdge) bool {
+		return g.Nodes[e.From] == nil || g.Nodes[e.To] == nil
+	})
+	g.seen = nil
+}
+
+// WhyInstalled returns every dependency chain from a root to the named package, each starting
+// with the root and ending with name. It returns nil if the package is not in the graph.
+func (g *Graph) WhyInstalled(name string) [][]string {
+	if _, ok := g.Nodes[name]; !ok {
+		return nil
+	}
+
+	deps := map[string][]string{}
+	for _, e := range g.Edges {
+		if !slices.Contains(deps[e.From], e.To) {
+			deps[e.From] = append(deps[e.From], e.To)
+		}
+	}
+
+	var (
+		chains [][]string
+		walk   func(path []string)
+	)
+	walk = func(path []string) {
+		last := path[len(path)-1]
+		if last == name {
+			chains = append(chains, slices.Clone(path))
+			return
+		}
+		for _, dep := range deps[last] {
+			// Dependencies may be cyclical, never visit a package twice in one chain.
+			if slices.Contains(path, dep) {
+				continue
+			}
+			walk(append(path, dep))
+		}
+	}
+	for _, root := range g.Roots {
+		walk([]string{root})
+	}
+	return chains
+}
+
+// DependencyGraph resolves the given packages like GetPackagesWithDependencies, and returns
+// how each of the resulting packages was pulled in.
+func (p *PkgResolver) DependencyGraph(ctx context.Context, packages []string) (*Graph, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "DependencyGraph")
+	defer span.End()
+
+	p.graph = newGraph()
+	defer func() { p.graph = nil }()
+
+	toInstall, _, err := p.GetPackagesWithDependencies(ctx, packages)
+	if err != nil {
+		return nil, err
+	}
+
+	g := p.graph
+	g.prune(toInstall)
+	return g, nil
+}
+
+// DependencyGraph resolves the world against the configured repositories, and returns how
+// each of the packages to install was pulled in.
+func (a *APK) DependencyGraph(ctx context.Context) (*Graph, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "DependencyGraph")
+	defer span.End()
+
+	world, err := a.GetWorld(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+
+	return a.newPkgResolver(ctx, indexes).DependencyGraph(ctx, world)
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDependencyGraph(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepo(t, testArch, []*Package{
+		{Name: "app", Version: "1.0.0", Dependencies: []string{"libfoo>=1.0.0", "so:libbar.so.1"}},
+		{Name: "libfoo", Version: "1.0.0", Dependencies: []string{"libbaz"}},
+		{Name: "libbar", Version: "1.0.0", Provides: []string{"so:libbar.so.1"}, Dependencies: []string{"libbaz"}},
+		{Name: "libbaz", Version: "1.0.0"},
+		{Name: "tool", Version: "1.0.0"},
+		{Name: "unused", Version: "1.0.0", Dependencies: []string{"libbaz"}},
+	})
+	a, _ := testAPKWithRepos(t, []string{repo})
+	require.NoError(t, a.SetWorld(ctx, []string{"app", "tool"}))
+
+	g, err := a.DependencyGraph(ctx)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"app", "tool"}, g.Roots)
+	require.Len(t, g.Nodes, 5)
+	require.NotContains(t, g.Nodes, "unused")
+	require.ElementsMatch(t, []GraphEdge{
+		{From: "app", To: "libfoo", Constraint: "libfoo>=1.0.0"},
+		{From: "app", To: "libbar", Constraint: "so:libbar.so.1"},
+		{From: "libfoo", To: "libbaz", Constraint: "libbaz"},
+		{From: "libbar", To: "libbaz", Constraint: "libbaz"},
+	}, g.Edges)
+
+	require.ElementsMatch(t, [][]string{
+		{"app", "libfoo", "libbaz"},
+		{"app", "libbar", "libbaz"},
+	}, g.WhyInstalled("libbaz"))
+	require.Equal(t, [][]string{{"tool"}}, g.WhyInstalled("tool"))
+	require.Nil(t, g.WhyInstalled("unused"))
+}
@@ -18,6 +18,8 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -25,6 +27,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -40,14 +43,14 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slices"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/sys/unix"
 	"gopkg.in/ini.v1"
 
+	apkauth "chainguard.dev/apko/pkg/apk/auth"
 	"chainguard.dev/apko/pkg/apk/expandapk"
 	apkfs "chainguard.dev/apko/pkg/apk/fs"
 	"chainguard.dev/apko/pkg/apk/internal/tarfs"
-
-	"github.com/chainguard-dev/clog"
 )
 
 // This is terrible but simpler than plumbing around a cache for now.
@@ -55,19 +58,142 @@ import (
 // which is expensive. This also dedupes simultaneous fetches.
 var globalApkCache = &apkCache{}
 
+// APK installs packages into a filesystem. An APK may be shared by goroutines that fetch
+// packages with FetchPackage, resolve packages, and read its state, such as the world, the
+// repositories, the installed database and the cache, while SetClient, SetWorld,
+// SetRepositories and InitKeyring may be called alongside them. Everything that installs or
+// removes packages, or initializes the database, must not run concurrently with anything else
+// that changes the filesystem.
 type APK struct {
-	arch               string
-	version            string
-	fs                 apkfs.FullFS
-	executor           Executor
-	ignoreMknodErrors  bool
+	arch              string
+	version           string
+	fs                apkfs.FullFS
+	executor          Executor
+	ignoreMknodErrors bool
+	// replaced by SetClient while requests may be made with it
+	clientMu           sync.RWMutex
 	client             *http.Client
 	cache              *cache
+	cacheBackend       Cache
 	ignoreSignatures   bool
 	noSignatureIndexes []string
 	auth               map[string]auth
 
+	// bounds concurrent fetches, nil means unbounded
+	fetchSem      *semaphore.Weighted
+	parallelFetch int
+	fetchRetry    retryPolicy
+
+	downgradePolicy  DowngradePolicy
+	progressNotifier ProgressNotifier
+
+	verifyExpandedFiles bool
+
+	// applied to the client for package and index downloads, 0 means none
+	httpTimeout time.Duration
+
+	// verify every index signature, regardless of ignoreSignatures and noSignatureIndexes
+	verifyIndexSignature bool
+
+	// never make network requests, only read from the cache
+	offline bool
+
+	// maps the URL of every request right before it is sent, cache keys use the original
+	urlRewriter func(string) string
+
+	// scratch space for expanding and installing packages, empty means the default temp dir
+	workDir string
+
+	// handed the install scripts of each package, nil means they are ignored
+	scriptRunner ScriptRunner
+
+	// public keys by name, used alongside the keys in etc/apk/keys
+	extraKeys map[string][]byte
+
+	// check that SetWorld is given a satisfiable world before writing it
+	validateWorld bool
+
+	// hardlinks identical files to each other, if set
+	dedupe *fileDeduper
+
+	// fails resolution for packages whose license it does not permit, if set
+	licensePolicy *licensePolicy
+
+	// time spent fetching and expanding each package
+	timings timingRecorder
+
+	// triggers of installed packages, until RunTriggers runs them
+	triggers TriggerSet
+
+	// order in which SetWorld writes packages
+	worldOrdering WorldOrdering
+
+	// OCI repositories by URI, so that their manifests are only fetched once
+	ociRepos sync.Map
+
+	// held while etc/apk/world is written, so that updates to it are not lost
+	worldMu sync.Mutex
+
+	// packages the last InstallPackages call found already installed
+	skippedMu sync.Mutex
+	skipped   []string
+
+	// repositories that InstallFrom restricted packages to, by package name
+	repoConstraintsMu sync.Mutex
+	repoConstraints   map[string]string
+
+	maxDownloadSize int64
+
+	ownerRemap func(uid, gid int) (int, int)
+
+	resumableDownloads bool
+
+	maxIndexAge time.Duration
+
+	versionComparer VersionComparer
+
+	pathExcludes []string
+
+	pruneExcludedDirs bool
+
+	authenticator apkauth.Authenticator
+
+	// regular files written at once while installing a package, less than 2 means one at a time
+	parallelExpand int
+
+	indexFormats []string
+
+	sourceDateEpoch *time.Time
+
+	checksumMismatchPolicy ChecksumMismatchPolicy
+
+	verifyCachedPackages bool
+
+	initDBProfile []PlannedEntry
+
+	// set by WithDetachedSignatures
+	detachedSignatures *detachedSignatures
+
+	logger *slog.Logger
+
+	// set by WithIndexCacheTTL
+	indexCacheTTL time.Duration
+
+	// set by WithInstallPrefix; fs is already rooted there
+	installPrefix string
+
+	// headers for every repository request, and for the requests to each repository URL
+	extraHeaders map[string]string
+	repoHeaders  map[string]map[string]string
+
+	// hosts that WithTrustedRepositories allows packages from; none means any
+	trustedRepositories []string
+
+	// replaces {snapshot} in repository URLs, if set
+	snapshotDate time.Time
+
 	// filename to owning package, last write wins
+	installedMu    sync.Mutex
 	installedFiles map[string]*Package
 }
 
@@ -78,26 +204,146 @@ func New(options ...Option) (*APK, error) {
 			return nil, err
 		}
 	}
+	if opt.ignoreSignatures && opt.verifyIndexSignature {
+		return nil, errors.New("WithInsecureIgnoreSignatures and WithVerifyIndexSignature cannot be used together")
+	}
+	if err := validatePathExcludes(opt.pathExcludes); err != nil {
+		return nil, err
+	}
+	if opt.cache != nil {
+		if err := opt.cache.checkSchema(); err != nil {
+			return nil, err
+		}
+	}
 
 	if opt.fs == nil {
 		// This is expensive so we only want to do it if we aren't passed WithFS.
 		opt.fs = apkfs.DirFS("/")
 	}
+	if _, ok := opt.fs.(apkfs.ChtimesFS); opt.sourceDateEpoch != nil && !ok {
+		return nil, errors.New("WithSourceDateEpoch needs a filesystem that can change file times")
+	}
+	if opt.installPrefix != "" {
+		prefixed, err := newPrefixFS(opt.fs, opt.installPrefix)
+		if err != nil {
+			return nil, err
+		}
+		opt.fs = prefixed
+	}
+
+	a := &APK{
+		client:                 http.DefaultClient,
+		fs:                     opt.fs,
+		arch:                   opt.arch,
+		executor:               opt.executor,
+		ignoreMknodErrors:      opt.ignoreMknodErrors,
+		version:                opt.version,
+		cache:                  opt.cache,
+		cacheBackend:           opt.cacheBackend,
+		noSignatureIndexes:     opt.noSignatureIndexes,
+		installedFiles:         map[string]*Package{},
+		auth:                   opt.auth,
+		fetchRetry:             opt.fetchRetry,
+		downgradePolicy:        opt.downgradePolicy,
+		progressNotifier:       opt.progressNotifier,
+		verifyExpandedFiles:    opt.verifyExpandedFiles,
+		httpTimeout:            opt.httpTimeout,
+		verifyIndexSignature:   opt.verifyIndexSignature,
+		offline:                opt.offline,
+		urlRewriter:            opt.urlRewriter,
+		workDir:                opt.workDir,
+		scriptRunner:           opt.scriptRunner,
+		extraKeys:              opt.extraKeys,
+		validateWorld:          opt.validateWorld,
+		licensePolicy:          opt.licensePolicy,
+		worldOrdering:          opt.worldOrdering,
+		ignoreSignatures:       opt.ignoreSignatures,
+		maxDownloadSize:        opt.maxDownloadSize,
+		ownerRemap:             opt.ownerRemap,
+		resumableDownloads:     opt.resumableDownloads,
+		maxIndexAge:            opt.maxIndexAge,
+		versionComparer:        opt.versionComparer,
+		pathExcludes:           opt.pathExcludes,
+		pruneExcludedDirs:      opt.pruneExcludedDirs,
+		authenticator:          opt.authenticator,
+		parallelExpand:         opt.parallelExpand,
+		indexFormats:           opt.indexFormats,
+		sourceDateEpoch:        opt.sourceDateEpoch,
+		checksumMismatchPolicy: opt.checksumMismatchPolicy,
+		verifyCachedPackages:   opt.verifyCachedPackages,
+		initDBProfile:          opt.initDBProfile,
+		logger:                 opt.logger,
+		indexCacheTTL:          opt.indexCacheTTL,
+		installPrefix:          opt.installPrefix,
+		extraHeaders:           opt.extraHeaders,
+		repoHeaders:            opt.repoHeaders,
+		trustedRepositories:    opt.trustedRepositories,
+		snapshotDate:           opt.snapshotDate,
+	}
+	if opt.offline && a.cache != nil {
+		a.cache.offline = true
+	}
+	a.offline = opt.offline || (a.cache != nil && a.cache.offline)
+	if opt.transportTuning != nil {
+		a.client = opt.transportTuning.client()
+	}
+	if opt.dedupeFiles {
+		a.dedupe = newFileDeduper()
+	}
+	if opt.parallelFetch > 0 {
+		a.fetchSem, a.parallelFetch = semaphore.NewWeighted(int64(opt.parallelFetch)), opt.parallelFetch
+	}
+	if opt.detachedSignaturesURL != "" {
+		a.detachedSignatures = &detachedSignatures{url: opt.detachedSignaturesURL}
+	}
+
+	return a, nil
+}
 
-	return &APK{
-		client:             http.DefaultClient,
-		fs:                 opt.fs,
-		arch:               opt.arch,
-		executor:           opt.executor,
-		ignoreMknodErrors:  opt.ignoreMknodErrors,
-		version:            opt.version,
-		cache:              opt.cache,
-		noSignatureIndexes: opt.noSignatureIndexes,
-		installedFiles:     map[string]*Package{},
-		auth:               opt.auth,
+// acquireFetch blocks until a fetch slot is available, returning a func to release it.
+func (a *APK) acquireFetch(ctx context.Context) (func(), error) {
+	if a.fetchSem == nil {
+		return func() {}, nil
+	}
+	if err := a.fetchSem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { a.fetchSem.Release(1) })
 	}, nil
 }
 
+// fileCache returns the Cache that downloaded files are stored in: the cache directory if there
+// is one, otherwise the cache backend, if any.
+func (a *APK) fileCache() Cache {
+	// Check first, so that a nil *cache is not returned as a non-nil Cache.
+	if a.cache != nil {
+		return a.cache
+	}
+	return a.cacheBackend
+}
+
+// cachingClient wraps client to use the configured cache, if any.
+func (a *APK) cachingClient(client *http.Client, etagRequired bool) *http.Client {
+	c := a.fileCache()
+	if c == nil {
+		return client
+	}
+	if a.resumableDownloads && a.cache != nil && !a.offline {
+		client = &http.Client{Transport: &resumeTransport{wrapped: client, root: a.cache.dir}}
+	}
+	return &http.Client{
+		Transport: &cacheTransport{
+			wrapped:      client,
+			cache:        c,
+			etagRequired: etagRequired,
+			offline:      a.offline,
+			indexTTL:     a.indexCacheTTL,
+		},
+	}
+}
+
 type directory struct {
 	path  string
 	perms os.FileMode
@@ -168,56 +414,94 @@ var initDeviceFiles = []deviceFile{
 // It is useful for fine-grained control, for proxying, or for setting alternate
 // paths.
 func (a *APK) SetClient(client *http.Client) {
+	a.clientMu.Lock()
+	defer a.clientMu.Unlock()
 	a.client = client
 }
 
 // ListInitFiles list the files that are installed during the InitDB phase.
 func (a *APK) ListInitFiles() []tar.Header {
-	headers := make([]tar.Header, 0, 20)
+	plan := a.initDBPlan()
+	headers := make([]tar.Header, 0, len(plan))
+	for _, e := range plan {
+		header := tar.Header{
+			Name:     e.Path,
+			Mode:     int64(e.Perms),
+			Typeflag: e.Type,
+			Uid:      0,
+			Gid:      0,
+		}
+		a.remapOwner(&header)
+		headers = append(headers, header)
+	}
+	return headers
+}
+
+// PlannedEntry is a filesystem entry that InitDB creates.
+type PlannedEntry struct {
+	Path  string
+	Perms os.FileMode
+	// Type is the tar type flag of the entry: tar.TypeDir, tar.TypeReg or tar.TypeChar.
+	Type byte
+	// Contents of a regular file.
+	Contents []byte
+	// Major and Minor are the device numbers of a character device.
+	Major, Minor uint32
+	// Optional is set for entries InitDB skips if they can't be created, which
+	// is the case for device files when WithIgnoreMknodErrors is set.
+	Optional bool
+}
+
+// InitDBPlan returns the directories, files and device files InitDB would create, in the order
+// it creates them, without changing the filesystem. The base directories InitDB expects to exist,
+// such as /etc and /dev, are not included.
+func (a *APK) InitDBPlan(ctx context.Context) ([]PlannedEntry, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "InitDBPlan")
+	defer span.End()
 
+	return a.initDBPlan(), nil
+}
+
+// emptyTar is an empty tar archive, which is what scripts.tar holds after InitDB.
+var emptyTar = make([]byte, 1024)
+
+func (a *APK) initDBPlan() []PlannedEntry {
+	profile := a.initDBProfile
+	if profile == nil {
+		profile = DefaultInitDBProfile(a.arch)
+	}
+	plan := make([]PlannedEntry, 0, len(profile))
+	for _, e := range profile {
+		if e.Type == tar.TypeChar && a.ignoreMknodErrors {
+			e.Optional = true
+		}
+		plan = append(plan, e)
+	}
+	return plan
+}
+
+// DefaultInitDBProfile returns the entries InitDB creates for arch unless WithInitDBProfile
+// is set, in the order it creates them. Callers can filter it to get a leaner layout.
+func DefaultInitDBProfile(arch string) []PlannedEntry {
 	// additionalFiles are files we need but can only be resolved in the context of
 	// this func, e.g. we need the architecture
 	additionalFiles := []file{
-		{"/etc/apk/arch", 0o644, []byte(a.arch + "\n")},
+		{"/etc/apk/arch", 0o644, []byte(arch + "\n")},
 	}
 
+	plan := make([]PlannedEntry, 0, len(initDirectories)+len(initFiles)+len(additionalFiles)+len(initDeviceFiles)+1)
 	for _, e := range initDirectories {
-		headers = append(headers, tar.Header{
-			Name:     e.path,
-			Mode:     int64(e.perms),
-			Typeflag: tar.TypeDir,
-			Uid:      0,
-			Gid:      0,
-		})
+		plan = append(plan, PlannedEntry{Path: e.path, Perms: e.perms, Type: tar.TypeDir})
 	}
 	for _, e := range append(initFiles, additionalFiles...) {
-		headers = append(headers, tar.Header{
-			Name:     e.path,
-			Mode:     int64(e.perms),
-			Typeflag: tar.TypeReg,
-			Uid:      0,
-			Gid:      0,
-		})
+		plan = append(plan, PlannedEntry{Path: e.path, Perms: e.perms, Type: tar.TypeReg, Contents: e.contents})
 	}
 	for _, e := range initDeviceFiles {
-		headers = append(headers, tar.Header{
-			Name:     e.path,
-			Typeflag: tar.TypeChar,
-			Mode:     int64(e.perms),
-			Uid:      0,
-			Gid:      0,
-		})
+		plan = append(plan, PlannedEntry{Path: e.path, Perms: e.perms, Type: tar.TypeChar, Major: e.major, Minor: e.minor})
 	}
-
 	// add scripts.tar with nothing in it
-	headers = append(headers, tar.Header{
-		Name:     scriptsFilePath,
-		Mode:     int64(scriptsTarPerms),
-		Typeflag: tar.TypeReg,
-		Uid:      0,
-		Gid:      0,
-	})
-	return headers
+	plan = append(plan, PlannedEntry{Path: scriptsFilePath, Perms: scriptsTarPerms, Type: tar.TypeReg, Contents: emptyTar})
+	return plan
 }
 
 // Initialize the APK database for a given build context.
@@ -226,7 +510,7 @@ func (a *APK) ListInitFiles() []tar.Header {
 // unless those files will be included in the installed database, in which case they can
 // be retrieved via GetInstalled().
 func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	/*
 		equivalent of: "apk add --initdb --arch arch --root root"
 	*/
@@ -235,12 +519,11 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "InitDB")
 	defer span.End()
 
-	// additionalFiles are files we need but can only be resolved in the context of
-	// this func, e.g. we need the architecture
-	additionalFiles := []file{
-		{"/etc/apk/arch", 0o644, []byte(a.arch + "\n")},
+	if a.installPrefix != "" {
+		if err := a.fs.MkdirAll(".", 0o755); err != nil {
+			return fmt.Errorf("failed to create install prefix %s: %w", a.installPrefix, err)
+		}
 	}
-
 	for _, e := range baseDirectories {
 		stat, err := a.fs.Stat(e.path)
 		switch {
@@ -257,46 +540,46 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 			return fmt.Errorf("base directory %s has incorrect permissions: %o", e.path, stat.Mode().Perm())
 		}
 	}
-	for _, e := range initDirectories {
-		err := a.fs.Mkdir(e.path, e.perms)
-		switch {
-		case err != nil && !errors.Is(err, fs.ErrExist):
-			return fmt.Errorf("failed to create directory %s: %w", e.path, err)
-		case err != nil && errors.Is(err, fs.ErrExist):
-			stat, err := a.fs.Stat(e.path)
-			if err != nil {
-				return fmt.Errorf("failed to stat directory %s: %w", e.path, err)
+	for _, e := range a.initDBPlan() {
+		switch e.Type {
+		case tar.TypeDir:
+			err := a.fs.Mkdir(e.Path, e.Perms)
+			switch {
+			case err != nil && !errors.Is(err, fs.ErrExist):
+				return fmt.Errorf("failed to create directory %s: %w", e.Path, err)
+			case err != nil && errors.Is(err, fs.ErrExist):
+				stat, err := a.fs.Stat(e.Path)
+				if err != nil {
+					return fmt.Errorf("failed to stat directory %s: %w", e.Path, err)
+				}
+				if !stat.IsDir() {
+					return fmt.Errorf("failed to create directory %s: already exists as file", e.Path)
+				}
 			}
-			if !stat.IsDir() {
-				return fmt.Errorf("failed to create directory %s: already exists as file", e.path)
+		case tar.TypeReg:
+			if err := a.fs.WriteFile(e.Path, e.Contents, e.Perms); err != nil {
+				return fmt.Errorf("failed to create file %s: %w", e.Path, err)
 			}
+		case tar.TypeChar:
+			perms := uint32(e.Perms.Perm())
+			err := a.fs.Mknod(e.Path, unix.S_IFCHR|perms, int(unix.Mkdev(e.Major, e.Minor)))
+			if !e.Optional && err != nil {
+				return fmt.Errorf("failed to create char device %s: %w", e.Path, err)
+			}
+			if err != nil {
+				// The device was skipped, so there is nothing to change the owner of.
+				continue
+			}
+		default:
+			continue
 		}
-	}
-	for _, e := range append(initFiles, additionalFiles...) {
-		if err := a.fs.WriteFile(e.path, e.contents, e.perms); err != nil {
-			return fmt.Errorf("failed to create file %s: %w", e.path, err)
-		}
-	}
-	for _, e := range initDeviceFiles {
-		perms := uint32(e.perms.Perm())
-		err := a.fs.Mknod(e.path, unix.S_IFCHR|perms, int(unix.Mkdev(e.major, e.minor)))
-		if !a.ignoreMknodErrors && err != nil {
-			return fmt.Errorf("failed to create char device %s: %w", e.path, err)
+		header := tar.Header{Name: e.Path, Typeflag: e.Type}
+		a.remapOwner(&header)
+		if err := a.chownRemapped(&header); err != nil {
+			return err
 		}
 	}
 
-	// add scripts.tar with nothing in it
-	scriptsTarPerms := 0o644
-	TarFile, err := a.fs.OpenFile(scriptsFilePath, os.O_CREATE|os.O_WRONLY, fs.FileMode(scriptsTarPerms))
-	if err != nil {
-		return fmt.Errorf("could not create tarball file '%s', got error '%w'", scriptsFilePath, err)
-	}
-	defer TarFile.Close()
-	tarWriter := tar.NewWriter(TarFile)
-	defer tarWriter.Close()
-
-	// nothing to add to it; scripts.tar should be empty
-
 	// get the alpine-keys base keys for our usage
 	if len(alpineVersions) > 0 {
 		if err := a.fetchAlpineKeys(ctx, alpineVersions); err != nil {
@@ -308,6 +591,10 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 		}
 	}
 
+	if err := a.setInitDBTimes(len(alpineVersions) > 0); err != nil {
+		return err
+	}
+
 	log.Debug("finished initializing apk database")
 	return nil
 }
@@ -316,7 +603,7 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 // directory by trying some common locations. These can be overridden
 // by passing one or more directories as arguments.
 func (a *APK) loadSystemKeyring(ctx context.Context, locations ...string) ([]string, error) {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	var ring []string
 	if len(locations) == 0 {
 		locations = []string{
@@ -354,8 +641,11 @@ func (a *APK) loadSystemKeyring(ctx context.Context, locations ...string) ([]str
 }
 
 // Installs the specified keys into the APK keyring inside the build context.
-func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string) error {
-	log := clog.FromContext(ctx)
+//
+// If expected is not nil, it maps a key's URL or filename to the hex-encoded SHA256 fingerprint of
+// its contents. Keys listed there whose contents do not match are rejected, and no keys are written.
+func (a *APK) InitKeyring(ctx context.Context, keyFiles []string, expected map[string]string) error {
+	log := a.log(ctx)
 	log.Debug("initializing apk keyring")
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "InitKeyring")
@@ -365,18 +655,21 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 		return fmt.Errorf("failed to make keys dir: %w", err)
 	}
 
-	if len(extraKeyFiles) > 0 {
-		log.Debugf("appending %d extra keys to keyring", len(extraKeyFiles))
-		keyFiles = append(keyFiles, extraKeyFiles...)
-	}
-
 	var eg errgroup.Group
 
-	for _, element := range keyFiles {
-		element := element
+	keys := make([][]byte, len(keyFiles))
+	for i, element := range keyFiles {
 		eg.Go(func() error {
 			log.Debugf("installing key %v", element)
 
+			if data, ok := a.extraKeys[element]; ok {
+				if err := verifyKeyFingerprint(element, data, expected); err != nil {
+					return err
+				}
+				keys[i] = data
+				return nil
+			}
+
 			var asURL *url.URL
 			var err error
 			if strings.HasPrefix(element, "https://") || strings.HasPrefix(element, "http://") {
@@ -393,15 +686,12 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 			var data []byte
 			switch asURL.Scheme {
 			case "file": //nolint:goconst
-				data, err = os.ReadFile(element)
+				data, err = os.ReadFile(localPath(element))
 				if err != nil {
 					return fmt.Errorf("failed to read apk key: %w", err)
 				}
 			case "https", "http": //nolint:goconst
-				client := a.client
-				if a.cache != nil {
-					client = a.cache.client(client, true)
-				}
+				client := a.cachingClient(a.httpClient(), true)
 				req, err := http.NewRequestWithContext(ctx, http.MethodGet, asURL.String(), nil)
 				if err != nil {
 					return err
@@ -416,6 +706,9 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 				} else if a, ok := a.auth[asURL.Host]; ok && a.user != "" && a.pass != "" {
 					req.SetBasicAuth(a.user, a.pass)
 				}
+				if err := authenticate(ctx, req, a.authenticator); err != nil {
+					return err
+				}
 
 				resp, err := client.Do(req)
 				if err != nil {
@@ -424,7 +717,7 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 				defer resp.Body.Close()
 
 				if resp.StatusCode < 200 || resp.StatusCode > 299 {
-					return fmt.Errorf("failed to fetch apk key: http response indicated error code: %d", resp.StatusCode)
+					return statusError(asURL.Redacted(), resp.StatusCode, fmt.Errorf("failed to fetch apk key: http response indicated error code: %d", resp.StatusCode))
 				}
 
 				data, err = io.ReadAll(resp.Body)
@@ -435,27 +728,84 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 				return fmt.Errorf("scheme %s not supported", asURL.Scheme)
 			}
 
-			// #nosec G306 -- apk keyring must be publicly readable
-			if err := a.fs.WriteFile(filepath.Join("etc", "apk", "keys", filepath.Base(element)), data,
-				0o644); err != nil {
-				return fmt.Errorf("failed to write apk key: %w", err)
+			if err := verifyKeyFingerprint(element, data, expected); err != nil {
+				return err
 			}
+			keys[i] = data
 
 			return nil
 		})
 	}
 
-	return eg.Wait()
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	for i, element := range keyFiles {
+		// #nosec G306 -- apk keyring must be publicly readable
+		if err := a.writeFileAtomic(filepath.Join("etc", "apk", "keys", filepath.Base(element)), keys[i],
+			0o644); err != nil {
+			return fmt.Errorf("failed to write apk key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// verifyKeyFingerprint checks the contents of a key against its expected SHA256 fingerprint,
+// looked up by the key's full URL first and then by its filename.
+func verifyKeyFingerprint(element string, data []byte, expected map[string]string) error {
+	want, ok := expected[element]
+	if !ok {
+		want, ok = expected[filepath.Base(element)]
+	}
+	if !ok {
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(want, got) {
+		return &SignatureError{Name: element, Err: fmt.Errorf("apk key %s has fingerprint %s, expected %s", element, got, want)}
+	}
+
+	return nil
 }
 
 // ResolveWorld determine the target state for the requested dependencies in /etc/apk/world. Does not install anything.
+// It returns the packages to install in installation order, and any conflicts declared by them.
+// The target filesystem is only read, never modified.
 func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*RepositoryPackage, conflicts []string, err error) {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	log.Debug("determining desired apk world")
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "ResolveWorld")
 	defer span.End()
 
+	directPkgs, err := a.GetWorld(ctx)
+	if err != nil {
+		return toInstall, conflicts, fmt.Errorf("error getting world packages: %w", err)
+	}
+
+	return a.resolvePackages(ctx, directPkgs)
+}
+
+// newPkgResolver returns a resolver for indexes that orders versions as configured on a.
+func (a *APK) newPkgResolver(ctx context.Context, indexes []NamedIndex) *PkgResolver {
+	resolver := NewPkgResolver(ctx, indexes)
+	resolver.SetVersionComparer(a.versionComparer)
+	a.repoConstraintsMu.Lock()
+	for name, repo := range a.repoConstraints {
+		resolver.RestrictToRepository(repo, name)
+	}
+	a.repoConstraintsMu.Unlock()
+	return resolver
+}
+
+// resolvePackages resolves the given packages and their dependencies against the configured repositories.
+func (a *APK) resolvePackages(ctx context.Context, directPkgs []string) (toInstall []*RepositoryPackage, conflicts []string, err error) {
+	log := a.log(ctx)
+	a.progress().OnResolveStart()
+
 	// to fix the world, we need to:
 	// 1. Get the apkIndexes for each repository for the target arch
 	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
@@ -466,19 +816,94 @@ func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*RepositoryPackage,
 	log.Debugf("got %d indexes:\n%s", len(indexes), strings.Join(indexNames(indexes), "\n"))
 
 	// 2. Get the dependency tree for each package from the world file
-	directPkgs, err := a.GetWorld()
-	if err != nil {
-		return toInstall, conflicts, fmt.Errorf("error getting world packages: %w", err)
-	}
-	resolver := NewPkgResolver(ctx, indexes)
+	trusted, someUntrusted := a.trustedIndexes(indexes)
+	resolver := a.newPkgResolver(ctx, trusted)
 	toInstall, conflicts, err = resolver.GetPackagesWithDependencies(ctx, directPkgs)
 	if err != nil {
-		return
+		if someUntrusted {
+			if uerr := a.untrustedError(ctx, indexes, directPkgs); uerr != nil {
+				err = uerr
+			}
+		}
+		return toInstall, conflicts, &ResolutionError{Err: err}
 	}
 	log.Debugf("got %d packages to install:\n%s", len(toInstall), strings.Join(packageRefs(toInstall), "\n"))
+	for _, pkg := range toInstall {
+		log.Debug("resolved package", "package", pkg.Name, "version", pkg.Version, "repository", redactURL(pkg.Repository().URI))
+	}
+
+	if err = a.checkDowngrades(ctx, toInstall); err != nil {
+		return nil, nil, err
+	}
+	if err = a.checkLicenses(toInstall); err != nil {
+		return nil, nil, err
+	}
 	return
 }
 
+// checkDowngrades applies the downgrade policy to packages whose resolved version is older
+// than the version in the installed database.
+func (a *APK) checkDowngrades(ctx context.Context, toInstall []*RepositoryPackage) error {
+	if a.downgradePolicy == DowngradeAllow {
+		return nil
+	}
+	log := a.log(ctx)
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("reading installed packages: %w", err)
+	}
+	installedVersions := make(map[string]string, len(installed))
+	for _, pkg := range installed {
+		installedVersions[pkg.Name] = pkg.Version
+	}
+
+	var errs []error
+	for _, pkg := range toInstall {
+		current, ok := installedVersions[pkg.Name]
+		if !ok {
+			continue
+		}
+		c, err := a.compareInstalledVersion(pkg, current)
+		if err != nil {
+			return err
+		}
+		if c >= 0 {
+			continue
+		}
+
+		downgrade := &DowngradeError{Package: pkg.Name, Installed: current, Resolved: pkg.Version}
+		if a.downgradePolicy == DowngradeWarn {
+			log.Warnf("%v", downgrade)
+			continue
+		}
+		errs = append(errs, downgrade)
+	}
+
+	return errors.Join(errs...)
+}
+
+// compareInstalledVersion compares the version of pkg to the current one installed, with the
+// comparer set with WithVersionComparer, which is given the versions as they are, or else by
+// parsing them.
+func (a *APK) compareInstalledVersion(pkg *RepositoryPackage, current string) (int, error) {
+	if a.versionComparer != nil {
+		return a.versionComparer.CompareVersions(pkg.Version, current), nil
+	}
+	currentVersion, err := ParseVersion(current)
+	if err != nil {
+		return 0, fmt.Errorf("parsing installed version %s of %s: %w", current, pkg.Name, err)
+	}
+	resolvedVersion, err := ParseVersion(pkg.Version)
+	if err != nil {
+		return 0, fmt.Errorf("parsing version %s of %s: %w", pkg.Version, pkg.Name, err)
+	}
+	return CompareVersions(resolvedVersion, currentVersion), nil
+}
+
 func (a *APK) CalculateWorld(ctx context.Context, allpkgs []*RepositoryPackage) ([]*APKResolved, error) {
 	// TODO: Consider making this configurable option.
 	jobs := runtime.GOMAXPROCS(0)
@@ -504,6 +929,8 @@ func (a *APK) CalculateWorld(ctx context.Context, allpkgs []*RepositoryPackage)
 			if err != nil {
 				return fmt.Errorf("fetching %s: %w", pkg.Name, err)
 			}
+			defer r.Close()
+
 			res, err := ResolveApk(gctx, r)
 			if err != nil {
 				return fmt.Errorf("resolving %s: %w", pkg.Name, err)
@@ -526,7 +953,7 @@ func (a *APK) CalculateWorld(ctx context.Context, allpkgs []*RepositoryPackage)
 }
 
 func (a *APK) ResolveAndCalculateWorld(ctx context.Context) ([]*APKResolved, error) {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	log.Debug("resolving and calculating 'world' (packages to install)")
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "CalculateWorld")
@@ -542,7 +969,7 @@ func (a *APK) ResolveAndCalculateWorld(ctx context.Context) ([]*APKResolved, err
 
 // FixateWorld force apk's resolver to re-resolve the requested dependencies in /etc/apk/world.
 func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	/*
 		equivalent of: "apk fix --arch arch --root root"
 		with possible options for --no-scripts, --no-cache, --update-cache
@@ -586,9 +1013,38 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	return a.InstallPackages(ctx, sourceDateEpoch, allInstPkgs)
 }
 
+// InstallPackages fetches, expands and installs the given packages, in order. Packages that are
+// already installed at the same version are neither fetched nor expanded, see SkippedPackages.
+// Fetches start with the largest packages, by the size their index declares, so that the
+// longest downloads overlap with the many small ones.
 func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, allpkgs []InstallablePackage) error {
+	log := a.log(ctx)
+
 	// TODO: Consider making this configurable option.
 	jobs := runtime.GOMAXPROCS(0)
+	if a.parallelFetch > 0 {
+		// No more goroutines than can fetch at once, so that they start in the order given.
+		jobs = min(jobs, a.parallelFetch)
+	}
+
+	if sourceDateEpoch == nil {
+		sourceDateEpoch = a.sourceDateEpoch
+	}
+
+	installed, err := a.installedByName()
+	if err != nil {
+		return err
+	}
+	skip := make([]bool, len(allpkgs))
+	var skipped []string
+	for i, pkg := range allpkgs {
+		if alreadyInstalled(installed, pkg) {
+			log.Debugf("skipping %s, already installed", pkg.PackageName())
+			skip[i] = true
+			skipped = append(skipped, pkg.PackageName())
+		}
+	}
+	a.setSkipped(skipped)
 
 	g, gctx := errgroup.WithContext(ctx)
 	g.SetLimit(jobs + 1)
@@ -616,6 +1072,9 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 			case <-gctx.Done():
 				return gctx.Err()
 			case <-ch:
+				if skip[i] {
+					continue
+				}
 				exp := expanded[i]
 				pkg := allpkgs[i]
 
@@ -649,8 +1108,12 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 
 	// Meanwhile, concurrently fetch and expand all our APKs.
 	// We signal they are ready to be installed by closing done[i].
-	for i, pkg := range allpkgs {
-		i, pkg := i, pkg
+	for _, i := range largestFirst(allpkgs) {
+		pkg := allpkgs[i]
+		if skip[i] {
+			close(done[i])
+			continue
+		}
 
 		g.Go(func() error {
 			exp, err := a.expandPackage(gctx, pkg)
@@ -683,7 +1146,7 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 
 		// Remove any files that were overwritten by another package.
 		files = slices.DeleteFunc(files, func(hdr tar.Header) bool {
-			owner, ok := a.installedFiles[hdr.Name]
+			owner, ok := a.fileOwner(hdr.Name)
 			if !ok {
 				// Keep directories, which actually should be duplicated in the idb.
 				return false
@@ -697,6 +1160,11 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 		}
 	}
 
+	if err := a.setInstalledTimes(allFiles); err != nil {
+		return err
+	}
+
+	a.progress().OnInstallComplete()
 	return nil
 }
 
@@ -715,7 +1183,7 @@ func (a *APK) fetchAlpineKeys(ctx context.Context, alpineVersions []string) erro
 	defer span.End()
 
 	u := alpineReleasesURL
-	client := a.client
+	client := a.httpClient()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return err
@@ -784,16 +1252,12 @@ func (a *APK) cachePackage(ctx context.Context, pkg InstallablePackage, exp *exp
 	defer span.End()
 
 	// Rename exp's temp files to content-addressable identifiers in the cache.
+	// cachedPackage looks for the control file first, so it goes last: until it is in place,
+	// other processes sharing the cache see a miss rather than a partial entry.
 
 	ctlHex := hex.EncodeToString(exp.ControlHash)
 	ctlDst := filepath.Join(cacheDir, ctlHex+".ctl.tar.gz")
 
-	if err := os.Rename(exp.ControlFile, ctlDst); err != nil {
-		return nil, fmt.Errorf("renaming control file: %w", err)
-	}
-
-	exp.ControlFile = ctlDst
-
 	if exp.SignatureFile != "" {
 		sigDst := filepath.Join(cacheDir, ctlHex+".sig.tar.gz")
 
@@ -819,6 +1283,12 @@ func (a *APK) cachePackage(ctx context.Context, pkg InstallablePackage, exp *exp
 	}
 	exp.TarFile = tarDst
 
+	if err := os.Rename(exp.ControlFile, ctlDst); err != nil {
+		return nil, fmt.Errorf("renaming control file: %w", err)
+	}
+
+	exp.ControlFile = ctlDst
+
 	return exp, nil
 }
 
@@ -949,14 +1419,35 @@ func (a *APK) expandPackage(ctx context.Context, pkg InstallablePackage) (*expan
 		// Calling APKExpanded.Close() will clean up a tempdir.
 		// This is fine when we have a cache because we move all the backing files into the cache.
 		// This is not fine when we don't have a cache because the tempdir contains all our state.
-		return expandPackage(ctx, a, pkg)
+		exp, err := expandPackage(ctx, a, pkg)
+		if err != nil {
+			return nil, err
+		}
+		if a.detachedSignatures != nil {
+			if err := a.verifyDetachedSignature(ctx, pkg, exp); err != nil {
+				exp.Close()
+				return nil, err
+			}
+		}
+		return exp, nil
 	}
 
-	return globalApkCache.get(ctx, a, pkg)
+	exp, err := globalApkCache.get(ctx, a, pkg)
+	if err != nil {
+		return nil, err
+	}
+	// The cache may have been filled without the manifest, check on every use. The expanded
+	// package is shared, so it is left open.
+	if a.detachedSignatures != nil {
+		if err := a.verifyDetachedSignature(ctx, pkg, exp); err != nil {
+			return nil, err
+		}
+	}
+	return exp, nil
 }
 
 func expandPackage(ctx context.Context, a *APK, pkg InstallablePackage) (*expandapk.APKExpanded, error) {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "expandPackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
 	defer span.End()
 
@@ -970,26 +1461,83 @@ func expandPackage(ctx context.Context, a *APK, pkg InstallablePackage) (*expand
 
 		exp, err := a.cachedPackage(ctx, pkg, cacheDir)
 		if err == nil {
-			log.Debugf("cache hit (%s)", pkg.PackageName())
+			// The cached control section is found by its checksum, but the data section it
+			// points at still has to be the one the index expects.
+			verr := verifyPackageHashes(pkg, exp)
+			if verr == nil && a.verifyCachedPackages {
+				verr = verifyCachedPackage(exp)
+			}
+			if verr != nil {
+				switch a.checksumMismatchPolicy {
+				case ChecksumMismatchWarn:
+					log.Warnf("cached %s does not match its checksums, using it anyway: %v", pkg.PackageName(), verr)
+				case ChecksumMismatchRedownload:
+					log.Warnf("cached %s does not match its checksums, downloading it again: %v", pkg.PackageName(), verr)
+					if err := invalidateCachedPackage(cacheDir); err != nil {
+						return nil, err
+					}
+					err = verr
+				default:
+					return nil, fmt.Errorf("verifying cached %s: %w", pkg.PackageName(), verr)
+				}
+			}
+		}
+		if err == nil {
+			log.Debug("cache hit", "package", pkg.PackageName(), "path", cacheDir)
 			return exp, nil
 		}
 
-		log.Debugf("cache miss (%s): %v", pkg.PackageName(), err)
+		log.Debug("cache miss", "package", pkg.PackageName(), "path", cacheDir, "reason", err)
+
+		// Keep PurgeCache away from this entry until it is fully written.
+		releaseEntry := a.cache.acquire(cacheDir)
+		defer releaseEntry()
 
 		if err := os.MkdirAll(cacheDir, 0o755); err != nil {
 			return nil, fmt.Errorf("unable to create cache directory %q: %w", cacheDir, err)
 		}
 	}
 
-	rc, err := a.FetchPackage(ctx, pkg)
+	release, err := a.acquireFetch(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("fetching package %q: %w", pkg.PackageName(), err)
+		return nil, err
 	}
-	defer rc.Close()
+	defer release()
 
-	exp, err := expandapk.ExpandApk(ctx, rc, cacheDir)
+	// Expand within the cache if there is one, so the results can be moved into place.
+	expandDir := a.workDir
+	if a.cache != nil {
+		expandDir = cacheDir
+	}
+	exp, err := a.fetchAndExpand(ctx, pkg, expandDir)
 	if err != nil {
-		return nil, fmt.Errorf("expanding %s: %w", pkg.PackageName(), err)
+		return nil, err
+	}
+
+	if err := verifyPackageHashes(pkg, exp); err != nil {
+		switch a.checksumMismatchPolicy {
+		case ChecksumMismatchWarn:
+			log.Warnf("%s does not match its checksums, installing it anyway: %v", pkg.PackageName(), err)
+		case ChecksumMismatchRedownload:
+			log.Warnf("%s does not match its checksums, downloading it again: %v", pkg.PackageName(), err)
+			exp.Close()
+			if a.cache != nil {
+				// A copy of the .apk in the cache would be served again.
+				if err := os.Remove(cacheDir + ".apk"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return nil, fmt.Errorf("invalidating cached %s: %w", pkg.PackageName(), err)
+				}
+			}
+			if exp, err = a.fetchAndExpand(ctx, pkg, expandDir); err != nil {
+				return nil, err
+			}
+			if err := verifyPackageHashes(pkg, exp); err != nil {
+				exp.Close()
+				return nil, fmt.Errorf("verifying %s: %w", pkg.PackageName(), err)
+			}
+		default:
+			exp.Close()
+			return nil, fmt.Errorf("verifying %s: %w", pkg.PackageName(), err)
+		}
 	}
 
 	// If we don't have a cache, we're done.
@@ -1000,12 +1548,73 @@ func expandPackage(ctx context.Context, a *APK, pkg InstallablePackage) (*expand
 	return a.cachePackage(ctx, pkg, exp, cacheDir)
 }
 
+// fetchAndExpand fetches pkg and expands it into dir.
+func (a *APK) fetchAndExpand(ctx context.Context, pkg InstallablePackage, dir string) (*expandapk.APKExpanded, error) {
+	start := time.Now()
+	fetched, err := a.fetchPackage(ctx, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("fetching package %q: %w", pkg.PackageName(), err)
+	}
+	if a.cache == nil {
+		// Without a cache directory to keep the expanded package, keep the .apk in the backend.
+		if fetched, err = a.readThrough(ctx, pkg, fetched); err != nil {
+			return nil, err
+		}
+	}
+	rc := &timedReader{ReadCloser: fetched}
+	defer rc.Close()
+	requested := time.Since(start)
+
+	start = time.Now()
+	exp, err := expandapk.ExpandApk(ctx, rc, dir)
+	// The package is read as it is expanded, tell apart waiting for it from the rest.
+	a.timings.add(pkg.PackageName(), requested+rc.elapsed, time.Since(start)-rc.elapsed)
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", pkg.PackageName(), err)
+	}
+	return exp, nil
+}
+
+// verifyPackageHashes checks an expanded package against the checksums its index entry
+// advertises. The control section is checked against the legacy sha1 checksum, and the
+// data section is checked against the sha256 data hash when one is known.
+func verifyPackageHashes(pkg InstallablePackage, exp *expandapk.APKExpanded) error {
+	if chk := pkg.ChecksumString(); len(chk) > 2 && strings.HasPrefix(chk, "Q1") {
+		want, err := base64.StdEncoding.DecodeString(chk[2:])
+		if err != nil {
+			return fmt.Errorf("decoding checksum %q: %w", chk, err)
+		}
+		if !bytes.Equal(want, exp.ControlHash) {
+			return fmt.Errorf("control checksum mismatch: expected %s, got Q1%s", chk, base64.StdEncoding.EncodeToString(exp.ControlHash))
+		}
+	}
+
+	if want := packageDataHash(pkg); want != "" {
+		if got := hex.EncodeToString(exp.PackageHash); !strings.EqualFold(want, got) {
+			return fmt.Errorf("data hash mismatch: expected %s, got %s", want, got)
+		}
+	}
+
+	return nil
+}
+
+// packageDataHash returns the hex-encoded sha256 of the package's data section, if known.
+func packageDataHash(pkg InstallablePackage) string {
+	if p, ok := pkg.(*RepositoryPackage); ok {
+		return p.DataHash
+	}
+	return ""
+}
+
 func packageAsURI(pkg InstallablePackage) (uri.URI, error) {
 	u := pkg.URL()
 
 	if strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://") {
 		return uri.Parse(u)
 	}
+	if isOCI(u) {
+		return uri.URI(u), nil
+	}
 
 	return uri.New(u), nil
 }
@@ -1019,14 +1628,52 @@ func packageAsURL(pkg InstallablePackage) (*url.URL, error) {
 	return url.Parse(string(asURI))
 }
 
+// FetchPackage fetches the given package and returns its contents, which the caller must close.
+// If WithParallelFetch was set, the fetch holds one of the available slots until it is closed.
+// With a cache, a package that is downloaded is also stored in the cache once it has been read in
+// full, so that later calls, from this or other processes sharing the cache, are served from
+// there.
 func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.ReadCloser, error) {
-	log := clog.FromContext(ctx)
-	log.Debugf("fetching %s", pkg)
+	release, err := a.acquireFetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	rc, err := a.fetchPackage(ctx, pkg)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if rc, err = a.readThrough(ctx, pkg, rc); err != nil {
+		release()
+		return nil, err
+	}
+	requested := time.Since(start)
+	timed := &timedReader{ReadCloser: rc, onClose: func(elapsed time.Duration) {
+		a.timings.add(pkg.PackageName(), requested+elapsed, 0)
+	}}
 
+	return &releasingReadCloser{ReadCloser: timed, release: release}, nil
+}
+
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releasingReadCloser) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
+
+func (a *APK) fetchPackage(ctx context.Context, pkg InstallablePackage) (io.ReadCloser, error) {
+	log := a.log(ctx)
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "fetchPackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
 	defer span.End()
 
 	u := pkg.URL()
+	log.Debug("fetching package", "package", pkg.PackageName(), "url", redactURL(u))
 
 	// Normalize the repo as a URI, so that local paths
 	// are translated into file:// URLs, allowing them to be parsed
@@ -1038,16 +1685,22 @@ func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.Read
 
 	switch asURL.Scheme {
 	case "file":
-		f, err := os.Open(u)
+		f, err := os.Open(localPath(u))
 		if err != nil {
 			return nil, fmt.Errorf("failed to read repository package apk %s: %w", u, err)
 		}
-		return f, nil
+		size := int64(-1)
+		if fi, err := f.Stat(); err == nil {
+			size = fi.Size()
+		}
+		return a.trackFetch(pkg, f, size), nil
 	case "https", "http":
-		client := a.client
-		if a.cache != nil {
-			client = a.cache.client(client, false)
+		client := a.httpClient()
+		limit := a.downloadLimit(pkg)
+		if limit > 0 {
+			client = &http.Client{Transport: &limitTransport{wrapped: client, pkg: pkg.PackageName(), limit: limit}}
 		}
+		client = a.cachingClient(a.fetchRetry.client(client), false)
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 		if err != nil {
 			return nil, err
@@ -1055,6 +1708,9 @@ func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.Read
 		if a, ok := a.auth[asURL.Host]; ok && a.user != "" && a.pass != "" {
 			req.SetBasicAuth(a.user, a.pass)
 		}
+		if err := authenticate(ctx, req, a.authenticator); err != nil {
+			return nil, err
+		}
 
 		// This will return a body that retries requests using Range requests if Read() hits an error.
 		rrt := newRangeRetryTransport(ctx, client)
@@ -1064,9 +1720,22 @@ func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.Read
 		}
 		if res.StatusCode != http.StatusOK {
 			res.Body.Close()
-			return nil, fmt.Errorf("unable to get package apk at %s: %v", u, res.Status)
+			return nil, statusError(asURL.Redacted(), res.StatusCode, fmt.Errorf("unable to get package apk at %s: %v", u, res.Status))
+		}
+		// Range requests after a failed read each get a fresh limit from the transport, so
+		// limit the body as a whole too.
+		return a.trackFetch(pkg, limitDownload(res.Body, pkg.PackageName(), limit), res.ContentLength), nil
+	case "oci":
+		rc, size, err := openOCI(ctx, u, a.fetchRetry.client(a.httpClient()), a.auth, a.authenticator, &a.ociRepos)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get package apk at %s: %w", u, err)
 		}
-		return res.Body, nil
+		limit := a.downloadLimit(pkg)
+		if limit > 0 && size > limit {
+			rc.Close()
+			return nil, &DownloadSizeError{Package: pkg.PackageName(), Limit: limit, Size: size}
+		}
+		return a.trackFetch(pkg, limitDownload(rc, pkg.PackageName(), limit), size), nil
 	default:
 		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
 	}
@@ -1092,17 +1761,103 @@ func packageInfo(exp *expandapk.APKExpanded) (*Package, error) {
 	if err = cfg.MapTo(pkg); err != nil {
 		return nil, fmt.Errorf("cfg.MapTo(): %w", err)
 	}
-	pkg.BuildTime = time.Unix(pkg.BuildDate, 0).UTC()
+	pkg.BuildTime = buildTime(pkg.BuildDate)
 	pkg.InstalledSize = pkg.Size
 	pkg.Size = uint64(exp.Size)
 	pkg.Checksum = exp.ControlHash
+	pkg.RawFields = rawFields(cfg)
 
 	return pkg, nil
 }
 
+// InstallLocalPackage installs the .apk file at path, which need not be part of any repository.
+// The file is read from the target filesystem if it exists there, otherwise from the host.
+// Its checksum is computed from the file itself. The package is recorded in the installed
+// database and added to the world.
+func (a *APK) InstallLocalPackage(ctx context.Context, path string) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallLocalPackage", trace.WithAttributes(attribute.String("path", path)))
+	defer span.End()
+
+	f, err := a.fs.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, a.workDir)
+	if err != nil {
+		return fmt.Errorf("expanding %s: %w", path, err)
+	}
+
+	pkg, err := packageInfo(exp)
+	if err != nil {
+		exp.Close()
+		return fmt.Errorf("failed to read .PKGINFO for %s: %w", path, err)
+	}
+
+	if err := a.installExpanded(ctx, pkg, exp); err != nil {
+		return fmt.Errorf("installing %s: %w", path, err)
+	}
+	return a.addToWorld(ctx, pkg.Name)
+}
+
+// installExpanded installs an expanded package that is not part of any repository, and records
+// it in the installed database. It takes care of closing exp.
+func (a *APK) installExpanded(ctx context.Context, pkg *Package, exp *expandapk.APKExpanded) error {
+	isInstalled, err := a.isInstalledPackage(pkg.Name)
+	if err != nil {
+		exp.Close()
+		return fmt.Errorf("error checking if package %s is installed: %w", pkg.Name, err)
+	}
+	if isInstalled {
+		exp.Close()
+		return fmt.Errorf("package %s is already installed", pkg.Name)
+	}
+
+	files, err := a.installPackage(ctx, pkg, exp, a.sourceDateEpoch)
+	if err != nil {
+		return err
+	}
+	if err := a.AddInstalledPackage(pkg, files); err != nil {
+		return fmt.Errorf("unable to update installed file for pkg %s: %w", pkg.Name, err)
+	}
+	return a.setInstalledTimes([][]tar.Header{files})
+}
+
+// addToWorld adds the packages that are not in the world yet to it.
+func (a *APK) addToWorld(ctx context.Context, names ...string) error {
+	a.worldMu.Lock()
+	defer a.worldMu.Unlock()
+	world, err := a.GetWorld(ctx)
+	if err != nil {
+		return err
+	}
+	added := false
+	for _, name := range names {
+		if !slices.Contains(world, name) {
+			world = append(world, name)
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	// The packages were installed from files, so they need not be in any repository.
+	if err := a.writeWorld(ctx, world); err != nil {
+		return err
+	}
+	if a.sourceDateEpoch == nil {
+		return nil
+	}
+	return a.setTimes([]string{worldFilePath, filepath.Dir(worldFilePath)})
+}
+
 // installPackage installs a single package and updates installed db.
 func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expandapk.APKExpanded, sourceDateEpoch *time.Time) ([]tar.Header, error) {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	log.Infof("installing %s (%s)", pkg.Name, pkg.Version)
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "installPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
@@ -1113,8 +1868,24 @@ func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expand
 	var (
 		err            error
 		installedFiles []tar.Header
+		scripts        map[string][]byte
 	)
 
+	if a.scriptRunner != nil || len(pkg.Triggers) > 0 {
+		control, err := expanded.ControlData()
+		if err != nil {
+			return nil, fmt.Errorf("reading control data for pkg %s: %w", pkg.Name, err)
+		}
+		if scripts, err = readScripts(control); err != nil {
+			return nil, fmt.Errorf("reading scripts for pkg %s: %w", pkg.Name, err)
+		}
+	}
+	if a.scriptRunner != nil {
+		if err := a.runScripts(ctx, pkg, scripts, isPreScript); err != nil {
+			return nil, err
+		}
+	}
+
 	if wh, ok := a.fs.(WriteHeaderer); ok {
 		installedFiles, err = a.lazilyInstallAPKFiles(ctx, wh, expanded.TarFS, pkg)
 		if err != nil {
@@ -1133,6 +1904,21 @@ func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expand
 		}
 	}
 
+	if a.verifyExpandedFiles {
+		if err := a.verifyInstalledFiles(pkg, installedFiles); err != nil {
+			return nil, fmt.Errorf("verifying files for pkg %s: %w", pkg.Name, err)
+		}
+	}
+
+	if a.scriptRunner != nil {
+		// The trigger is deferred until RunTriggers.
+		isPostScript := func(name string) bool { return !isPreScript(name) && name != triggerScript }
+		if err := a.runScripts(ctx, pkg, scripts, isPostScript); err != nil {
+			return nil, err
+		}
+	}
+	a.collectTrigger(pkg, scripts, installedFiles)
+
 	// update the scripts.tar
 	controlData, err := os.Open(expanded.ControlFile)
 	if err != nil {
@@ -1155,6 +1941,43 @@ func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expand
 	return installedFiles, nil
 }
 
+// verifyInstalledFiles reads back the regular files that pkg wrote and compares them to the
+// checksums recorded in their tar headers. Files that another package owns, for example
+// because it replaces pkg, are skipped.
+func (a *APK) verifyInstalledFiles(pkg *Package, files []tar.Header) error {
+	for i := range files {
+		header := &files[i]
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if owner, _ := a.fileOwner(header.Name); owner != pkg {
+			continue
+		}
+		want, err := checksumFromHeader(header)
+		if err != nil {
+			return err
+		}
+		if want == nil {
+			continue
+		}
+
+		f, err := a.fs.Open(header.Name)
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", header.Name, err)
+		}
+		h := sha1.New() //nolint:gosec // this is what apk tools is using
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", header.Name, err)
+		}
+		if got := h.Sum(nil); !bytes.Equal(want, got) {
+			return fmt.Errorf("checksum mismatch for %s: expected %x, got %x", header.Name, want, got)
+		}
+	}
+	return nil
+}
+
 func (a *APK) datahash(controlTarGz io.Reader) (string, error) {
 	values, err := a.controlValue(controlTarGz, "datahash")
 	if err != nil {
@@ -15,7 +15,12 @@
 package apk
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
@@ -27,10 +32,14 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 
+	apkauth "chainguard.dev/apko/pkg/apk/auth"
 	apkfs "chainguard.dev/apko/pkg/apk/fs"
 )
 
@@ -94,6 +103,91 @@ func TestInitDB(t *testing.T) {
 	}
 }
 
+func TestInitDBPlan(t *testing.T) {
+	for _, ignore := range []bool{true, false} {
+		t.Run(fmt.Sprintf("ignoreMknodErrors=%v", ignore), func(t *testing.T) {
+			if !ignore && ignoreMknodErrors {
+				t.Skip("cannot create device files on this platform")
+			}
+			ctx := context.Background()
+			src := apkfs.NewMemFS()
+			a, err := New(WithFS(src), WithIgnoreMknodErrors(ignore))
+			require.NoError(t, err)
+
+			plan, err := a.InitDBPlan(ctx)
+			require.NoError(t, err)
+			require.NotEmpty(t, plan)
+			_, err = src.Stat("etc/apk")
+			require.ErrorIs(t, err, fs.ErrNotExist, "planning should not change the filesystem")
+
+			require.NoError(t, a.InitDB(ctx))
+			for _, e := range plan {
+				require.Equal(t, ignore && e.Type == tar.TypeChar, e.Optional, "optional %s", e.Path)
+
+				fi, err := src.Stat(e.Path)
+				if e.Optional && err != nil {
+					continue
+				}
+				require.NoError(t, err, "error statting %s", e.Path)
+				require.Equal(t, e.Perms.Perm(), fi.Mode().Perm(), "mismatched permissions for %s", e.Path)
+				switch e.Type {
+				case tar.TypeDir:
+					require.True(t, fi.IsDir(), "expected %s to be a directory", e.Path)
+				case tar.TypeReg:
+					got, err := src.ReadFile(e.Path)
+					require.NoError(t, err)
+					require.Equal(t, len(e.Contents), len(got), "mismatched contents for %s", e.Path)
+				case tar.TypeChar:
+					require.Equal(t, os.ModeCharDevice, fi.Mode().Type()&os.ModeCharDevice, "expected %s to be a character device", e.Path)
+				}
+			}
+		})
+	}
+}
+
+func TestInitDBProfile(t *testing.T) {
+	ctx := context.Background()
+	src := apkfs.NewMemFS()
+	profile := []PlannedEntry{
+		{Path: "/etc/apk", Perms: 0o755, Type: tar.TypeDir},
+		{Path: "/lib/apk", Perms: 0o755, Type: tar.TypeDir},
+		{Path: "/lib/apk/db", Perms: 0o755, Type: tar.TypeDir},
+		{Path: "/lib/apk/db/installed", Perms: 0o644, Type: tar.TypeReg},
+		{Path: "/etc/apk/world", Perms: 0o644, Type: tar.TypeReg, Contents: []byte("\n")},
+	}
+	a, err := New(WithFS(src), WithInitDBProfile(profile))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+
+	plan, err := a.InitDBPlan(ctx)
+	require.NoError(t, err)
+	require.Equal(t, profile, plan)
+
+	var created []string
+	require.NoError(t, fs.WalkDir(src, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		created = append(created, p)
+		return nil
+	}))
+	// the base directories are always created
+	require.ElementsMatch(t, []string{
+		".", "tmp", "dev", "etc", "lib", "proc", "var",
+		"etc/apk", "etc/apk/world", "lib/apk", "lib/apk/db", "lib/apk/db/installed",
+	}, created)
+
+	b, err := src.ReadFile("etc/apk/world")
+	require.NoError(t, err)
+	require.Equal(t, "\n", string(b))
+
+	def, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch))
+	require.NoError(t, err)
+	plan, err = def.InitDBPlan(ctx)
+	require.NoError(t, err)
+	require.Equal(t, DefaultInitDBProfile(testArch), plan)
+}
+
 func TestSetWorld(t *testing.T) {
 	ctx := context.Background()
 	src := apkfs.NewMemFS()
@@ -274,6 +368,45 @@ func TestInitKeyring(t *testing.T) {
 	})
 }
 
+func TestInitKeyringFingerprints(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keyName := "alpine-devel@lists.alpinelinux.org-5e69ca50.rsa.pub"
+	keyPath := filepath.Join(dir, keyName)
+	require.NoError(t, os.WriteFile(keyPath, []byte(testDemoKey), 0o644)) //nolint:gosec
+	sum := sha256.Sum256([]byte(testDemoKey))
+	fingerprint := hex.EncodeToString(sum[:])
+
+	for _, tt := range []struct {
+		name     string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{name: "nil map", expected: nil},
+		{name: "match by path", expected: map[string]string{keyPath: fingerprint}},
+		{name: "match by filename", expected: map[string]string{keyName: strings.ToUpper(fingerprint)}},
+		{name: "mismatch", expected: map[string]string{keyName: strings.Repeat("0", len(fingerprint))}, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := apkfs.NewMemFS()
+			a, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
+			require.NoError(t, err)
+
+			err = a.InitKeyring(ctx, []string{keyPath}, tt.expected)
+			if tt.wantErr {
+				require.ErrorContains(t, err, "fingerprint")
+				_, err := src.Stat(filepath.Join(DefaultKeyRingPath, keyName))
+				require.ErrorIs(t, err, fs.ErrNotExist, "mismatched key should not be written")
+				return
+			}
+			require.NoError(t, err)
+			got, err := src.ReadFile(filepath.Join(DefaultKeyRingPath, keyName))
+			require.NoError(t, err)
+			require.Equal(t, testDemoKey, string(got))
+		})
+	}
+}
+
 func TestLoadSystemKeyring(t *testing.T) {
 	t.Run("non-existent dir", func(t *testing.T) {
 		ctx := context.Background()
@@ -353,6 +486,79 @@ func TestLoadSystemKeyring(t *testing.T) {
 	}
 }
 
+func TestResolveWorld(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepo(t, testArch, []*Package{
+		{Name: "foo", Version: "1.0.0", Dependencies: []string{"libfoo"}},
+		{Name: "foo", Version: "2.0.0", Dependencies: []string{"libfoo"}},
+		{Name: "libfoo", Version: "1.0.0"},
+		{Name: "bar", Version: "1.0.0", Dependencies: []string{"so:libbaz.so.1"}},
+		{Name: "baz", Version: "1.0.0", Provides: []string{"so:libbaz.so.1"}},
+	})
+	a, src := testAPKWithRepos(t, []string{repo})
+	require.NoError(t, a.SetWorld(ctx, []string{"foo=1.0.0", "bar"}))
+
+	before, err := src.ReadFile(installedFilePath)
+	require.NoError(t, err)
+
+	pkgs, conflicts, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+	require.Empty(t, conflicts)
+
+	got := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		got = append(got, pkg.Name+"-"+pkg.Version)
+	}
+	require.Equal(t, []string{"baz-1.0.0", "bar-1.0.0", "libfoo-1.0.0", "foo-1.0.0"}, got)
+
+	after, err := src.ReadFile(installedFilePath)
+	require.NoError(t, err)
+	require.Equal(t, before, after, "resolving should not install anything")
+}
+
+func TestInstallLocalPackage(t *testing.T) {
+	ctx := context.Background()
+	hostPath := filepath.Join(testPrimaryPkgDir, testPkgFilename)
+
+	check := func(t *testing.T, a *APK, src apkfs.FullFS) {
+		t.Helper()
+		_, err := src.Stat("etc/crontabs/root")
+		require.NoError(t, err, "package files should be installed")
+
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		require.Len(t, installed, 1)
+		require.Equal(t, testPkg.Name, installed[0].Name)
+		require.Equal(t, testPkg.Version, installed[0].Version)
+		require.Equal(t, testPkg.Checksum, installed[0].Checksum, "checksum should be computed from the file")
+
+		world, err := a.GetWorld(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{testPkg.Name}, world)
+	}
+
+	t.Run("host filesystem", func(t *testing.T) {
+		a, src := testAPKWithRepos(t, nil)
+		require.NoError(t, a.InstallLocalPackage(ctx, hostPath))
+		check(t, a, src)
+
+		require.ErrorContains(t, a.InstallLocalPackage(ctx, hostPath), "already installed")
+	})
+	t.Run("target filesystem", func(t *testing.T) {
+		a, src := testAPKWithRepos(t, nil)
+		b, err := os.ReadFile(hostPath)
+		require.NoError(t, err)
+		require.NoError(t, src.WriteFile(filepath.Join("tmp", testPkgFilename), b, 0o644))
+
+		require.NoError(t, a.InstallLocalPackage(ctx, filepath.Join("tmp", testPkgFilename)))
+		check(t, a, src)
+	})
+	t.Run("missing", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, nil)
+		require.Error(t, a.InstallLocalPackage(ctx, filepath.Join(t.TempDir(), testPkgFilename)))
+	})
+}
+
 func TestFetchPackage(t *testing.T) {
 	var (
 		repo          = Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
@@ -534,6 +740,527 @@ func TestFetchPackage(t *testing.T) {
 	})
 }
 
+// testCountingTransport tracks the maximum number of requests in flight at once.
+type testCountingTransport struct {
+	wrapped  http.RoundTripper
+	delay    time.Duration
+	mu       sync.Mutex
+	inflight int
+	max      int
+}
+
+func (t *testCountingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.inflight++
+	if t.inflight > t.max {
+		t.max = t.inflight
+	}
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		t.inflight--
+		t.mu.Unlock()
+	}()
+
+	time.Sleep(t.delay)
+	return t.wrapped.RoundTrip(request)
+}
+
+func TestDowngradePolicy(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepo(t, testArch, []*Package{
+		{Name: "foo", Version: "1.0.0"},
+		{Name: "foo", Version: "2.0.0"},
+	})
+
+	for _, tt := range []struct {
+		name    string
+		options []Option
+		wantErr bool
+	}{
+		{name: "default allows"},
+		{name: "allow", options: []Option{WithDowngradePolicy(DowngradeAllow)}},
+		{name: "warn", options: []Option{WithDowngradePolicy(DowngradeWarn)}},
+		{name: "forbid", options: []Option{WithDowngradePolicy(DowngradeForbid)}, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := testAPKWithRepos(t, []string{repo}, tt.options...)
+			require.NoError(t, a.AddInstalledPackage(&Package{Name: "foo", Version: "2.0.0"}, nil))
+			require.NoError(t, a.SetWorld(ctx, []string{"foo=1.0.0"}))
+
+			pkgs, _, err := a.ResolveWorld(ctx)
+			if tt.wantErr {
+				var downgrade *DowngradeError
+				require.ErrorAs(t, err, &downgrade)
+				require.Equal(t, &DowngradeError{Package: "foo", Installed: "2.0.0", Resolved: "1.0.0"}, downgrade)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, pkgs, 1)
+			require.Equal(t, "1.0.0", pkgs[0].Version)
+		})
+	}
+
+	t.Run("upgrade is not a downgrade", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, []string{repo}, WithDowngradePolicy(DowngradeForbid))
+		require.NoError(t, a.AddInstalledPackage(&Package{Name: "foo", Version: "1.0.0"}, nil))
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+
+		pkgs, _, err := a.ResolveWorld(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "2.0.0", pkgs[0].Version)
+	})
+}
+
+func TestExpandPackageVerifiesHashes(t *testing.T) {
+	const (
+		checksum = "Q1LLq2qDNrS/qRnhxQ3hsY/sHbQnc="
+		datahash = "1a3a8e47d2287da6d505d973412cee1ad64bcc17bc5995069e4e932055ecb0c4"
+		template = "C:%s\nP:alpine-baselayout\nV:3.2.0-r23\nA:aarch64\nH:%s\n\n"
+	)
+	ctx := context.Background()
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+
+	expand := func(t *testing.T, checksum, datahash string) error {
+		t.Helper()
+		packages, err := ParsePackageIndex(io.NopCloser(strings.NewReader(fmt.Sprintf(template, checksum, datahash))))
+		require.NoError(t, err)
+		require.Len(t, packages, 1)
+		require.Equal(t, datahash, packages[0].DataHash)
+
+		a, err := New(WithFS(apkfs.NewMemFS()), WithIgnoreMknodErrors(ignoreMknodErrors))
+		require.NoError(t, err)
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		})
+		pkg := NewRepositoryPackage(packages[0], repo.WithIndex(&APKIndex{Packages: packages}))
+		exp, err := a.expandPackage(ctx, pkg)
+		if err == nil {
+			exp.Close()
+		}
+		return err
+	}
+
+	t.Run("both hashes match", func(t *testing.T) {
+		require.NoError(t, expand(t, checksum, datahash))
+	})
+	t.Run("legacy checksum only", func(t *testing.T) {
+		require.NoError(t, expand(t, checksum, ""))
+	})
+	t.Run("data hash mismatch", func(t *testing.T) {
+		corrupt := strings.Repeat("0", len(datahash))
+		require.ErrorContains(t, expand(t, checksum, corrupt), "data hash mismatch")
+	})
+	t.Run("control checksum mismatch", func(t *testing.T) {
+		corrupt := "Q1" + base64.StdEncoding.EncodeToString(make([]byte, 20))
+		require.ErrorContains(t, expand(t, corrupt, datahash), "control checksum mismatch")
+	})
+	t.Run("cached data hash mismatch", func(t *testing.T) {
+		packages, err := ParsePackageIndex(io.NopCloser(strings.NewReader(fmt.Sprintf(template, checksum, datahash))))
+		require.NoError(t, err)
+		a, err := New(WithFS(apkfs.NewMemFS()), WithIgnoreMknodErrors(ignoreMknodErrors), WithCache(t.TempDir(), false))
+		require.NoError(t, err)
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		})
+		pkg := NewRepositoryPackage(packages[0], repo.WithIndex(&APKIndex{Packages: packages}))
+		// Go around the in-memory cache of expanded packages, so the second call reads the cache directory.
+		_, err = expandPackage(ctx, a, pkg)
+		require.NoError(t, err)
+
+		pkg.DataHash = strings.Repeat("0", len(datahash))
+		_, err = expandPackage(ctx, a, pkg)
+		require.ErrorContains(t, err, "data hash mismatch")
+	})
+}
+
+// testTruncatingFS drops the second half of every write to path, as a flaky filesystem might.
+type testTruncatingFS struct {
+	apkfs.FullFS
+	path string
+}
+
+func (f *testTruncatingFS) OpenFile(name string, flag int, perm fs.FileMode) (apkfs.File, error) {
+	file, err := f.FullFS.OpenFile(name, flag, perm)
+	if err != nil || name != f.path {
+		return file, err
+	}
+	return &testTruncatingFile{File: file}, nil
+}
+
+type testTruncatingFile struct {
+	apkfs.File
+}
+
+func (f *testTruncatingFile) Write(p []byte) (int, error) {
+	if _, err := f.File.Write(p[:len(p)/2]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func TestVerifyExpandedFiles(t *testing.T) {
+	const truncated = "etc/truncated"
+	install := func(t *testing.T, verify bool) error {
+		t.Helper()
+		src := &testTruncatingFS{FullFS: apkfs.NewMemFS(), path: truncated}
+		a, err := New(WithFS(src), WithArch(testArch), WithIgnoreMknodErrors(ignoreMknodErrors), WithVerifyExpandedFiles(verify))
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(context.Background()))
+
+		fp := fakePackage(t, &Package{Name: "flaky", Version: "1.0.0-r0"}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/intact", 0o644, false, []byte("this file is written in full"), nil},
+			{truncated, 0o644, false, []byte("this file loses its second half"), nil},
+		})
+		return a.InstallPackages(context.Background(), nil, []InstallablePackage{fp})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		require.NoError(t, install(t, false))
+	})
+	t.Run("enabled", func(t *testing.T) {
+		err := install(t, true)
+		require.ErrorContains(t, err, "checksum mismatch for "+truncated)
+	})
+}
+
+func TestParallelFetch(t *testing.T) {
+	var (
+		repo          = Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+		repoWithIndex = repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}})
+		pkg           = NewRepositoryPackage(&testPkg, repoWithIndex)
+		ctx           = context.Background()
+	)
+
+	t.Run("bounded in-flight requests", func(t *testing.T) {
+		const limit = 2
+		a, err := New(WithFS(apkfs.NewMemFS()), WithParallelFetch(limit))
+		require.NoError(t, err)
+
+		transport := &testCountingTransport{
+			wrapped: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+			delay:   20 * time.Millisecond,
+		}
+		a.SetClient(&http.Client{Transport: transport})
+
+		var g errgroup.Group
+		for i := 0; i < 4*limit; i++ {
+			g.Go(func() error {
+				rc, err := a.FetchPackage(ctx, pkg)
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+				_, err = io.Copy(io.Discard, rc)
+				return err
+			})
+		}
+		require.NoError(t, g.Wait())
+		require.LessOrEqual(t, transport.max, limit)
+		require.Greater(t, transport.max, 0)
+	})
+
+	t.Run("expand different packages in same repo dir", func(t *testing.T) {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithCache(t.TempDir(), false), WithParallelFetch(2))
+		require.NoError(t, err)
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testAlternatePkgDir, basenameOnly: true},
+		})
+
+		var g errgroup.Group
+		for _, version := range []string{"3.2.0-r23", "3.4.0-r0"} {
+			p := NewRepositoryPackage(&Package{Name: testPkg.Name, Version: version, Arch: testArch}, repoWithIndex)
+			g.Go(func() error {
+				exp, err := expandPackage(ctx, a, p)
+				if err != nil {
+					return err
+				}
+				return exp.Close()
+			})
+		}
+		require.NoError(t, g.Wait())
+	})
+}
+
+// testFlakyTransport fails the first failures requests, alternating between a 502 and a
+// network error, before handing requests to wrapped.
+type testFlakyTransport struct {
+	wrapped  http.RoundTripper
+	failures int
+
+	mu       sync.Mutex
+	requests int
+}
+
+func (t *testFlakyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests++
+	n := t.requests
+	t.mu.Unlock()
+
+	if n > t.failures {
+		return t.wrapped.RoundTrip(request)
+	}
+	if n%2 == 0 {
+		return nil, fmt.Errorf("connection reset by peer")
+	}
+	return &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Body:       io.NopCloser(strings.NewReader("bad gateway")),
+	}, nil
+}
+
+func TestFetchRetry(t *testing.T) {
+	var (
+		repo          = Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+		repoWithIndex = repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}})
+		pkg           = NewRepositoryPackage(&testPkg, repoWithIndex)
+		ctx           = context.Background()
+	)
+
+	fetch := func(t *testing.T, transport http.RoundTripper, options ...Option) error {
+		t.Helper()
+		a, err := New(append([]Option{WithFS(apkfs.NewMemFS())}, options...)...)
+		require.NoError(t, err)
+		a.SetClient(&http.Client{Transport: transport})
+		rc, err := a.FetchPackage(ctx, pkg)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(io.Discard, rc)
+		return err
+	}
+
+	t.Run("transient failures are retried", func(t *testing.T) {
+		transport := &testFlakyTransport{
+			wrapped:  &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+			failures: 2,
+		}
+		require.NoError(t, fetch(t, transport, WithFetchRetry(3, time.Millisecond)))
+		require.Equal(t, 3, transport.requests)
+	})
+	t.Run("gives up after attempts", func(t *testing.T) {
+		transport := &testFlakyTransport{
+			wrapped:  &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+			failures: 2,
+		}
+		require.Error(t, fetch(t, transport, WithFetchRetry(2, time.Millisecond)))
+		require.Equal(t, 2, transport.requests)
+	})
+	t.Run("not found is not retried", func(t *testing.T) {
+		transport := &testFlakyTransport{
+			wrapped: &testLocalTransport{fail: true},
+		}
+		require.Error(t, fetch(t, transport, WithFetchRetry(3, time.Millisecond)))
+		require.Equal(t, 1, transport.requests)
+	})
+	t.Run("no retry by default", func(t *testing.T) {
+		transport := &testFlakyTransport{
+			wrapped:  &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+			failures: 1,
+		}
+		require.Error(t, fetch(t, transport))
+		require.Equal(t, 1, transport.requests)
+	})
+}
+
+// testStreamTransport answers every request with size bytes, without announcing a length
+// unless announce is set.
+type testStreamTransport struct {
+	size     int64
+	announce bool
+}
+
+func (t *testStreamTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Body:          io.NopCloser(strings.NewReader(strings.Repeat("x", int(t.size)))),
+		ContentLength: -1,
+	}
+	if t.announce {
+		resp.ContentLength = t.size
+	}
+	return resp, nil
+}
+
+func TestMaxDownloadSize(t *testing.T) {
+	ctx := context.Background()
+	declared := testPkg
+	declared.Size = 1000
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+	pkg := NewRepositoryPackage(&declared, repo.WithIndex(&APKIndex{Packages: []*Package{&declared}}))
+
+	fetch := func(t *testing.T, transport http.RoundTripper, options ...Option) (int64, error) {
+		t.Helper()
+		a, err := New(append([]Option{WithFS(apkfs.NewMemFS())}, options...)...)
+		require.NoError(t, err)
+		a.SetClient(&http.Client{Transport: transport})
+		rc, err := a.FetchPackage(ctx, pkg)
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		return io.Copy(io.Discard, rc)
+	}
+
+	t.Run("no limit by default", func(t *testing.T) {
+		n, err := fetch(t, &testStreamTransport{size: 5000})
+		require.NoError(t, err)
+		require.Equal(t, int64(5000), n)
+	})
+	t.Run("larger than the index declares", func(t *testing.T) {
+		n, err := fetch(t, &testStreamTransport{size: 5000}, WithMaxDownloadSize(1<<20))
+		var sizeErr *DownloadSizeError
+		require.ErrorAs(t, err, &sizeErr)
+		require.Equal(t, int64(1000), sizeErr.Limit)
+		require.Equal(t, int64(1000), n)
+	})
+	t.Run("larger than the maximum", func(t *testing.T) {
+		_, err := fetch(t, &testStreamTransport{size: 900}, WithMaxDownloadSize(500))
+		var sizeErr *DownloadSizeError
+		require.ErrorAs(t, err, &sizeErr)
+		require.Equal(t, int64(500), sizeErr.Limit)
+	})
+	t.Run("announced size is rejected up front", func(t *testing.T) {
+		_, err := fetch(t, &testStreamTransport{size: 5000, announce: true}, WithMaxDownloadSize(1<<20))
+		var sizeErr *DownloadSizeError
+		require.ErrorAs(t, err, &sizeErr)
+		require.Equal(t, int64(5000), sizeErr.Size)
+	})
+	t.Run("oversized download is not cached", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		_, err := fetch(t, &testStreamTransport{size: 5000}, WithMaxDownloadSize(1<<20), WithCache(cacheDir, false))
+		require.ErrorIs(t, err, &DownloadSizeError{})
+		a, err := New(WithFS(apkfs.NewMemFS()), WithCache(cacheDir, false))
+		require.NoError(t, err)
+		require.False(t, a.packageCached(pkg))
+	})
+	t.Run("within the limits", func(t *testing.T) {
+		n, err := fetch(t, &testStreamTransport{size: 1000}, WithMaxDownloadSize(1000))
+		require.NoError(t, err)
+		require.Equal(t, int64(1000), n)
+	})
+}
+
+// testMemCache is a Cache that keeps everything in memory.
+type testMemCache struct {
+	mu    sync.Mutex
+	files map[CacheKey][]byte
+}
+
+func (c *testMemCache) Get(_ context.Context, key CacheKey) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.files[key]
+	if !ok {
+		return nil, fmt.Errorf("%v: %w", key, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (c *testMemCache) Put(_ context.Context, key CacheKey, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.files == nil {
+		c.files = map[CacheKey][]byte{}
+	}
+	c.files[key] = b
+	return nil
+}
+
+func (c *testMemCache) Has(_ context.Context, key CacheKey) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.files[key]
+	return ok, nil
+}
+
+func TestCacheBackend(t *testing.T) {
+	var (
+		repo          = Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+		repoWithIndex = repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}})
+		pkg           = NewRepositoryPackage(&testPkg, repoWithIndex)
+		ctx           = context.Background()
+	)
+
+	want, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, testPkgFilename))
+	require.NoError(t, err)
+
+	t.Run("fetch package", func(t *testing.T) {
+		backend := &testMemCache{}
+		a, err := New(WithFS(apkfs.NewMemFS()), WithCacheBackend(backend))
+		require.NoError(t, err)
+
+		fetch := func(transport http.RoundTripper) []byte {
+			a.SetClient(&http.Client{Transport: transport})
+			rc, err := a.FetchPackage(ctx, pkg)
+			require.NoError(t, err)
+			defer rc.Close()
+			b, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			return b
+		}
+
+		// The first fetch fills the cache.
+		require.Equal(t, want, fetch(&testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}))
+		ok, err := backend.Has(ctx, CacheKey{Repo: testAlpineRepos, Arch: testArch, Filename: testPkgFilename})
+		require.NoError(t, err)
+		require.True(t, ok, "package should be cached")
+
+		// The second is served from the cache without touching the network.
+		require.Equal(t, want, fetch(&testLocalTransport{fail: true}))
+	})
+	t.Run("expand package", func(t *testing.T) {
+		backend := &testMemCache{}
+		a, err := New(WithFS(apkfs.NewMemFS()), WithCacheBackend(backend))
+		require.NoError(t, err)
+		a.SetClient(&http.Client{Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}})
+
+		exp, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		exp.Close()
+
+		rc, err := backend.Get(ctx, CacheKey{Repo: testAlpineRepos, Arch: testArch, Filename: testPkgFilename})
+		require.NoError(t, err, "package should be cached")
+		defer rc.Close()
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	})
+	t.Run("etag required", func(t *testing.T) {
+		globalEtagCache = &etagCache{}
+		backend := &testMemCache{}
+		client := &http.Client{Transport: &cacheTransport{
+			wrapped: &http.Client{
+				Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true, headers: map[string][]string{"Etag": {`"testetag"`}}},
+			},
+			cache:        backend,
+			etagRequired: true,
+		}}
+
+		u := fmt.Sprintf("%s/%s/%s", testAlpineRepos, testArch, testPkgFilename)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		got, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+
+		ok, err := backend.Has(ctx, CacheKey{Repo: testAlpineRepos, Arch: testArch, Filename: testPkgFilename, Etag: "testetag"})
+		require.NoError(t, err)
+		require.True(t, ok, "file should be cached under its etag")
+	})
+}
+
 func TestAuth_good(t *testing.T) {
 	called := false
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -597,3 +1324,210 @@ func TestAuth_bad(t *testing.T) {
 	require.Error(t, err, "should fail with bad auth")
 	require.True(t, called, "did not make request")
 }
+
+func TestAuthenticator(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gotuser, gotpass, ok := r.BasicAuth(); !ok || gotuser != testUser || gotpass != testPass {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.FileServer(http.Dir(testPrimaryPkgDir)).ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+
+	repo := Repository{URI: s.URL}
+	repoWithIndex := repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}})
+	pkg := NewRepositoryPackage(&testPkg, repoWithIndex)
+	ctx := context.Background()
+
+	a, err := New(WithFS(apkfs.NewMemFS()), WithAuthenticator(apkauth.ChainAuth(
+		apkauth.StaticAuth("other.example.com", "baduser", "badpass"),
+		apkauth.StaticAuth(host, testUser, testPass),
+	)))
+	require.NoError(t, err, "unable to create APK")
+	require.NoError(t, a.InitDB(ctx))
+
+	rc, err := a.FetchPackage(ctx, pkg)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+}
+
+func TestBearerAuth(t *testing.T) {
+	const token = "a-secret-token"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.FileServer(http.Dir(testPrimaryPkgDir)).ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+
+	repo := Repository{URI: s.URL}
+	repoWithIndex := repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}})
+	pkg := NewRepositoryPackage(&testPkg, repoWithIndex)
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"right token", token, true},
+		{"wrong token", "not-the-token", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := New(WithFS(apkfs.NewMemFS()), WithAuthenticator(apkauth.BearerAuth(host, tt.token)))
+			require.NoError(t, err, "unable to create APK")
+			require.NoError(t, a.InitDB(ctx))
+
+			rc, err := a.FetchPackage(ctx, pkg)
+			if !tt.ok {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+		})
+	}
+}
+
+func TestWorkDir(t *testing.T) {
+	ctx := context.Background()
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0", Arch: testArch, Dependencies: []string{"libfoo"}},
+		{Name: "libfoo", Version: "1.0.0", Arch: testArch},
+	}
+	repo := testLocalRepoWithFiles(t, testArch, packages, map[string][]testDirEntry{
+		"foo":    {{path: "usr", dir: true, perms: 0o755}, {path: "usr/foo", perms: 0o755}},
+		"libfoo": {{path: "usr", dir: true, perms: 0o755}, {path: "usr/libfoo.so", perms: 0o644, content: []byte("libfoo")}},
+	})
+	// A truncated package, so expanding it fails part way.
+	truncated := t.TempDir()
+	b, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, testPkgFilename))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(truncated, testPkgFilename), b[:len(b)-100], 0o644)) //nolint:gosec // we're writing a test file
+
+	workDir, defaultTmp := t.TempDir(), t.TempDir()
+	t.Setenv("TMPDIR", defaultTmp)
+
+	requireEmpty := func(t *testing.T, dir string) {
+		t.Helper()
+		des, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, des, "expected %s to be empty", dir)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		a, src := testAPKWithRepos(t, []string{repo}, WithWorkDir(workDir))
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+
+		_, err := src.Stat("usr/libfoo.so")
+		require.NoError(t, err)
+		requireEmpty(t, workDir)
+		requireEmpty(t, defaultTmp)
+	})
+	t.Run("error", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, nil, WithWorkDir(workDir))
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: truncated, basenameOnly: true},
+		})
+		repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+		pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+		_, err := a.expandPackage(ctx, pkg)
+		require.ErrorContains(t, err, "expanding")
+		requireEmpty(t, workDir)
+		requireEmpty(t, defaultTmp)
+	})
+}
+
+func TestFileRepository(t *testing.T) {
+	ctx := context.Background()
+
+	// testPrimaryPkgDir holds the index and packages directly, serve it as the testArch directory.
+	pkgDir, err := filepath.Abs(testPrimaryPkgDir)
+	require.NoError(t, err)
+	root := t.TempDir()
+	require.NoError(t, os.Symlink(pkgDir, filepath.Join(root, testArch)))
+	repo := "file://" + root
+
+	cacheDir := t.TempDir()
+	a, src := testAPKWithRepos(t, []string{repo}, WithCache(cacheDir, false))
+	// Every HTTP request fails, so everything has to come from the file:// repository.
+	a.SetClient(&http.Client{Transport: &testLocalTransport{fail: true}})
+
+	indexes, err := a.GetRepositoryIndexes(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+
+	var pkg *RepositoryPackage
+	for _, p := range indexes[0].Packages() {
+		if p.Name == testPkg.Name && p.Version == testPkg.Version {
+			// The index entry was taken from a different build of the package on disk.
+			pkg = NewRepositoryPackage(&testPkg, p.Repository())
+		}
+	}
+	require.NotNil(t, pkg, "expected %s in the index", testPkg.Name)
+	require.Equal(t, repo+"/"+testArch+"/"+testPkgFilename, pkg.URL())
+
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{pkg}))
+	_, err = src.Stat("etc/motd")
+	require.NoError(t, err)
+
+	cached, err := cacheDirForPackage(cacheDir, pkg)
+	require.NoError(t, err)
+	_, err = os.Stat(cached)
+	require.NoError(t, err, "expected the package to be cached")
+}
+
+func TestInstallSkipsInstalledPackages(t *testing.T) {
+	ctx := context.Background()
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0", Arch: testArch},
+		{Name: "bar", Version: "1.0.0", Arch: testArch},
+	}
+	dir := testLocalRepoWithFiles(t, testArch, packages, map[string][]testDirEntry{
+		"foo": {{path: "usr", dir: true, perms: 0o755}, {path: "usr/foo", perms: 0o755, content: []byte("foo")}},
+		"bar": {{path: "usr", dir: true, perms: 0o755}, {path: "usr/bar", perms: 0o755, content: []byte("bar")}},
+	})
+
+	var (
+		mu      sync.Mutex
+		fetched []string
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".apk") {
+			mu.Lock()
+			fetched = append(fetched, filepath.Base(r.URL.Path))
+			mu.Unlock()
+		}
+		http.ServeFile(w, r, filepath.Join(dir, r.URL.Path))
+	}))
+	defer s.Close()
+
+	a, src := testAPKWithRepos(t, []string{s.URL})
+	require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+	require.Equal(t, []string{"foo-1.0.0.apk"}, fetched)
+	require.Empty(t, a.SkippedPackages())
+
+	fetched = nil
+	require.NoError(t, a.FixateWorld(ctx, nil))
+	require.Empty(t, fetched, "expected nothing to be fetched for an unchanged world")
+	require.Equal(t, []string{"foo"}, a.SkippedPackages())
+
+	fetched = nil
+	require.NoError(t, a.SetWorld(ctx, []string{"foo", "bar"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+	require.Equal(t, []string{"bar-1.0.0.apk"}, fetched)
+	require.Equal(t, []string{"foo"}, a.SkippedPackages())
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 2, "foo should only be recorded once")
+	_, err = src.Stat("usr/bar")
+	require.NoError(t, err)
+}
@@ -30,15 +30,20 @@ import (
 	"sync"
 	"time"
 
-	"github.com/klauspost/compress/gzip"
+	"github.com/chainguard-dev/clog"
 	"go.lsp.dev/uri"
 	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
 
+	apkauth "chainguard.dev/apko/pkg/apk/auth"
+	"chainguard.dev/apko/pkg/apk/expandapk"
 	sign "chainguard.dev/apko/pkg/apk/signature"
 )
 
 var signatureFileRegex = regexp.MustCompile(`^\.SIGN\.RSA\.(.*\.rsa\.pub)$`)
 
+const defaultIndexParallelism = 4
+
 // This is terrible but simpler than plumbing around a cache for now.
 // We just hold the parsed index in memory rather than re-parsing it every time,
 // which requires gunzipping, which is (somewhat) expensive.
@@ -64,12 +69,17 @@ type indexCache struct {
 }
 
 func (i *indexCache) get(ctx context.Context, u string, keys map[string][]byte, arch string, opts *indexOpts) (*APKIndex, error) {
-	if strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://") {
+	// An index loaded without checking its signature must not be handed out when it is checked.
+	key := u
+	if !shouldCheckSignatureForIndex(u, arch, opts) {
+		key += " (unverified)"
+	}
+	if strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://") || isOCI(u) {
 		// We don't want remote indexes to change while we're running.
-		once, _ := i.onces.LoadOrStore(u, &sync.Once{})
+		once, _ := i.onces.LoadOrStore(key, &sync.Once{})
 		once.(*sync.Once).Do(func() {
 			idx, err := getRepositoryIndex(ctx, u, keys, arch, opts)
-			i.indexes.Store(u, indexResult{
+			i.indexes.Store(key, indexResult{
 				idx: idx,
 				err: err,
 			})
@@ -79,25 +89,28 @@ func (i *indexCache) get(ctx context.Context, u string, keys map[string][]byte,
 		defer i.Unlock()
 
 		// We do expect local indexes to change, so we check modtimes.
-		stat, err := os.Stat(u)
+		stat, err := os.Stat(localPath(u))
 		if err != nil {
 			return nil, nil
 		}
 
 		mod := stat.ModTime()
-		before, ok := i.modtimes[u]
+		before, ok := i.modtimes[key]
 		if !ok || mod.After(before) {
 			// If this is the first time or it has changed since the last time...
 			idx, err := getRepositoryIndex(ctx, u, keys, arch, opts)
-			i.indexes.Store(u, indexResult{
+			i.indexes.Store(key, indexResult{
 				idx: idx,
 				err: err,
 			})
-			i.modtimes[u] = mod
+			if i.modtimes == nil {
+				i.modtimes = map[string]time.Time{}
+			}
+			i.modtimes[key] = mod
 		}
 	}
 
-	v, ok := i.indexes.Load(u)
+	v, ok := i.indexes.Load(key)
 	if !ok {
 		asURL, _ := url.Parse(u)
 		panic(fmt.Errorf("did not see index %q after writing it", asURL.Redacted()))
@@ -109,10 +122,24 @@ func (i *indexCache) get(ctx context.Context, u string, keys map[string][]byte,
 
 // IndexURL full URL to the index file for the given repo and arch
 func IndexURL(repo, arch string) string {
-	return fmt.Sprintf("%s/%s/%s", repo, arch, indexFilename)
+	return indexURLFor(repo, arch, indexFilename)
+}
+
+// DefaultIndexFilenames are the index files that are looked for in a repository, in order,
+// unless WithIndexFilenames says otherwise.
+var DefaultIndexFilenames = []string{indexFilename, "APKINDEX.tar.zst"}
+
+// errIndexNotFound is returned when a repository has no index at a URL.
+var errIndexNotFound = errors.New("repository index not found")
+
+// indexURLFor is the URL of the index file filename for the given repo and arch.
+func indexURLFor(repo, arch, filename string) string {
+	return fmt.Sprintf("%s/%s/%s", repo, arch, filename)
 }
 
 // GetRepositoryIndexes returns the indexes for the named repositories, keys and archs.
+// The indexes are fetched concurrently, see WithIndexParallelism. If any of them fails,
+// the returned error names each repository that failed.
 // The signatures for each index are verified unless ignoreSignatures is set to true.
 // The key-value pairs in the map for `keys` are the name of the key and the contents of the key.
 // The name is just indicative. If it finds a match, it will use it. Else, it will try all keys.
@@ -125,48 +152,98 @@ func GetRepositoryIndexes(ctx context.Context, repos []string, keys map[string][
 		opt(opts)
 	}
 
-	for _, repo := range repos {
-		// does it start with a pin?
-		var (
-			repoName string
-			repoURL  = repo
-		)
-		if strings.HasPrefix(repo, "@") {
-			// it's a pinned repository, get the name
-			parts := strings.Fields(repo)
-			if len(parts) < 2 {
-				return nil, fmt.Errorf("invalid repository line: %q", repo)
-			}
-			repoName = parts[0][1:]
-			repoURL = parts[1]
-		}
+	parallelism := opts.parallelism
+	if parallelism < 1 {
+		parallelism = defaultIndexParallelism
+	}
 
-		u := IndexURL(repoURL, arch)
-		repoBase := fmt.Sprintf("%s/%s", repoURL, arch)
+	// Fetch concurrently, but keep the indexes in the order of repos, which decides precedence.
+	results := make([]NamedIndex, len(repos))
+	errs := make([]error, len(repos))
+	var g errgroup.Group
+	g.SetLimit(parallelism)
+	for i, repo := range repos {
+		g.Go(func() error {
+			results[i], errs[i] = getNamedRepositoryIndex(ctx, repo, keys, arch, opts)
+			return nil
+		})
+	}
+	_ = g.Wait()
 
-		index, err := globalIndexCache.get(ctx, u, keys, arch, opts)
-		if err != nil {
-			asURL, _ := url.Parse(u)
-			return nil, fmt.Errorf("reading index %s: %w", asURL.Redacted(), err)
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	for _, index := range results {
+		// Can happen for fs.ErrNotExist in file scheme, we just ignore it.
+		if index != nil {
+			indexes = append(indexes, index)
 		}
+	}
+	return indexes, nil
+}
 
-		// Can happen for fs.ErrNotExist in file scheme, we just ignore it.
-		if index == nil {
-			continue
+// getNamedRepositoryIndex returns the index for a single line of /etc/apk/repositories, or nil
+// if a local repository has no index for arch.
+func getNamedRepositoryIndex(ctx context.Context, repo string, keys map[string][]byte, arch string, opts *indexOpts) (NamedIndex, error) {
+	// does it start with a pin?
+	spec, err := ParseRepoSpec(repo)
+	if err != nil {
+		return nil, err
+	}
+	repoName, repoURL := spec.Tag, spec.URI
+
+	repoBase := fmt.Sprintf("%s/%s", repoURL, arch)
+
+	filenames := indexFilenamesFor(repoURL, opts.indexFilenames)
+	// Look for each of the index files in turn, reporting that none exists for the first.
+	var (
+		index    *APKIndex
+		firstErr error
+	)
+	for _, filename := range filenames {
+		u := indexURLFor(repoURL, arch, filename)
+		idx, err := globalIndexCache.get(ctx, u, keys, arch, opts)
+		if err != nil && !errors.Is(err, errIndexNotFound) {
+			return nil, fmt.Errorf("reading index %s: %w", redactURL(u), err)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("reading index %s: %w", redactURL(u), err)
 		}
+		if idx != nil {
+			index = idx
+			break
+		}
+	}
+	if index == nil {
+		// A local repository without an index is skipped.
+		return nil, firstErr
+	}
+
+	repoRef := Repository{URI: repoBase}
+	return NewNamedRepositoryWithIndex(repoName, repoRef.WithIndex(index)), nil
+}
 
-		repoRef := Repository{URI: repoBase}
-		indexes = append(indexes, NewNamedRepositoryWithIndex(repoName, repoRef.WithIndex(index)))
+// indexFilenamesFor returns the index files to look for in the repository at repoURL, in order,
+// given those set with WithIndexFilenames, if any.
+func indexFilenamesFor(repoURL string, filenames []string) []string {
+	if isOCI(repoURL) {
+		// OCI repositories hold the index in a layer of its own name.
+		return []string{indexFilename}
 	}
-	return indexes, nil
+	if len(filenames) == 0 {
+		return DefaultIndexFilenames
+	}
+	return filenames
 }
 
 func shouldCheckSignatureForIndex(index string, arch string, opts *indexOpts) bool {
 	if opts.ignoreSignatures {
 		return false
 	}
+	// index may be any of the index files of the repository
+	dir := index[:strings.LastIndex(index, "/")]
 	for _, ignoredIndex := range opts.noSignatureIndexes {
-		if IndexURL(ignoredIndex, arch) == index {
+		if fmt.Sprintf("%s/%s", ignoredIndex, arch) == dir {
 			return false
 		}
 	}
@@ -182,7 +259,7 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 		asURL *url.URL
 		err   error
 	)
-	if strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://") {
+	if strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://") || isOCI(u) {
 		asURL, err = url.Parse(u)
 	} else {
 		// Attempt to parse non-https elements into URI's so they are translated into
@@ -195,7 +272,7 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 
 	switch asURL.Scheme {
 	case "file":
-		b, err = os.ReadFile(u)
+		b, err = os.ReadFile(localPath(u))
 		if err != nil {
 			if !errors.Is(err, fs.ErrNotExist) {
 				return nil, fmt.Errorf("failed to read repository %s: %w", asURL.Redacted(), err)
@@ -216,6 +293,9 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 		} else if a, ok := opts.auth[asURL.Host]; ok && a.user != "" || a.pass != "" {
 			req.SetBasicAuth(a.user, a.pass)
 		}
+		if err := authenticate(ctx, req, opts.authenticator); err != nil {
+			return nil, err
+		}
 
 		// This will return a body that retries requests using Range requests if Read() hits an error.
 		rrt := newRangeRetryTransport(ctx, client)
@@ -227,9 +307,9 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 		case http.StatusOK:
 			// this is fine
 		case http.StatusNotFound:
-			return nil, fmt.Errorf("repository index not found for architecture %s at %s", arch, asURL.Redacted())
+			return nil, &NotFoundError{URL: asURL.Redacted(), StatusCode: res.StatusCode, Err: fmt.Errorf("%w for architecture %s at %s", errIndexNotFound, arch, asURL.Redacted())}
 		default:
-			return nil, fmt.Errorf("unexpected status code %d when getting repository index for architecture %s at %s", res.StatusCode, arch, asURL.Redacted())
+			return nil, statusError(asURL.Redacted(), res.StatusCode, fmt.Errorf("unexpected status code %d when getting repository index for architecture %s at %s", res.StatusCode, arch, asURL.Redacted()))
 		}
 		defer res.Body.Close()
 		buf := bytes.NewBuffer(nil)
@@ -237,6 +317,19 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 			return nil, fmt.Errorf("unable to read repository index at %s: %w", asURL.Redacted(), err)
 		}
 		b = buf.Bytes()
+	case "oci":
+		client := opts.ociClient
+		if client == nil {
+			client = opts.httpClient
+		}
+		rc, _, err := openOCI(ctx, u, client, opts.auth, opts.authenticator, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get repository index at %s: %w", asURL.Redacted(), err)
+		}
+		defer rc.Close()
+		if b, err = io.ReadAll(rc); err != nil {
+			return nil, fmt.Errorf("unable to read repository index at %s: %w", asURL.Redacted(), err)
+		}
 	default:
 		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
 	}
@@ -244,17 +337,16 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 	// validate the signature
 	if shouldCheckSignatureForIndex(u, arch, opts) {
 		buf := bytes.NewReader(b)
-		gzipReader, err := gzip.NewReader(buf)
-		if err != nil {
-			return nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
-		}
-		// set multistream to false, so we can read each part separately;
+		// read only the first compressed stream, so we can read each part separately;
 		// the first part is the signature, the second is the index, which should be
 		// verified.
-		gzipReader.Multistream(false)
-		defer gzipReader.Close()
+		zr, err := expandapk.NewStreamDecompressor(buf)
+		if err != nil {
+			return nil, &SignatureError{Name: asURL.Redacted(), Err: fmt.Errorf("cannot verify the signature of index %s: %w", asURL.Redacted(), err)}
+		}
+		defer zr.Close()
 
-		tarReader := tar.NewReader(gzipReader)
+		tarReader := tar.NewReader(zr)
 
 		// read the signature
 		signatureFile, err := tarReader.Next()
@@ -269,12 +361,12 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 		if err != nil {
 			return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
 		}
-		// with multistream false, we should read the next one
-		if _, err := tarReader.Next(); err != nil && !errors.Is(err, io.EOF) {
-			return nil, fmt.Errorf("unexpected error reading from tgz: %w", err)
+		// read to the end of the signature stream
+		if _, err := io.Copy(io.Discard, zr); err != nil {
+			return nil, fmt.Errorf("unexpected error reading signature from repository index: %w", err)
 		}
 		// we now have the signature bytes and name, get the contents of the rest;
-		// this should be everything else in the raw gzip file as is.
+		// this should be everything else in the raw compressed file as is.
 		allBytes := len(b)
 		unreadBytes := buf.Len()
 		readBytes := allBytes - unreadBytes
@@ -286,26 +378,26 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 		}
 		// now we can check the signature
 		if keys == nil {
-			return nil, fmt.Errorf("no keys provided to verify signature")
+			return nil, &SignatureError{Name: asURL.Redacted(), Err: fmt.Errorf("no keys provided to verify signature")}
 		}
 		var verified bool
+		verifiedBy := matches[1]
 		keyData, ok := keys[matches[1]]
 		if ok {
-			if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err != nil {
-				verified = false
-			}
+			verified = sign.RSAVerifySHA1Digest(indexDigest, signature, keyData) == nil
 		}
 		if !verified {
-			for _, keyData := range keys {
+			for name, keyData := range keys {
 				if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err == nil {
-					verified = true
+					verified, verifiedBy = true, name
 					break
 				}
 			}
 		}
 		if !verified {
-			return nil, fmt.Errorf("no key found to verify signature for keyfile %s; tried all other keys as well", matches[1])
+			return nil, &SignatureError{Name: asURL.Redacted(), Err: fmt.Errorf("no key found to verify signature for keyfile %s; tried all other keys as well", matches[1])}
 		}
+		clog.FromContext(ctx).Debug("verified index signature", "index", asURL.Redacted(), "key", verifiedBy)
 	}
 	// with a valid signature, convert it to an ApkIndex
 	index, err := IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
@@ -321,6 +413,11 @@ type indexOpts struct {
 	noSignatureIndexes []string
 	httpClient         *http.Client
 	auth               map[string]auth
+	authenticator      apkauth.Authenticator
+	indexFilenames     []string
+	// for oci:// repositories, which must not go through the caching httpClient
+	ociClient   *http.Client
+	parallelism int
 }
 type IndexOption func(*indexOpts)
 
@@ -342,6 +439,20 @@ func WithHTTPClient(c *http.Client) IndexOption {
 	}
 }
 
+func withOCIClient(c *http.Client) IndexOption {
+	return func(o *indexOpts) {
+		o.ociClient = c
+	}
+}
+
+// WithIndexParallelism bounds how many indexes GetRepositoryIndexes fetches at once.
+// If not provided, or if n is less than 1, up to four indexes are fetched at once.
+func WithIndexParallelism(n int) IndexOption {
+	return func(o *indexOpts) {
+		o.parallelism = n
+	}
+}
+
 func WithIndexAuth(domain, user, pass string) IndexOption {
 	return func(o *indexOpts) {
 		if o.auth == nil {
@@ -350,3 +461,21 @@ func WithIndexAuth(domain, user, pass string) IndexOption {
 		o.auth[domain] = auth{user, pass}
 	}
 }
+
+// WithIndexFilenames sets the index files to look for in each repository, in order, such as
+// "APKINDEX.tar.gz" and "APKINDEX.tar.zst". The first one that exists is used. Indexes may be
+// gzip or zstd compressed, whatever their name. If not provided, DefaultIndexFilenames are
+// looked for.
+func WithIndexFilenames(filenames ...string) IndexOption {
+	return func(o *indexOpts) {
+		o.indexFilenames = filenames
+	}
+}
+
+// WithIndexAuthenticator adds credentials from authenticator to the requests for indexes that
+// get none from WithIndexAuth or the repository URL.
+func WithIndexAuthenticator(authenticator apkauth.Authenticator) IndexOption {
+	return func(o *indexOpts) {
+		o.authenticator = authenticator
+	}
+}
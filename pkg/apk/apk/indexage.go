@@ -0,0 +1,152 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// IndexAge returns how long ago the cached index of repoURI, for the architecture of a, was
+// downloaded or last revalidated with the repository. It returns an error wrapping
+// fs.ErrNotExist if no cache is configured or the index is not in it.
+func (a *APK) IndexAge(_ context.Context, repoURI string) (time.Duration, error) {
+	if a.cache == nil {
+		return 0, fmt.Errorf("no cache configured: %w", fs.ErrNotExist)
+	}
+	spec, err := ParseRepoSpec(repoURI)
+	if err != nil {
+		return 0, err
+	}
+	u, err := url.Parse(IndexURL(spec.URI, a.arch))
+	if err != nil {
+		return 0, fmt.Errorf("parsing repository %s: %w", redactURL(spec.URI), err)
+	}
+	cacheFile, err := cachePathFromURL(a.cache.dir, *u)
+	if err != nil {
+		return 0, err
+	}
+	_, fi, err := newestCachedIndex(cacheFile)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(fi.ModTime()), nil
+}
+
+// newestCachedIndex returns the path and file info of the newest copy of the index cached at
+// cacheFile: the copy revalidated with Last-Modified if there is one, otherwise the newest of
+// the copies stored by etag. It returns an error wrapping fs.ErrNotExist if there is none.
+func newestCachedIndex(cacheFile string) (string, os.FileInfo, error) {
+	// Files revalidated with Last-Modified live at cacheFile itself.
+	if _, err := os.Stat(lastmodFile(cacheFile)); err == nil {
+		fi, err := os.Stat(cacheFile)
+		if err != nil {
+			return "", nil, err
+		}
+		return cacheFile, fi, nil
+	}
+
+	cacheDir := cacheDirFromFile(cacheFile)
+	des, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("listing %q: %w", cacheDir, err)
+	}
+	if len(des) == 0 {
+		return "", nil, fmt.Errorf("no cached entries for %s: %w", cacheDir, fs.ErrNotExist)
+	}
+
+	newest, err := des[0].Info()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, de := range des[1:] {
+		fi, err := de.Info()
+		if err != nil {
+			return "", nil, err
+		}
+		if fi.ModTime().After(newest.ModTime()) {
+			newest = fi
+		}
+	}
+	return filepath.Join(cacheDir, newest.Name()), newest, nil
+}
+
+// touchCached records that the cached file was just revalidated, which IndexAge reports on.
+func touchCached(cacheFile string) {
+	now := time.Now()
+	_ = os.Chtimes(cacheFile, now, now)
+}
+
+// checkIndexAges enforces WithMaxIndexAge and WithIndexCacheTTL for the cached indexes of repos.
+// Stale indexes are forgotten by this process, so that they are revalidated with the repository
+// when they are next fetched. In offline mode they cannot be, so an index older than the maximum
+// age is an error, while one past its TTL is used as it is.
+func (a *APK) checkIndexAges(ctx context.Context, repos []string) error {
+	if (a.maxIndexAge <= 0 && a.indexCacheTTL <= 0) || a.cache == nil {
+		return nil
+	}
+	for _, repo := range repos {
+		spec, err := ParseRepoSpec(repo)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(spec.URI, "https://") && !strings.HasPrefix(spec.URI, "http://") {
+			// Only indexes downloaded over HTTP are cached.
+			continue
+		}
+		age, err := a.IndexAge(ctx, repo)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		tooOld := a.maxIndexAge > 0 && age > a.maxIndexAge
+		expired := a.indexCacheTTL > 0 && age > a.indexCacheTTL
+		switch {
+		case tooOld && a.offline:
+			return fmt.Errorf("%w: cached index of %s is %s old, more than the maximum of %s", ErrOffline, redactURL(spec.URI), age.Round(time.Second), a.maxIndexAge)
+		case tooOld, expired && !a.offline:
+		default:
+			continue
+		}
+		a.log(ctx).Debugf("cached index of %s is %s old, revalidating", redactURL(spec.URI), age.Round(time.Second))
+		u := IndexURL(spec.URI, a.arch)
+		globalEtagCache.forget(u)
+		globalIndexCache.forget(u)
+	}
+	return nil
+}
+
+// forget drops the result for url, so that the next request for it goes to the server again.
+func (e *etagCache) forget(url string) {
+	e.etags.Delete(url)
+	e.resps.Delete(url)
+}
+
+// forget drops the remote index at u, whether or not its signature was checked, so that the next
+// get fetches it again.
+func (i *indexCache) forget(u string) {
+	for _, key := range []string{u, u + " (unverified)"} {
+		i.onces.Delete(key)
+		i.indexes.Delete(key)
+	}
+}
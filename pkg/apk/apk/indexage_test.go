@@ -0,0 +1,202 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testMethodTransport records the method of each request it passes on.
+type testMethodTransport struct {
+	wrapped http.RoundTripper
+	mu      sync.Mutex
+	methods []string
+}
+
+func (t *testMethodTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.methods = append(t.methods, request.Method)
+	t.mu.Unlock()
+	return t.wrapped.RoundTrip(request)
+}
+
+func (t *testMethodTransport) reset() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	methods := t.methods
+	t.methods = nil
+	return methods
+}
+
+func TestMaxIndexAge(t *testing.T) {
+	ctx := context.Background()
+	globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+	t.Cleanup(func() { globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{} })
+
+	cacheDir := t.TempDir()
+	transport := &testMethodTransport{wrapped: &testLocalTransport{
+		root:         testPrimaryPkgDir,
+		basenameOnly: true,
+		headers:      map[string][]string{http.CanonicalHeaderKey("etag"): {"an-etag"}},
+	}}
+	newAPK := func(t *testing.T, options ...Option) *APK {
+		a, _ := testAPKWithRepos(t, []string{testAlpineRepos}, options...)
+		a.SetClient(&http.Client{Transport: transport})
+		return a
+	}
+	etagFile := filepath.Join(cacheDir, url.QueryEscape(testAlpineRepos), testArch, "APKINDEX", "an-etag.tar.gz")
+	age := func(d time.Duration) {
+		then := time.Now().Add(-d)
+		require.NoError(t, os.Chtimes(etagFile, then, then))
+	}
+
+	a := newAPK(t, WithCache(cacheDir, false), WithMaxIndexAge(time.Hour))
+	_, err := a.IndexAge(ctx, testAlpineRepos)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = a.GetRepositoryIndexes(ctx, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{http.MethodHead, http.MethodGet}, transport.reset())
+	indexAge, err := a.IndexAge(ctx, testAlpineRepos)
+	require.NoError(t, err)
+	require.Less(t, indexAge, time.Minute)
+
+	t.Run("fresh index is reused", func(t *testing.T) {
+		_, err := a.GetRepositoryIndexes(ctx, true)
+		require.NoError(t, err)
+		require.Empty(t, transport.reset())
+	})
+
+	t.Run("aged index is revalidated", func(t *testing.T) {
+		age(2 * time.Hour)
+		indexAge, err := a.IndexAge(ctx, testAlpineRepos)
+		require.NoError(t, err)
+		require.Greater(t, indexAge, time.Hour)
+
+		_, err = a.GetRepositoryIndexes(ctx, true)
+		require.NoError(t, err)
+		// The etag still matches, so the cached copy is kept and only its age is reset.
+		require.Equal(t, []string{http.MethodHead}, transport.reset())
+		indexAge, err = a.IndexAge(ctx, testAlpineRepos)
+		require.NoError(t, err)
+		require.Less(t, indexAge, time.Minute)
+	})
+
+	t.Run("no maximum age", func(t *testing.T) {
+		age(2 * time.Hour)
+		_, err := newAPK(t, WithCache(cacheDir, false)).GetRepositoryIndexes(ctx, true)
+		require.NoError(t, err)
+		require.Empty(t, transport.reset())
+	})
+
+	t.Run("offline", func(t *testing.T) {
+		age(2 * time.Hour)
+		_, err := newAPK(t, WithCache(cacheDir, true), WithMaxIndexAge(time.Hour)).GetRepositoryIndexes(ctx, true)
+		require.ErrorIs(t, err, ErrOffline)
+
+		_, err = newAPK(t, WithCache(cacheDir, true), WithMaxIndexAge(3*time.Hour)).GetRepositoryIndexes(ctx, true)
+		require.NoError(t, err)
+		require.Empty(t, transport.reset())
+	})
+}
+
+func TestIndexCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+	t.Cleanup(func() { globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{} })
+
+	cacheDir := t.TempDir()
+	transport := &testMethodTransport{wrapped: &testLocalTransport{
+		root:         testPrimaryPkgDir,
+		basenameOnly: true,
+		headers:      map[string][]string{http.CanonicalHeaderKey("etag"): {"an-etag"}},
+	}}
+	newAPK := func(t *testing.T) *APK {
+		// Each APK stands in for a new process, which has not seen the index yet.
+		globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+		a, _ := testAPKWithRepos(t, []string{testAlpineRepos}, WithCache(cacheDir, false), WithIndexCacheTTL(time.Hour))
+		a.SetClient(&http.Client{Transport: transport})
+		return a
+	}
+	archDir := filepath.Join(cacheDir, url.QueryEscape(testAlpineRepos), testArch)
+	age := func(file string, d time.Duration) {
+		then := time.Now().Add(-d)
+		require.NoError(t, os.Chtimes(filepath.Join(archDir, file), then, then))
+	}
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+	fetch := func(t *testing.T, a *APK) {
+		rc, err := a.FetchPackage(ctx, pkg)
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+	}
+
+	a := newAPK(t)
+	_, err := a.GetRepositoryIndexes(ctx, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{http.MethodHead, http.MethodGet}, transport.reset())
+	fetch(t, a)
+	require.Equal(t, []string{http.MethodGet}, transport.reset())
+
+	t.Run("within the TTL", func(t *testing.T) {
+		age(filepath.Join("APKINDEX", "an-etag.tar.gz"), 59*time.Minute)
+		_, err := newAPK(t).GetRepositoryIndexes(ctx, true)
+		require.NoError(t, err)
+		require.Empty(t, transport.reset())
+	})
+
+	t.Run("past the TTL", func(t *testing.T) {
+		age(filepath.Join("APKINDEX", "an-etag.tar.gz"), 61*time.Minute)
+		age(testPkgFilename, 61*time.Minute)
+		a := newAPK(t)
+		_, err := a.GetRepositoryIndexes(ctx, true)
+		require.NoError(t, err)
+		// The etag still matches, so only a revalidation is made.
+		require.Equal(t, []string{http.MethodHead}, transport.reset())
+		indexAge, err := a.IndexAge(ctx, testAlpineRepos)
+		require.NoError(t, err)
+		require.Less(t, indexAge, time.Minute)
+
+		// Packages are not revalidated, however old.
+		fetch(t, a)
+		require.Empty(t, transport.reset())
+	})
+
+	t.Run("past the TTL in a running process", func(t *testing.T) {
+		a := newAPK(t)
+		_, err := a.GetRepositoryIndexes(ctx, true)
+		require.NoError(t, err)
+		require.Empty(t, transport.reset())
+
+		age(filepath.Join("APKINDEX", "an-etag.tar.gz"), 61*time.Minute)
+		_, err = a.GetRepositoryIndexes(ctx, true)
+		require.NoError(t, err)
+		require.Equal(t, []string{http.MethodHead}, transport.reset())
+	})
+}
@@ -28,6 +28,7 @@ import (
 	"strings"
 
 	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
 
 	"chainguard.dev/apko/pkg/apk/internal/tarfs"
 )
@@ -68,7 +69,7 @@ func (a *APK) writeOneFile(header *tar.Header, r io.Reader, allowOverwrite bool)
 }
 
 // installRegularFile handles the various error modes of writing a regular file
-func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir string, pkg *Package) (bool, error) {
+func (a *APK) installRegularFile(header *tar.Header, tr io.Reader, tmpDir string, pkg *Package) (bool, error) {
 	checksum, err := checksumFromHeader(header)
 	if err != nil {
 		return false, err
@@ -112,7 +113,13 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 	if err := a.writeOneFile(header, r, false); err != nil {
 		// If the error is something other than the file exists, return the error.
 		var fileExistsError FileExistsError
-		if !errors.As(err, &fileExistsError) || pkg.Origin == "" {
+		if !errors.As(err, &fileExistsError) {
+			return false, err
+		}
+		if pkg.Origin == "" {
+			if pk, ok := a.fileOwner(header.Name); ok {
+				return false, &FileConflictError{Path: header.Name, Owner: pk.Name, Conflict: pkg.Name}
+			}
 			return false, err
 		}
 
@@ -127,7 +134,7 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 		// 2. The packages are in the same origin.
 
 		// If the existing file's package replaces the package we want to install, we don't need to write this file.
-		pk, ok := a.installedFiles[header.Name]
+		pk, ok := a.fileOwner(header.Name)
 		if !ok {
 			return false, fmt.Errorf("found existing file we did not install (this should never happen): %s", header.Name)
 		}
@@ -141,7 +148,7 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 		// Otherwise, we can only overwrite the file if it's in the same origin or if it replaces the existing package.
 		_, isReplaced := replaceMap[pk.Name]
 		if pk.Origin != pkg.Origin && !isReplaced {
-			return false, fmt.Errorf("unable to install file over existing one, different contents: %s", header.Name)
+			return false, &FileConflictError{Path: header.Name, Owner: pk.Name, Conflict: pkg.Name}
 		}
 
 		if err := a.writeOneFile(header, r, true); err != nil {
@@ -178,8 +185,8 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 	_, span := otel.Tracer("go-apk").Start(ctx, "installAPKFiles")
 	defer span.End()
 
-	var files []tar.Header
-	tmpDir, err := os.MkdirTemp("", "apk-install")
+	var headers []*tar.Header
+	tmpDir, err := os.MkdirTemp(a.workDir, "apk-install")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
 	}
@@ -191,8 +198,21 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 	//  * This does not make any sense if the file has v2.0
 	//  * style .PKGINFO
 	var startedDataSection bool
+	excludes := newExcludeTracker()
+	var writers *fileWriters
+	if a.parallelExpand > 1 {
+		writers = newFileWriters(ctx, a.parallelExpand)
+		// nothing may be left writing when this returns, as tmpDir goes away
+		defer func() { _ = writers.wait() }()
+	}
 	tr := tar.NewReader(in)
 	for {
+		if writers != nil && writers.failed() {
+			if err := writers.wait(); err != nil {
+				return nil, err
+			}
+			return nil, ctx.Err()
+		}
 		header, err := tr.Next()
 		if errors.Is(err, io.EOF) {
 			break
@@ -207,9 +227,15 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 		}
 		// whatever it is now, it is in the data section
 		startedDataSection = true
+		if a.excluded(header.Name) {
+			excludes.exclude(header.Name)
+			continue
+		}
+		a.remapOwner(header)
 
 		switch header.Typeflag {
 		case tar.TypeDir:
+			a.trackCreatedDir(excludes, header.Name)
 			// special case, if the target already exists, and it is a symlink to a directory, we can accept it as is
 			// otherwise, we need to create the directory.
 			if fi, err := a.fs.Stat(header.Name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
@@ -223,6 +249,9 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 			if err := a.fs.MkdirAll(header.Name, header.FileInfo().Mode().Perm()); err != nil {
 				return nil, fmt.Errorf("error creating directory %s: %w", header.Name, err)
 			}
+			if err := a.chownRemapped(header); err != nil {
+				return nil, err
+			}
 			// xattrs
 			for k, v := range header.PAXRecords {
 				if !strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
@@ -235,13 +264,25 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 			}
 
 		case tar.TypeReg:
-			installed, err := a.installRegularFile(header, tr, tmpDir, pkg)
-			if err != nil {
-				return nil, err
+			if writers != nil && header.Size <= maxBufferedFileSize {
+				if writers.pending[header.Name] {
+					// the same path again, which must be written after the first
+					if err := writers.wait(); err != nil {
+						return nil, err
+					}
+				}
+				content, err := io.ReadAll(tr)
+				if err != nil {
+					return nil, fmt.Errorf("error reading %s: %w", header.Name, err)
+				}
+				writers.pending[header.Name] = true
+				writers.g.Go(func() error {
+					return a.installRegularEntry(header, bytes.NewReader(content), tmpDir, pkg)
+				})
+				break
 			}
-
-			if installed {
-				a.installedFiles[header.Name] = pkg
+			if err := a.installRegularEntry(header, tr, tmpDir, pkg); err != nil {
+				return nil, err
 			}
 
 		case tar.TypeSymlink:
@@ -255,6 +296,12 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 				return nil, fmt.Errorf("unable to install symlink from %s -> %s: %w", header.Name, header.Linkname, err)
 			}
 		case tar.TypeLink:
+			if writers != nil {
+				// the target may still be being written
+				if err := writers.wait(); err != nil {
+					return nil, err
+				}
+			}
 			if err := a.fs.Link(header.Linkname, header.Name); err != nil {
 				return nil, err
 			}
@@ -262,10 +309,107 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 			return nil, fmt.Errorf("unsupported file type %s %v", header.Name, header.Typeflag)
 		}
 
+		headers = append(headers, header)
+	}
+	if writers != nil {
+		if err := writers.wait(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the writers fill in the checksums of regular files, so the headers are copied once they are done
+	files := make([]tar.Header, 0, len(headers))
+	for _, header := range headers {
 		files = append(files, *header)
 	}
+	return a.pruneExcluded(excludes, files)
+}
+
+// installRegularEntry installs the regular file for header with the content in r, and records
+// pkg as its owner.
+func (a *APK) installRegularEntry(header *tar.Header, r io.Reader, tmpDir string, pkg *Package) error {
+	if a.dedupe != nil {
+		linked, err := a.linkDuplicate(header)
+		if err != nil {
+			return err
+		}
+		if linked {
+			a.setFileOwner(header.Name, pkg)
+			return nil
+		}
+	}
+
+	installed, err := a.installRegularFile(header, r, tmpDir, pkg)
+	if err != nil {
+		return err
+	}
+	if !installed {
+		return nil
+	}
+	if err := a.chownRemapped(header); err != nil {
+		return err
+	}
+	a.setFileOwner(header.Name, pkg)
+	if a.dedupe != nil {
+		if err := a.dedupe.record(header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxBufferedFileSize is the largest file that is read into memory to be written by one of the
+// WithParallelExpand writers. Larger files are written as they are read.
+const maxBufferedFileSize = 8 << 20
+
+// fileWriters writes regular files of a package concurrently.
+type fileWriters struct {
+	ctx context.Context
+	n   int
+	g   *errgroup.Group
+	// done once a write fails
+	gctx context.Context
+	// the paths being written since the last wait
+	pending map[string]bool
+}
 
-	return files, nil
+func newFileWriters(ctx context.Context, n int) *fileWriters {
+	w := &fileWriters{ctx: ctx, n: n}
+	w.reset()
+	return w
+}
+
+func (w *fileWriters) reset() {
+	w.g, w.gctx = errgroup.WithContext(w.ctx)
+	w.g.SetLimit(w.n)
+	w.pending = map[string]bool{}
+}
+
+// failed reports whether a write has failed, so that no more should be started.
+func (w *fileWriters) failed() bool {
+	return w.gctx.Err() != nil
+}
+
+// wait blocks until every file being written is done, and returns the first error.
+func (w *fileWriters) wait() error {
+	err := w.g.Wait()
+	w.reset()
+	return err
+}
+
+// fileOwner returns the package that installed the file name, if any.
+func (a *APK) fileOwner(name string) (*Package, bool) {
+	a.installedMu.Lock()
+	defer a.installedMu.Unlock()
+	pkg, ok := a.installedFiles[name]
+	return pkg, ok
+}
+
+// setFileOwner records that pkg installed the file name.
+func (a *APK) setFileOwner(name string, pkg *Package) {
+	a.installedMu.Lock()
+	defer a.installedMu.Unlock()
+	a.installedFiles[name] = pkg
 }
 
 func checksumFromHeader(header *tar.Header) ([]byte, error) {
@@ -312,6 +456,7 @@ func (a *APK) lazilyInstallAPKFiles(ctx context.Context, wh WriteHeaderer, tf *t
 	files := make([]tar.Header, 0, len(entries))
 
 	var startedDataSection bool
+	excludes := newExcludeTracker()
 	for _, file := range entries {
 		// per https://git.alpinelinux.org/apk-tools/tree/src/extract_v2.c?id=337734941831dae9a6aa441e38611c43a5fd72c0#n120
 		//  * APKv1.0 compatibility - first non-hidden file is
@@ -324,17 +469,27 @@ func (a *APK) lazilyInstallAPKFiles(ctx context.Context, wh WriteHeaderer, tf *t
 		// whatever it is now, it is in the data section
 		startedDataSection = true
 
-		installed, err := wh.WriteHeader(file.Header, tf, pkg)
+		header := file.Header
+		if a.excluded(header.Name) {
+			excludes.exclude(header.Name)
+			continue
+		}
+		if header.Typeflag == tar.TypeDir {
+			a.trackCreatedDir(excludes, header.Name)
+		}
+		a.remapOwner(&header)
+
+		installed, err := wh.WriteHeader(header, tf, pkg)
 		if err != nil {
 			return nil, err
 		}
 
-		if installed && file.Header.Typeflag == tar.TypeReg {
-			a.installedFiles[file.Header.Name] = pkg
+		if installed && header.Typeflag == tar.TypeReg {
+			a.setFileOwner(header.Name, pkg)
 		}
 
-		files = append(files, file.Header)
+		files = append(files, header)
 	}
 
-	return files, nil
+	return a.pruneExcluded(excludes, files)
 }
@@ -22,10 +22,13 @@ import (
 	"crypto/sha1" //nolint:gosec // this is what apk tools is using
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"sort"
+	"strings"
 	"testing"
 	"text/template"
 
@@ -172,7 +175,9 @@ func TestInstallAPKFiles(t *testing.T) {
 			})
 
 			err = apk.InstallPackages(context.Background(), nil, []InstallablePackage{fp1, fp2})
-			require.Error(t, err, "some double-write error")
+			var conflict *FileConflictError
+			require.ErrorAs(t, err, &conflict)
+			require.Equal(t, &FileConflictError{Path: overwriteFilename, Owner: "first", Conflict: "second"}, conflict)
 
 			actual, err := src.ReadFile(overwriteFilename)
 			require.NoError(t, err, "error reading %s", overwriteFilename)
@@ -180,6 +185,25 @@ func TestInstallAPKFiles(t *testing.T) {
 
 			checkDuplicateIDBEntries(t, apk)
 		})
+		t.Run("no origin and different content", func(t *testing.T) {
+			apk, _, err := testGetTestAPK()
+			require.NoErrorf(t, err, "failed to get test APK")
+			overwriteFilename := "etc/doublewrite"
+
+			fp1 := fakePackage(t, &Package{Name: "first"}, []testDirEntry{
+				{"etc", 0o755, true, nil, nil},
+				{overwriteFilename, 0o755, false, []byte("hello world"), nil},
+			})
+			fp2 := fakePackage(t, &Package{Name: "second"}, []testDirEntry{
+				{"etc", 0o755, true, nil, nil},
+				{overwriteFilename, 0o755, false, []byte("extra long I am here"), nil},
+			})
+
+			err = apk.InstallPackages(context.Background(), nil, []InstallablePackage{fp1, fp2})
+			var conflict *FileConflictError
+			require.ErrorAs(t, err, &conflict)
+			require.Equal(t, &FileConflictError{Path: overwriteFilename, Owner: "first", Conflict: "second"}, conflict)
+		})
 		t.Run("different origin and content, but with replaces", func(t *testing.T) {
 			apk, src, err := testGetTestAPK()
 			require.NoErrorf(t, err, "failed to get test APK")
@@ -358,8 +382,23 @@ func fakePackage(t *testing.T, pkg *Package, entries []testDirEntry) Installable
 		t.Fatal(err)
 	}
 
-	h := sha1.New() //nolint:gosec
+	// Write the data section first, so that its hash can go into .PKGINFO.
+	var data bytes.Buffer
 	dh := sha256.New()
+	dzw := gzip.NewWriter(io.MultiWriter(&data, dh))
+	dtw := tar.NewWriter(dzw)
+	if err := writeFiles(dtw, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := dtw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pkg.DataHash = hex.EncodeToString(dh.Sum(nil))
+
+	h := sha1.New() //nolint:gosec
 
 	mw := io.MultiWriter(f, h)
 
@@ -384,26 +423,34 @@ func fakePackage(t *testing.T, pkg *Package, entries []testDirEntry) Installable
 		t.Fatal(err)
 	}
 
-	if err := tw.Flush(); err != nil {
-		t.Fatal(err)
+	scripts := make([]string, 0, len(pkg.Scripts))
+	for name := range pkg.Scripts {
+		scripts = append(scripts, name)
 	}
-
-	if err := zw.Close(); err != nil {
-		t.Fatal(err)
+	sort.Strings(scripts)
+	for _, name := range scripts {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o755,
+			Size:     int64(len(pkg.Scripts[name])),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(pkg.Scripts[name]); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	mw = io.MultiWriter(f, dh)
-	zw.Reset(mw)
-
-	if err := writeFiles(tw, entries); err != nil {
+	if err := tw.Flush(); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := tw.Close(); err != nil {
+	if err := zw.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := zw.Close(); err != nil {
+	if _, err := f.Write(data.Bytes()); err != nil {
 		t.Fatal(err)
 	}
 
@@ -411,8 +458,6 @@ func fakePackage(t *testing.T, pkg *Package, entries []testDirEntry) Installable
 		t.Fatal(err)
 	}
 
-	pkg.DataHash = base64.StdEncoding.EncodeToString(dh.Sum(nil))
-
 	return &testPackage{
 		pkg:      pkg,
 		file:     f.Name(),
@@ -498,4 +543,56 @@ replaces = {{ $dep }}
 provider_priority = {{ .Dependencies.ProviderPriority }}
 {{- end }}
 datahash = {{.DataHash}}
+{{- range $trigger := .Triggers }}
+triggers = {{ $trigger }}
+{{- end }}
 `
+
+func TestParallelExpand(t *testing.T) {
+	ctx := context.Background()
+	entries := []testDirEntry{{"usr", 0o755, true, nil, nil}}
+	want := map[string]string{}
+	for d := range 8 {
+		dir := fmt.Sprintf("usr/dir%d", d)
+		entries = append(entries, testDirEntry{dir, 0o755, true, nil, nil})
+		for f := range 32 {
+			name := fmt.Sprintf("%s/file%d", dir, f)
+			content := strings.Repeat(name, f+1)
+			entries = append(entries, testDirEntry{name, 0o644, false, []byte(content), nil})
+			want[name] = content
+		}
+	}
+
+	for _, n := range []int{0, 1, 4, 16} {
+		t.Run(fmt.Sprintf("%d workers", n), func(t *testing.T) {
+			a, src := testAPKWithRepos(t, nil, WithParallelExpand(n))
+			fp := fakePackage(t, &Package{Name: "many", Version: "1.0.0-r0", Arch: testArch, Origin: "many"}, entries)
+			require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{fp}))
+
+			for name, content := range want {
+				b, err := src.ReadFile(name)
+				require.NoError(t, err)
+				require.Equal(t, content, string(b), "wrong content for %s", name)
+			}
+			owned, err := a.OwnedFiles(ctx, "many")
+			require.NoError(t, err)
+			require.Len(t, owned, len(want))
+			checkDuplicateIDBEntries(t, a)
+
+			// A package from another origin that writes one of the same files still conflicts.
+			conflicting := fakePackage(t, &Package{Name: "other", Version: "1.0.0-r0", Arch: testArch, Origin: "other"}, []testDirEntry{
+				{"usr", 0o755, true, nil, nil},
+				{"usr/dir3", 0o755, true, nil, nil},
+				{"usr/dir3/new", 0o644, false, []byte("new"), nil},
+				{"usr/dir3/file7", 0o644, false, []byte("different"), nil},
+			})
+			err = a.InstallPackages(ctx, nil, []InstallablePackage{conflicting})
+			var conflict *FileConflictError
+			require.ErrorAs(t, err, &conflict)
+			require.Equal(t, &FileConflictError{Path: "usr/dir3/file7", Owner: "many", Conflict: "other"}, conflict)
+			b, err := src.ReadFile("usr/dir3/file7")
+			require.NoError(t, err)
+			require.Equal(t, want["usr/dir3/file7"], string(b))
+		})
+	}
+}
@@ -17,19 +17,24 @@ package apk
 import (
 	"archive/tar"
 	"bufio"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/apko/pkg/apk/expandapk"
 )
 
 type InstalledPackage struct {
@@ -47,6 +52,90 @@ func (a *APK) GetInstalled() ([]*InstalledPackage, error) {
 	return ParseInstalled(installedFile)
 }
 
+// InstalledPackages returns the packages recorded in the installed database of the target
+// filesystem, in installation order, each with the files it owns.
+func (a *APK) InstalledPackages(ctx context.Context) ([]*InstalledPackage, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "InstalledPackages")
+	defer span.End()
+
+	return a.GetInstalled()
+}
+
+// OwnedFiles returns the paths of the files, symlinks and other non-directory entries that the
+// installed package pkgName owns according to the installed database, in database order. It
+// returns an error wrapping fs.ErrNotExist if the package is not installed.
+func (a *APK) OwnedFiles(ctx context.Context, pkgName string) ([]string, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "OwnedFiles")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range installed {
+		if pkg.Name != pkgName {
+			continue
+		}
+		files := []string{}
+		for _, f := range pkg.Files {
+			if f.Typeflag != tar.TypeDir {
+				files = append(files, f.Name)
+			}
+		}
+		return files, nil
+	}
+	return nil, fmt.Errorf("package %s is not installed: %w", pkgName, fs.ErrNotExist)
+}
+
+// InstalledByOrigin returns the installed packages grouped by their origin, the package they were
+// built from, in installation order within each group. Subpackages share the origin of their
+// main package. A package without an origin is its own origin.
+func (a *APK) InstalledByOrigin(ctx context.Context) (map[string][]*InstalledPackage, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "InstalledByOrigin")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, err
+	}
+	byOrigin := make(map[string][]*InstalledPackage)
+	for _, pkg := range installed {
+		origin := pkg.Origin
+		if origin == "" {
+			origin = pkg.Name
+		}
+		byOrigin[origin] = append(byOrigin[origin], pkg)
+	}
+	return byOrigin, nil
+}
+
+// FileOwner returns the name of the installed package that owns path according to the installed
+// database. Paths may be given with or without a leading slash. If several packages list path,
+// the last one installed owns it. It returns an error wrapping fs.ErrNotExist if no installed
+// package owns path.
+func (a *APK) FileOwner(ctx context.Context, path string) (string, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "FileOwner")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return "", err
+	}
+	want := strings.TrimPrefix(filepath.Clean("/"+path), "/")
+	owner := ""
+	for _, pkg := range installed {
+		for _, f := range pkg.Files {
+			if f.Typeflag != tar.TypeDir && f.Name == want {
+				owner = pkg.Name
+			}
+		}
+	}
+	if owner == "" {
+		return "", fmt.Errorf("%s is not owned by any installed package: %w", path, fs.ErrNotExist)
+	}
+	return owner, nil
+}
+
 // addInstalledPackage add a package to the list of installed packages
 func (a *APK) AddInstalledPackage(pkg *Package, files []tar.Header) error {
 	// be sure to open the file in append mode so we add to the end
@@ -113,11 +202,57 @@ func (a *APK) isInstalledPackage(pkg string) (bool, error) {
 	return false, nil
 }
 
+// installedByName returns the installed packages by name, or none if there is no installed database.
+func (a *APK) installedByName() (map[string]*InstalledPackage, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading installed packages: %w", err)
+	}
+	byName := make(map[string]*InstalledPackage, len(installed))
+	for _, pkg := range installed {
+		byName[pkg.Name] = pkg
+	}
+	return byName, nil
+}
+
+// alreadyInstalled reports whether pkg is installed at the same version. Packages are compared
+// by checksum when both sides have one, and by version otherwise.
+func alreadyInstalled(installed map[string]*InstalledPackage, pkg InstallablePackage) bool {
+	current, ok := installed[pkg.PackageName()]
+	if !ok {
+		return false
+	}
+	if sum, currentSum := pkg.ChecksumString(), current.ChecksumString(); sum != "" && currentSum != "" {
+		return sum == currentSum
+	}
+	if rp, ok := pkg.(*RepositoryPackage); ok {
+		return rp.Version == current.Version
+	}
+	return false
+}
+
+// SkippedPackages returns the names of the packages that the last InstallPackages call did not
+// fetch, because they were already installed at the same version.
+func (a *APK) SkippedPackages() []string {
+	a.skippedMu.Lock()
+	defer a.skippedMu.Unlock()
+	return slices.Clone(a.skipped)
+}
+
+func (a *APK) setSkipped(skipped []string) {
+	a.skippedMu.Lock()
+	defer a.skippedMu.Unlock()
+	a.skipped = skipped
+}
+
 // updateScriptsTar insert the scripts into the tarball
 func (a *APK) updateScriptsTar(pkg *Package, controlTarGz io.Reader, sourceDateEpoch *time.Time) error {
-	gz, err := gzip.NewReader(controlTarGz)
+	gz, err := expandapk.NewDecompressor(controlTarGz)
 	if err != nil {
-		return fmt.Errorf("unable to gunzip control tar.gz file: %w", err)
+		return fmt.Errorf("unable to decompress control tar.gz file: %w", err)
 	}
 	defer gz.Close()
 	tr := tar.NewReader(gz)
@@ -184,9 +319,9 @@ func (a *APK) readScriptsTar() (io.ReadCloser, error) {
 
 // TODO: We should probably parse control section on the first pass and reuse it.
 func (a *APK) controlValue(controlTarGz io.Reader, want string) ([]string, error) {
-	gz, err := gzip.NewReader(controlTarGz)
+	gz, err := expandapk.NewDecompressor(controlTarGz)
 	if err != nil {
-		return nil, fmt.Errorf("unable to gunzip control tar file: %w", err)
+		return nil, fmt.Errorf("unable to decompress control tar file: %w", err)
 	}
 	defer gz.Close()
 
@@ -288,12 +423,11 @@ func ParseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 		case "c":
 			pkg.RepoCommit = val
 		case "t":
-			i, err := strconv.ParseInt(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse build time %s: %w", val, err)
+			// A build time that cannot be parsed is treated as unknown.
+			if i, err := strconv.ParseInt(val, 10, 64); err == nil {
+				pkg.BuildDate = i
+				pkg.BuildTime = buildTime(i)
 			}
-			pkg.BuildDate = i
-			pkg.BuildTime = time.Unix(i, 0).UTC()
 		case "i":
 			pkg.InstallIf = strings.Split(val, " ")
 		case "S":
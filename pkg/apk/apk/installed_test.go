@@ -19,11 +19,13 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"strings"
 	"testing"
 	"time"
@@ -104,6 +106,107 @@ func TestAddInstalledPackage(t *testing.T) {
 	require.Contains(t, str, want)
 }
 
+func TestInstalledPackages(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testAPKWithRepos(t, nil)
+
+	fp1 := fakePackage(t, &Package{Name: "first", Version: "1.0.0-r0", Arch: testArch}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/first", 0o644, false, []byte("first"), nil},
+	})
+	fp2 := fakePackage(t, &Package{Name: "second", Version: "2.0.0-r0", Arch: testArch}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/second", 0o644, false, []byte("second"), nil},
+	})
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{fp1, fp2}))
+
+	pkgs, err := a.InstalledPackages(ctx)
+	require.NoError(t, err)
+
+	got := map[string][]string{}
+	for _, pkg := range pkgs {
+		require.Equal(t, testArch, pkg.Arch)
+		key := pkg.Name + "-" + pkg.Version
+		for _, f := range pkg.Files {
+			got[key] = append(got[key], f.Name)
+		}
+	}
+	require.Equal(t, map[string][]string{
+		"first-1.0.0-r0":  {"etc", "etc/first"},
+		"second-2.0.0-r0": {"usr", "usr/second"},
+	}, got)
+}
+
+func TestFileOwnership(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testAPKWithRepos(t, nil)
+
+	fp1 := fakePackage(t, &Package{Name: "first", Version: "1.0.0-r0", Arch: testArch}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/first", 0o644, false, []byte("first"), nil},
+		{"etc/first.conf", 0o644, false, []byte("conf"), nil},
+	})
+	fp2 := fakePackage(t, &Package{Name: "second", Version: "2.0.0-r0", Arch: testArch}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"usr", 0o755, true, nil, nil},
+		{"usr/second", 0o644, false, []byte("second"), nil},
+	})
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{fp1, fp2}))
+
+	files, err := a.OwnedFiles(ctx, "first")
+	require.NoError(t, err)
+	require.Equal(t, []string{"etc/first", "etc/first.conf"}, files)
+	files, err = a.OwnedFiles(ctx, "second")
+	require.NoError(t, err)
+	require.Equal(t, []string{"usr/second"}, files)
+	_, err = a.OwnedFiles(ctx, "third")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	for path, want := range map[string]string{
+		"etc/first.conf": "first",
+		"/usr/second":    "second",
+	} {
+		owner, err := a.FileOwner(ctx, path)
+		require.NoError(t, err)
+		require.Equal(t, want, owner, path)
+	}
+	for _, path := range []string{"etc", "etc/unmanaged", "lib/apk/db/installed"} {
+		_, err := a.FileOwner(ctx, path)
+		require.ErrorIs(t, err, fs.ErrNotExist, path)
+	}
+}
+
+func TestInstalledByOrigin(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testAPKWithRepos(t, nil)
+
+	var pkgs []InstallablePackage
+	for _, pkg := range []*Package{
+		{Name: "openssl", Version: "3.1.0-r0", Arch: testArch, Origin: "openssl"},
+		{Name: "libcrypto3", Version: "3.1.0-r0", Arch: testArch, Origin: "openssl"},
+		{Name: "busybox", Version: "1.36.0-r0", Arch: testArch, Origin: "busybox"},
+		{Name: "libssl3", Version: "3.1.0-r0", Arch: testArch, Origin: "openssl"},
+		{Name: "standalone", Version: "1.0.0-r0", Arch: testArch},
+	} {
+		pkgs = append(pkgs, fakePackage(t, pkg, nil))
+	}
+	require.NoError(t, a.InstallPackages(ctx, nil, pkgs))
+
+	byOrigin, err := a.InstalledByOrigin(ctx)
+	require.NoError(t, err)
+	names := map[string][]string{}
+	for origin, installed := range byOrigin {
+		for _, pkg := range installed {
+			names[origin] = append(names[origin], pkg.Name)
+		}
+	}
+	require.Equal(t, map[string][]string{
+		"openssl":    {"openssl", "libcrypto3", "libssl3"},
+		"busybox":    {"busybox"},
+		"standalone": {"standalone"},
+	}, names)
+}
+
 func TestIsInstalledPackage(t *testing.T) {
 	a, _, err := testGetTestAPK()
 	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
@@ -354,3 +457,41 @@ func TestSortTarHeaders(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildTime(t *testing.T) {
+	const db = `P:dated
+V:1.0.0-r0
+t:1700000000
+
+P:undated
+V:1.0.0-r0
+
+P:garbled
+V:1.0.0-r0
+t:yesterday
+
+`
+	want := map[string]time.Time{
+		"dated":   time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC),
+		"undated": {},
+		"garbled": {},
+	}
+
+	installed, err := ParseInstalled(strings.NewReader(db))
+	require.NoError(t, err)
+	require.Len(t, installed, len(want))
+	for _, pkg := range installed {
+		require.Equal(t, want[pkg.Name], pkg.BuildTime, pkg.Name)
+	}
+
+	indexed, err := ParsePackageIndex(strings.NewReader(db))
+	require.NoError(t, err)
+	require.Len(t, indexed, len(want))
+	for _, pkg := range indexed {
+		require.Equal(t, want[pkg.Name], pkg.BuildTime, pkg.Name)
+	}
+
+	// An unknown build time is written back as 0.
+	require.Contains(t, PackageToInstalled(&Package{Name: "undated"}), "t:0")
+	require.Contains(t, PackageToInstalled(&Package{Name: "dated", BuildTime: want["dated"]}), "t:1700000000")
+}
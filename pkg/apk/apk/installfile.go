@@ -0,0 +1,192 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"chainguard.dev/apko/pkg/apk/expandapk"
+	sign "chainguard.dev/apko/pkg/apk/signature"
+)
+
+// InstallPackageFile installs the package in the file filename, such as hello-1.0.0-r0.apk, of
+// the repository repoURI for the architecture of a, whether or not the index of the repository
+// lists it. The metadata comes from the .PKGINFO of the package, which must match the name and
+// version in filename. The package must be signed by a key in the keyring, unless signatures
+// are not checked for the indexes of repoURI, and its data must match the data hash that its
+// control section records. If the index of the repository lists the package, it must also match
+// the checksums there. The package is recorded in the installed database and added to the
+// world pinned to its version, so that resolving the world does not replace it.
+func (a *APK) InstallPackageFile(ctx context.Context, repoURI, filename string) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallPackageFile", trace.WithAttributes(attribute.String("repository", repoURI), attribute.String("filename", filename)))
+	defer span.End()
+
+	name, version, err := parsePackageFilename(filename)
+	if err != nil {
+		return err
+	}
+	repo := &Repository{URI: fmt.Sprintf("%s/%s", strings.TrimSuffix(repoURI, "/"), a.arch)}
+	if !a.trusted(repo.URI) {
+		return &UntrustedRepositoryError{Package: name, Repository: redactURL(repo.URI)}
+	}
+	rp := NewRepositoryPackage(&Package{Name: name, Version: version, Arch: a.arch}, repo.WithIndex(&APKIndex{}))
+
+	rc, err := a.FetchPackage(ctx, rp)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", filename, err)
+	}
+	exp, err := expandapk.ExpandApk(ctx, rc, a.workDir)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("expanding %s: %w", filename, err)
+	}
+
+	pkg, err := packageInfo(exp)
+	if err != nil {
+		exp.Close()
+		return fmt.Errorf("failed to read .PKGINFO for %s: %w", filename, err)
+	}
+	if pkg.Name != name || pkg.Version != version {
+		exp.Close()
+		return fmt.Errorf("%s holds package %s-%s", filename, pkg.Name, pkg.Version)
+	}
+	// The checksum of pkg is that of its own control section, so check against the index where
+	// it lists the package.
+	want := NewRepositoryPackage(pkg, rp.Repository())
+	if indexed := a.indexedPackage(ctx, repoURI, name, version); indexed != nil {
+		want = indexed
+	}
+	if err := a.verifyPackageFile(filename, repoURI, want, exp); err != nil {
+		exp.Close()
+		return err
+	}
+
+	if err := a.installExpanded(ctx, pkg, exp); err != nil {
+		return fmt.Errorf("installing %s: %w", filename, err)
+	}
+	return a.addToWorld(ctx, pkg.Name+"="+pkg.Version)
+}
+
+// parsePackageFilename returns the name and version of the package in filename, which is
+// named as Package.Filename names it.
+func parsePackageFilename(filename string) (name, version string, err error) {
+	base, ok := strings.CutSuffix(filename, ".apk")
+	if !ok || filename != path.Base(filename) || strings.ContainsRune(filename, '\\') {
+		return "", "", fmt.Errorf("invalid package filename %q", filename)
+	}
+	// The version itself holds one dash, before the release.
+	i := strings.LastIndex(base, "-")
+	if i > 0 {
+		i = strings.LastIndex(base[:i], "-")
+	}
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid package filename %q", filename)
+	}
+	return base[:i], base[i+1:], nil
+}
+
+// indexedPackage returns the entry of the index of repoURI for the package name at version, or
+// nil if the index does not list it. An index that cannot be fetched is treated as not listing
+// it, as the package signature is checked regardless.
+func (a *APK) indexedPackage(ctx context.Context, repoURI, name, version string) *RepositoryPackage {
+	indexes, err := a.repositoryIndexes(ctx, []string{repoURI}, a.arch, a.ignoreSignatures)
+	if err != nil {
+		a.log(ctx).Debug("not checking package against repository index", "repository", redactURL(repoURI), "error", err)
+		return nil
+	}
+	for _, index := range indexes {
+		for _, pkg := range index.Packages() {
+			if pkg.Name == name && pkg.Version == version {
+				return pkg
+			}
+		}
+	}
+	return nil
+}
+
+// verifyPackageFile checks the package in filename, expanded to exp, against the checksums in pkg
+// and, unless they are not checked for repoURI, against the signature it was built with.
+func (a *APK) verifyPackageFile(filename, repoURI string, pkg *RepositoryPackage, exp *expandapk.APKExpanded) error {
+	if err := verifyPackageHashes(pkg, exp); err != nil {
+		return fmt.Errorf("verifying %s: %w", filename, err)
+	}
+	if !a.verifyIndexSignature && (a.ignoreSignatures || slices.Contains(a.noSignatureIndexes, repoURI)) {
+		return nil
+	}
+	return a.verifyPackageSignature(filename, exp)
+}
+
+// verifyPackageSignature checks the signature section of exp, which is over the SHA1 digest of
+// its control section, against the keyring.
+func (a *APK) verifyPackageSignature(filename string, exp *expandapk.APKExpanded) error {
+	if exp.SignatureFile == "" {
+		return &SignatureError{Name: filename, Err: fmt.Errorf("package %s is not signed", filename)}
+	}
+	f, err := os.Open(exp.SignatureFile)
+	if err != nil {
+		return fmt.Errorf("reading signature of %s: %w", filename, err)
+	}
+	defer f.Close()
+	zr, err := expandapk.NewDecompressor(f)
+	if err != nil {
+		return fmt.Errorf("reading signature of %s: %w", filename, err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("reading signature of %s: %w", filename, err)
+	}
+	keyName, ok := strings.CutPrefix(hdr.Name, ".SIGN.RSA.")
+	if !ok {
+		return &SignatureError{Name: filename, Err: fmt.Errorf("unsupported signature %s in %s", hdr.Name, filename)}
+	}
+	sig, err := io.ReadAll(tr)
+	if err != nil {
+		return fmt.Errorf("reading signature of %s: %w", filename, err)
+	}
+
+	keys, err := a.keyring()
+	if err != nil {
+		return err
+	}
+	if key, ok := keys[keyName]; ok && sign.RSAVerifySHA1Digest(exp.ControlHash, sig, key) == nil {
+		return nil
+	}
+	var errs []error
+	for name, key := range keys {
+		err := sign.RSAVerifySHA1Digest(exp.ControlHash, sig, key)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	if len(errs) == 0 {
+		return &SignatureError{Name: filename, Err: fmt.Errorf("no keys to verify the signature of %s", filename)}
+	}
+	return &SignatureError{Name: filename, Err: fmt.Errorf("no key verifies the signature of %s: %w", filename, errors.Join(errs...))}
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstallPackageFile(t *testing.T) {
+	ctx := context.Background()
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "foo", Version: "2.0.0-r0", Arch: testArch},
+	}
+	entries := map[string][]testDirEntry{"foo": {{path: "usr", dir: true, perms: 0o755}, {path: "usr/foo", perms: 0o644, content: []byte("foo")}}}
+	repo := testLocalRepoWithFiles(t, testArch, packages, entries)
+
+	a, src := testAPKWithRepos(t, []string{repo})
+	indexes, err := a.GetRepositoryIndexes(ctx, false)
+	require.NoError(t, err)
+	resolved, err := a.newPkgResolver(ctx, indexes).ResolvePackage("foo", nil)
+	require.NoError(t, err)
+	require.Equal(t, "2.0.0-r0", resolved[0].Version, "the index should list a newer version")
+
+	require.NoError(t, a.InstallPackageFile(ctx, repo, "foo-1.0.0-r0.apk"))
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+	require.Equal(t, "foo", installed[0].Name)
+	require.Equal(t, "1.0.0-r0", installed[0].Version)
+	b, err := src.ReadFile("usr/foo")
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(b))
+	world, err := a.GetWorld(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo=1.0.0-r0"}, world)
+
+	for _, tt := range []struct {
+		name, filename, err string
+	}{
+		{"not an apk", "foo-1.0.0-r0.tar.gz", "invalid package filename"},
+		{"path", "../foo-1.0.0-r0.apk", "invalid package filename"},
+		{"no version", "foo.apk", "invalid package filename"},
+		{"missing", "foo-3.0.0-r0.apk", "fetching foo-3.0.0-r0.apk"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := testAPKWithRepos(t, []string{repo})
+			require.ErrorContains(t, a.InstallPackageFile(ctx, repo, tt.filename), tt.err)
+		})
+	}
+
+	t.Run("index checksum", func(t *testing.T) {
+		// The index of other lists foo-1.0.0-r0 with a checksum the file does not have.
+		listed := []*Package{{Name: "foo", Version: "1.0.0-r0", Arch: testArch, Checksum: make([]byte, 20)}}
+		other := testLocalRepo(t, testArch, listed)
+		b, err := os.ReadFile(filepath.Join(repo, testArch, "foo-1.0.0-r0.apk"))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(other, testArch, "foo-1.0.0-r0.apk"), b, 0o644)) //nolint:gosec // we're writing a test file
+
+		a, _ := testAPKWithRepos(t, []string{other})
+		require.ErrorContains(t, a.InstallPackageFile(ctx, other, "foo-1.0.0-r0.apk"), "control checksum mismatch")
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		require.Empty(t, installed)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, nil)
+		err := a.InstallPackageFile(ctx, repo, "foo-1.0.0-r0.apk")
+		require.ErrorIs(t, err, &SignatureError{})
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		require.Empty(t, installed)
+	})
+}
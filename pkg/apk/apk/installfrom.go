@@ -0,0 +1,120 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstallFrom adds packages to the world and installs them, taking them only from the
+// repository repoURI, which must be one of the configured repositories, even if others have
+// them too. Their dependencies resolve from any repository as usual. The restriction applies
+// to every later resolution by a; calling InstallFrom again for a package moves it to the new
+// repository. If the packages cannot be installed, the world and the restrictions are put back
+// as they were, and the filesystem is left as FixateWorld left it.
+func (a *APK) InstallFrom(ctx context.Context, repoURI string, packages []string) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallFrom", trace.WithAttributes(attribute.String("repository", repoURI)))
+	defer span.End()
+
+	repos, err := a.GetRepositories(ctx)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(repos, func(line string) bool {
+		spec, err := ParseRepoSpec(line)
+		return err == nil && spec.URI == repoURI
+	}) {
+		return fmt.Errorf("repository %s is not configured", redactURL(repoURI))
+	}
+
+	// The restrictions come first, so that validating the world takes them into account.
+	restore := a.restrictToRepository(repoURI, packages)
+	previous, err := a.extendWorld(ctx, packages)
+	if err != nil {
+		restore()
+		return err
+	}
+
+	if err := a.FixateWorld(ctx, nil); err != nil {
+		restore()
+		a.worldMu.Lock()
+		defer a.worldMu.Unlock()
+		if werr := a.writeWorld(ctx, previous); werr != nil {
+			return fmt.Errorf("%w (restoring the world: %w)", err, werr)
+		}
+		return err
+	}
+	return nil
+}
+
+// restrictToRepository restricts the packages to repoURI for later resolutions, and returns a
+// func that puts back the restrictions they had before.
+func (a *APK) restrictToRepository(repoURI string, packages []string) func() {
+	a.repoConstraintsMu.Lock()
+	defer a.repoConstraintsMu.Unlock()
+	if a.repoConstraints == nil {
+		a.repoConstraints = map[string]string{}
+	}
+	previous := map[string]string{}
+	for _, pkg := range packages {
+		name := resolvePackageNameVersionPin(pkg).name
+		if _, seen := previous[name]; seen {
+			continue
+		}
+		previous[name] = a.repoConstraints[name]
+		a.repoConstraints[name] = repoURI
+	}
+
+	return func() {
+		a.repoConstraintsMu.Lock()
+		defer a.repoConstraintsMu.Unlock()
+		for name, repoURI := range previous {
+			if repoURI == "" {
+				delete(a.repoConstraints, name)
+			} else {
+				a.repoConstraints[name] = repoURI
+			}
+		}
+	}
+}
+
+// extendWorld adds packages to the world, validating it as SetWorld does, and returns the world
+// as it was before.
+func (a *APK) extendWorld(ctx context.Context, packages []string) ([]string, error) {
+	a.worldMu.Lock()
+	defer a.worldMu.Unlock()
+	previous, err := a.GetWorld(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+	world := slices.Clone(previous)
+	for _, pkg := range packages {
+		if !slices.Contains(world, pkg) {
+			world = append(world, pkg)
+		}
+	}
+	if a.validateWorld {
+		if err := a.ValidateWorld(ctx, world); err != nil {
+			return nil, err
+		}
+	}
+	return previous, a.writeWorld(ctx, world)
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstallFrom(t *testing.T) {
+	ctx := context.Background()
+	files := map[string][]testDirEntry{
+		"foo": {{"usr", 0o755, true, nil, nil}, {"usr/bin", 0o755, true, nil, nil}, {"usr/bin/foo", 0o755, false, []byte("foo"), nil}},
+		"bar": {{"usr", 0o755, true, nil, nil}, {"usr/lib", 0o755, true, nil, nil}, {"usr/lib/bar", 0o644, false, []byte("bar"), nil}},
+	}
+	mirror := testLocalRepoWithFiles(t, testArch, []*Package{
+		{Name: "foo", Version: "1.0.0-r0", Arch: testArch, Dependencies: []string{"bar"}},
+	}, files)
+	upstream := testLocalRepoWithFiles(t, testArch, []*Package{
+		{Name: "foo", Version: "2.0.0-r0", Arch: testArch, Dependencies: []string{"bar"}},
+		{Name: "bar", Version: "1.0.0-r0", Arch: testArch},
+	}, files)
+
+	a, _ := testAPKWithRepos(t, []string{upstream, mirror})
+	require.ErrorContains(t, a.InstallFrom(ctx, t.TempDir(), []string{"foo"}), "not configured")
+
+	require.NoError(t, a.InstallFrom(ctx, mirror, []string{"foo"}))
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	versions := map[string]string{}
+	for _, pkg := range installed {
+		versions[pkg.Name] = pkg.Version
+	}
+	require.Equal(t, map[string]string{"foo": "1.0.0-r0", "bar": "1.0.0-r0"}, versions)
+
+	world, err := a.GetWorld(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo"}, world)
+
+	// Without the restriction, the newer foo upstream would be chosen.
+	toInstall, _, err := a.resolvePackages(ctx, []string{"foo"})
+	require.NoError(t, err)
+	for _, pkg := range toInstall {
+		if pkg.Name == "foo" {
+			require.Equal(t, "1.0.0-r0", pkg.Version)
+		}
+	}
+	b, _ := testAPKWithRepos(t, []string{upstream, mirror})
+	toInstall, _, err = b.resolvePackages(ctx, []string{"foo"})
+	require.NoError(t, err)
+	for _, pkg := range toInstall {
+		if pkg.Name == "foo" {
+			require.Equal(t, "2.0.0-r0", pkg.Version)
+		}
+	}
+
+	t.Run("failure", func(t *testing.T) {
+		// bar is only upstream, so it cannot be installed from the mirror.
+		require.Error(t, a.InstallFrom(ctx, mirror, []string{"bar"}))
+		world, err := a.GetWorld(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"foo"}, world, "the world should be put back")
+		toInstall, _, err := a.resolvePackages(ctx, []string{"bar"})
+		require.NoError(t, err, "bar should not stay restricted to the mirror")
+		require.Len(t, toInstall, 1)
+	})
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"strings"
+)
+
+// licensePolicy decides which license identifiers packages may carry.
+type licensePolicy struct {
+	allow, deny []string
+}
+
+// permits reports whether a package with the given license expression may be installed.
+// Each identifier must not be denied and, if there is an allow list, must be allowed. As in
+// SPDX expressions, "A OR B" is permitted if either side is, and "A AND B" only if both are.
+func (p *licensePolicy) permits(expression string) bool {
+	tokens := licenseTokens(expression)
+	if len(tokens) == 0 {
+		return len(p.allow) == 0
+	}
+	lp := &licenseParser{tokens: tokens, permits: p.permitsID}
+	ok := lp.or()
+	// Only an unbalanced ")" stops parsing early, check whatever follows it too.
+	for lp.pos < len(lp.tokens) {
+		lp.pos++
+		ok = lp.or() && ok
+	}
+	return ok
+}
+
+func (p *licensePolicy) permitsID(id string) bool {
+	for _, d := range p.deny {
+		if licenseMatches(d, id) {
+			return false
+		}
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, a := range p.allow {
+		if licenseMatches(a, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// licenseMatches reports whether the license identifier id matches a policy entry, ignoring
+// case. An entry without an -only or -or-later suffix, such as GPL-3.0, matches all of
+// GPL-3.0, GPL-3.0-only, GPL-3.0-or-later and GPL-3.0+.
+func licenseMatches(entry, id string) bool {
+	if strings.EqualFold(entry, id) {
+		return true
+	}
+	lower := strings.ToLower(id)
+	for _, suffix := range []string{"-only", "-or-later", "+"} {
+		if base, ok := strings.CutSuffix(lower, suffix); ok {
+			return strings.EqualFold(entry, base)
+		}
+	}
+	return false
+}
+
+// licenseTokens splits a license expression into identifiers, operators and parentheses.
+func licenseTokens(expression string) []string {
+	expression = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expression)
+	return strings.Fields(expression)
+}
+
+// licenseParser evaluates a tokenized license expression, where AND binds tighter than OR.
+// Identifiers next to each other without an operator, as in older package metadata, are
+// treated as if joined by AND.
+type licenseParser struct {
+	tokens  []string
+	pos     int
+	permits func(id string) bool
+}
+
+func (lp *licenseParser) peek() string {
+	if lp.pos < len(lp.tokens) {
+		return lp.tokens[lp.pos]
+	}
+	return ""
+}
+
+func (lp *licenseParser) or() bool {
+	ok := lp.and()
+	for strings.EqualFold(lp.peek(), "OR") {
+		lp.pos++
+		// Evaluate both sides so that the whole expression is consumed.
+		right := lp.and()
+		ok = ok || right
+	}
+	return ok
+}
+
+func (lp *licenseParser) and() bool {
+	ok := lp.term()
+	for {
+		next := lp.peek()
+		switch {
+		case strings.EqualFold(next, "AND"):
+			lp.pos++
+		case next == "" || next == ")" || strings.EqualFold(next, "OR"):
+			return ok
+		}
+		right := lp.term()
+		ok = ok && right
+	}
+}
+
+func (lp *licenseParser) term() bool {
+	tok := lp.peek()
+	switch {
+	case tok == "" || tok == ")":
+		// A missing identifier cannot be permitted by an allow list.
+		return lp.permits("")
+	case strings.EqualFold(tok, "AND") || strings.EqualFold(tok, "OR"):
+		lp.pos++
+		return lp.permits("")
+	}
+	lp.pos++
+	if tok == "(" {
+		ok := lp.or()
+		if lp.peek() == ")" {
+			lp.pos++
+		}
+		return ok
+	}
+	// The exception in "id WITH exception" does not change which license applies.
+	if strings.EqualFold(lp.peek(), "WITH") {
+		lp.pos += 2
+	}
+	return lp.permits(tok)
+}
+
+// checkLicenses applies the license policy to the resolved packages.
+func (a *APK) checkLicenses(toInstall []*RepositoryPackage) error {
+	if a.licensePolicy == nil {
+		return nil
+	}
+	var errs []error
+	for _, pkg := range toInstall {
+		if !a.licensePolicy.permits(pkg.License) {
+			errs = append(errs, &LicensePolicyError{Package: pkg.Name, License: pkg.License})
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLicensePolicy(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepo(t, testArch, []*Package{
+		{Name: "gpl", Version: "1.0.0", License: "GPL-3.0-or-later"},
+		{Name: "mit", Version: "1.0.0", License: "MIT"},
+		{Name: "dual", Version: "1.0.0", License: "MIT OR GPL-3.0-only"},
+		{Name: "unlicensed", Version: "1.0.0"},
+	})
+
+	for _, tt := range []struct {
+		name        string
+		allow, deny []string
+		world       []string
+		wantDenied  []string
+	}{
+		{name: "no policy", world: []string{"gpl", "mit", "unlicensed"}},
+		{name: "deny GPL", deny: []string{"GPL-3.0"}, world: []string{"gpl", "mit", "dual"}, wantDenied: []string{"gpl"}},
+		{name: "deny is case insensitive", deny: []string{"gpl-3.0-or-later"}, world: []string{"gpl"}, wantDenied: []string{"gpl"}},
+		{name: "deny exact", deny: []string{"GPL-3.0-only"}, world: []string{"gpl", "dual"}},
+		{name: "allow MIT", allow: []string{"MIT"}, world: []string{"gpl", "mit", "dual", "unlicensed"}, wantDenied: []string{"gpl", "unlicensed"}},
+		{name: "deny wins over allow", allow: []string{"MIT", "GPL-3.0"}, deny: []string{"MIT"}, world: []string{"mit", "dual"}, wantDenied: []string{"mit"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := testAPKWithRepos(t, []string{repo}, WithLicensePolicy(tt.allow, tt.deny))
+			require.NoError(t, a.SetWorld(ctx, tt.world))
+
+			_, _, err := a.ResolveWorld(ctx)
+			if len(tt.wantDenied) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+
+			var denied []string
+			for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+				var licenseErr *LicensePolicyError
+				require.True(t, errors.As(e, &licenseErr), "unexpected error %v", e)
+				denied = append(denied, licenseErr.Package)
+			}
+			require.ElementsMatch(t, tt.wantDenied, denied)
+		})
+	}
+}
+
+func TestLicensePolicyPermits(t *testing.T) {
+	p := &licensePolicy{allow: []string{"MIT", "Apache-2.0"}, deny: []string{"GPL-3.0"}}
+	for expression, want := range map[string]bool{
+		"MIT":                            true,
+		"MIT AND Apache-2.0":             true,
+		"MIT AND GPL-3.0-only":           false,
+		"MIT OR GPL-3.0+":                true,
+		"(MIT OR GPL-3.0) AND BSD":       false,
+		"BSD OR (MIT AND Apache-2.0)":    true,
+		"Apache-2.0 WITH LLVM-exception": true,
+		"MIT Apache-2.0":                 true,
+		"MIT GPL-3.0":                    false,
+		"":                               false,
+	} {
+		require.Equal(t, want, p.permits(expression), expression)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+// Lockfile pins the exact packages resolved for a world, in installation order.
+type Lockfile struct {
+	Packages []LockedPackage `json:"packages"`
+}
+
+// LockedPackage is a single package pinned by a Lockfile.
+type LockedPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+	// Repository is the URI of the repository including the architecture, as in RepositoryWithIndex.URI.
+	Repository string `json:"repository"`
+	// Checksum is APK-style: 'Q1' prefixed SHA1 hash of the control section of the package.
+	Checksum string `json:"checksum"`
+}
+
+// WriteLockfile resolves the world and writes a Lockfile for the result to w.
+// The output only depends on the resolved packages, so it is stable across runs.
+func (a *APK) WriteLockfile(ctx context.Context, w io.Writer) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "WriteLockfile")
+	defer span.End()
+
+	pkgs, _, err := a.ResolveWorld(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting package dependencies: %w", err)
+	}
+
+	lock := Lockfile{Packages: make([]LockedPackage, 0, len(pkgs))}
+	for _, pkg := range pkgs {
+		lock.Packages = append(lock.Packages, LockedPackage{
+			Name:       pkg.Name,
+			Version:    pkg.Version,
+			Arch:       pkg.Arch,
+			Repository: pkg.Repository().URI,
+			Checksum:   pkg.ChecksumString(),
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(lock)
+}
+
+// InstallFromLockfile installs exactly the packages listed in the Lockfile read from r, in order,
+// without resolving the world. It fails if a package no longer matches its pinned checksum.
+func (a *APK) InstallFromLockfile(ctx context.Context, r io.Reader, sourceDateEpoch *time.Time) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallFromLockfile")
+	defer span.End()
+
+	var lock Lockfile
+	if err := json.NewDecoder(r).Decode(&lock); err != nil {
+		return fmt.Errorf("parsing lockfile: %w", err)
+	}
+
+	pkgs := make([]InstallablePackage, 0, len(lock.Packages))
+	for _, locked := range lock.Packages {
+		if !strings.HasPrefix(locked.Checksum, "Q1") {
+			return fmt.Errorf("locked package %s has unexpected checksum %q", locked.Name, locked.Checksum)
+		}
+		checksum, err := base64.StdEncoding.DecodeString(locked.Checksum[2:])
+		if err != nil {
+			return fmt.Errorf("decoding checksum of locked package %s: %w", locked.Name, err)
+		}
+
+		repo := Repository{URI: locked.Repository}
+		pkg := &Package{
+			Name:     locked.Name,
+			Version:  locked.Version,
+			Arch:     locked.Arch,
+			Checksum: checksum,
+		}
+		pkgs = append(pkgs, NewRepositoryPackage(pkg, repo.WithIndex(&APKIndex{Packages: []*Package{pkg}})))
+	}
+
+	return a.InstallPackages(ctx, sourceDateEpoch, pkgs)
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockfile(t *testing.T) {
+	ctx := context.Background()
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0", Arch: testArch, Dependencies: []string{"libfoo"}},
+		{Name: "libfoo", Version: "1.0.0", Arch: testArch},
+	}
+	repo := testLocalRepoWithFiles(t, testArch, packages, map[string][]testDirEntry{
+		"foo":    {{path: "usr", dir: true, perms: 0o755}, {path: "usr/foo", perms: 0o755, content: []byte("foo")}},
+		"libfoo": {{path: "usr", dir: true, perms: 0o755}, {path: "usr/libfoo.so", perms: 0o644, content: []byte("libfoo")}},
+	})
+
+	a, _ := testAPKWithRepos(t, []string{repo})
+	require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+
+	var buf bytes.Buffer
+	require.NoError(t, a.WriteLockfile(ctx, &buf))
+
+	var lock Lockfile
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &lock))
+	require.Equal(t, []LockedPackage{{
+		Name:       "libfoo",
+		Version:    "1.0.0",
+		Arch:       testArch,
+		Repository: filepath.Join(repo, testArch),
+		Checksum:   packages[1].ChecksumString(),
+	}, {
+		Name:       "foo",
+		Version:    "1.0.0",
+		Arch:       testArch,
+		Repository: filepath.Join(repo, testArch),
+		Checksum:   packages[0].ChecksumString(),
+	}}, lock.Packages)
+
+	t.Run("deterministic", func(t *testing.T) {
+		var again bytes.Buffer
+		require.NoError(t, a.WriteLockfile(ctx, &again))
+		require.Equal(t, buf.String(), again.String())
+	})
+
+	t.Run("install", func(t *testing.T) {
+		b, src := testAPKWithRepos(t, []string{repo})
+		require.NoError(t, b.InstallFromLockfile(ctx, bytes.NewReader(buf.Bytes()), nil))
+
+		got, err := src.ReadFile("usr/foo")
+		require.NoError(t, err)
+		require.Equal(t, "foo", string(got))
+
+		installed, err := b.GetInstalled()
+		require.NoError(t, err)
+		require.Len(t, installed, 2)
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		// Pin foo to the checksum of libfoo, as if the mirror now served a different foo.
+		tampered := Lockfile{Packages: append([]LockedPackage{}, lock.Packages...)}
+		tampered.Packages[1].Checksum = packages[1].ChecksumString()
+
+		b, err := json.Marshal(tampered)
+		require.NoError(t, err)
+
+		c, _ := testAPKWithRepos(t, []string{repo})
+		require.ErrorContains(t, c.InstallFromLockfile(ctx, bytes.NewReader(b), nil), "checksum mismatch")
+	})
+}
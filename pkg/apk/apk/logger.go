@@ -0,0 +1,38 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// log returns the logger given by WithLogger, or else the one in ctx.
+func (a *APK) log(ctx context.Context) *clog.Logger {
+	if a.logger == nil {
+		return clog.FromContext(ctx)
+	}
+	return clog.NewLoggerWithContext(ctx, a.logger)
+}
+
+// logContext returns ctx with the logger given by WithLogger, if any, for the functions that
+// take their logger from the context.
+func (a *APK) logContext(ctx context.Context) context.Context {
+	if a.logger == nil {
+		return ctx
+	}
+	return clog.WithLogger(ctx, clog.NewLogger(a.logger))
+}
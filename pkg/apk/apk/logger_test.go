@@ -0,0 +1,100 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer that can be written to from several goroutines.
+type syncBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func TestWithLogger(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepoWithFiles(t, testArch, []*Package{{Name: "foo", Version: "1.0.0-r0", Arch: testArch}}, map[string][]testDirEntry{
+		"foo": {{"usr", 0o755, true, nil, nil}, {"usr/foo", 0o644, false, []byte("foo"), nil}},
+	})
+	cacheDir := t.TempDir()
+
+	install := func() []map[string]any {
+		// Make sure the package is taken from the cache directory, rather than reused from before.
+		globalApkCache = &apkCache{}
+		t.Cleanup(func() { globalApkCache = &apkCache{} })
+
+		var buf syncBuffer
+		logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		a, _ := testAPKWithRepos(t, []string{repo}, WithCache(cacheDir, false), WithLogger(logger))
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+
+		var records []map[string]any
+		scanner := bufio.NewScanner(&buf.Buffer)
+		for scanner.Scan() {
+			var r map[string]any
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+			records = append(records, r)
+		}
+		require.NoError(t, scanner.Err())
+		return records
+	}
+	find := func(records []map[string]any, msg string) map[string]any {
+		for _, r := range records {
+			if r["msg"] == msg {
+				return r
+			}
+		}
+		return nil
+	}
+
+	first := install()
+	resolved := find(first, "resolved package")
+	require.NotNil(t, resolved, "resolution is logged")
+	require.Equal(t, "foo", resolved["package"])
+	require.Equal(t, "1.0.0-r0", resolved["version"])
+	require.Contains(t, resolved["repository"], repo)
+	miss := find(first, "cache miss")
+	require.NotNil(t, miss, "the cache miss is logged")
+	require.Equal(t, "foo", miss["package"])
+	fetch := find(first, "fetching package")
+	require.NotNil(t, fetch, "the fetch is logged")
+	require.Equal(t, "foo", fetch["package"])
+	require.Contains(t, fetch["url"], "foo-1.0.0-r0.apk")
+	require.Equal(t, "DEBUG", fetch["level"])
+	require.Nil(t, find(first, "cache hit"))
+
+	second := install()
+	hit := find(second, "cache hit")
+	require.NotNil(t, hit, "the cache hit is logged")
+	require.Equal(t, "foo", hit["package"])
+	require.Contains(t, hit["path"], cacheDir)
+	require.Nil(t, find(second, "fetching package"))
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+)
+
+// MirrorTo resolves the world and writes the resolved packages to destDir as a repository for
+// the architecture of a, that is, the packages and an APKINDEX.tar.gz listing them in
+// destDir/<arch>. The index is not signed, so the mirror is used with WithNoSignatureIndexes
+// or signed afterwards. Packages already in destDir are downloaded again. Downloads run
+// concurrently, bounded by WithParallelFetch if set, and start with the largest packages.
+func (a *APK) MirrorTo(ctx context.Context, destDir string) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "MirrorTo")
+	defer span.End()
+
+	toInstall, _, err := a.ResolveWorld(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting package dependencies: %w", err)
+	}
+
+	dir := filepath.Join(destDir, a.arch)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating mirror directory: %w", err)
+	}
+
+	var g errgroup.Group
+	if a.parallelFetch > 0 {
+		g.SetLimit(a.parallelFetch)
+	}
+	for _, i := range largestFirst(toInstall) {
+		pkg := toInstall[i]
+		g.Go(func() error {
+			if err := a.mirrorPackage(ctx, pkg, filepath.Join(dir, pkg.Filename())); err != nil {
+				return fmt.Errorf("mirroring %s: %w", pkg.PackageName(), err)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	pkgs := make([]*Package, 0, len(toInstall))
+	for _, pkg := range toInstall {
+		pkgs = append(pkgs, pkg.Package)
+	}
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: pkgs})
+	if err != nil {
+		return fmt.Errorf("creating mirror index: %w", err)
+	}
+	if err := writeCacheFile(filepath.Join(dir, indexFilename), archive); err != nil {
+		return fmt.Errorf("writing mirror index: %w", err)
+	}
+	return nil
+}
+
+// mirrorPackage downloads pkg to the file at dest.
+func (a *APK) mirrorPackage(ctx context.Context, pkg *RepositoryPackage, dest string) error {
+	rc, err := a.FetchPackage(ctx, pkg)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return writeCacheFile(dest, &sizedReader{Reader: rc, pkg: pkg.PackageName(), size: int64(pkg.Size)})
+}
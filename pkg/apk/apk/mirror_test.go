@@ -0,0 +1,74 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorTo(t *testing.T) {
+	ctx := context.Background()
+	globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+	t.Cleanup(func() { globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{} })
+
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0-r0", Arch: testArch, Dependencies: []string{"bar"}},
+		{Name: "bar", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "baz", Version: "1.0.0-r0", Arch: testArch},
+	}
+	entries := map[string][]testDirEntry{}
+	for _, pkg := range packages {
+		entries[pkg.Name] = []testDirEntry{{path: "usr", dir: true, perms: 0o755}, {path: "usr/" + pkg.Name, perms: 0o755, content: []byte(pkg.Name)}}
+	}
+	repo := testLocalRepoWithFiles(t, testArch, packages, entries)
+
+	a, _ := testAPKWithRepos(t, []string{repo})
+	require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+	mirror := t.TempDir()
+	require.NoError(t, a.MirrorTo(ctx, mirror))
+
+	f, err := os.Open(filepath.Join(mirror, testArch, indexFilename))
+	require.NoError(t, err)
+	index, err := IndexFromArchive(f)
+	require.NoError(t, err)
+	names := map[string]*Package{}
+	for _, pkg := range index.Packages {
+		names[pkg.Name] = pkg
+	}
+	require.Len(t, names, 2)
+	for _, pkg := range packages[:2] {
+		require.Contains(t, names, pkg.Name)
+		require.Equal(t, pkg.Checksum, names[pkg.Name].Checksum)
+		_, err := os.Stat(filepath.Join(mirror, testArch, pkg.Filename()))
+		require.NoError(t, err, "%s is not mirrored", pkg.Name)
+	}
+	_, err = os.Stat(filepath.Join(mirror, testArch, packages[2].Filename()))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// The mirror can be installed from on its own.
+	fromMirror, src := testAPKWithRepos(t, []string{mirror})
+	require.NoError(t, fromMirror.SetWorld(ctx, []string{"foo"}))
+	require.NoError(t, fromMirror.FixateWorld(ctx, nil))
+	for _, name := range []string{"foo", "bar"} {
+		b, err := src.ReadFile("usr/" + name)
+		require.NoError(t, err)
+		require.Equal(t, name, string(b))
+	}
+}
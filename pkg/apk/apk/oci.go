@@ -0,0 +1,235 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	apkauth "chainguard.dev/apko/pkg/apk/auth"
+)
+
+const (
+	ociScheme = "oci://"
+
+	// ociTitleAnnotation holds the file name of each layer in an OCI repository.
+	ociTitleAnnotation = "org.opencontainers.image.title"
+)
+
+func isOCI(u string) bool {
+	return strings.HasPrefix(u, ociScheme)
+}
+
+// OCIRepository reads an apk repository that is published to an OCI registry, for repository
+// URIs such as oci://registry.example.com/apk/main. Each architecture is an artifact tagged with
+// the architecture name, holding APKINDEX.tar.gz and the packages as layers. The file name of
+// each layer is its org.opencontainers.image.title annotation, as written by oras push.
+type OCIRepository struct {
+	repo    name.Repository
+	options []remote.Option
+
+	mu        sync.Mutex
+	manifests map[string]*v1.Manifest
+}
+
+// NewOCIRepository returns an OCIRepository for an oci:// repository URI. The remote options
+// are used for every registry request, and are how credentials are passed in: registries that
+// require bearer tokens get them in exchange for the credentials of the authenticator.
+func NewOCIRepository(uri string, options ...remote.Option) (*OCIRepository, error) {
+	if !isOCI(uri) {
+		return nil, fmt.Errorf("not an OCI repository: %s", uri)
+	}
+	repo, err := name.NewRepository(strings.TrimPrefix(uri, ociScheme))
+	if err != nil {
+		return nil, fmt.Errorf("parsing OCI repository %s: %w", uri, err)
+	}
+	return &OCIRepository{repo: repo, options: options, manifests: map[string]*v1.Manifest{}}, nil
+}
+
+// Open returns the contents of filename for the given architecture, and its size.
+// It returns an error wrapping fs.ErrNotExist if the artifact has no such file.
+func (r *OCIRepository) Open(ctx context.Context, arch, filename string) (io.ReadCloser, int64, error) {
+	desc, err := r.Stat(ctx, arch, filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	layer, err := remote.Layer(r.repo.Digest(desc.Digest.String()), r.remoteOptions(ctx)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("getting %s from %s: %w", filename, r.repo, err)
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading %s from %s: %w", filename, r.repo, err)
+	}
+	return rc, desc.Size, nil
+}
+
+// Stat returns the descriptor of the layer holding filename for the given architecture, without
+// fetching it. It returns an error wrapping fs.ErrNotExist if the artifact has no such file.
+func (r *OCIRepository) Stat(ctx context.Context, arch, filename string) (v1.Descriptor, error) {
+	manifest, err := r.manifest(ctx, arch)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	for _, desc := range manifest.Layers {
+		if desc.Annotations[ociTitleAnnotation] == filename {
+			return desc, nil
+		}
+	}
+	return v1.Descriptor{}, fmt.Errorf("%s not found in %s:%s: %w", filename, r.repo, arch, fs.ErrNotExist)
+}
+
+// remoteOptions returns the options for a request, without sharing a backing array between
+// concurrent requests.
+func (r *OCIRepository) remoteOptions(ctx context.Context) []remote.Option {
+	return append(slices.Clip(r.options), remote.WithContext(ctx))
+}
+
+// manifest returns the manifest for arch, fetching it only once.
+func (r *OCIRepository) manifest(ctx context.Context, arch string) (*v1.Manifest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.manifests[arch]; ok {
+		return m, nil
+	}
+	img, err := remote.Image(r.repo.Tag(arch), r.remoteOptions(ctx)...)
+	if err != nil {
+		return nil, fmt.Errorf("getting %s:%s: %w", r.repo, arch, err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest of %s:%s: %w", r.repo, arch, err)
+	}
+	r.manifests[arch] = m
+	return m, nil
+}
+
+// splitOCIURL splits the URL of a file in an OCI repository, which is laid out like any other
+// repository, into the repository URI, the architecture and the file name.
+func splitOCIURL(u string) (repo, arch, filename string, err error) {
+	dir, filename := path.Split(u)
+	repo, arch = path.Split(strings.TrimSuffix(dir, "/"))
+	repo = strings.TrimSuffix(repo, "/")
+	if filename == "" || arch == "" || len(repo) <= len(ociScheme) {
+		return "", "", "", fmt.Errorf("invalid OCI repository file %s", u)
+	}
+	return repo, arch, filename, nil
+}
+
+// ociRepositoryFor returns the OCI repository holding the file at u, with the architecture and
+// file name within it. Requests go through client, with the credentials in auths for the
+// registry host, or else those that authenticator adds. Repositories are reused from repos, if
+// given.
+func ociRepositoryFor(u string, client *http.Client, auths map[string]auth, authenticator apkauth.Authenticator, repos *sync.Map) (repo *OCIRepository, arch, filename string, err error) {
+	repoURI, arch, filename, err := splitOCIURL(u)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if repos != nil {
+		if r, ok := repos.Load(repoURI); ok {
+			return r.(*OCIRepository), arch, filename, nil
+		}
+	}
+	repo, err = NewOCIRepository(repoURI, ociRemoteOptions(repoURI, client, auths, authenticator)...)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if repos != nil {
+		r, _ := repos.LoadOrStore(repoURI, repo)
+		repo = r.(*OCIRepository)
+	}
+	return repo, arch, filename, nil
+}
+
+// openOCI opens the file at u in an OCI repository, see ociRepositoryFor.
+func openOCI(ctx context.Context, u string, client *http.Client, auths map[string]auth, authenticator apkauth.Authenticator, repos *sync.Map) (io.ReadCloser, int64, error) {
+	repo, arch, filename, err := ociRepositoryFor(u, client, auths, authenticator, repos)
+	if err != nil {
+		return nil, 0, err
+	}
+	return repo.Open(ctx, arch, filename)
+}
+
+// ociRemoteOptions returns the options for the registry of repoURI, see ociRepositoryFor.
+func ociRemoteOptions(repoURI string, client *http.Client, auths map[string]auth, authenticator apkauth.Authenticator) []remote.Option {
+	var transport http.RoundTripper = http.DefaultTransport
+	if client != nil {
+		// The whole client, so that its timeout applies too.
+		transport = clientTransport{client: client}
+	}
+	options := []remote.Option{remote.WithTransport(transport)}
+
+	host, _, _ := strings.Cut(strings.TrimPrefix(repoURI, ociScheme), "/")
+	if a, ok := auths[host]; ok && a.user != "" && a.pass != "" {
+		options = append(options, remote.WithAuth(authn.FromConfig(authn.AuthConfig{Username: a.user, Password: a.pass})))
+	} else if authenticator != nil {
+		options = append(options, remote.WithAuth(&ociAuthenticator{host: host, authenticator: authenticator}))
+	}
+	return options
+}
+
+// clientTransport sends requests with client, for APIs that only take an http.RoundTripper.
+type clientTransport struct {
+	client *http.Client
+}
+
+func (t clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.client.Do(req)
+}
+
+// ociAuthenticator gives a registry the credentials that an apkauth.Authenticator adds to
+// requests for its host. Basic auth credentials are exchanged for a bearer token by registries
+// that require one, and bearer tokens are sent as they are.
+type ociAuthenticator struct {
+	host          string
+	authenticator apkauth.Authenticator
+}
+
+var _ authn.ContextAuthenticator = (*ociAuthenticator)(nil)
+
+func (o *ociAuthenticator) Authorization() (*authn.AuthConfig, error) {
+	return o.AuthorizationContext(context.Background())
+}
+
+func (o *ociAuthenticator) AuthorizationContext(ctx context.Context) (*authn.AuthConfig, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+o.host+"/v2/", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.authenticator.AddAuth(ctx, req); err != nil {
+		return nil, fmt.Errorf("adding credentials for %s: %w", o.host, err)
+	}
+	if user, pass, ok := req.BasicAuth(); ok {
+		return &authn.AuthConfig{Username: user, Password: pass}, nil
+	}
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		return &authn.AuthConfig{RegistryToken: token}, nil
+	}
+	return &authn.AuthConfig{}, nil
+}
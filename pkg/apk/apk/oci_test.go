@@ -0,0 +1,164 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/require"
+
+	apkauth "chainguard.dev/apko/pkg/apk/auth"
+)
+
+// testTokenRegistry serves an in-memory registry that only accepts a bearer token, which it
+// hands out in exchange for the given basic auth credentials.
+func testTokenRegistry(t *testing.T, user, pass string) *httptest.Server {
+	t.Helper()
+
+	const token = "test-token"
+	reg := registry.New()
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if u, p, ok := r.BasicAuth(); !ok || u != user || p != pass {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"token": %q}`, token)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, s.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// testPushOCIRepository pushes the files in dir/arch as an OCI repository artifact tagged arch.
+func testPushOCIRepository(t *testing.T, ref string, dir, arch string, options ...remote.Option) {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Join(dir, arch))
+	require.NoError(t, err)
+	img := empty.Image
+	for _, entry := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, arch, entry.Name()))
+		require.NoError(t, err)
+		img, err = mutate.Append(img, mutate.Addendum{
+			Layer:       static.NewLayer(b, types.MediaType("application/octet-stream")),
+			Annotations: map[string]string{ociTitleAnnotation: entry.Name()},
+		})
+		require.NoError(t, err)
+	}
+	tag, err := name.NewTag(ref + ":" + arch)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(tag, img, options...))
+}
+
+func TestOCIRepository(t *testing.T) {
+	ctx := context.Background()
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0", Arch: testArch, Dependencies: []string{"libfoo"}},
+		{Name: "libfoo", Version: "1.0.0", Arch: testArch},
+	}
+	dir := testLocalRepoWithFiles(t, testArch, packages, map[string][]testDirEntry{
+		"foo":    {{path: "usr", dir: true, perms: 0o755}, {path: "usr/foo", perms: 0o755, content: []byte("foo")}},
+		"libfoo": {{path: "usr", dir: true, perms: 0o755}, {path: "usr/libfoo.so", perms: 0o644, content: []byte("libfoo")}},
+	})
+
+	s := testTokenRegistry(t, "user", "pass")
+	host := strings.TrimPrefix(s.URL, "http://")
+	testPushOCIRepository(t, host+"/apk/main", dir, testArch, remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"}))
+	repo := "oci://" + host + "/apk/main"
+
+	t.Run("install", func(t *testing.T) {
+		a, src := testAPKWithRepos(t, []string{repo}, WithAuth(host, "user", "pass"))
+		require.NoError(t, a.ValidateRepositories(ctx))
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+
+		for _, path := range []string{"usr/foo", "usr/libfoo.so"} {
+			_, err := src.Stat(path)
+			require.NoError(t, err, path)
+		}
+	})
+	for _, tt := range []struct {
+		name          string
+		authenticator apkauth.Authenticator
+	}{
+		// exchanged for a token by the registry
+		{"basic", apkauth.StaticAuth(host, "user", "pass")},
+		{"bearer", apkauth.BearerAuth(host, "test-token")},
+	} {
+		t.Run("authenticator "+tt.name, func(t *testing.T) {
+			ref := host + "/apk/" + tt.name
+			testPushOCIRepository(t, ref, dir, testArch, remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"}))
+			a, src := testAPKWithRepos(t, []string{"oci://" + ref}, WithAuthenticator(tt.authenticator))
+			require.NoError(t, a.ValidateRepositories(ctx))
+			require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+			require.NoError(t, a.FixateWorld(ctx, nil))
+			_, err := src.Stat("usr/foo")
+			require.NoError(t, err)
+		})
+	}
+	t.Run("unauthorized", func(t *testing.T) {
+		// A different repository path, so that the index is not served from the index cache.
+		testPushOCIRepository(t, host+"/apk/other", dir, testArch, remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"}))
+		a, _ := testAPKWithRepos(t, []string{"oci://" + host + "/apk/other"})
+		require.Error(t, a.ValidateRepositories(ctx))
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		require.Error(t, a.FixateWorld(ctx, nil))
+	})
+}
+
+func TestOCIRepositoryTimeout(t *testing.T) {
+	ctx := context.Background()
+	dir := testLocalRepoWithFiles(t, testArch, []*Package{{Name: "foo", Version: "1.0.0", Arch: testArch}}, nil)
+
+	// Manifests are served slower than the timeout.
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/") {
+			time.Sleep(500 * time.Millisecond)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+	testPushOCIRepository(t, host+"/apk/main", dir, testArch)
+
+	a, _ := testAPKWithRepos(t, []string{"oci://" + host + "/apk/main"}, WithHTTPTimeout(100*time.Millisecond))
+	require.ErrorContains(t, a.ValidateRepositories(ctx), "Client.Timeout exceeded")
+}
@@ -15,22 +15,66 @@
 package apk
 
 import (
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
+	apkauth "chainguard.dev/apko/pkg/apk/auth"
 	apkfs "chainguard.dev/apko/pkg/apk/fs"
 )
 
 type opts struct {
-	executor           Executor
-	arch               string
-	ignoreMknodErrors  bool
-	fs                 apkfs.FullFS
-	version            string
-	cache              *cache
-	noSignatureIndexes []string
-	auth               map[string]auth
+	executor               Executor
+	arch                   string
+	ignoreMknodErrors      bool
+	fs                     apkfs.FullFS
+	version                string
+	cache                  *cache
+	cacheBackend           Cache
+	noSignatureIndexes     []string
+	auth                   map[string]auth
+	parallelFetch          int
+	fetchRetry             retryPolicy
+	downgradePolicy        DowngradePolicy
+	progressNotifier       ProgressNotifier
+	verifyExpandedFiles    bool
+	httpTimeout            time.Duration
+	verifyIndexSignature   bool
+	offline                bool
+	urlRewriter            func(string) string
+	workDir                string
+	scriptRunner           ScriptRunner
+	extraKeys              map[string][]byte
+	validateWorld          bool
+	dedupeFiles            bool
+	transportTuning        *transportTuning
+	licensePolicy          *licensePolicy
+	worldOrdering          WorldOrdering
+	ignoreSignatures       bool
+	maxDownloadSize        int64
+	ownerRemap             func(uid, gid int) (int, int)
+	resumableDownloads     bool
+	maxIndexAge            time.Duration
+	versionComparer        VersionComparer
+	pathExcludes           []string
+	pruneExcludedDirs      bool
+	authenticator          apkauth.Authenticator
+	parallelExpand         int
+	indexFormats           []string
+	sourceDateEpoch        *time.Time
+	checksumMismatchPolicy ChecksumMismatchPolicy
+	verifyCachedPackages   bool
+	initDBProfile          []PlannedEntry
+	detachedSignaturesURL  string
+	logger                 *slog.Logger
+	indexCacheTTL          time.Duration
+	installPrefix          string
+	extraHeaders           map[string]string
+	repoHeaders            map[string]map[string]string
+	trustedRepositories    []string
+	snapshotDate           time.Time
 }
 
 type Option func(*opts) error
@@ -81,6 +125,9 @@ func WithFS(fs apkfs.FullFS) Option {
 //
 // If offline is true, only read from the cache and do not make any network requests to
 // populate it.
+//
+// The cache directory records the version of its layout. Entries written with another layout
+// are removed when the APK is created, so that they are fetched again rather than misread.
 func WithCache(cacheDir string, offline bool) Option {
 	return func(o *opts) error {
 		var err error
@@ -99,6 +146,467 @@ func WithCache(cacheDir string, offline bool) Option {
 	}
 }
 
+// WithOffline guarantees that no network requests are made. Packages, indexes and keys are
+// only read from the cache set with WithCache or WithCacheBackend, and anything missing from it
+// fails with ErrOffline. Default is false.
+func WithOffline(offline bool) Option {
+	return func(o *opts) error {
+		o.offline = offline
+		return nil
+	}
+}
+
+// WithCacheBackend sets a Cache to use for downloaded apk files and APKINDEX files, for example
+// one shared between machines. If WithCache is also provided, the cache directory is used instead.
+// Unlike the cache directory, a backend does not record when an index was last revalidated, so
+// indexes are revalidated on every use, WithIndexCacheTTL has no effect and WithOffline only
+// serves packages.
+func WithCacheBackend(c Cache) Option {
+	return func(o *opts) error {
+		o.cacheBackend = c
+		return nil
+	}
+}
+
+// WithParallelFetch bounds the number of packages that are fetched and expanded
+// concurrently. If not provided, or if n is less than 1, there is no limit.
+func WithParallelFetch(n int) Option {
+	return func(o *opts) error {
+		o.parallelFetch = n
+		return nil
+	}
+}
+
+// WithFetchRetry retries package and index downloads that fail with a network error or a 5xx
+// response, up to attempts tries in total. Each retry waits twice as long as the previous one,
+// starting at baseDelay, plus some jitter. Other responses, such as 403 or 404, are not retried.
+// If not provided, requests are attempted once.
+func WithFetchRetry(attempts int, baseDelay time.Duration) Option {
+	return func(o *opts) error {
+		o.fetchRetry = retryPolicy{attempts: attempts, baseDelay: baseDelay}
+		return nil
+	}
+}
+
+// WithHTTPTimeout limits how long each package or index request may take, including reading
+// the response body. If not provided, only the deadline of the passed context applies.
+func WithHTTPTimeout(d time.Duration) Option {
+	return func(o *opts) error {
+		o.httpTimeout = d
+		return nil
+	}
+}
+
+// WithURLRewriter rewrites the URL of every repository request right before it is sent, for
+// example to route all traffic through an internal mirror. Cache entries are still keyed by the
+// original URL, so caches stay portable between environments with and without the rewriter.
+func WithURLRewriter(rewrite func(string) string) Option {
+	return func(o *opts) error {
+		o.urlRewriter = rewrite
+		return nil
+	}
+}
+
+// WithWorkDir sets the directory packages are expanded into and installed from, which must
+// exist. Everything written there is removed again once it is no longer needed. Packages that are
+// cached are still expanded within the cache directory. If not provided, the default directory
+// for temporary files is used.
+func WithWorkDir(path string) Option {
+	return func(o *opts) error {
+		o.workDir = path
+		return nil
+	}
+}
+
+// WithScriptRunner hands the install scripts of every package, such as .pre-install and
+// .post-install, to runner as the package is installed. Scripts named .pre-* are passed before
+// the package's files are installed, all others afterwards, except for .trigger which is left to
+// RunTriggers. If not provided, scripts are only recorded in the installed database and never run.
+func WithScriptRunner(runner ScriptRunner) Option {
+	return func(o *opts) error {
+		o.scriptRunner = runner
+		return nil
+	}
+}
+
+// WithExtraKeys supplies public keys by name, in addition to those found in etc/apk/keys, for
+// example when keys are embedded rather than stored on disk. They are used to verify repository
+// indexes, and InitKeyring takes a key whose name matches one of them from here instead of
+// reading or fetching it. A key in etc/apk/keys takes precedence over one with the same name.
+func WithExtraKeys(keys map[string][]byte) Option {
+	return func(o *opts) error {
+		o.extraKeys = keys
+		return nil
+	}
+}
+
+// WithValidateWorld makes SetWorld call ValidateWorld first, and leave etc/apk/world untouched
+// if the packages cannot be resolved. Default is false.
+func WithValidateWorld(validate bool) Option {
+	return func(o *opts) error {
+		o.validateWorld = validate
+		return nil
+	}
+}
+
+// WithDedupeFiles hardlinks each regular file that is installed to an earlier identical file,
+// with the same content, mode, ownership and xattrs, instead of writing another copy. If the
+// filesystem does not support hardlinks, files are written out as usual. This only applies to
+// filesystems that files are written to, not those that install lazily via WriteHeaderer.
+// Default is false.
+func WithDedupeFiles(dedupe bool) Option {
+	return func(o *opts) error {
+		o.dedupeFiles = dedupe
+		return nil
+	}
+}
+
+// WithTransportTuning configures the http.Transport of the default client, to keep up to
+// maxIdleConnsPerHost idle connections to each host for reuse, and to attempt HTTP/2 if forceHTTP2
+// is true. If forceHTTP2 is false, HTTP/2 is attempted as by http.DefaultTransport. A client
+// passed to SetClient is used as is, without any tuning.
+func WithTransportTuning(maxIdleConnsPerHost int, forceHTTP2 bool) Option {
+	return func(o *opts) error {
+		o.transportTuning = &transportTuning{maxIdleConnsPerHost: maxIdleConnsPerHost, forceHTTP2: forceHTTP2}
+		return nil
+	}
+}
+
+// WithLicensePolicy fails resolution with a LicensePolicyError for every package whose license
+// matches an entry in deny or, if allow is not empty, is not in allow. Licenses are compared as
+// SPDX expressions, so "MIT OR GPL-3.0-only" is permitted if either license is. Entries match
+// identifiers case insensitively, and an entry such as GPL-3.0 also matches GPL-3.0-only,
+// GPL-3.0-or-later and GPL-3.0+. Packages without a license fail a non-empty allow list.
+func WithLicensePolicy(allow, deny []string) Option {
+	return func(o *opts) error {
+		if len(allow) == 0 && len(deny) == 0 {
+			o.licensePolicy = nil
+			return nil
+		}
+		o.licensePolicy = &licensePolicy{allow: allow, deny: deny}
+		return nil
+	}
+}
+
+// WorldOrdering is the order in which SetWorld writes packages to etc/apk/world.
+type WorldOrdering int
+
+const (
+	// WorldOrderAlpha sorts the packages alphabetically. This is the default.
+	WorldOrderAlpha WorldOrdering = iota
+	// WorldOrderInsertion keeps the packages in the order they were given.
+	WorldOrderInsertion
+)
+
+// WithWorldOrdering sets the order in which SetWorld writes packages. If not provided, they are
+// sorted alphabetically.
+func WithWorldOrdering(ordering WorldOrdering) Option {
+	return func(o *opts) error {
+		o.worldOrdering = ordering
+		return nil
+	}
+}
+
+// WithMaxDownloadSize aborts the download of any package larger than bytes, or larger than the
+// size its index declares, with a DownloadSizeError. If not provided or not positive,
+// downloads are not limited.
+func WithMaxDownloadSize(bytes int64) Option {
+	return func(o *opts) error {
+		o.maxDownloadSize = bytes
+		return nil
+	}
+}
+
+// WithUIDGIDMap installs every file, and creates every file InitDB creates, owned by uid and gid
+// instead of the owner recorded in the package. Mode bits are kept. If not provided, files keep
+// their recorded owner.
+func WithUIDGIDMap(uid, gid int) Option {
+	return WithOwnershipRemap(func(int, int) (int, int) { return uid, gid })
+}
+
+// WithOwnershipRemap is like WithUIDGIDMap, but calls remap with the recorded owner of each file
+// to get the owner to install it with.
+func WithOwnershipRemap(remap func(uid, gid int) (int, int)) Option {
+	return func(o *opts) error {
+		o.ownerRemap = remap
+		return nil
+	}
+}
+
+// WithResumableDownloads keeps the bytes of index and package downloads in the cache directory as
+// they arrive, so that an interrupted download continues where it stopped with a Range request
+// the next time, instead of starting over. Servers that answer a Range request with the whole
+// file are handled by starting over. Only has an effect with WithCache. Default is false.
+func WithResumableDownloads(resumable bool) Option {
+	return func(o *opts) error {
+		o.resumableDownloads = resumable
+		return nil
+	}
+}
+
+// WithMaxIndexAge sets the maximum age of a cached repository index, as reported by IndexAge.
+// Older indexes are revalidated with the repository before they are used, even if this process
+// already fetched them, and in offline mode they are an error. Only has an effect with WithCache.
+// Default is 0, which means cached indexes are used at any age.
+func WithMaxIndexAge(d time.Duration) Option {
+	return func(o *opts) error {
+		o.maxIndexAge = d
+		return nil
+	}
+}
+
+// WithVersionComparer sets how versions are ordered when resolving packages, to pick the newest
+// version of a package and to check version constraints other than ~, and when applying the
+// downgrade policy. Default is APKVersionComparer.
+func WithVersionComparer(c VersionComparer) Option {
+	return func(o *opts) error {
+		o.versionComparer = c
+		return nil
+	}
+}
+
+// WithPathExcludes skips the files and directories that match any of patterns when installing
+// packages, along with everything under a matching directory. Patterns use the syntax of
+// path.Match and are matched against paths relative to the root, without a leading slash, such
+// as "usr/share/man/*". Excluded files are not written and are not recorded as owned by their
+// package in the installed database.
+func WithPathExcludes(patterns []string) Option {
+	return func(o *opts) error {
+		o.pathExcludes = patterns
+		return nil
+	}
+}
+
+// WithPruneExcludedDirs removes the directories that a package creates and that are left empty
+// because everything in them was excluded with WithPathExcludes. Default is false.
+func WithPruneExcludedDirs(prune bool) Option {
+	return func(o *opts) error {
+		o.pruneExcludedDirs = prune
+		return nil
+	}
+}
+
+// WithParallelExpand writes up to n of the regular files of a package at once while installing
+// it, rather than one at a time. Directories, links and other entries are still created in
+// order, as they are read. Files of up to 8 MiB are read into memory to be handed to a writer,
+// so memory use grows with n. This only applies to filesystems that files are written to, not
+// those that install lazily via WriteHeaderer. If not provided, or if n is less than 2, files
+// are written one at a time.
+func WithParallelExpand(n int) Option {
+	return func(o *opts) error {
+		o.parallelExpand = n
+		return nil
+	}
+}
+
+// WithIndexFormats sets the index files to look for in each repository, in the order given,
+// such as "APKINDEX.tar.zst" and "APKINDEX.tar.gz". Indexes are decoded according to their
+// content, so either may be gzip or zstd compressed. Signatures can only be verified for gzip
+// indexes. By default, DefaultIndexFilenames are looked for.
+func WithIndexFormats(formats []string) Option {
+	return func(o *opts) error {
+		o.indexFormats = formats
+		return nil
+	}
+}
+
+// WithSourceDateEpoch sets the access and modification times of the files, directories and
+// devices that InitDB and InstallPackages create, and of the installed database, to t, so that
+// installs are reproducible. It is also used for the scripts of packages when InstallPackages is
+// not given a time of its own. The filesystem must implement fs.ChtimesFS.
+func WithSourceDateEpoch(t time.Time) Option {
+	return func(o *opts) error {
+		o.sourceDateEpoch = &t
+		return nil
+	}
+}
+
+// WithChecksumMismatchPolicy sets what happens when a package does not match the checksums of
+// its index entry. It also makes cached packages get checked each time they are used, which
+// means reading them in full. By default, mismatches fail the install and cached packages are
+// trusted.
+func WithChecksumMismatchPolicy(policy ChecksumMismatchPolicy) Option {
+	return func(o *opts) error {
+		o.checksumMismatchPolicy = policy
+		o.verifyCachedPackages = true
+		return nil
+	}
+}
+
+// WithInitDBProfile sets the directories, files and device files InitDB creates, in place of
+// DefaultInitDBProfile. Entries are created in order without their parents, so a directory must
+// come before what it holds, and the base directories such as /etc and /dev are still created.
+// Entries of other types than tar.TypeDir, tar.TypeReg and tar.TypeChar are ignored. An empty
+// profile creates nothing beyond the base directories.
+func WithInitDBProfile(profile []PlannedEntry) Option {
+	return func(o *opts) error {
+		if profile == nil {
+			profile = []PlannedEntry{}
+		}
+		o.initDBProfile = profile
+		return nil
+	}
+}
+
+// WithDetachedSignatures verifies every package against a detached signature manifest at u,
+// a file path or an http(s) URL, in addition to the checks done otherwise. Each line of the
+// manifest holds the filename of a package and the base64 of an RSA signature over the SHA1
+// digest of the whole .apk file, separated by whitespace; empty lines and lines starting with #
+// are skipped. A package is rejected unless the manifest has a signature for it that one of the
+// keys in etc/apk/keys or given by WithExtraKeys verifies. The manifest is fetched once, when
+// the first package is.
+func WithDetachedSignatures(u string) Option {
+	return func(o *opts) error {
+		o.detachedSignaturesURL = u
+		return nil
+	}
+}
+
+// WithLogger sets the logger for what the APK does, in place of the one in the context of each
+// call. Resolution, fetches, cache hits and misses, and index signature checks are logged at
+// debug level, with the package, repository or index they concern as attributes.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *opts) error {
+		o.logger = logger
+		return nil
+	}
+}
+
+// WithIndexCacheTTL sets how long a cached repository index is used without revalidating it with
+// the repository, even by a new process. Once it is older, it is revalidated with its etag or
+// Last-Modified value before it is used. Packages are never revalidated, as they do not change
+// once published. Only has an effect with WithCache. Default is 0, which revalidates cached
+// indexes once in each process.
+func WithIndexCacheTTL(d time.Duration) Option {
+	return func(o *opts) error {
+		o.indexCacheTTL = d
+		return nil
+	}
+}
+
+// WithInstallPrefix installs into the directory prefix of the filesystem rather than at its
+// root, for staging a root to layer elsewhere. Everything, the database in lib/apk/db and
+// etc/apk included, is read and written under prefix, and the paths the database records are
+// relative to it. prefix must be a relative path, or an absolute one that is taken relative to
+// the root of the filesystem. Default is "", which installs at the root.
+func WithInstallPrefix(prefix string) Option {
+	return func(o *opts) error {
+		o.installPrefix = prefix
+		return nil
+	}
+}
+
+// WithExtraHeaders adds headers to every request for indexes, packages and keys, for example a
+// token that a CDN requires or a User-Agent that a mirror allows. They never replace a header that
+// the request already has, such as the Authorization header from WithAuth or WithAuthenticator.
+func WithExtraHeaders(headers map[string]string) Option {
+	return func(o *opts) error {
+		o.extraHeaders = headers
+		return nil
+	}
+}
+
+// WithRepositoryHeaders is like WithExtraHeaders, but only for requests to the repository at
+// repo, that is, to URLs within it. They take precedence over headers with the same name from
+// WithExtraHeaders. Where repositories are nested, the headers of the longest match apply.
+func WithRepositoryHeaders(repo string, headers map[string]string) Option {
+	return func(o *opts) error {
+		if o.repoHeaders == nil {
+			o.repoHeaders = make(map[string]map[string]string)
+		}
+		o.repoHeaders[repo] = headers
+		return nil
+	}
+}
+
+// WithTrustedRepositories only installs packages from repositories on hosts, which match the
+// host of a repository URL with or without its port. Packages from other repositories, including
+// local ones, are left out of resolution, and resolution fails with an UntrustedRepositoryError
+// for each package, dependencies included, that is only available from them. With no hosts, every
+// repository is trusted.
+func WithTrustedRepositories(hosts []string) Option {
+	return func(o *opts) error {
+		o.trustedRepositories = hosts
+		return nil
+	}
+}
+
+// WithSnapshotDate resolves against the snapshot of each repository taken at t, for repositories
+// whose URL says where their snapshots are with a {snapshot} placeholder, such as
+// https://example.com/snapshots/{snapshot}/main. The placeholder is replaced with t in UTC, as
+// 20060102T150405Z, or in the Go time layout given after a colon, as in {snapshot:2006-01-02}.
+// Indexes and packages are then fetched, and cached, by the URL of that snapshot. Repositories
+// without the placeholder are not affected, while those with it fail to load if no date is set.
+func WithSnapshotDate(t time.Time) Option {
+	return func(o *opts) error {
+		o.snapshotDate = t
+		return nil
+	}
+}
+
+// WithProgressNotifier sets a ProgressNotifier to receive events while resolving, fetching and
+// installing packages. If not provided, no events are sent.
+func WithProgressNotifier(notifier ProgressNotifier) Option {
+	return func(o *opts) error {
+		o.progressNotifier = notifier
+		return nil
+	}
+}
+
+// WithVerifyExpandedFiles checks every regular file written while installing a package against
+// the checksum recorded for it in the package, failing the install on a mismatch.
+// Default is false.
+func WithVerifyExpandedFiles(verify bool) Option {
+	return func(o *opts) error {
+		o.verifyExpandedFiles = verify
+		return nil
+	}
+}
+
+// DowngradePolicy controls what happens when resolution selects an older version of a package
+// than the one already recorded in the installed database.
+type DowngradePolicy int
+
+const (
+	// DowngradeAllow installs the older version. This is the default.
+	DowngradeAllow DowngradePolicy = iota
+	// DowngradeWarn installs the older version and logs a warning.
+	DowngradeWarn
+	// DowngradeForbid fails resolution with a DowngradeError.
+	DowngradeForbid
+)
+
+// WithDowngradePolicy sets how to handle packages that would be downgraded. If not provided,
+// downgrades are allowed.
+func WithDowngradePolicy(policy DowngradePolicy) Option {
+	return func(o *opts) error {
+		o.downgradePolicy = policy
+		return nil
+	}
+}
+
+// WithInsecureIgnoreSignatures disables signature verification for every repository index, as
+// if all of them were listed in WithNoSignatureIndexes. It is meant for development against
+// unsigned repositories, and a warning is logged whenever indexes are loaded with it set.
+// Packages are still checked against the checksums in their index, which is all that ties
+// them to a signature. It cannot be combined with WithVerifyIndexSignature. Default is false.
+func WithInsecureIgnoreSignatures(ignore bool) Option {
+	return func(o *opts) error {
+		o.ignoreSignatures = ignore
+		return nil
+	}
+}
+
+// WithVerifyIndexSignature requires every repository index to be signed by a key in
+// etc/apk/keys. When set, indexes listed in WithNoSignatureIndexes are verified too, and the
+// ignoreSignatures argument of GetRepositoryIndexes has no effect. Default is false.
+func WithVerifyIndexSignature(verify bool) Option {
+	return func(o *opts) error {
+		o.verifyIndexSignature = verify
+		return nil
+	}
+}
+
 func WithNoSignatureIndexes(noSignatureIndex ...string) Option {
 	return func(o *opts) error {
 		o.noSignatureIndexes = append(o.noSignatureIndexes, noSignatureIndex...)
@@ -118,6 +626,17 @@ func WithAuth(domain, user, pass string) Option {
 	}
 }
 
+// WithAuthenticator adds credentials from authenticator to the requests for packages, indexes
+// and keys that get none from WithAuth or the repository URL. Use auth.ChainAuth to combine
+// authenticators for different hosts. For OCI repositories, registries that require bearer tokens
+// get them in exchange for the credentials it adds.
+func WithAuthenticator(authenticator apkauth.Authenticator) Option {
+	return func(o *opts) error {
+		o.authenticator = authenticator
+		return nil
+	}
+}
+
 func defaultOpts() *opts {
 	return &opts{
 		arch:              ArchToAPK(runtime.GOARCH),
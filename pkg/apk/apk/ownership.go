@@ -0,0 +1,42 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"fmt"
+)
+
+// remapOwner rewrites the owner of header with the configured ownership remapping, if any. The
+// user and group names are cleared, as they belong to the original ids.
+func (a *APK) remapOwner(header *tar.Header) {
+	if a.ownerRemap == nil {
+		return
+	}
+	header.Uid, header.Gid = a.ownerRemap(header.Uid, header.Gid)
+	header.Uname, header.Gname = "", ""
+}
+
+// chownRemapped gives the file written for header the owner in header, if ownership is remapped.
+// Links are skipped, as changing their owner would change that of their target.
+func (a *APK) chownRemapped(header *tar.Header) error {
+	if a.ownerRemap == nil || header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink {
+		return nil
+	}
+	if err := a.fs.Chown(header.Name, header.Uid, header.Gid); err != nil {
+		return fmt.Errorf("error changing owner of %s: %w", header.Name, err)
+	}
+	return nil
+}
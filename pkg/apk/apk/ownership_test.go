@@ -0,0 +1,89 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUIDGIDMap(t *testing.T) {
+	ctx := context.Background()
+	packages := []*Package{{Name: "foo", Version: "1.0.0", Arch: testArch}}
+	repo := testLocalRepoWithFiles(t, testArch, packages, map[string][]testDirEntry{
+		"foo": {
+			{path: "usr", dir: true, perms: 0o755},
+			{path: "usr/bin", dir: true, perms: 0o750},
+			{path: "usr/bin/foo", perms: 0o4755, content: []byte("foo")},
+		},
+	})
+
+	owner := func(t *testing.T, fi os.FileInfo) (int, int) {
+		t.Helper()
+		hdr, ok := fi.Sys().(*tar.Header)
+		require.True(t, ok)
+		return hdr.Uid, hdr.Gid
+	}
+
+	a, src := testAPKWithRepos(t, []string{repo}, WithUIDGIDMap(1000, 1001))
+	require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	for path, mode := range map[string]os.FileMode{
+		"usr":         0o755,
+		"usr/bin":     0o750,
+		"usr/bin/foo": 0o755 | os.ModeSetuid,
+	} {
+		fi, err := src.Stat(path)
+		require.NoError(t, err)
+		uid, gid := owner(t, fi)
+		require.Equal(t, 1000, uid, path)
+		require.Equal(t, 1001, gid, path)
+		require.Equal(t, mode, fi.Mode()&(os.ModePerm|os.ModeSetuid), path)
+	}
+
+	db, err := src.ReadFile(installedFilePath)
+	require.NoError(t, err)
+	require.Contains(t, string(db), "F:usr\nM:1000:1001:0755\n")
+	require.Contains(t, string(db), "F:usr/bin\nM:1000:1001:0750\n")
+	require.Contains(t, string(db), "R:foo\na:1000:1001:0755\n")
+
+	fi, err := src.Stat("dev/null")
+	require.NoError(t, err)
+	uid, gid := owner(t, fi)
+	require.Equal(t, 1000, uid, "device files should be remapped too")
+	require.Equal(t, 1001, gid)
+	for _, hdr := range a.ListInitFiles() {
+		require.Equal(t, 1000, hdr.Uid, hdr.Name)
+	}
+
+	t.Run("remap function", func(t *testing.T) {
+		a, src := testAPKWithRepos(t, []string{repo}, WithOwnershipRemap(func(uid, gid int) (int, int) {
+			return uid + 100000, gid + 100000
+		}))
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+
+		fi, err := src.Stat("usr/bin/foo")
+		require.NoError(t, err)
+		uid, gid := owner(t, fi)
+		require.Equal(t, 100000, uid)
+		require.Equal(t, 100000, gid)
+	})
+}
@@ -17,10 +17,10 @@ package apk
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/sha1" //nolint:gosec // this is what apk tools is using
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -49,7 +49,7 @@ func PackageToInstalled(pkg *Package) (out []string) {
 	}
 	out = append(out, fmt.Sprintf("c:%s", pkg.RepoCommit))
 	out = append(out, fmt.Sprintf("i:%s", pkg.InstallIf))
-	out = append(out, fmt.Sprintf("t:%d", pkg.BuildTime.Unix()))
+	out = append(out, fmt.Sprintf("t:%d", buildDate(pkg.BuildTime)))
 	out = append(out, fmt.Sprintf("S:%d", pkg.Size))
 	out = append(out, fmt.Sprintf("I:%d", pkg.InstalledSize))
 	out = append(out, fmt.Sprintf("k:%d", pkg.ProviderPriority))
@@ -86,6 +86,11 @@ type PackageInfo struct {
 	RepoCommit       string   `ini:"commit"`
 	Replaces         []string `ini:"replaces,,allowshadow"`
 	DataHash         string   `ini:"datahash"`
+	Triggers         []string `ini:"triggers,,allowshadow"`
+
+	// RawFields holds every field of .PKGINFO, including those not modeled above, keyed by
+	// name, with the values of repeated fields in order.
+	RawFields map[string][]string
 }
 
 // Package represents a single package with the information present in an
@@ -106,11 +111,25 @@ type Package struct {
 	Size             uint64 `ini:"size"`
 	InstalledSize    uint64
 	ProviderPriority uint64 `ini:"provider_priority"`
-	BuildTime        time.Time
-	BuildDate        int64    `ini:"builddate"`
-	RepoCommit       string   `ini:"commit"`
-	Replaces         []string `ini:"replaces,,allowshadow"`
-	DataHash         string   `ini:"datahash"`
+	// BuildTime is when the package was built, from the t: field of an index or the builddate
+	// of .PKGINFO. It is the zero time if the package does not say or cannot be parsed.
+	BuildTime  time.Time
+	BuildDate  int64    `ini:"builddate"`
+	RepoCommit string   `ini:"commit"`
+	Replaces   []string `ini:"replaces,,allowshadow"`
+	DataHash   string   `ini:"datahash"`
+	// Triggers holds the directory globs that the package's .trigger script watches, as
+	// space-separated lists. Only set for packages parsed from an .apk.
+	Triggers []string `ini:"triggers,,allowshadow"`
+
+	// Scripts holds the install scripts from the control section, such as .post-install,
+	// keyed by name. Only set for packages parsed from an .apk, as indexes do not carry them.
+	Scripts map[string][]byte
+
+	// RawFields holds every field of .PKGINFO, including those not modeled above, keyed by
+	// name, with the values of repeated fields in order. Only set for packages parsed from an
+	// .apk.
+	RawFields map[string][]string
 }
 
 func (p *Package) String() string {
@@ -131,7 +150,7 @@ func (p *Package) ChecksumString() string {
 
 // ParsePackage parses a .apk file and returns a Package struct
 func ParsePackage(ctx context.Context, apkPackage io.Reader, size uint64) (*Package, error) {
-	pkginfo, h, err := ParsePackageInfo(apkPackage)
+	pkginfo, h, scripts, err := parseControl(apkPackage)
 	if err != nil {
 		return nil, err
 	}
@@ -152,19 +171,28 @@ func ParsePackage(ctx context.Context, apkPackage io.Reader, size uint64) (*Pack
 		Size:             size,
 		InstalledSize:    pkginfo.Size,
 		ProviderPriority: pkginfo.ProviderPriority,
-		BuildTime:        time.Unix(pkginfo.BuildDate, 0).UTC(),
+		BuildTime:        buildTime(pkginfo.BuildDate),
 		BuildDate:        pkginfo.BuildDate,
 		RepoCommit:       pkginfo.RepoCommit,
 		Replaces:         pkginfo.Replaces,
 		DataHash:         pkginfo.DataHash,
+		Triggers:         pkginfo.Triggers,
+		Scripts:          scripts,
+		RawFields:        pkginfo.RawFields,
 	}, nil
 }
 
 // ParsePackageInfo returns a parsed .PKGINFO from an APK reader and the control section hash.
 func ParsePackageInfo(apkPackage io.Reader) (*PackageInfo, hash.Hash, error) {
+	pkginfo, h, _, err := parseControl(apkPackage)
+	return pkginfo, h, err
+}
+
+// parseControl is like ParsePackageInfo, but also returns the install scripts.
+func parseControl(apkPackage io.Reader) (*PackageInfo, hash.Hash, map[string][]byte, error) {
 	split, err := expandapk.Split(apkPackage)
 	if err != nil {
-		return nil, nil, fmt.Errorf("splitting apk: %w", err)
+		return nil, nil, nil, fmt.Errorf("splitting apk: %w", err)
 	}
 	control := split[0]
 	if len(split) == 3 {
@@ -174,38 +202,80 @@ func ParsePackageInfo(apkPackage io.Reader) (*PackageInfo, hash.Hash, error) {
 
 	b, err := io.ReadAll(control)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	h := sha1.New() //nolint:gosec
 	if _, err = h.Write(b); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	zr, err := gzip.NewReader(bytes.NewReader(b))
+	zr, err := expandapk.NewDecompressor(bytes.NewReader(b))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
+	defer zr.Close()
 
+	var (
+		pkg     *PackageInfo
+		scripts map[string][]byte
+	)
 	tr := tar.NewReader(zr)
 	for {
 		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) && pkg != nil {
+			return pkg, h, scripts, nil
+		}
 		if err != nil {
-			return nil, nil, fmt.Errorf("did not see .PKGINFO in APK: %w", err)
+			return nil, nil, nil, fmt.Errorf("did not see .PKGINFO in APK: %w", err)
 		}
 
 		if hdr.Name == ".PKGINFO" {
 			cfg, err := ini.ShadowLoad(tr)
 			if err != nil {
-				return nil, nil, fmt.Errorf("ini.ShadowLoad(): %w", err)
+				return nil, nil, nil, fmt.Errorf("ini.ShadowLoad(): %w", err)
 			}
 
-			pkg := new(PackageInfo)
+			pkg = new(PackageInfo)
 			if err = cfg.MapTo(pkg); err != nil {
-				return nil, nil, fmt.Errorf("cfg.MapTo(): %w", err)
+				return nil, nil, nil, fmt.Errorf("cfg.MapTo(): %w", err)
 			}
-
-			return pkg, h, nil
+			pkg.RawFields = rawFields(cfg)
+		} else if isScript(hdr) {
+			script, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("reading %s: %w", hdr.Name, err)
+			}
+			if scripts == nil {
+				scripts = map[string][]byte{}
+			}
+			scripts[hdr.Name] = script
 		}
 	}
 }
+
+// buildTime returns the time of the Unix timestamp builddate, or the zero time for a package
+// that has none.
+func buildTime(builddate int64) time.Time {
+	if builddate <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(builddate, 0).UTC()
+}
+
+// buildDate is the Unix timestamp of t, or 0 for the zero time, as written to the t: field.
+func buildDate(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// rawFields returns all the fields of a parsed .PKGINFO.
+func rawFields(cfg *ini.File) map[string][]string {
+	fields := map[string][]string{}
+	for _, key := range cfg.Section(ini.DefaultSection).Keys() {
+		fields[key.Name()] = append(fields[key.Name()], key.ValueWithShadows()...)
+	}
+	return fields
+}
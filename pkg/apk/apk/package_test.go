@@ -1,12 +1,17 @@
 package apk
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParsePackage(t *testing.T) {
@@ -45,7 +50,6 @@ func TestParsePackage(t *testing.T) {
 			Dependencies:  []string{"busybox"},
 			Size:          499,
 			InstalledSize: 4117,
-			BuildTime:     time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC),
 			BuildDate:     0,
 			DataHash:      "1c6e256b3f9e0629730659382a81f82d4ac81b0f04fc9e70a6b1b5c653989911",
 		},
@@ -61,7 +65,6 @@ func TestParsePackage(t *testing.T) {
 			Replaces:      []string{"foo", "bar"},
 			Size:          1477,
 			InstalledSize: 2532,
-			BuildTime:     time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC),
 			BuildDate:     0,
 			DataHash:      "71b14cc95cf71f4f6c1666cb1699b3bc4f52d17f5575c893324c8f62bb19d9b3",
 		},
@@ -82,9 +85,42 @@ func TestParsePackage(t *testing.T) {
 			if err != nil {
 				t.Fatalf("ParsePackage(): %v", err)
 			}
-			if d := cmp.Diff(c.want, got); d != "" {
+			if d := cmp.Diff(c.want, got, cmpopts.IgnoreFields(Package{}, "RawFields")); d != "" {
 				t.Errorf("ParsePackage() mismatch (-want  got):\n%s", d)
 			}
 		})
 	}
 }
+
+func TestParsePackageRawFields(t *testing.T) {
+	pkginfo := []byte(`pkgname = custom
+pkgver = 1.0.0-r0
+arch = x86_64
+depend = foo
+depend = bar
+X-Custom = hello
+X-Custom = world
+`)
+
+	// An .apk is the gzipped control section followed by the gzipped data section.
+	var apk bytes.Buffer
+	for _, section := range []map[string][]byte{{".PKGINFO": pkginfo}, {"usr/share/custom": []byte("data")}} {
+		zw := gzip.NewWriter(&apk)
+		tw := tar.NewWriter(zw)
+		for name, b := range section {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(b))}))
+			_, err := tw.Write(b)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Flush())
+		require.NoError(t, zw.Close())
+	}
+
+	pkg, err := ParsePackage(context.Background(), bytes.NewReader(apk.Bytes()), uint64(apk.Len()))
+	require.NoError(t, err)
+	require.Equal(t, "custom", pkg.Name)
+	require.Equal(t, []string{"foo", "bar"}, pkg.Dependencies)
+	require.Equal(t, []string{"hello", "world"}, pkg.RawFields["X-Custom"])
+	require.Equal(t, []string{"foo", "bar"}, pkg.RawFields["depend"])
+	require.Equal(t, []string{"1.0.0-r0"}, pkg.RawFields["pkgver"])
+}
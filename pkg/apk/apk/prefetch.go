@@ -0,0 +1,123 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+)
+
+// PrefetchWorld resolves the world and downloads every resolved package into the cache, so that
+// a later install, even in offline mode, does not need the network. Packages are neither
+// expanded nor installed, and the target filesystem is only read. Indexes are revalidated with
+// their repositories as usual. Packages that are already cached, or that come from local
+// repositories, are skipped. Downloads run concurrently, bounded by WithParallelFetch if set, and
+// start with the largest packages. It is an error if no cache is configured.
+func (a *APK) PrefetchWorld(ctx context.Context) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "PrefetchWorld")
+	defer span.End()
+
+	if a.fileCache() == nil {
+		return errors.New("no cache to prefetch packages into")
+	}
+
+	toInstall, _, err := a.ResolveWorld(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting package dependencies: %w", err)
+	}
+
+	var g errgroup.Group
+	if a.parallelFetch > 0 {
+		g.SetLimit(a.parallelFetch)
+	}
+	for _, i := range largestFirst(toInstall) {
+		pkg := toInstall[i]
+		u := pkg.URL()
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			continue
+		}
+		if a.packageCached(pkg) {
+			continue
+		}
+		g.Go(func() error {
+			if err := a.prefetchPackage(ctx, pkg); err != nil {
+				return fmt.Errorf("prefetching %s: %w", pkg.PackageName(), err)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// prefetchPackage downloads pkg into the cache.
+func (a *APK) prefetchPackage(ctx context.Context, pkg *RepositoryPackage) error {
+	// FetchPackage stores the package in the cache once it has been read in full.
+	rc, err := a.FetchPackage(ctx, pkg)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		rc.Close()
+		return err
+	}
+	return rc.Close()
+}
+
+// sizedReader fails at the end of a download of pkg that is not size bytes long, so that a
+// truncated download is not cached. A size of 0 is not checked.
+type sizedReader struct {
+	io.Reader
+	pkg  string
+	size int64
+	read int64
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	if errors.Is(err, io.EOF) && r.size > 0 && r.read != r.size {
+		return n, fmt.Errorf("downloaded %d bytes of %s, expected %d", r.read, r.pkg, r.size)
+	}
+	return n, err
+}
+
+// largestFirst returns the indexes of pkgs ordered by the size their index declares, largest
+// first, keeping the order of packages of the same or unknown size.
+func largestFirst[P InstallablePackage](pkgs []P) []int {
+	order := make([]int, len(pkgs))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(i, j int) int {
+		return cmp.Compare(declaredSize(pkgs[j]), declaredSize(pkgs[i]))
+	})
+	return order
+}
+
+// declaredSize returns the size that the index of pkg declares, or 0 if it is not known.
+func declaredSize(pkg InstallablePackage) uint64 {
+	if p, ok := pkg.(*RepositoryPackage); ok {
+		return p.Size
+	}
+	return 0
+}
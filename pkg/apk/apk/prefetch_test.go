@@ -0,0 +1,156 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestPrefetchWorld(t *testing.T) {
+	ctx := context.Background()
+	globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+	t.Cleanup(func() { globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{} })
+
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0", Arch: testArch, Dependencies: []string{"bar"}},
+		{Name: "bar", Version: "1.0.0", Arch: testArch},
+		{Name: "baz", Version: "1.0.0", Arch: testArch},
+	}
+	entries := map[string][]testDirEntry{}
+	for _, pkg := range packages {
+		entries[pkg.Name] = []testDirEntry{{path: "usr", dir: true, perms: 0o755}, {path: "usr/" + pkg.Name, perms: 0o755, content: []byte(pkg.Name)}}
+	}
+	dir := testLocalRepoWithFiles(t, testArch, packages, entries)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(dir, r.URL.Path))
+	}))
+	defer s.Close()
+
+	cacheDir := t.TempDir()
+	a, src := testAPKWithRepos(t, []string{s.URL}, WithCache(cacheDir, false), WithParallelFetch(2))
+	require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+
+	// Concurrent prefetches of the same packages must not trip over each other.
+	var g errgroup.Group
+	for range 3 {
+		g.Go(func() error { return a.PrefetchWorld(ctx) })
+	}
+	require.NoError(t, g.Wait())
+
+	resolved, _, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+	require.Len(t, resolved, 2)
+	for _, pkg := range resolved {
+		u, err := packageAsURL(pkg)
+		require.NoError(t, err)
+		cacheFile, err := cachePathFromURL(cacheDir, *u)
+		require.NoError(t, err)
+		_, err = os.Stat(cacheFile)
+		require.NoError(t, err, "%s is not cached", pkg.Name)
+
+		// Nothing is expanded or installed.
+		expanded, err := cacheDirForPackage(cacheDir, pkg)
+		require.NoError(t, err)
+		_, err = os.Stat(expanded)
+		require.ErrorIs(t, err, os.ErrNotExist)
+		_, err = src.Stat("usr/" + pkg.Name)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+
+	// With the repository gone, an offline install is served from the cache.
+	s.Close()
+	offline, src := testAPKWithRepos(t, []string{s.URL}, WithCache(cacheDir, true))
+	require.NoError(t, offline.SetWorld(ctx, []string{"foo"}))
+	require.NoError(t, offline.FixateWorld(ctx, nil))
+	for _, name := range []string{"foo", "bar"} {
+		b, err := src.ReadFile("usr/" + name)
+		require.NoError(t, err)
+		require.Equal(t, name, string(b))
+	}
+
+	t.Run("no cache", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, []string{dir})
+		require.Error(t, a.PrefetchWorld(ctx))
+	})
+}
+
+func TestInstallPackagesLargestFirst(t *testing.T) {
+	ctx := context.Background()
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	t.Cleanup(func() { globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{} })
+
+	// Sizes are as the index declares them; the unsized package keeps its place after the rest.
+	packages := []*Package{
+		{Name: "small", Version: "1.0.0", Arch: testArch, Size: 10},
+		{Name: "unsized", Version: "1.0.0", Arch: testArch},
+		{Name: "large", Version: "1.0.0", Arch: testArch, Size: 100000},
+		{Name: "medium", Version: "1.0.0", Arch: testArch, Size: 1000},
+	}
+	entries := map[string][]testDirEntry{}
+	for _, pkg := range packages {
+		entries[pkg.Name] = []testDirEntry{{path: "usr", dir: true, perms: 0o755}, {path: "usr/" + pkg.Name, perms: 0o755, content: []byte(pkg.Name)}}
+	}
+	dir := testLocalRepoWithFiles(t, testArch, packages, entries)
+
+	var (
+		mu      sync.Mutex
+		fetched []string
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := path.Base(r.URL.Path); strings.HasSuffix(name, ".apk") {
+			mu.Lock()
+			fetched = append(fetched, strings.TrimSuffix(name, "-1.0.0.apk"))
+			mu.Unlock()
+		}
+		http.ServeFile(w, r, filepath.Join(dir, r.URL.Path))
+	}))
+	defer s.Close()
+
+	a, src := testAPKWithRepos(t, []string{s.URL}, WithParallelFetch(1))
+	indexes, err := a.GetRepositoryIndexes(ctx, false)
+	require.NoError(t, err)
+	var pkgs []InstallablePackage
+	for _, pkg := range packages {
+		repoPkg, err := NewPkgResolver(ctx, indexes).ResolvePackage(pkg.Name, nil)
+		require.NoError(t, err)
+		require.Len(t, repoPkg, 1)
+		pkgs = append(pkgs, repoPkg[0])
+	}
+
+	require.NoError(t, a.InstallPackages(ctx, nil, pkgs))
+	require.Equal(t, []string{"large", "medium", "small", "unsized"}, fetched)
+
+	// Packages are still installed in the order given.
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	var names []string
+	for _, pkg := range installed {
+		names = append(names, pkg.Name)
+	}
+	require.Equal(t, []string{"small", "unsized", "large", "medium"}, names)
+	_, err = src.Stat("usr/large")
+	require.NoError(t, err)
+}
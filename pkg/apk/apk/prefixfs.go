@@ -0,0 +1,176 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"time"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+)
+
+// prefixFS is the part of a filesystem under a directory, for WithInstallPrefix. Symlink
+// targets are left as they are, as they are resolved relative to the prefix once it is the
+// root of something.
+type prefixFS struct {
+	fs     apkfs.FullFS
+	prefix string
+}
+
+var (
+	_ apkfs.FullFS     = (*prefixFS)(nil)
+	_ apkfs.RenameFS   = (*prefixFS)(nil)
+	_ apkfs.ChtimesFS  = (*prefixFS)(nil)
+	_ apkfs.ReadLinkFS = (*prefixFS)(nil)
+)
+
+// newPrefixFS returns fsys under prefix, which must be a relative path within it.
+func newPrefixFS(fsys apkfs.FullFS, prefix string) (*prefixFS, error) {
+	clean := path.Clean(prefix)
+	if path.IsAbs(clean) {
+		clean = clean[1:]
+	}
+	if !fs.ValidPath(clean) || clean == "." {
+		return nil, fmt.Errorf("invalid install prefix %q", prefix)
+	}
+	return &prefixFS{fs: fsys, prefix: clean}, nil
+}
+
+func (p *prefixFS) path(name string) string {
+	return path.Join(p.prefix, name)
+}
+
+func (p *prefixFS) Mkdir(name string, perm fs.FileMode) error {
+	return p.fs.Mkdir(p.path(name), perm)
+}
+
+func (p *prefixFS) MkdirAll(name string, perm fs.FileMode) error {
+	return p.fs.MkdirAll(p.path(name), perm)
+}
+
+func (p *prefixFS) Open(name string) (fs.File, error) {
+	return p.fs.Open(p.path(name))
+}
+
+func (p *prefixFS) OpenReaderAt(name string) (apkfs.File, error) {
+	return p.fs.OpenReaderAt(p.path(name))
+}
+
+func (p *prefixFS) OpenFile(name string, flag int, perm fs.FileMode) (apkfs.File, error) {
+	return p.fs.OpenFile(p.path(name), flag, perm)
+}
+
+func (p *prefixFS) ReadFile(name string) ([]byte, error) {
+	return p.fs.ReadFile(p.path(name))
+}
+
+func (p *prefixFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
+	return p.fs.WriteFile(p.path(name), b, mode)
+}
+
+func (p *prefixFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return p.fs.ReadDir(p.path(name))
+}
+
+func (p *prefixFS) Mknod(name string, mode uint32, dev int) error {
+	return p.fs.Mknod(p.path(name), mode, dev)
+}
+
+func (p *prefixFS) Readnod(name string) (int, error) {
+	return p.fs.Readnod(p.path(name))
+}
+
+func (p *prefixFS) Symlink(oldname, newname string) error {
+	return p.fs.Symlink(oldname, p.path(newname))
+}
+
+func (p *prefixFS) Link(oldname, newname string) error {
+	return p.fs.Link(p.path(oldname), p.path(newname))
+}
+
+func (p *prefixFS) Readlink(name string) (string, error) {
+	return p.fs.Readlink(p.path(name))
+}
+
+func (p *prefixFS) Stat(name string) (fs.FileInfo, error) {
+	return p.fs.Stat(p.path(name))
+}
+
+func (p *prefixFS) Lstat(name string) (fs.FileInfo, error) {
+	return p.fs.Lstat(p.path(name))
+}
+
+func (p *prefixFS) Create(name string) (apkfs.File, error) {
+	return p.fs.Create(p.path(name))
+}
+
+func (p *prefixFS) Remove(name string) error {
+	return p.fs.Remove(p.path(name))
+}
+
+func (p *prefixFS) Chmod(name string, perm fs.FileMode) error {
+	return p.fs.Chmod(p.path(name), perm)
+}
+
+func (p *prefixFS) Chown(name string, uid int, gid int) error {
+	return p.fs.Chown(p.path(name), uid, gid)
+}
+
+func (p *prefixFS) SetXattr(name string, attr string, data []byte) error {
+	return p.fs.SetXattr(p.path(name), attr, data)
+}
+
+func (p *prefixFS) GetXattr(name string, attr string) ([]byte, error) {
+	return p.fs.GetXattr(p.path(name), attr)
+}
+
+func (p *prefixFS) RemoveXattr(name string, attr string) error {
+	return p.fs.RemoveXattr(p.path(name), attr)
+}
+
+func (p *prefixFS) ListXattrs(name string) (map[string][]byte, error) {
+	return p.fs.ListXattrs(p.path(name))
+}
+
+// Rename renames within the prefix. On a filesystem that cannot rename, newname is written
+// with the contents of oldname instead, which is no longer atomic.
+func (p *prefixFS) Rename(oldname, newname string) error {
+	if rfs, ok := p.fs.(apkfs.RenameFS); ok {
+		return rfs.Rename(p.path(oldname), p.path(newname))
+	}
+	fi, err := p.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	b, err := p.ReadFile(oldname)
+	if err != nil {
+		return err
+	}
+	if err := p.WriteFile(newname, b, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return p.Remove(oldname)
+}
+
+func (p *prefixFS) Chtimes(name string, atime, mtime time.Time) error {
+	cfs, ok := p.fs.(apkfs.ChtimesFS)
+	if !ok {
+		return fmt.Errorf("changing times of %s: %w", name, errors.ErrUnsupported)
+	}
+	return cfs.Chtimes(p.path(name), atime, mtime)
+}
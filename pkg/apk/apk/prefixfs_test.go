@@ -0,0 +1,73 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+)
+
+func TestInstallPrefix(t *testing.T) {
+	ctx := context.Background()
+	packages := []*Package{{Name: "foo", Version: "1.0.0-r0", Arch: testArch}}
+	repo := testLocalRepoWithFiles(t, testArch, packages, map[string][]testDirEntry{
+		"foo": {
+			{path: "usr", dir: true, perms: 0o755},
+			{path: "usr/bin", dir: true, perms: 0o755},
+			{path: "usr/bin/foo", perms: 0o755, content: []byte("foo")},
+		},
+	})
+
+	a, src := testAPKWithRepos(t, []string{repo}, WithInstallPrefix("/mnt/root"))
+	require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	for _, name := range []string{installedFilePath, scriptsFilePath, triggersFilePath, "usr/bin/foo"} {
+		_, err := src.Stat("mnt/root/" + name)
+		require.NoError(t, err, "%s is not under the prefix", name)
+	}
+	world, err := src.ReadFile("mnt/root/etc/apk/world")
+	require.NoError(t, err)
+	require.Equal(t, "foo\n", string(world))
+	repositories, err := src.ReadFile("mnt/root/etc/apk/repositories")
+	require.NoError(t, err)
+	require.Equal(t, repo+"\n", string(repositories))
+
+	// Nothing was written outside of the prefix.
+	entries, err := fs.ReadDir(src, ".")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "mnt", entries[0].Name())
+
+	// The database records paths relative to the prefix.
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+	var names []string
+	for _, f := range installed[0].Files {
+		names = append(names, f.Name)
+	}
+	require.Contains(t, names, "usr/bin/foo")
+
+	t.Run("invalid prefix", func(t *testing.T) {
+		_, err := New(WithFS(apkfs.NewMemFS()), WithInstallPrefix("../outside"))
+		require.ErrorContains(t, err, "invalid install prefix")
+	})
+}
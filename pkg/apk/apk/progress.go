@@ -0,0 +1,70 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import "io"
+
+// ProgressNotifier receives progress events while resolving, fetching and installing packages.
+// Packages are fetched concurrently, so implementations must be safe for concurrent use.
+type ProgressNotifier interface {
+	// OnResolveStart is called before resolving the requested packages.
+	OnResolveStart()
+	// OnPackageFetch is called when a package download starts. bytesTotal is -1 if unknown.
+	OnPackageFetch(name string, bytesTotal int64)
+	// OnPackageFetchProgress is called as a package is read, with the number of bytes read so far.
+	OnPackageFetchProgress(name string, bytesDone int64)
+	// OnInstallComplete is called once all packages have been installed.
+	OnInstallComplete()
+}
+
+type nopProgressNotifier struct{}
+
+func (nopProgressNotifier) OnResolveStart()                      {}
+func (nopProgressNotifier) OnPackageFetch(string, int64)         {}
+func (nopProgressNotifier) OnPackageFetchProgress(string, int64) {}
+func (nopProgressNotifier) OnInstallComplete()                   {}
+
+// progress returns the configured notifier, or one that does nothing.
+func (a *APK) progress() ProgressNotifier {
+	if a.progressNotifier == nil {
+		return nopProgressNotifier{}
+	}
+	return a.progressNotifier
+}
+
+// trackFetch notifies that the download of pkg has started and reports progress as rc is read.
+func (a *APK) trackFetch(pkg InstallablePackage, rc io.ReadCloser, bytesTotal int64) io.ReadCloser {
+	if a.progressNotifier == nil {
+		return rc
+	}
+	a.progressNotifier.OnPackageFetch(pkg.PackageName(), bytesTotal)
+	return &progressReader{ReadCloser: rc, name: pkg.PackageName(), notifier: a.progressNotifier}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	name     string
+	notifier ProgressNotifier
+	done     int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.done += int64(n)
+		r.notifier.OnPackageFetchProgress(r.name, r.done)
+	}
+	return n, err
+}
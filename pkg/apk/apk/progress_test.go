@@ -0,0 +1,102 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testRecordingNotifier struct {
+	mu     sync.Mutex
+	events []string
+	// name -> last reported bytes done
+	progress  map[string]int64
+	regressed bool
+}
+
+func (n *testRecordingNotifier) record(event string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, event)
+}
+
+func (n *testRecordingNotifier) OnResolveStart() { n.record("resolve") }
+
+func (n *testRecordingNotifier) OnPackageFetch(name string, bytesTotal int64) {
+	n.record(fmt.Sprintf("fetch %s %d", name, bytesTotal))
+}
+
+func (n *testRecordingNotifier) OnPackageFetchProgress(name string, bytesDone int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.progress == nil {
+		n.progress = map[string]int64{}
+	}
+	if bytesDone <= n.progress[name] {
+		n.regressed = true
+	}
+	n.progress[name] = bytesDone
+}
+
+func (n *testRecordingNotifier) OnInstallComplete() { n.record("installed") }
+
+func TestProgressNotifier(t *testing.T) {
+	ctx := context.Background()
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0", Arch: testArch, Dependencies: []string{"bar"}},
+		{Name: "bar", Version: "1.0.0", Arch: testArch},
+	}
+	repo := testLocalRepoWithFiles(t, testArch, packages, map[string][]testDirEntry{
+		"foo": {{path: "foo", perms: 0o644, content: []byte("foo")}},
+		"bar": {{path: "bar", perms: 0o644, content: []byte("bar")}},
+	})
+
+	notifier := &testRecordingNotifier{}
+	a, _ := testAPKWithRepos(t, []string{repo}, WithProgressNotifier(notifier))
+	require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	sizes := map[string]int64{}
+	for _, pkg := range packages {
+		fi, err := os.Stat(filepath.Join(repo, testArch, pkg.Filename()))
+		require.NoError(t, err)
+		sizes[pkg.Name] = fi.Size()
+	}
+
+	// Packages are fetched concurrently, so we only know that both fetches
+	// happen between resolving and finishing the install.
+	require.Len(t, notifier.events, 4)
+	require.Equal(t, "resolve", notifier.events[0])
+	require.ElementsMatch(t, []string{
+		fmt.Sprintf("fetch foo %d", sizes["foo"]),
+		fmt.Sprintf("fetch bar %d", sizes["bar"]),
+	}, notifier.events[1:3])
+	require.Equal(t, "installed", notifier.events[3])
+	require.Equal(t, sizes, notifier.progress, "every package should be read to the end")
+	require.False(t, notifier.regressed, "progress should only grow")
+
+	t.Run("nil notifier", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, []string{repo}, WithProgressNotifier(nil))
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+	})
+}
@@ -0,0 +1,274 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+type removeOpts struct {
+	force bool
+}
+
+// RemoveOption is an option for RemovePackage.
+type RemoveOption func(*removeOpts)
+
+// WithForceRemove removes the package even if other installed packages depend on it.
+func WithForceRemove(force bool) RemoveOption {
+	return func(o *removeOpts) {
+		o.force = force
+	}
+}
+
+// RemovePackage uninstalls the installed package name. The files it lists that no other
+// installed package lists are removed, and so are its directories once they are empty. Its
+// entries in the installed database, the scripts and the triggers are dropped, and so are the
+// world entries for it. Other installed packages that depend on it, with no other installed
+// package to satisfy them, make it fail unless WithForceRemove is given. It returns an error
+// wrapping fs.ErrNotExist if the package is not installed.
+func (a *APK) RemovePackage(ctx context.Context, name string, opts ...RemoveOption) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "RemovePackage")
+	defer span.End()
+
+	o := &removeOpts{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(installed, func(p *InstalledPackage) bool { return p.Name == name })
+	if i < 0 {
+		return fmt.Errorf("package %s is not installed: %w", name, fs.ErrNotExist)
+	}
+	pkg := installed[i]
+	others := slices.Delete(slices.Clone(installed), i, i+1)
+
+	if !o.force {
+		if dependents := dependentsOf(pkg, others); len(dependents) != 0 {
+			return fmt.Errorf("package %s is required by %s", name, strings.Join(dependents, ", "))
+		}
+	}
+
+	if err := a.removeFiles(pkg, others); err != nil {
+		return err
+	}
+	if err := a.removeInstalledEntry(name); err != nil {
+		return err
+	}
+	if err := a.removeScripts(pkg); err != nil {
+		return err
+	}
+	if err := a.removeTriggers(pkg); err != nil {
+		return err
+	}
+
+	a.installedMu.Lock()
+	for file, owner := range a.installedFiles {
+		if owner.Name == name {
+			delete(a.installedFiles, file)
+		}
+	}
+	a.installedMu.Unlock()
+
+	a.worldMu.Lock()
+	defer a.worldMu.Unlock()
+	world, err := a.GetWorld(ctx)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	kept := slices.DeleteFunc(slices.Clone(world), func(w string) bool {
+		return resolvePackageNameVersionPin(w).name == name
+	})
+	if len(kept) != len(world) {
+		return a.writeWorld(ctx, kept)
+	}
+	return nil
+}
+
+// dependentsOf returns the names of the packages in others with a dependency that pkg
+// satisfies and none of the others do.
+func dependentsOf(pkg *InstalledPackage, others []*InstalledPackage) []string {
+	provides := func(p *InstalledPackage, name string) bool {
+		if p.Name == name {
+			return true
+		}
+		for _, provided := range p.Provides {
+			if resolvePackageNameVersionPin(provided).name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	var dependents []string
+	for _, other := range others {
+		for _, dep := range other.Dependencies {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+			name := resolvePackageNameVersionPin(dep).name
+			if !provides(pkg, name) || slices.ContainsFunc(others, func(p *InstalledPackage) bool { return provides(p, name) }) {
+				continue
+			}
+			dependents = append(dependents, other.Name)
+			break
+		}
+	}
+	return dependents
+}
+
+// removeFiles removes the files of pkg that none of others list, then its directories that
+// none of others list once they are empty.
+func (a *APK) removeFiles(pkg *InstalledPackage, others []*InstalledPackage) error {
+	shared := map[string]bool{}
+	for _, other := range others {
+		for _, f := range other.Files {
+			shared[strings.TrimSuffix(f.Name, "/")] = true
+		}
+	}
+
+	var dirs []string
+	for _, f := range pkg.Files {
+		name := strings.TrimSuffix(f.Name, "/")
+		if shared[name] {
+			continue
+		}
+		if f.Typeflag == tar.TypeDir {
+			dirs = append(dirs, name)
+			continue
+		}
+		if err := a.fs.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing %s: %w", name, err)
+		}
+	}
+
+	// Children sort after their parents, so the reverse order goes deepest first.
+	slices.Sort(dirs)
+	slices.Reverse(dirs)
+	for _, dir := range dirs {
+		entries, err := a.fs.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading directory %s: %w", dir, err)
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		if err := a.fs.Remove(dir); err != nil {
+			return fmt.Errorf("removing directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// removeInstalledEntry drops the entry of the package name from the installed database,
+// leaving the others as they are written.
+func (a *APK) removeInstalledEntry(name string) error {
+	b, err := a.fs.ReadFile(installedFilePath)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", installedFilePath, err)
+	}
+	var kept []string
+	for _, entry := range strings.Split(string(b), "\n\n") {
+		if strings.TrimSpace(entry) == "" || slices.Contains(strings.Split(entry, "\n"), "P:"+name) {
+			continue
+		}
+		kept = append(kept, strings.Trim(entry, "\n")+"\n\n")
+	}
+	if err := a.writeFileAtomic(installedFilePath, []byte(strings.Join(kept, "")), 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", installedFilePath, err)
+	}
+	return nil
+}
+
+// removeScripts drops the scripts of pkg from scripts.tar.
+func (a *APK) removeScripts(pkg *InstalledPackage) error {
+	f, err := a.readScriptsTar()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading scripts: %w", err)
+	}
+	defer f.Close()
+
+	prefix := fmt.Sprintf("%s-%s.Q1%s", pkg.Name, pkg.Version, base64.StdEncoding.EncodeToString(pkg.Checksum))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading scripts: %w", err)
+		}
+		if strings.HasPrefix(hdr.Name, prefix) {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing scripts: %w", err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("writing scripts: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("writing scripts: %w", err)
+	}
+	if err := a.writeFileAtomic(scriptsFilePath, buf.Bytes(), scriptsTarPerms); err != nil {
+		return fmt.Errorf("writing %s: %w", scriptsFilePath, err)
+	}
+	return nil
+}
+
+// removeTriggers drops the triggers of pkg from the triggers file.
+func (a *APK) removeTriggers(pkg *InstalledPackage) error {
+	b, err := a.fs.ReadFile(triggersFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", triggersFilePath, err)
+	}
+	prefix := base64.StdEncoding.EncodeToString(pkg.Checksum) + " "
+	var kept []string
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if line != "" && !strings.HasPrefix(line, prefix) {
+			kept = append(kept, line)
+		}
+	}
+	if err := a.writeFileAtomic(triggersFilePath, []byte(strings.Join(kept, "")), 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", triggersFilePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemovePackage(t *testing.T) {
+	ctx := context.Background()
+	a, src := testAPKWithRepos(t, nil)
+
+	base := fakePackage(t, &Package{Name: "base", Version: "1.0.0-r0", Arch: testArch}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/base", 0o755, false, []byte("base"), nil},
+	})
+	tool := fakePackage(t, &Package{Name: "tool", Version: "1.0.0-r0", Arch: testArch, Dependencies: []string{"base"}}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/tool", 0o755, false, []byte("tool"), nil},
+		{"usr/share", 0o755, true, nil, nil},
+		{"usr/share/tool", 0o755, true, nil, nil},
+		{"usr/share/tool/data", 0o644, false, []byte("data"), nil},
+	})
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{base, tool}))
+	require.NoError(t, a.SetWorld(ctx, []string{"base", "tool"}))
+
+	t.Run("required", func(t *testing.T) {
+		err := a.RemovePackage(ctx, "base")
+		require.ErrorContains(t, err, "required by tool")
+		_, err = src.Stat("usr/bin/base")
+		require.NoError(t, err)
+	})
+
+	t.Run("not installed", func(t *testing.T) {
+		require.ErrorIs(t, a.RemovePackage(ctx, "missing"), os.ErrNotExist)
+	})
+
+	require.NoError(t, a.RemovePackage(ctx, "tool"))
+
+	for _, name := range []string{"usr/bin/tool", "usr/share/tool/data", "usr/share/tool", "usr/share"} {
+		_, err := src.Stat(name)
+		require.ErrorIs(t, err, os.ErrNotExist, "%s was not removed", name)
+	}
+	b, err := src.ReadFile("usr/bin/base")
+	require.NoError(t, err)
+	require.Equal(t, "base", string(b))
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+	require.Equal(t, "base", installed[0].Name)
+	db, err := src.ReadFile(installedFilePath)
+	require.NoError(t, err)
+	require.NotContains(t, string(db), "P:tool")
+
+	world, err := a.GetWorld(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"base"}, world)
+
+	// Nothing depends on base any more, and it owned usr/bin alone.
+	require.NoError(t, a.RemovePackage(ctx, "base"))
+	_, err = src.Stat("usr")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	db, err = src.ReadFile(installedFilePath)
+	require.NoError(t, err)
+	require.Empty(t, strings.TrimSpace(string(db)))
+}
+
+func TestRemovePackageForce(t *testing.T) {
+	ctx := context.Background()
+	a, src := testAPKWithRepos(t, nil)
+
+	base := fakePackage(t, &Package{Name: "base", Version: "1.0.0-r0", Arch: testArch}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/base", 0o755, false, []byte("base"), nil},
+	})
+	tool := fakePackage(t, &Package{Name: "tool", Version: "1.0.0-r0", Arch: testArch, Dependencies: []string{"base"}}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/tool", 0o755, false, []byte("tool"), nil},
+	})
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{base, tool}))
+
+	require.NoError(t, a.RemovePackage(ctx, "base", WithForceRemove(true)))
+	_, err := src.Stat("usr/bin/base")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	// usr/bin is shared with tool, so it stays.
+	_, err = src.Stat("usr/bin/tool")
+	require.NoError(t, err)
+}
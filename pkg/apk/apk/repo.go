@@ -15,18 +15,22 @@
 package apk
 
 import (
-	"bufio"
 	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
+	"unicode"
 
 	"go.opentelemetry.io/otel"
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/chainguard-dev/clog"
 )
@@ -41,6 +45,16 @@ type NamedIndex interface {
 	Count() int
 }
 
+// IndexWithMetadata is a NamedIndex that also has the metadata of its APKINDEX, as the indexes
+// returned by GetRepositoryIndexes and NewNamedRepositoryWithIndex do. Check for it with a type
+// assertion, other NamedIndex implementations need not have metadata.
+type IndexWithMetadata interface {
+	NamedIndex
+	Metadata() IndexMetadata
+}
+
+var _ IndexWithMetadata = (*namedRepositoryWithIndex)(nil)
+
 func indexNames(indexes []NamedIndex) []string {
 	names := make([]string, len(indexes))
 	for i, idx := range indexes {
@@ -49,6 +63,29 @@ func indexNames(indexes []NamedIndex) []string {
 	return names
 }
 
+// MergeIndexes merges the packages of the given indexes into a single list, in order.
+//
+// Repositories take precedence in the order they are passed: when several indexes contain a
+// package with the same name and version, only the entry from the first of them is kept.
+// Each returned package's Repository() is the repository its entry came from.
+func MergeIndexes(indexes []NamedIndex) []*RepositoryPackage {
+	type nameVersion struct{ name, version string }
+
+	seen := map[nameVersion]struct{}{}
+	merged := []*RepositoryPackage{}
+	for _, index := range indexes {
+		for _, pkg := range index.Packages() {
+			key := nameVersion{pkg.Name, pkg.Version}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			merged = append(merged, pkg)
+		}
+	}
+	return merged
+}
+
 type namedRepositoryWithIndex struct {
 	name string
 	repo *RepositoryWithIndex
@@ -72,6 +109,13 @@ func (n *namedRepositoryWithIndex) Count() int {
 	return n.repo.Count()
 }
 
+func (n *namedRepositoryWithIndex) Metadata() IndexMetadata {
+	if n.repo == nil {
+		return IndexMetadata{}
+	}
+	return n.repo.Metadata()
+}
+
 func (n *namedRepositoryWithIndex) Packages() []*RepositoryPackage {
 	if n.repo == nil {
 		return nil
@@ -87,14 +131,17 @@ func (n *namedRepositoryWithIndex) Source() string {
 }
 
 // repositoryPackage is a package that is part of a repository.
-// it is nearly identical to RepositoryPackage, but it includes the pinned name of the repository.
+// it is nearly identical to RepositoryPackage, but it includes the pinned name of the repository,
+// and the position of the repository in the list, as earlier repositories take precedence.
 type repositoryPackage struct {
 	*RepositoryPackage
 	pinnedName string
+	repoOrder  int
 }
 
 // SetRepositories sets the contents of /etc/apk/repositories file.
 // The base directory of /etc/apk must already exist, i.e. this only works on an initialized APK database.
+// The file is replaced atomically, so it is never left partly written.
 func (a *APK) SetRepositories(ctx context.Context, repos []string) error {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "SetRepositories")
 	defer span.End()
@@ -108,7 +155,7 @@ func (a *APK) SetRepositories(ctx context.Context, repos []string) error {
 	data := strings.Join(repos, "\n") + "\n"
 
 	// #nosec G306 -- apk repositories must be publicly readable
-	if err := a.fs.WriteFile(filepath.Join("etc", "apk", "repositories"),
+	if err := a.writeFileAtomic(filepath.Join("etc", "apk", "repositories"),
 		[]byte(data), 0o644); err != nil {
 		return fmt.Errorf("failed to write apk repositories list: %w", err)
 	}
@@ -116,46 +163,188 @@ func (a *APK) SetRepositories(ctx context.Context, repos []string) error {
 	return nil
 }
 
-func (a *APK) GetRepositories() (repos []string, err error) {
+// RepoSpec describes a single entry of /etc/apk/repositories.
+type RepoSpec struct {
+	// URI is the base URI of the repository, without the architecture.
+	URI string
+	// Tag pins the repository, so that only world entries of the form name@tag are resolved from it.
+	Tag string
+	// Priority orders the repositories. Repositories with a higher priority are written first,
+	// and so take precedence when the same package is present in several of them.
+	Priority int
+}
+
+// String returns the repositories line for the spec, e.g. "@edge https://example.com/edge".
+func (r RepoSpec) String() string {
+	if r.Tag == "" {
+		return r.URI
+	}
+	return "@" + r.Tag + " " + r.URI
+}
+
+// ParseRepoSpec parses a single line of /etc/apk/repositories. The file has no notion of
+// priority, so the returned spec always has a Priority of zero.
+func ParseRepoSpec(line string) (RepoSpec, error) {
+	if !strings.HasPrefix(line, "@") {
+		return RepoSpec{URI: line}, nil
+	}
+	// it's a pinned repository, get the name
+	parts := strings.Fields(line)
+	if len(parts) < 2 {
+		return RepoSpec{}, fmt.Errorf("invalid repository line: %q", line)
+	}
+	return RepoSpec{URI: parts[1], Tag: parts[0][1:]}, nil
+}
+
+// SetRepositoriesTyped sets the list of repositories like SetRepositories, but takes
+// structured specs rather than preformatted lines.
+func (a *APK) SetRepositoriesTyped(ctx context.Context, repos []RepoSpec) error {
+	sorted := slices.Clone(repos)
+	slices.SortStableFunc(sorted, func(a, b RepoSpec) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+
+	lines := make([]string, 0, len(sorted))
+	for _, repo := range sorted {
+		if repo.URI == "" {
+			return fmt.Errorf("repository with tag %q has no URI", repo.Tag)
+		}
+		if strings.ContainsFunc(repo.Tag, unicode.IsSpace) {
+			return fmt.Errorf("invalid tag %q for repository %s", repo.Tag, repo.URI)
+		}
+		lines = append(lines, repo.String())
+	}
+	return a.SetRepositories(ctx, lines)
+}
+
+// GetRepositories returns the repositories listed in /etc/apk/repositories, in order, with the
+// date set by WithSnapshotDate in place of their snapshot placeholders.
+// Blank lines and lines starting with # are ignored.
+func (a *APK) GetRepositories(ctx context.Context) ([]string, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "GetRepositories")
+	defer span.End()
+
 	// get the repository URLs
 	reposFile, err := a.fs.Open(reposFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("could not open repositories file in %s at %s: %w", a.fs, reposFilePath, err)
 	}
 	defer reposFile.Close()
-	scanner := bufio.NewScanner(reposFile)
-	for scanner.Scan() {
-		repos = append(repos, scanner.Text())
+	repos, err := readConfigLines(reposFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repositories file: %w", err)
 	}
-	return
+	for i, repo := range repos {
+		if repos[i], err = a.expandSnapshot(repo); err != nil {
+			return nil, err
+		}
+	}
+	return repos, nil
 }
 
-// GetRepositoryIndexes returns the indexes for the repositories in the specified root.
-// The signatures for each index are verified unless ignoreSignatures is set to true.
-func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) ([]NamedIndex, error) {
-	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetRepositoryIndexes")
+// ValidateRepositories checks that the index of every repository in /etc/apk/repositories can be
+// reached for the configured architecture, asking remote repositories for its headers only. The
+// index files are looked for as when fetching indexes, see WithIndexFormats, and any of them will
+// do. If a repository has none, the error names it along with the HTTP status or error for the
+// first.
+func (a *APK) ValidateRepositories(ctx context.Context) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "ValidateRepositories")
 	defer span.End()
 
-	// get the repository URLs
-	repos, err := a.GetRepositories()
+	repos, err := a.GetRepositories(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	archFile, err := a.fs.Open(archFilePath)
+	errs := make([]error, len(repos))
+	var g errgroup.Group
+	for i, repo := range repos {
+		g.Go(func() error {
+			spec, err := ParseRepoSpec(repo)
+			if err != nil {
+				errs[i] = err
+				return nil
+			}
+			var firstErr error
+			for _, filename := range indexFilenamesFor(spec.URI, a.indexFormats) {
+				err := a.checkRepository(ctx, indexURLFor(spec.URI, a.arch, filename))
+				if err == nil {
+					return nil
+				}
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+			errs[i] = fmt.Errorf("repository %s: %w", redactURL(spec.URI), firstErr)
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid repositories:\n%w", err)
+	}
+	return nil
+}
+
+// checkRepository checks that the index at u exists.
+func (a *APK) checkRepository(ctx context.Context, u string) error {
+	if isOCI(u) {
+		repo, arch, filename, err := ociRepositoryFor(u, a.fetchRetry.client(a.httpClient()), a.auth, a.authenticator, &a.ociRepos)
+		if err != nil {
+			return err
+		}
+		_, err = repo.Stat(ctx, arch, filename)
+		return err
+	}
+	if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		_, err := os.Stat(localPath(u))
+		return err
+	}
+
+	asURL, err := url.Parse(u)
 	if err != nil {
-		return nil, fmt.Errorf("could not open arch file in %s at %s: %w", a.fs, archFile, err)
+		return fmt.Errorf("failed to parse repo as URI: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, asURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	// if the repo URL contains HTTP Basic Auth credentials, add them to the request
+	if asURL.User != nil {
+		user := asURL.User.Username()
+		pass, _ := asURL.User.Password()
+		req.SetBasicAuth(user, pass)
+		req.URL.User = nil
+	} else if a, ok := a.auth[asURL.Host]; ok && a.user != "" && a.pass != "" {
+		req.SetBasicAuth(a.user, a.pass)
+	}
+	if err := authenticate(ctx, req, a.authenticator); err != nil {
+		return err
 	}
-	defer archFile.Close()
 
-	archB, err := io.ReadAll(archFile)
+	res, err := a.httpClient().Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read arch file: %w", err)
+		return err
 	}
-	// trim the newline
-	arch := strings.TrimSuffix(string(archB), "\n")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s for %s", res.Status, indexFilename)
+	}
+	return nil
+}
+
+// redactURL hides any password in u, which may also be a local path.
+func redactURL(u string) string {
+	asURL, err := url.Parse(u)
+	if err != nil || asURL.User == nil {
+		return u
+	}
+	return asURL.Redacted()
+}
 
-	// create the list of keys
+// keyring returns the public keys in etc/apk/keys by name, along with those given by WithExtraKeys.
+func (a *APK) keyring() (map[string][]byte, error) {
 	keys := make(map[string][]byte)
 	dir, err := a.fs.ReadDir(keysDirPath)
 	if err != nil {
@@ -172,17 +361,82 @@ func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) (
 		}
 		keys[d.Name()] = b
 	}
-	httpClient := a.client
-	if a.cache != nil {
-		httpClient = a.cache.client(httpClient, true)
+	for name, b := range a.extraKeys {
+		if _, ok := keys[name]; !ok {
+			keys[name] = b
+		}
+	}
+	return keys, nil
+}
+
+// GetRepositoryIndexes returns the indexes for the repositories in the specified root.
+// The signatures for each index are verified unless ignoreSignatures is set to true, or
+// WithInsecureIgnoreSignatures was given.
+func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) ([]NamedIndex, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetRepositoryIndexes")
+	defer span.End()
+
+	if a.ignoreSignatures {
+		a.log(ctx).Warn("signature verification is disabled for all repository indexes, do not use this outside of development")
+		ignoreSignatures = true
+	}
+
+	// get the repository URLs
+	repos, err := a.GetRepositories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkIndexAges(ctx, repos); err != nil {
+		return nil, err
+	}
+
+	archFile, err := a.fs.Open(archFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open arch file in %s at %s: %w", a.fs, archFile, err)
+	}
+	defer archFile.Close()
+
+	archB, err := io.ReadAll(archFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read arch file: %w", err)
+	}
+	// trim the newline
+	arch := strings.TrimSuffix(string(archB), "\n")
+
+	return a.repositoryIndexes(ctx, repos, arch, ignoreSignatures)
+}
+
+// repositoryIndexes fetches the indexes of repos for arch with the keyring, cache, signature
+// settings and credentials of a.
+func (a *APK) repositoryIndexes(ctx context.Context, repos []string, arch string, ignoreSignatures bool) ([]NamedIndex, error) {
+	keys, err := a.keyring()
+	if err != nil {
+		return nil, err
+	}
+	httpClient := a.cachingClient(a.fetchRetry.client(a.httpClient()), true)
+	noSignatureIndexes := make([]string, 0, len(a.noSignatureIndexes))
+	for _, repo := range a.noSignatureIndexes {
+		// so that they match the repositories as listed by GetRepositories
+		if expanded, err := a.expandSnapshot(repo); err == nil {
+			noSignatureIndexes = append(noSignatureIndexes, expanded)
+		}
+	}
+	if a.verifyIndexSignature {
+		ignoreSignatures, noSignatureIndexes = false, nil
 	}
 	opts := []IndexOption{WithIgnoreSignatures(ignoreSignatures),
-		WithIgnoreSignatureForIndexes(a.noSignatureIndexes...),
-		WithHTTPClient(httpClient)}
+		WithIgnoreSignatureForIndexes(noSignatureIndexes...),
+		WithHTTPClient(httpClient), withOCIClient(a.fetchRetry.client(a.httpClient()))}
 	for domain, auth := range a.auth {
 		opts = append(opts, WithIndexAuth(domain, auth.user, auth.pass))
 	}
-	return GetRepositoryIndexes(ctx, repos, keys, arch, opts...)
+	if a.authenticator != nil {
+		opts = append(opts, WithIndexAuthenticator(a.authenticator))
+	}
+	if len(a.indexFormats) > 0 {
+		opts = append(opts, WithIndexFilenames(a.indexFormats...))
+	}
+	return GetRepositoryIndexes(a.logContext(ctx), repos, keys, arch, opts...)
 }
 
 // PkgResolver resolves packages from a list of indexes.
@@ -201,6 +455,18 @@ type PkgResolver struct {
 
 	parsedVersions map[string]Version
 	depForVersion  map[string]parsedConstraint
+
+	// records how packages are pulled in while resolving, if set
+	graph *Graph
+
+	// orders versions, if set, instead of CompareVersions
+	versionComparer VersionComparer
+
+	// dependencies that nothing provides, collected while resolving a package
+	unsatisfied []UnsatisfiedDependency
+
+	// repositories that packages are restricted to, by package name
+	repoConstraints map[string]string
 }
 
 // NewPkgResolver creates a new pkgResolver from a list of indexes.
@@ -222,11 +488,12 @@ func NewPkgResolver(_ context.Context, indexes []NamedIndex) *PkgResolver {
 	}
 
 	// create a map of every package by name and version to its RepositoryPackage
-	for _, index := range indexes {
+	for i, index := range indexes {
 		for _, pkg := range index.Packages() {
 			pkgNameMap[pkg.Name] = append(pkgNameMap[pkg.Name], &repositoryPackage{
 				RepositoryPackage: pkg,
 				pinnedName:        index.Name(),
+				repoOrder:         i,
 			})
 			for _, dep := range pkg.InstallIf {
 				if _, ok := installIfMap[dep]; !ok {
@@ -235,6 +502,7 @@ func NewPkgResolver(_ context.Context, indexes []NamedIndex) *PkgResolver {
 				installIfMap[dep] = append(installIfMap[dep], &repositoryPackage{
 					RepositoryPackage: pkg,
 					pinnedName:        index.Name(),
+					repoOrder:         i,
 				})
 			}
 		}
@@ -407,7 +675,7 @@ func (p *PkgResolver) constrain(constraints []string, dq map[*RepositoryPackage]
 					continue
 				}
 
-				if !parsed.dep.satisfies(actualVersion, requiredVersion) {
+				if !p.satisfies(parsed.dep, provider.Version, parsed.version, actualVersion, requiredVersion) {
 					p.disqualify(dq, provider.RepositoryPackage, fmt.Sprintf("%q does not satisfy %q", provider.Version, constraint))
 				}
 			} else {
@@ -422,7 +690,7 @@ func (p *PkgResolver) constrain(constraints []string, dq map[*RepositoryPackage]
 						dq[provider.RepositoryPackage] = fmt.Sprintf("parsing %q: %v", pp.version, err)
 						continue
 					}
-					if !parsed.dep.satisfies(actualVersion, requiredVersion) {
+					if !p.satisfies(parsed.dep, pp.version, parsed.version, actualVersion, requiredVersion) {
 						dq[provider.RepositoryPackage] = fmt.Sprintf("%q provides %q which does not satisfy %q", provider.Filename(), provides, constraint)
 					}
 				}
@@ -448,8 +716,23 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 	var (
 		dependenciesMap = make(map[string]*RepositoryPackage, len(packages))
 		installTracked  = map[string]*RepositoryPackage{}
+		unsatisfied     []UnsatisfiedDependency
 	)
 
+	// Packages that nothing provides are reported together with the missing dependencies of the
+	// others, instead of failing on the first.
+	constraints = slices.DeleteFunc(constraints, func(constraint string) bool {
+		if strings.HasPrefix(constraint, "!") {
+			return false
+		}
+		if _, ok := p.nameMap[p.resolvePackageNameVersionPin(constraint).name]; ok {
+			return false
+		}
+		unsatisfied = append(unsatisfied, UnsatisfiedDependency{Constraint: constraint})
+		return true
+	})
+	packages = slices.Clone(constraints)
+
 	if err := p.constrain(constraints, dq); err != nil {
 		return nil, nil, fmt.Errorf("constraining initial packages: %w", err)
 	}
@@ -479,9 +762,15 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 	// now get the dependencies for each package
 	for _, pkgName := range packages {
 		pkg, deps, confs, err := p.GetPackageWithDependencies(pkgName, dependenciesMap, dq)
+		var unsatisfiedErr *UnsatisfiedError
+		if errors.As(err, &unsatisfiedErr) {
+			unsatisfied = append(unsatisfied, unsatisfiedErr.Missing...)
+			continue
+		}
 		if err != nil {
 			return toInstall, nil, &ConstraintError{pkgName, err}
 		}
+		p.graph.addRoot(pkg.Name)
 		for _, dep := range deps {
 			if _, ok := installTracked[dep.Name]; !ok {
 				toInstall = append(toInstall, dep)
@@ -501,6 +790,13 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 		conflicts = append(conflicts, confs...)
 	}
 
+	if len(unsatisfied) != 0 {
+		return nil, nil, newUnsatisfiedError(unsatisfied)
+	}
+
+	toInstall, confs := p.addInstallIf(toInstall, installTracked, dependenciesMap, dq)
+	conflicts = append(conflicts, confs...)
+
 	conflicts = uniqify(conflicts)
 
 	return toInstall, conflicts, nil
@@ -528,10 +824,16 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 	}
 
 	pin := p.resolvePackageNameVersionPin(pkgName).pin
+	p.unsatisfied = nil
 	deps, conflicts, err := p.getPackageDependencies(pkg, pin, true, parents, localExisting, existingOrigins, dq)
+	unsatisfied := p.unsatisfied
+	p.unsatisfied = nil
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	if len(unsatisfied) != 0 {
+		return nil, nil, nil, newUnsatisfiedError(unsatisfied)
+	}
 	// eliminate duplication in dependencies
 	added := make(map[string]*RepositoryPackage, len(deps))
 	dependencies := make([]*RepositoryPackage, 0, len(deps))
@@ -569,6 +871,12 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 				}
 			}
 			if matchCount == len(installIfPkg.InstallIf) {
+				for _, subDep := range installIfPkg.InstallIf {
+					from := p.resolvePackageNameVersionPin(subDep).name
+					if addedPkg, ok := added[from]; ok {
+						p.graph.addEdge(addedPkg.Name, installIfPkg.Name, subDep)
+					}
+				}
 				// all dependencies are met, so add it
 				if _, ok := added[installIfPkg.Name]; !ok {
 					dependencies = append(dependencies, installIfPkg.RepositoryPackage)
@@ -580,6 +888,67 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 	return pkg, dependencies, conflicts, nil
 }
 
+// addInstallIf adds the packages whose install_if entries are all in the resolved set, with their
+// dependencies, to toInstall, until no more are triggered. Each entry is a package name, or a
+// name=version that the resolved package must match exactly. Packages pulled in this way that
+// cannot be resolved are left out, since nothing asked for them.
+func (p *PkgResolver) addInstallIf(toInstall []*RepositoryPackage, installTracked, dependenciesMap map[string]*RepositoryPackage, dq map[*RepositoryPackage]string) ([]*RepositoryPackage, []string) {
+	var conflicts []string
+	tried := map[string]bool{}
+	for i := 0; i < len(toInstall); i++ {
+		trigger := toInstall[i]
+		candidates := append(slices.Clone(p.installIfMap[trigger.Name]), p.installIfMap[trigger.Name+"="+trigger.Version]...)
+		for _, candidate := range candidates {
+			name := candidate.Name
+			if _, ok := installTracked[name]; ok || tried[name] {
+				continue
+			}
+			pkg, err := p.resolvePackage(name, dq)
+			if err != nil || !p.installIfSatisfied(pkg, installTracked) {
+				continue
+			}
+			// Once triggered, it is resolved for good or not at all.
+			tried[name] = true
+			pkg, deps, confs, err := p.GetPackageWithDependencies(name, dependenciesMap, dq)
+			if err != nil {
+				continue
+			}
+			for _, entry := range pkg.InstallIf {
+				if from, ok := installTracked[p.resolvePackageNameVersionPin(entry).name]; ok {
+					p.graph.addEdge(from.Name, pkg.Name, entry)
+				}
+			}
+			// appended after the trigger, so that they are checked for triggering others in turn
+			for _, dep := range append(deps, pkg) {
+				if _, ok := installTracked[dep.Name]; !ok {
+					toInstall = append(toInstall, dep)
+					installTracked[dep.Name] = dep
+				}
+				if _, ok := dependenciesMap[dep.Name]; !ok {
+					dependenciesMap[dep.Name] = dep
+				}
+			}
+			conflicts = append(conflicts, confs...)
+		}
+	}
+	return toInstall, conflicts
+}
+
+// installIfSatisfied reports whether every install_if entry of pkg is in resolved.
+func (p *PkgResolver) installIfSatisfied(pkg *RepositoryPackage, resolved map[string]*RepositoryPackage) bool {
+	if len(pkg.InstallIf) == 0 {
+		return false
+	}
+	for _, entry := range pkg.InstallIf {
+		constraint := p.resolvePackageNameVersionPin(entry)
+		got, ok := resolved[constraint.name]
+		if !ok || (constraint.version != "" && got.Version != constraint.version) {
+			return false
+		}
+	}
+	return true
+}
+
 // ResolvePackage given a single package name and optional version constraints, resolve to a list of packages
 // that satisfy the constraint. The list will be sorted by version number, with the highest version first
 // and decreasing from there. In general, the first one in the list is the best match. This function
@@ -710,7 +1079,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 				}
 				// we accept invalid versions for ourself, but do not try to use it to fulfill
 				if err1 == nil && err2 == nil {
-					if compare.satisfies(actualVersion, requiredVersion) {
+					if p.satisfies(compare, pkg.Version, version, actualVersion, requiredVersion) {
 						// we provide it, so skip looking elsewhere
 						continue
 					}
@@ -720,7 +1089,9 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 			// first see if it is a name of a package
 			depPkgWithVersions, ok := p.nameMap[name]
 			if !ok {
-				return nil, nil, fmt.Errorf("could not find package either named %s or that provides %s for %s", dep, dep, pkg.Name)
+				// Keep going, to find any other dependencies that nothing provides.
+				p.unsatisfied = append(p.unsatisfied, UnsatisfiedDependency{Constraint: dep, RequiredBy: pkg.Name})
+				continue
 			}
 			// pkgsWithVersions contains a map of all versions of the package
 			// get the one that most matches what was requested
@@ -768,6 +1139,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 
 		depPkg := best.RepositoryPackage
 		p.disqualifyConflicts(depPkg, dq)
+		p.graph.addEdge(pkg.Name, depPkg.Name, lowest)
 
 		// and then recurse to its children
 		// each child gets the parental chain, but should not affect any others,
@@ -793,6 +1165,67 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 	return dependencies, conflicts, nil
 }
 
+// SetVersionComparer sets how the resolver orders versions, both to pick the newest version of a
+// package and to check version constraints other than ~. If c is nil, CompareVersions is used.
+func (p *PkgResolver) SetVersionComparer(c VersionComparer) {
+	p.versionComparer = c
+}
+
+// RestrictToRepository limits the packages named names to those in the repository repoURI, as
+// given in /etc/apk/repositories, wherever they are needed. Other packages, including their
+// dependencies, still come from any repository.
+func (p *PkgResolver) RestrictToRepository(repoURI string, names ...string) {
+	if p.repoConstraints == nil {
+		p.repoConstraints = map[string]string{}
+	}
+	for _, name := range names {
+		p.repoConstraints[name] = repoURI
+	}
+}
+
+// allowedByRepository reports whether pkg is in the repository its name is restricted to, if any.
+func (p *PkgResolver) allowedByRepository(pkg *repositoryPackage) bool {
+	repoURI, ok := p.repoConstraints[pkg.Name]
+	if !ok {
+		return true
+	}
+	// The packages of a repository are in a directory for their architecture.
+	uri := pkg.Repository().URI
+	repoURI = strings.TrimSuffix(repoURI, "/")
+	i := strings.LastIndex(uri, "/")
+	return uri == repoURI || (i >= 0 && uri[:i] == repoURI)
+}
+
+// compareVersions compares the actual version to the required one with the comparer of the
+// resolver, which is given the versions as they are. Without one, they are parsed, and a version
+// that does not parse is older than any that does.
+func (p *PkgResolver) compareVersions(actual, required string) int {
+	if p.versionComparer != nil {
+		return p.versionComparer.CompareVersions(actual, required)
+	}
+	actualVersion, err := p.parseVersion(actual)
+	if err != nil {
+		return -1
+	}
+	requiredVersion, err := p.parseVersion(required)
+	if err != nil {
+		return 1
+	}
+	return CompareVersions(actualVersion, requiredVersion)
+}
+
+// satisfies reports whether the actual version satisfies dep on the required version, given both
+// as strings and parsed, see compareVersions.
+func (p *PkgResolver) satisfies(dep versionDependency, actual, required string, actualVersion, requiredVersion Version) bool {
+	if dep == versionTilde {
+		return includesVersion(actualVersion, requiredVersion)
+	}
+	if dep == versionAny {
+		return true
+	}
+	return dep.allows(p.compareVersions(actual, required))
+}
+
 func (p *PkgResolver) parseVersion(version string) (Version, error) {
 	pkg, ok := p.parsedVersions[version]
 	if ok {
@@ -822,8 +1255,8 @@ func (p *PkgResolver) resolvePackageNameVersionPin(pkgName string) parsedConstra
 
 // sortPackages sorts a slice of packages in descending order of preference, based on
 // matching origin to a provided comparison package, whether or not one of the packages
-// already is installed, the versions, and whether an origin already exists.
-// The pin is for preference only; prefer a package that matches the pin over one that does not.
+// already is installed, the versions, whether an origin already exists, and the order of the
+// repositories, earlier ones first. The pin is for preference only; prefer a package that matches the pin over one that does not.
 // If a name is provided, then this is indicated as the name of the package we are looking for.
 // This may affect the sort order, as not all packages may have the same name.
 // For example, if the original search was for package "a", then pkgs may contain some that
@@ -864,6 +1297,13 @@ func (p *PkgResolver) comparePackages(compare *RepositoryPackage, name string, e
 		iMatched, iOk := existing[a.Name]
 		jMatched, jOk := existing[b.Name]
 
+		// the very package already chosen, e.g. from a pinned repository, beats the same version elsewhere
+		if iSame, jSame := iOk && iMatched == a.RepositoryPackage, jOk && jMatched == b.RepositoryPackage; iSame != jSame {
+			if iSame {
+				return -1
+			}
+			return 1
+		}
 		// because existing takes priority, if either matches, we should take it
 		// check if the first matches
 		if iOk && iMatched.Version == a.Version && (!jOk || jMatched.Version != b.Version) {
@@ -902,37 +1342,30 @@ func (p *PkgResolver) comparePackages(compare *RepositoryPackage, name string, e
 			return 1
 		}
 		// both matched or both did not, so just compare versions
-		// version priority
-		iVersion, err := p.parseVersion(iVersionStr)
-		if err != nil {
-			return 1
-		}
-		jVersion, err := p.parseVersion(jVersionStr)
-		if err != nil {
-			// If j fails to parse, prefer i.
-			return -1
-		}
-		versions := CompareVersions(iVersion, jVersion)
+		// version priority. Without a comparer, a version that fails to parse loses.
+		versions := p.compareVersions(iVersionStr, jVersionStr)
 		if versions != equal {
 			return -1 * versions
 		}
-		// if versions are equal, they might not be the same as the package versions
-		if iVersionStr != a.Version || jVersionStr != b.Version {
-			iVersion, err := p.parseVersion(a.Version)
-			if err != nil {
-				return 1
-			}
-			jVersion, err := p.parseVersion(b.Version)
-			if err != nil {
-				// If j fails to parse, prefer i.
+		// of providers of the same version, one that replaces the other wins
+		if aReplaces, bReplaces := slices.Contains(a.Replaces, b.Name), slices.Contains(b.Replaces, a.Name); aReplaces != bReplaces {
+			if aReplaces {
 				return -1
 			}
-			versions := CompareVersions(iVersion, jVersion)
+			return 1
+		}
+		// if versions are equal, they might not be the same as the package versions
+		if iVersionStr != a.Version || jVersionStr != b.Version {
+			versions := p.compareVersions(a.Version, b.Version)
 			if versions != equal {
 				return -1 * versions
 			}
 		}
-		// if versions are equal, compare names
+		// if versions are equal, the repository listed first wins
+		if a.repoOrder != b.repoOrder {
+			return cmp.Compare(a.repoOrder, b.repoOrder)
+		}
+		// then compare names
 		return cmp.Compare(a.Name, b.Name)
 	}
 }
@@ -996,6 +1429,41 @@ func (e *DepError) Error() string {
 	return fmt.Sprintf("resolving %q deps:\n%s", e.Package.Filename(), e.Wrapped.Error())
 }
 
+// UnsatisfiedDependency is a dependency that no package in the indexes provides.
+type UnsatisfiedDependency struct {
+	Constraint string
+	// RequiredBy is the name of the package that depends on Constraint, or empty if the
+	// constraint was asked for directly, as in the world.
+	RequiredBy string
+}
+
+// UnsatisfiedError is returned by resolving when nothing in the indexes provides some of the
+// dependencies. It lists all of them, not just the first one found.
+type UnsatisfiedError struct {
+	Missing []UnsatisfiedDependency
+}
+
+// newUnsatisfiedError returns an UnsatisfiedError for missing, sorted and without duplicates.
+func newUnsatisfiedError(missing []UnsatisfiedDependency) *UnsatisfiedError {
+	slices.SortFunc(missing, func(a, b UnsatisfiedDependency) int {
+		return cmp.Or(cmp.Compare(a.RequiredBy, b.RequiredBy), cmp.Compare(a.Constraint, b.Constraint))
+	})
+	return &UnsatisfiedError{Missing: slices.Compact(missing)}
+}
+
+func (e *UnsatisfiedError) Error() string {
+	var b strings.Builder
+	b.WriteString("could not find any package that provides:")
+	for _, m := range e.Missing {
+		if m.RequiredBy == "" {
+			fmt.Fprintf(&b, "\n  %q (requested directly)", m.Constraint)
+		} else {
+			fmt.Fprintf(&b, "\n  %q (required by %q)", m.Constraint, m.RequiredBy)
+		}
+	}
+	return b.String()
+}
+
 type DisqualifiedError struct {
 	Package *RepositoryPackage
 	Wrapped error
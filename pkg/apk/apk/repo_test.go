@@ -15,8 +15,19 @@
 package apk
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
 	"net/http/httptest"
@@ -24,15 +35,20 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/maps"
 	"golang.org/x/sync/errgroup"
 
+	"chainguard.dev/apko/pkg/apk/expandapk"
 	apkfs "chainguard.dev/apko/pkg/apk/fs"
+	sign "chainguard.dev/apko/pkg/apk/signature"
 )
 
 var (
@@ -332,6 +348,168 @@ func TestIndexAuth_good(t *testing.T) {
 	require.True(t, called, "did not make request")
 }
 
+func TestGetRepositoryIndexesParallel(t *testing.T) {
+	var (
+		mu               sync.Mutex
+		inFlight, peak   int
+		requested        = map[string]bool{}
+		release          = make(chan struct{})
+		allRequested     = make(chan struct{})
+		expectedRequests = 3
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		requested[repo] = true
+		if len(requested) == expectedRequests {
+			close(allRequested)
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+
+		// Hold every response until all of them were requested, which only happens if
+		// they are fetched concurrently.
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+
+		if repo == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.URL.Path = "/" + indexFilename
+		http.FileServer(http.Dir(testPrimaryPkgDir)).ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	go func() {
+		<-allRequested
+		close(release)
+	}()
+
+	ctx := context.Background()
+	opts := []IndexOption{WithIgnoreSignatures(true), WithHTTPClient(s.Client())}
+
+	indexes, err := GetRepositoryIndexes(ctx, []string{s.URL + "/main", "@community " + s.URL + "/community", s.URL + "/testing"}, nil, testArch, opts...)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		IndexURL(s.URL+"/main", testArch),
+		IndexURL(s.URL+"/community", testArch),
+		IndexURL(s.URL+"/testing", testArch),
+	}, indexNames(indexes))
+	require.Equal(t, "community", indexes[1].Name())
+	require.Equal(t, 3, peak, "indexes should be fetched concurrently")
+
+	_, err = GetRepositoryIndexes(ctx, []string{s.URL + "/main", s.URL + "/broken"}, nil, testArch, opts...)
+	require.ErrorContains(t, err, IndexURL(s.URL+"/broken", testArch))
+	require.NotContains(t, err.Error(), "/main/")
+}
+
+func TestVerifyIndexSignature(t *testing.T) {
+	ctx := context.Background()
+
+	// Sign one index with a fresh key, and keep another one unsigned to tamper with.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "test.rsa")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	signed := testLocalRepo(t, testArch, []*Package{{Name: "foo", Version: "1.0.0-r0"}})
+	signedIndex := filepath.Join(signed, testArch, indexFilename)
+	unsigned, err := os.ReadFile(signedIndex)
+	require.NoError(t, err)
+	require.NoError(t, sign.SignIndex(ctx, keyFile, signedIndex))
+	signedBytes, err := os.ReadFile(signedIndex)
+	require.NoError(t, err)
+
+	// Keep the signature, but swap in an index that lists another package. Each call returns a
+	// new repository, since parsed local indexes are cached by path.
+	tampered := func(t *testing.T) string {
+		repo := testLocalRepo(t, testArch, []*Package{{Name: "evil", Version: "1.0.0-r0"}})
+		index := filepath.Join(repo, testArch, indexFilename)
+		evil, err := os.ReadFile(index)
+		require.NoError(t, err)
+		signature := signedBytes[:len(signedBytes)-len(unsigned)]
+		require.NoError(t, os.WriteFile(index, append(slices.Clone(signature), evil...), 0o644)) //nolint:gosec // we're writing a test file
+		return repo
+	}
+
+	indexes := func(t *testing.T, repo string, options ...Option) ([]NamedIndex, error) {
+		t.Helper()
+		a, src := testAPKWithRepos(t, []string{repo}, options...)
+		require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, "test.rsa.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0o644))
+		return a.GetRepositoryIndexes(ctx, false)
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		idx, err := indexes(t, signed, WithVerifyIndexSignature(true))
+		require.NoError(t, err)
+		require.Len(t, idx, 1)
+		require.Equal(t, "foo", idx[0].Packages()[0].Name)
+	})
+	t.Run("tampered", func(t *testing.T) {
+		_, err := indexes(t, tampered(t), WithVerifyIndexSignature(true))
+		require.ErrorContains(t, err, "no key found to verify signature")
+	})
+	t.Run("tampered without verification", func(t *testing.T) {
+		// testAPKWithRepos skips signature checks for its repositories unless asked not to.
+		idx, err := indexes(t, tampered(t))
+		require.NoError(t, err)
+		require.Equal(t, "evil", idx[0].Packages()[0].Name)
+	})
+}
+
+func TestExtraKeys(t *testing.T) {
+	ctx := context.Background()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "test.rsa")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	extraKeys := map[string][]byte{"test.rsa.pub": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})}
+
+	// Each call returns a new repository, since parsed local indexes are cached by path.
+	signed := func(t *testing.T) string {
+		repo := testLocalRepo(t, testArch, []*Package{{Name: "foo", Version: "1.0.0-r0"}})
+		require.NoError(t, sign.SignIndex(ctx, keyFile, filepath.Join(repo, testArch, indexFilename)))
+		return repo
+	}
+
+	t.Run("in memory only", func(t *testing.T) {
+		a, src := testAPKWithRepos(t, []string{signed(t)}, WithVerifyIndexSignature(true), WithExtraKeys(extraKeys))
+		des, err := src.ReadDir(keysDirPath)
+		require.NoError(t, err)
+		require.Empty(t, des, "no key should be on disk")
+
+		idx, err := a.GetRepositoryIndexes(ctx, false)
+		require.NoError(t, err)
+		require.Equal(t, "foo", idx[0].Packages()[0].Name)
+	})
+	t.Run("no keys", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, []string{signed(t)}, WithVerifyIndexSignature(true))
+		_, err := a.GetRepositoryIndexes(ctx, false)
+		require.ErrorContains(t, err, "no key found to verify signature")
+	})
+	t.Run("InitKeyring", func(t *testing.T) {
+		a, src := testAPKWithRepos(t, nil, WithExtraKeys(extraKeys))
+		require.NoError(t, a.InitKeyring(ctx, []string{"test.rsa.pub"}, nil))
+		b, err := src.ReadFile(filepath.Join(keysDirPath, "test.rsa.pub"))
+		require.NoError(t, err)
+		require.Equal(t, extraKeys["test.rsa.pub"], b)
+	})
+}
+
 func TestIndexAuth_bad(t *testing.T) {
 	called := false
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -361,6 +539,39 @@ func TestIndexAuth_bad(t *testing.T) {
 	require.True(t, called, "did not make request")
 }
 
+func TestSetRepositoriesTyped(t *testing.T) {
+	ctx := context.Background()
+	a, src := testAPKWithRepos(t, nil)
+
+	specs := []RepoSpec{
+		{URI: "https://example.com/main"},
+		{URI: "https://example.com/edge", Tag: "edge"},
+		{URI: "https://example.com/local", Priority: 10},
+	}
+	require.NoError(t, a.SetRepositoriesTyped(ctx, specs))
+
+	data, err := src.ReadFile(reposFilePath)
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/local\nhttps://example.com/main\n@edge https://example.com/edge\n", string(data))
+
+	lines, err := a.GetRepositories(ctx)
+	require.NoError(t, err)
+	var parsed []RepoSpec
+	for _, line := range lines {
+		spec, err := ParseRepoSpec(line)
+		require.NoError(t, err)
+		parsed = append(parsed, spec)
+	}
+	require.Equal(t, []RepoSpec{
+		{URI: "https://example.com/local"},
+		{URI: "https://example.com/main"},
+		{URI: "https://example.com/edge", Tag: "edge"},
+	}, parsed)
+
+	require.Error(t, a.SetRepositoriesTyped(ctx, []RepoSpec{{Tag: "edge"}}))
+	require.Error(t, a.SetRepositoriesTyped(ctx, []RepoSpec{{URI: "https://example.com/edge", Tag: "bad tag"}}))
+}
+
 func testGetPackagesAndIndex() ([]*RepositoryPackage, []*RepositoryWithIndex) {
 	// create a tree of packages, including some multiple that depend on the same one
 	// but no circular dependencies; this is an acyclic graph
@@ -869,6 +1080,103 @@ func TestExcludedDeps(t *testing.T) {
 	}
 }
 
+func TestUnsatisfiedDependencies(t *testing.T) {
+	providers := map[string][]string{
+		"libfoo=1.0-r0": {"so:libfoo.so.1"},
+	}
+	dependers := map[string][]string{
+		"app=1.0-r0":    {"so:libfoo.so.1", "so:libmissing.so.1", "helper"},
+		"helper=1.0-r0": {"libgone"},
+		"tool=1.0-r0":   {"so:libmissing.so.1"},
+	}
+
+	resolver := makeResolver(providers, dependers)
+	_, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"app", "tool", "nonexistent"})
+	var unsatisfied *UnsatisfiedError
+	require.ErrorAs(t, err, &unsatisfied)
+	require.Equal(t, []UnsatisfiedDependency{
+		{Constraint: "nonexistent"},
+		{Constraint: "so:libmissing.so.1", RequiredBy: "app"},
+		{Constraint: "libgone", RequiredBy: "helper"},
+		{Constraint: "so:libmissing.so.1", RequiredBy: "tool"},
+	}, unsatisfied.Missing)
+	require.ErrorContains(t, err, `"so:libmissing.so.1" (required by "app")`)
+	require.ErrorContains(t, err, `"nonexistent" (requested directly)`)
+
+	// With nothing missing, the same resolver still resolves.
+	pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"libfoo"})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+}
+
+func TestInstallIf(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepo(t, testArch, []*Package{
+		{Name: "foo", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "bar", Version: "1.0.0-r0", Arch: testArch, Dependencies: []string{"libbar"}},
+		{Name: "libbar", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "foo-bar", Version: "1.0.0-r0", Arch: testArch, InstallIf: []string{"foo", "bar"}, Dependencies: []string{"foo-bar-data"}},
+		{Name: "foo-bar-data", Version: "1.0.0-r0", Arch: testArch},
+		// triggered in turn by a package that install_if pulled in
+		{Name: "foo-bar-doc", Version: "1.0.0-r0", Arch: testArch, InstallIf: []string{"foo-bar", "libbar=1.0.0-r0"}},
+		{Name: "foo-old", Version: "1.0.0-r0", Arch: testArch, InstallIf: []string{"foo", "libbar=0.9.0-r0"}},
+	})
+	a, _ := testAPKWithRepos(t, []string{repo})
+	indexes, err := a.GetRepositoryIndexes(ctx, false)
+	require.NoError(t, err)
+	resolver := NewPkgResolver(ctx, indexes)
+
+	resolve := func(world ...string) []string {
+		pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, world)
+		require.NoError(t, err)
+		names := make([]string, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Name)
+		}
+		return names
+	}
+	require.Equal(t, []string{"foo"}, resolve("foo"))
+	require.Equal(t, []string{"libbar", "bar"}, resolve("bar"))
+	require.Equal(t, []string{"foo", "libbar", "bar", "foo-bar-data", "foo-bar", "foo-bar-doc"}, resolve("foo", "bar"))
+}
+
+func TestVersionRanges(t *testing.T) {
+	providers := map[string][]string{}
+	for _, v := range []string{"0.9-r0", "1.0-r0", "1.0-r1", "1.2.3-r0", "1.2.9-r0", "1.5-r0", "2.0-r0", "2.1-r0"} {
+		providers["foo="+v] = nil
+	}
+	resolver := makeResolver(providers, nil)
+
+	for _, tt := range []struct {
+		constraints []string
+		want        string
+	}{
+		{[]string{"foo"}, "2.1-r0"},
+		{[]string{"foo=1.0-r0"}, "1.0-r0"},
+		{[]string{"foo>1.5"}, "2.1-r0"},
+		{[]string{"foo>=2.0"}, "2.1-r0"},
+		{[]string{"foo<2.0"}, "1.5-r0"},
+		{[]string{"foo<=2.0-r0"}, "2.0-r0"},
+		{[]string{"foo<1.0"}, "0.9-r0"},
+		{[]string{"foo~1.0"}, "1.0-r1"},
+		{[]string{"foo~=1.2"}, "1.2.9-r0"},
+		{[]string{"foo>1.0", "foo<2.0"}, "1.5-r0"},
+		{[]string{"foo>=1.0", "foo<1.5"}, "1.2.9-r0"},
+		{[]string{"foo>1.0", "foo<2.0", "foo~1.2.3"}, "1.2.3-r0"},
+		{[]string{"foo<=2.0-r0", "foo>=2.0"}, "2.0-r0"},
+	} {
+		t.Run(strings.Join(tt.constraints, " "), func(t *testing.T) {
+			pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), tt.constraints)
+			require.NoError(t, err)
+			require.Len(t, pkgs, 1)
+			require.Equal(t, tt.want, pkgs[0].Version)
+		})
+	}
+
+	_, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"foo>2.0", "foo<2.1"})
+	require.Error(t, err, "no version is in the range")
+}
+
 func TestSameProvidedVersion(t *testing.T) {
 	providers := map[string][]string{
 		"ld-linux=2.38-r10": {"so:ld-linux-aarch64.so.1=1.0"},
@@ -947,6 +1255,124 @@ func TestConstrains(t *testing.T) {
 	}
 }
 
+func TestMergeIndexes(t *testing.T) {
+	first := &Repository{URI: "https://first.example.com/main/" + testArch}
+	second := &Repository{URI: "https://second.example.com/main/" + testArch}
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{
+		first.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "foo", Version: "1.0.0", Description: "from first"},
+			{Name: "bar", Version: "1.0.0"},
+		}}),
+		second.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "foo", Version: "1.0.0", Description: "from second"},
+			{Name: "foo", Version: "2.0.0"},
+			{Name: "baz", Version: "1.0.0"},
+		}}),
+	})
+
+	merged := MergeIndexes(indexes)
+
+	got := make([]string, 0, len(merged))
+	for _, pkg := range merged {
+		got = append(got, fmt.Sprintf("%s-%s@%s", pkg.Name, pkg.Version, pkg.Repository().URI))
+	}
+	require.Equal(t, []string{
+		"foo-1.0.0@" + first.URI,
+		"bar-1.0.0@" + first.URI,
+		"foo-2.0.0@" + second.URI,
+		"baz-1.0.0@" + second.URI,
+	}, got)
+	require.Equal(t, "from first", merged[0].Description, "the first repository should win ties")
+}
+
+func TestResolveProvidesAndReplaces(t *testing.T) {
+	repo := &Repository{URI: "https://example.com/main/" + testArch}
+	resolve := func(t *testing.T, pkgs []*Package, world ...string) []string {
+		resolver := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{
+			repo.WithIndex(&APKIndex{Packages: pkgs}),
+		}))
+		resolved, _, err := resolver.GetPackagesWithDependencies(context.Background(), world)
+		require.NoError(t, err)
+		names := make([]string, 0, len(resolved))
+		for _, pkg := range resolved {
+			names = append(names, pkg.Name+"-"+pkg.Version)
+		}
+		return names
+	}
+
+	t.Run("virtual", func(t *testing.T) {
+		pkgs := []*Package{
+			{Name: "libssl3", Version: "3.1.0-r0", Provides: []string{"so:libssl.so.3=3"}},
+			{Name: "curl", Version: "8.0.0-r0", Dependencies: []string{"so:libssl.so.3"}},
+		}
+		require.Equal(t, []string{"libssl3-3.1.0-r0"}, resolve(t, pkgs, "so:libssl.so.3"))
+		require.Equal(t, []string{"libssl3-3.1.0-r0", "curl-8.0.0-r0"}, resolve(t, pkgs, "curl"))
+	})
+	t.Run("versioned virtual", func(t *testing.T) {
+		pkgs := []*Package{
+			{Name: "libssl3", Version: "3.1.0-r0", Provides: []string{"so:libssl.so.3=3"}},
+			{Name: "libssl3-next", Version: "3.2.0-r0", Provides: []string{"so:libssl.so.3=4"}},
+		}
+		require.Equal(t, []string{"libssl3-next-3.2.0-r0"}, resolve(t, pkgs, "so:libssl.so.3"))
+		require.Equal(t, []string{"libssl3-3.1.0-r0"}, resolve(t, pkgs, "so:libssl.so.3<4"))
+	})
+	t.Run("replaces", func(t *testing.T) {
+		pkgs := []*Package{
+			{Name: "busybox-foo", Version: "2.0.0-r0", Provides: []string{"cmd:foo=1"}},
+			{Name: "foo", Version: "1.0.0-r0", Provides: []string{"cmd:foo=1"}, Replaces: []string{"busybox-foo"}},
+		}
+		require.Equal(t, []string{"foo-1.0.0-r0"}, resolve(t, pkgs, "cmd:foo"))
+	})
+	t.Run("replaces older", func(t *testing.T) {
+		// Replacing only breaks ties, a newer provider still wins.
+		pkgs := []*Package{
+			{Name: "busybox-foo", Version: "2.0.0-r0", Provides: []string{"cmd:foo=2"}},
+			{Name: "foo", Version: "1.0.0-r0", Provides: []string{"cmd:foo=1"}, Replaces: []string{"busybox-foo"}},
+		}
+		require.Equal(t, []string{"busybox-foo-2.0.0-r0"}, resolve(t, pkgs, "cmd:foo"))
+	})
+}
+
+func TestRepositoryPriority(t *testing.T) {
+	ctx := context.Background()
+	index := func(name, uri string) NamedIndex {
+		repo := &Repository{URI: uri}
+		return NewNamedRepositoryWithIndex(name, repo.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "foo", Version: "1.0.0-r0"},
+				{Name: "bar", Version: "1.0.0-r0", Dependencies: []string{"foo"}},
+			},
+		}))
+	}
+	main, community, edge := index("", "https://example.com/main"), index("", "https://example.com/community"), index("edge", "https://example.com/edge")
+	resolve := func(t *testing.T, indexes []NamedIndex, world ...string) map[string]string {
+		pkgs, _, err := NewPkgResolver(ctx, indexes).GetPackagesWithDependencies(ctx, world)
+		require.NoError(t, err)
+		repos := map[string]string{}
+		for _, pkg := range pkgs {
+			repos[pkg.Name] = pkg.Repository().URI
+		}
+		return repos
+	}
+
+	t.Run("first repository wins", func(t *testing.T) {
+		require.Equal(t, map[string]string{
+			"foo": "https://example.com/main",
+			"bar": "https://example.com/main",
+		}, resolve(t, []NamedIndex{main, community, edge}, "bar"))
+		require.Equal(t, map[string]string{
+			"foo": "https://example.com/community",
+			"bar": "https://example.com/community",
+		}, resolve(t, []NamedIndex{edge, community, main}, "bar"))
+	})
+	t.Run("tag pin", func(t *testing.T) {
+		require.Equal(t, map[string]string{
+			"foo": "https://example.com/edge",
+			"bar": "https://example.com/main",
+		}, resolve(t, []NamedIndex{main, community, edge}, "bar", "foo@edge"))
+	})
+}
+
 func testNamedRepositoryFromIndexes(indexes []*RepositoryWithIndex) (named []NamedIndex) {
 	for _, index := range indexes {
 		named = append(named, NewNamedRepositoryWithIndex("", index))
@@ -999,3 +1425,253 @@ func makeResolver(provs, deps map[string][]string) *PkgResolver {
 	})
 	return NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{repoWithIndex}))
 }
+
+func TestValidateRepositories(t *testing.T) {
+	ctx := context.Background()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/missing/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/zstd/") && strings.HasSuffix(r.URL.Path, ".tar.gz") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+
+	repos := []string{s.URL + "/main", s.URL + "/missing", "@community " + s.URL + "/community"}
+	a, _ := testAPKWithRepos(t, repos, WithAuth(host, "user", "pass"))
+
+	err := a.ValidateRepositories(ctx)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "repository "+s.URL+"/missing: unexpected status 404")
+	require.NotContains(t, err.Error(), s.URL+"/main")
+	require.NotContains(t, err.Error(), s.URL+"/community")
+
+	t.Run("zstd index only", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, []string{s.URL + "/zstd"}, WithAuth(host, "user", "pass"))
+		require.NoError(t, a.ValidateRepositories(ctx))
+
+		a, _ = testAPKWithRepos(t, []string{s.URL + "/zstd"}, WithAuth(host, "user", "pass"), WithIndexFormats([]string{indexFilename}))
+		require.ErrorContains(t, a.ValidateRepositories(ctx), "unexpected status 404")
+	})
+	t.Run("without credentials", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, repos[:1])
+		require.ErrorContains(t, a.ValidateRepositories(ctx), "401")
+	})
+	t.Run("local", func(t *testing.T) {
+		repo := testLocalRepo(t, testArch, nil)
+		a, _ := testAPKWithRepos(t, []string{repo, "file://" + repo})
+		require.NoError(t, a.ValidateRepositories(ctx))
+
+		a, _ = testAPKWithRepos(t, []string{repo, t.TempDir()})
+		require.Error(t, a.ValidateRepositories(ctx))
+	})
+}
+
+func TestInsecureIgnoreSignatures(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepo(t, testArch, []*Package{{Name: "foo", Version: "1.0.0"}})
+
+	load := func(t *testing.T, options ...Option) ([]NamedIndex, error) {
+		t.Helper()
+		src := apkfs.NewMemFS()
+		a, err := New(append([]Option{WithFS(src), WithArch(testArch), WithIgnoreMknodErrors(ignoreMknodErrors)}, options...)...)
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, a.SetRepositories(ctx, []string{repo}))
+		return a.GetRepositoryIndexes(ctx, false)
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		indexes, err := load(t, WithInsecureIgnoreSignatures(true))
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+		require.Equal(t, 1, indexes[0].Count())
+	})
+	t.Run("disabled", func(t *testing.T) {
+		_, err := load(t)
+		require.ErrorContains(t, err, "signature")
+	})
+	t.Run("with verification", func(t *testing.T) {
+		_, err := New(WithFS(apkfs.NewMemFS()), WithInsecureIgnoreSignatures(true), WithVerifyIndexSignature(true))
+		require.Error(t, err)
+	})
+}
+
+func TestZstdIndex(t *testing.T) {
+	gz, err := os.Open(filepath.Join(testPrimaryPkgDir, indexFilename))
+	require.NoError(t, err)
+	defer gz.Close()
+	zr, err := gzip.NewReader(gz)
+	require.NoError(t, err)
+	var index bytes.Buffer
+	zw, err := zstd.NewWriter(&index)
+	require.NoError(t, err)
+	_, err = io.Copy(zw, zr)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	var (
+		mu        sync.Mutex
+		requested []string
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path != "/"+testArch+"/APKINDEX.tar.zst" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(index.Bytes())
+	}))
+	defer s.Close()
+
+	ctx := context.Background()
+	opts := []IndexOption{WithIgnoreSignatures(true), WithHTTPClient(s.Client())}
+
+	indexes, err := GetRepositoryIndexes(ctx, []string{s.URL}, nil, testArch, opts...)
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.NotZero(t, indexes[0].Count())
+	require.Equal(t, []string{"/" + testArch + "/APKINDEX.tar.gz", "/" + testArch + "/APKINDEX.tar.zst"}, requested)
+
+	_, err = GetRepositoryIndexes(ctx, []string{s.URL}, nil, testArch, append(opts, WithIndexFilenames(indexFilename))...)
+	require.ErrorContains(t, err, "repository index not found")
+
+	// The whole index is a single zstd frame, so there is no signature section to verify.
+	_, err = GetRepositoryIndexes(ctx, []string{s.URL}, nil, testArch, WithHTTPClient(s.Client()))
+	require.ErrorContains(t, err, "signature")
+}
+
+// testFakeMagic starts the streams of testFakeDecompressor, which are the magic bytes, the
+// length of the contents as a big-endian uint32 and then the contents as they are.
+var testFakeMagic = []byte("APKFAKE\x00")
+
+type testFakeDecompressor struct{}
+
+func (testFakeDecompressor) Magic() []byte { return testFakeMagic }
+
+func (testFakeDecompressor) NewReader(r io.Reader, single bool) (io.ReadCloser, error) {
+	var out bytes.Buffer
+	for {
+		header := make([]byte, len(testFakeMagic)+4)
+		if _, err := io.ReadFull(r, header); errors.Is(err, io.EOF) && out.Len() > 0 {
+			return io.NopCloser(&out), nil
+		} else if err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(&out, r, int64(binary.BigEndian.Uint32(header[len(testFakeMagic):]))); err != nil {
+			return nil, err
+		}
+		if single {
+			return io.NopCloser(&out), nil
+		}
+	}
+}
+
+func testFakeCompress(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(slices.Clone(testFakeMagic), uint32(len(b))), b...)
+}
+
+func TestRegisteredDecompressor(t *testing.T) {
+	ctx := context.Background()
+	// There is no way to unregister it, but no other test uses its magic bytes.
+	expandapk.RegisterDecompressor(testFakeDecompressor{})
+
+	// untar returns the tar stream of a gzip-compressed one, without its end-of-archive marker
+	// if open, so that another tar stream can follow it.
+	untar := func(t *testing.T, gz io.Reader, open bool) []byte {
+		t.Helper()
+		zr, err := gzip.NewReader(gz)
+		require.NoError(t, err)
+		b, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		if open {
+			b = bytes.TrimRight(b, "\x00")
+			b = b[:(len(b)+511)/512*512]
+		}
+		return b
+	}
+
+	t.Run("signed index", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		keyFile := filepath.Join(t.TempDir(), "test.rsa")
+		require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+		pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+
+		archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{{Name: "foo", Version: "1.0.0-r0"}}})
+		require.NoError(t, err)
+		index := testFakeCompress(untar(t, archive, false))
+		digest, err := sign.HashData(index)
+		require.NoError(t, err)
+		signature, err := sign.RSASignSHA1Digest(digest, keyFile, "")
+		require.NoError(t, err)
+		var sigTar bytes.Buffer
+		tw := tar.NewWriter(&sigTar)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: ".SIGN.RSA.test.rsa.pub", Mode: 0o644, Size: int64(len(signature)), Typeflag: tar.TypeReg}))
+		_, err = tw.Write(signature)
+		require.NoError(t, err)
+		require.NoError(t, tw.Flush())
+
+		repo := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(repo, testArch), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(repo, testArch, indexFilename), append(testFakeCompress(sigTar.Bytes()), index...), 0o644)) //nolint:gosec // we're writing a test file
+
+		a, src := testAPKWithRepos(t, []string{repo}, WithVerifyIndexSignature(true))
+		indexes, err := a.GetRepositoryIndexes(ctx, false)
+		require.ErrorContains(t, err, "no key found to verify signature")
+		require.Empty(t, indexes)
+
+		require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, "test.rsa.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0o644))
+		globalIndexCache = &indexCache{}
+		t.Cleanup(func() { globalIndexCache = &indexCache{} })
+		indexes, err = a.GetRepositoryIndexes(ctx, false)
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+		require.Equal(t, "foo", indexes[0].Packages()[0].Name)
+	})
+
+	t.Run("package", func(t *testing.T) {
+		pkg := fakePackage(t, &Package{Name: "fake", Version: "1.0.0-r0", Arch: testArch}, []testDirEntry{
+			{"usr", 0o755, true, nil, nil},
+			{"usr/fake", 0o644, false, []byte("fake"), nil},
+		})
+		fake, ok := pkg.(*testPackage)
+		require.True(t, ok)
+		f, err := os.Open(fake.file)
+		require.NoError(t, err)
+		defer f.Close()
+		sections, err := expandapk.Split(f)
+		require.NoError(t, err)
+		require.Len(t, sections, 2)
+		control := testFakeCompress(untar(t, sections[0], true))
+		data := testFakeCompress(untar(t, sections[1], false))
+		apk := append(slices.Clone(control), data...)
+
+		parsed, err := ParsePackage(ctx, bytes.NewReader(apk), uint64(len(apk)))
+		require.NoError(t, err)
+		require.Equal(t, "fake", parsed.Name)
+		controlHash := sha1.Sum(control) //nolint:gosec // this is what apk tools is using
+		require.Equal(t, controlHash[:], parsed.Checksum)
+
+		resolved, err := ResolveApk(ctx, bytes.NewReader(apk))
+		require.NoError(t, err)
+		require.Equal(t, controlHash[:], resolved.ControlHash)
+		require.Equal(t, len(control), resolved.ControlSize)
+	})
+}
@@ -60,6 +60,11 @@ func (r *RepositoryWithIndex) Count() int {
 	return len(r.index.Packages)
 }
 
+// Metadata returns the metadata of the index of this repository.
+func (r *RepositoryWithIndex) Metadata() IndexMetadata {
+	return r.index.Metadata()
+}
+
 // RepoAbbr returns a short name of this repository consiting of the repo name
 // and the architecture.
 func (r *RepositoryWithIndex) RepoAbbr() string {
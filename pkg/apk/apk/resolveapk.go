@@ -12,9 +12,9 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/klauspost/compress/gzip"
-
 	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/apko/pkg/apk/expandapk"
 )
 
 // An implementation of io.Reader designed specifically for use in the resolveApk() method.
@@ -76,7 +76,6 @@ func ResolveApk(ctx context.Context, source io.Reader) (*APKResolved, error) {
 	controlIdx := 0
 	signed := false
 
-	var gzi *gzip.Reader
 	cr := &countingWriter{}
 	tr := io.TeeReader(source, cr)
 	norar := newNoReadAheadApkReader(tr)
@@ -86,20 +85,12 @@ func ResolveApk(ctx context.Context, source io.Reader) (*APKResolved, error) {
 
 		hr := io.TeeReader(norar, h)
 
-		var err error
-
-		if gzi == nil {
-			gzi, err = gzip.NewReader(hr)
-		} else {
-			err = gzi.Reset(hr)
-		}
-
+		gzi, err := expandapk.NewStreamDecompressor(hr)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return nil, fmt.Errorf("creating gzip reader: %w", err)
+			return nil, fmt.Errorf("creating decompressor: %w", err)
 		}
-		gzi.Multistream(false)
 
 		if streamId == 0 {
 			tr := tar.NewReader(gzi)
@@ -143,6 +134,7 @@ func ResolveApk(ctx context.Context, source io.Reader) (*APKResolved, error) {
 			if _, err := io.Copy(io.Discard, gzi); err != nil {
 				return nil, fmt.Errorf("ResolveApk error 2: %v", err)
 			}
+			gzi.Close()
 
 			hashes[streamId] = h.Sum(nil)
 			gzipStreamSizes[streamId] = cr.bytesWritten
@@ -0,0 +1,230 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resumeTransport keeps the bytes of every download in a partial file in the cache directory as
+// they are read, so that a download that is interrupted resumes with a Range request for the
+// remaining bytes the next time. Downloads only resume if the server sent an ETag or
+// Last-Modified value for the partial bytes, which the Range request carries in If-Range so that
+// a changed file is downloaded in full again.
+//
+// Each download records its bytes in a temporary file of its own, which only replaces the
+// partial file once the download stops, so concurrent downloads of the same file, from one
+// process or several sharing the cache, never write to the same partial file.
+type resumeTransport struct {
+	wrapped *http.Client
+	root    string
+}
+
+// partialFile holds the validator of an interrupted download on its first line, followed by the
+// bytes downloaded so far.
+func partialFile(cacheFile string) string {
+	return cacheFile + ".partial"
+}
+
+func (t *resumeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" || req.URL == nil {
+		return t.wrapped.Do(req)
+	}
+	cacheFile, err := cachePathFromURL(t.root, *req.URL)
+	if err != nil {
+		return t.wrapped.Do(req)
+	}
+
+	if existing, validator, offset := openPartial(cacheFile); existing != nil {
+		r := req.Clone(req.Context())
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		r.Header.Set("If-Range", validator)
+		resp, err := t.wrapped.Do(r)
+		if err != nil {
+			existing.Close()
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+			return t.resume(resp, cacheFile, existing, validator, offset)
+		case resp.StatusCode == http.StatusOK:
+			// The server ignored the range, or the file changed: start over with this response.
+			existing.Close()
+			return t.start(resp, cacheFile)
+		}
+		// Anything else, such as 416 for a partial file that is somehow complete or too long,
+		// is retried as a plain request for the whole file.
+		existing.Close()
+		resp.Body.Close()
+	}
+
+	resp, err := t.wrapped.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	return t.start(resp, cacheFile)
+}
+
+// openPartial opens the partial file of cacheFile, positioned after its validator, and returns
+// it with the validator and the number of bytes it holds. It returns a nil file if there is no
+// partial download to resume.
+func openPartial(cacheFile string) (*os.File, string, int64) {
+	f, err := os.Open(partialFile(cacheFile))
+	if err != nil {
+		return nil, "", 0
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, "", 0
+	}
+	// The partial file was renamed into place whole, so the validator is on its first line.
+	line, err := bufio.NewReader(io.LimitReader(f, maxValidatorLen+1)).ReadString('\n')
+	validator := strings.TrimSuffix(line, "\n")
+	offset := fi.Size() - int64(len(line))
+	if err != nil || validator == "" || offset <= 0 {
+		f.Close()
+		return nil, "", 0
+	}
+	if _, err := f.Seek(int64(len(line)), io.SeekStart); err != nil {
+		f.Close()
+		return nil, "", 0
+	}
+	return f, validator, offset
+}
+
+// maxValidatorLen bounds the first line of a partial file that is read as its validator.
+const maxValidatorLen = 1024
+
+// start records the body of resp as it is read, to be kept as the partial file if it is not
+// read to the end.
+func (t *resumeTransport) start(resp *http.Response, cacheFile string) (*http.Response, error) {
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if validator == "" || len(validator) > maxValidatorLen || strings.ContainsAny(validator, "\r\n") {
+		// Without a validator, a download cannot safely be resumed.
+		return resp, nil
+	}
+	tmp, err := createPartial(cacheFile, validator)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	resp.Body = &resumeBody{Reader: io.TeeReader(resp.Body, tmp), network: resp.Body, tmp: tmp, cacheFile: cacheFile}
+	return resp, nil
+}
+
+// resume returns a response with the bytes in the partial file existing followed by the
+// remaining bytes in resp, all of which are recorded again as they are read.
+func (t *resumeTransport) resume(resp *http.Response, cacheFile string, existing *os.File, validator string, offset int64) (*http.Response, error) {
+	tmp, err := createPartial(cacheFile, validator)
+	if err != nil {
+		existing.Close()
+		resp.Body.Close()
+		return nil, err
+	}
+
+	contentLength := int64(-1)
+	if resp.ContentLength >= 0 {
+		contentLength = offset + resp.ContentLength
+	}
+	header := resp.Header.Clone()
+	header.Del("Content-Range")
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         resp.Proto,
+		ProtoMajor:    resp.ProtoMajor,
+		ProtoMinor:    resp.ProtoMinor,
+		Header:        header,
+		ContentLength: contentLength,
+		Request:       resp.Request,
+		Body: &resumeBody{
+			Reader:    io.TeeReader(io.MultiReader(io.LimitReader(existing, offset), resp.Body), tmp),
+			network:   resp.Body,
+			existing:  existing,
+			tmp:       tmp,
+			cacheFile: cacheFile,
+		},
+	}, nil
+}
+
+// createPartial creates a temporary file next to cacheFile to record a download in, starting
+// with its validator.
+func createPartial(cacheFile, validator string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cacheFile), filepath.Base(partialFile(cacheFile))+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a temporary partial file: %w", err)
+	}
+	if _, err := io.WriteString(tmp, validator+"\n"); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("writing %s: %w", tmp.Name(), err)
+	}
+	return tmp, nil
+}
+
+// resumeBody reads a download while it is recorded in a temporary file. If the download is
+// complete, the recording and any partial file are removed; otherwise the recording replaces
+// the partial file when the body is closed.
+type resumeBody struct {
+	io.Reader
+	network   io.ReadCloser
+	existing  *os.File
+	tmp       *os.File
+	cacheFile string
+	done      bool
+}
+
+func (b *resumeBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if errors.Is(err, io.EOF) && !b.done {
+		// Complete, so the cache has no more use for the partial bytes.
+		b.done = true
+		b.tmp.Close()
+		os.Remove(b.tmp.Name())
+		os.Remove(partialFile(b.cacheFile))
+	}
+	return n, err
+}
+
+func (b *resumeBody) Close() error {
+	if b.existing != nil {
+		b.existing.Close()
+	}
+	if !b.done {
+		b.done = true
+		if err := b.tmp.Close(); err == nil {
+			if err := os.Rename(b.tmp.Name(), partialFile(b.cacheFile)); err != nil {
+				os.Remove(b.tmp.Name())
+			}
+		} else {
+			os.Remove(b.tmp.Name())
+		}
+	}
+	return b.network.Close()
+}
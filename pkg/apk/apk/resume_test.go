@@ -0,0 +1,197 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testInterruptingServer serves content, but while interrupt is set it stops every download of it
+// halfway and fails Range requests. Unless ignoreRange is set, it answers Range requests with the
+// requested bytes.
+type testInterruptingServer struct {
+	content     []byte
+	ignoreRange bool
+
+	mu        sync.Mutex
+	interrupt bool
+	ranges    []string
+}
+
+func (s *testInterruptingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	interrupt := s.interrupt
+	rng := r.Header.Get("Range")
+	s.ranges = append(s.ranges, rng)
+	s.mu.Unlock()
+
+	w.Header().Set("ETag", `"v1"`)
+	if rng != "" && interrupt {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if rng != "" && !s.ignoreRange && r.Header.Get("If-Range") == `"v1"` {
+		var start int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-", &start); err != nil {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(s.content)-1, len(s.content)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.content)-start))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(s.content[start:])
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.content)))
+	if interrupt {
+		_, _ = w.Write(s.content[:len(s.content)/2])
+		panic(http.ErrAbortHandler)
+	}
+	_, _ = w.Write(s.content)
+}
+
+func TestResumableDownloads(t *testing.T) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+
+	for _, tt := range []struct {
+		name        string
+		ignoreRange bool
+		wantRange   string
+	}{
+		{name: "resumes from the partial bytes", wantRange: fmt.Sprintf("bytes=%d-", len(content)/2)},
+		{name: "starts over without range support", ignoreRange: true, wantRange: fmt.Sprintf("bytes=%d-", len(content)/2)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &testInterruptingServer{content: content, ignoreRange: tt.ignoreRange, interrupt: true}
+			s := httptest.NewServer(server)
+			defer s.Close()
+
+			repo := Repository{URI: s.URL + "/" + testArch}
+			pkg := NewRepositoryPackage(&Package{Name: "big", Version: "1.0.0"}, repo.WithIndex(&APKIndex{}))
+			a, err := New(WithFS(apkfs.NewMemFS()), WithCache(t.TempDir(), false), WithResumableDownloads(true))
+			require.NoError(t, err)
+
+			fetch := func() ([]byte, error) {
+				rc, err := a.FetchPackage(ctx, pkg)
+				if err != nil {
+					return nil, err
+				}
+				defer rc.Close()
+				return io.ReadAll(rc)
+			}
+
+			_, err = fetch()
+			require.Error(t, err, "the first download should be interrupted")
+
+			server.mu.Lock()
+			server.interrupt = false
+			server.ranges = nil
+			server.mu.Unlock()
+
+			got, err := fetch()
+			require.NoError(t, err)
+			require.Equal(t, content, got)
+			require.Equal(t, tt.wantRange, server.ranges[0], "the download should resume")
+
+			server.mu.Lock()
+			server.ranges = nil
+			server.mu.Unlock()
+			got, err = fetch()
+			require.NoError(t, err)
+			require.Equal(t, content, got)
+			require.Empty(t, server.ranges, "a complete download should be served from the cache, not resumed")
+		})
+	}
+}
+
+func TestResumableDownloadsConcurrent(t *testing.T) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	server := &testInterruptingServer{content: content}
+	s := httptest.NewServer(server)
+	defer s.Close()
+
+	repo := Repository{URI: s.URL + "/" + testArch}
+	pkg := NewRepositoryPackage(&Package{Name: "big", Version: "1.0.0"}, repo.WithIndex(&APKIndex{}))
+	a, err := New(WithFS(apkfs.NewMemFS()), WithCache(t.TempDir(), false), WithResumableDownloads(true))
+	require.NoError(t, err)
+
+	// open starts a download and reads n bytes of it.
+	open := func(n int) io.ReadCloser {
+		t.Helper()
+		rc, err := a.FetchPackage(ctx, pkg)
+		require.NoError(t, err)
+		_, err = io.ReadFull(rc, make([]byte, n))
+		require.NoError(t, err)
+		return rc
+	}
+
+	// Two downloads of the same file overlap, and both stop before the end.
+	first := open(len(content) * 4 / 10)
+	second := open(len(content) / 10)
+	require.NoError(t, second.Close())
+	_, err = io.ReadFull(first, make([]byte, len(content)*2/10))
+	require.NoError(t, err)
+	require.NoError(t, first.Close())
+
+	// More downloads run at once, some of them stopping early, while the others resume.
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, err := a.FetchPackage(ctx, pkg)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer rc.Close()
+			if i%2 == 1 {
+				_, err = io.ReadFull(rc, make([]byte, len(content)/(i+1)))
+				assert.NoError(t, err)
+				return
+			}
+			got, err := io.ReadAll(rc)
+			assert.NoError(t, err)
+			assert.Equal(t, content, got)
+		}()
+	}
+	wg.Wait()
+
+	got, err := func() ([]byte, error) {
+		rc, err := a.FetchPackage(ctx, pkg)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}()
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+}
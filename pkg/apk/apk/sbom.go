@@ -0,0 +1,266 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	purl "github.com/package-url/packageurl-go"
+	"go.opentelemetry.io/otel"
+)
+
+// SBOMFormat is a serialization format for GenerateSBOM.
+type SBOMFormat string
+
+const (
+	// SBOMFormatSPDX is an SPDX 2.3 JSON document.
+	SBOMFormatSPDX SBOMFormat = "spdx-json"
+	// SBOMFormatCycloneDX is a CycloneDX 1.5 JSON document.
+	SBOMFormatCycloneDX SBOMFormat = "cyclonedx-json"
+)
+
+// sbomPackage is what an SBOM records about an installed package.
+type sbomPackage struct {
+	*InstalledPackage
+	// repository is the URI of the repository the package is available from, if known.
+	repository string
+}
+
+func (p sbomPackage) purl() string {
+	qualifiers := map[string]string{}
+	if p.Arch != "" {
+		qualifiers["arch"] = p.Arch
+	}
+	if p.repository != "" {
+		qualifiers["repository_url"] = p.repository
+	}
+	return purl.NewPackageURL("apk", "", p.Name, p.Version, purl.QualifiersFromMap(qualifiers), "").String()
+}
+
+// GenerateSBOM writes a bill of materials of the installed packages to w, in the given format.
+// Licenses come from the installed package metadata. The repository each package came from is
+// looked up in the configured repositories, and left out if they cannot be read.
+func (a *APK) GenerateSBOM(ctx context.Context, format SBOMFormat, w io.Writer) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "GenerateSBOM")
+	defer span.End()
+
+	var render func([]sbomPackage, time.Time) any
+	switch format {
+	case SBOMFormatSPDX:
+		render = spdxDocument
+	case SBOMFormatCycloneDX:
+		render = cycloneDXDocument
+	default:
+		return fmt.Errorf("unsupported SBOM format %q", format)
+	}
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("error getting installed packages: %w", err)
+	}
+
+	repositories := map[string]string{}
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		a.log(ctx).Warnf("not recording package repositories in SBOM: %v", err)
+	}
+	for _, index := range indexes {
+		for _, pkg := range index.Packages() {
+			key := pkg.Name + "=" + pkg.Version
+			if _, ok := repositories[key]; !ok {
+				repositories[key] = pkg.Repository().URI
+			}
+		}
+	}
+
+	// Use the newest build time as the creation time, so that the same packages always result
+	// in the same document. Without any, it is the epoch.
+	created := time.Unix(0, 0)
+	pkgs := make([]sbomPackage, 0, len(installed))
+	for _, pkg := range installed {
+		if pkg.BuildTime.After(created) {
+			created = pkg.BuildTime
+		}
+		pkgs = append(pkgs, sbomPackage{
+			InstalledPackage: pkg,
+			repository:       repositories[pkg.Name+"="+pkg.Version],
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(render(pkgs, created.UTC())); err != nil {
+		return fmt.Errorf("error writing %s SBOM: %w", format, err)
+	}
+	return nil
+}
+
+type spdxDoc struct {
+	SPDXVersion       string        `json:"spdxVersion"`
+	DataLicense       string        `json:"dataLicense"`
+	ID                string        `json:"SPDXID"`
+	Name              string        `json:"name"`
+	Namespace         string        `json:"documentNamespace"`
+	CreationInfo      spdxCreation  `json:"creationInfo"`
+	DocumentDescribes []string      `json:"documentDescribes"`
+	Packages          []spdxPackage `json:"packages"`
+}
+
+type spdxCreation struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	ID               string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	Version          string            `json:"versionInfo"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	BuiltDate        string            `json:"builtDate,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs"`
+}
+
+type spdxExternalRef struct {
+	Category string `json:"referenceCategory"`
+	Type     string `json:"referenceType"`
+	Locator  string `json:"referenceLocator"`
+}
+
+// spdxInvalidIDChars matches what may not appear in an SPDX identifier.
+var spdxInvalidIDChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+func spdxDocument(pkgs []sbomPackage, created time.Time) any {
+	doc := spdxDoc{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		ID:          "SPDXRef-DOCUMENT",
+		Name:        "apk-installed-packages",
+		Namespace:   "https://spdx.org/spdxdocs/go-apk/",
+		CreationInfo: spdxCreation{
+			Created:  created.Format(time.RFC3339),
+			Creators: []string{"Tool: go-apk"},
+		},
+		DocumentDescribes: []string{},
+		Packages:          []spdxPackage{},
+	}
+	for _, pkg := range pkgs {
+		p := spdxPackage{
+			ID:               "SPDXRef-Package-" + spdxInvalidIDChars.ReplaceAllString(pkg.Name+"-"+pkg.Version, "-"),
+			Name:             pkg.Name,
+			Version:          pkg.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				Category: "PACKAGE-MANAGER",
+				Type:     "purl",
+				Locator:  pkg.purl(),
+			}},
+		}
+		if pkg.License != "" {
+			p.LicenseConcluded = pkg.License
+			p.LicenseDeclared = pkg.License
+		}
+		if pkg.repository != "" {
+			p.DownloadLocation = pkg.repository
+		}
+		if pkg.Origin != "" {
+			p.SourceInfo = "built from origin package " + pkg.Origin
+		}
+		if !pkg.BuildTime.IsZero() {
+			p.BuiltDate = pkg.BuildTime.UTC().Format(time.RFC3339)
+		}
+		doc.DocumentDescribes = append(doc.DocumentDescribes, p.ID)
+		doc.Packages = append(doc.Packages, p)
+	}
+	return doc
+}
+
+type cycloneDXDoc struct {
+	BOMFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Version     int                  `json:"version"`
+	Metadata    cycloneDXMetadata    `json:"metadata"`
+	Components  []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string `json:"timestamp"`
+	Tools     struct {
+		Components []cycloneDXComponent `json:"components"`
+	} `json:"tools"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Licenses   []cycloneDXLicense  `json:"licenses,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXLicense struct {
+	Expression string `json:"expression"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func cycloneDXDocument(pkgs []sbomPackage, created time.Time) any {
+	doc := cycloneDXDoc{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Metadata:    cycloneDXMetadata{Timestamp: created.Format(time.RFC3339)},
+		Components:  []cycloneDXComponent{},
+	}
+	doc.Metadata.Tools.Components = []cycloneDXComponent{{Type: "application", Name: "go-apk"}}
+	for _, pkg := range pkgs {
+		c := cycloneDXComponent{
+			Type:    "library",
+			BOMRef:  pkg.purl(),
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			PURL:    pkg.purl(),
+		}
+		if pkg.License != "" {
+			c.Licenses = []cycloneDXLicense{{Expression: pkg.License}}
+		}
+		if pkg.Origin != "" {
+			c.Properties = append(c.Properties, cycloneDXProperty{Name: "apk:origin", Value: pkg.Origin})
+		}
+		if pkg.repository != "" {
+			c.Properties = append(c.Properties, cycloneDXProperty{Name: "apk:repository", Value: pkg.repository})
+		}
+		if !pkg.BuildTime.IsZero() {
+			c.Properties = append(c.Properties, cycloneDXProperty{Name: "apk:buildTime", Value: pkg.BuildTime.UTC().Format(time.RFC3339)})
+		}
+		doc.Components = append(doc.Components, c)
+	}
+	return doc
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateSBOM(t *testing.T) {
+	ctx := context.Background()
+	installed := []*Package{
+		{Name: "foo", Version: "1.0.0-r0", Arch: testArch, License: "Apache-2.0", Origin: "foo", BuildTime: time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)},
+		{Name: "libfoo", Version: "1.0.0-r0", Arch: testArch, License: "MIT AND BSD-3-Clause", Origin: "foo"},
+		{Name: "bar", Version: "2.0.0-r1", Arch: testArch, License: "GPL-2.0-only", Origin: "bar"},
+	}
+	repo := testLocalRepo(t, testArch, installed[:2])
+
+	a, _ := testAPKWithRepos(t, []string{repo})
+	for _, pkg := range installed {
+		require.NoError(t, a.AddInstalledPackage(pkg, nil))
+	}
+
+	t.Run("spdx", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, a.GenerateSBOM(ctx, SBOMFormatSPDX, &buf))
+
+		var doc struct {
+			SPDXVersion string `json:"spdxVersion"`
+			Packages    []struct {
+				Name             string `json:"name"`
+				Version          string `json:"versionInfo"`
+				License          string `json:"licenseDeclared"`
+				DownloadLocation string `json:"downloadLocation"`
+				BuiltDate        string `json:"builtDate"`
+			} `json:"packages"`
+		}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+		require.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+		require.Len(t, doc.Packages, len(installed))
+		for i, pkg := range installed {
+			require.Equal(t, pkg.Name, doc.Packages[i].Name)
+			require.Equal(t, pkg.Version, doc.Packages[i].Version)
+			require.Equal(t, pkg.License, doc.Packages[i].License)
+		}
+		require.Equal(t, repo+"/"+testArch, doc.Packages[0].DownloadLocation)
+		require.Equal(t, "NOASSERTION", doc.Packages[2].DownloadLocation, "bar is not in any repository")
+		require.Equal(t, "2023-11-14T22:13:20Z", doc.Packages[0].BuiltDate)
+		require.Empty(t, doc.Packages[1].BuiltDate, "libfoo has no build time")
+	})
+	t.Run("cyclonedx", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, a.GenerateSBOM(ctx, SBOMFormatCycloneDX, &buf))
+
+		var doc struct {
+			BOMFormat  string `json:"bomFormat"`
+			Components []struct {
+				Name     string `json:"name"`
+				Version  string `json:"version"`
+				PURL     string `json:"purl"`
+				Licenses []struct {
+					Expression string `json:"expression"`
+				} `json:"licenses"`
+			} `json:"components"`
+		}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+		require.Equal(t, "CycloneDX", doc.BOMFormat)
+		require.Len(t, doc.Components, len(installed))
+		for i, pkg := range installed {
+			require.Equal(t, pkg.Name, doc.Components[i].Name)
+			require.Equal(t, pkg.Version, doc.Components[i].Version)
+			require.Len(t, doc.Components[i].Licenses, 1)
+			require.Equal(t, pkg.License, doc.Components[i].Licenses[0].Expression)
+			require.Contains(t, doc.Components[i].PURL, "pkg:apk/"+pkg.Name+"@"+pkg.Version)
+		}
+	})
+	t.Run("unsupported format", func(t *testing.T) {
+		require.Error(t, a.GenerateSBOM(ctx, "swid", &bytes.Buffer{}))
+	})
+}
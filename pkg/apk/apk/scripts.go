@@ -0,0 +1,84 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ScriptRunner is handed the install scripts of each package as it is installed, and decides
+// whether to run, log or skip them. Returning an error fails the install.
+type ScriptRunner interface {
+	// RunScript is called with the name of the script, such as .post-install, and its content.
+	RunScript(ctx context.Context, pkg *Package, name string, script []byte) error
+}
+
+// isScript reports whether a control section entry is an install script, rather than .PKGINFO.
+func isScript(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeReg && hdr.Name != ".PKGINFO" && strings.HasPrefix(hdr.Name, ".")
+}
+
+// readScripts returns the install scripts in the uncompressed control section, keyed by name.
+func readScripts(control []byte) (map[string][]byte, error) {
+	scripts := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(control))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return scripts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !isScript(hdr) {
+			continue
+		}
+		script, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", hdr.Name, err)
+		}
+		scripts[hdr.Name] = script
+	}
+}
+
+// runScripts passes the scripts for which match returns true to the script runner, in name order.
+func (a *APK) runScripts(ctx context.Context, pkg *Package, scripts map[string][]byte, match func(name string) bool) error {
+	names := make([]string, 0, len(scripts))
+	for name := range scripts {
+		if match(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := a.scriptRunner.RunScript(ctx, pkg, name, scripts[name]); err != nil {
+			return fmt.Errorf("running %s for %s: %w", name, pkg.Name, err)
+		}
+	}
+	return nil
+}
+
+// isPreScript reports whether a script runs before the package's files are installed.
+func isPreScript(name string) bool {
+	return strings.HasPrefix(name, ".pre-")
+}
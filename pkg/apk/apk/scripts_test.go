@@ -0,0 +1,92 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testScriptRunner struct {
+	calls []string
+	run   func(pkg *Package, name string, script []byte) error
+}
+
+func (r *testScriptRunner) RunScript(_ context.Context, pkg *Package, name string, script []byte) error {
+	r.calls = append(r.calls, pkg.Name+" "+name+" "+string(script))
+	if r.run != nil {
+		return r.run(pkg, name, script)
+	}
+	return nil
+}
+
+func TestScriptRunner(t *testing.T) {
+	ctx := context.Background()
+	scripts := map[string][]byte{
+		".pre-install":  []byte("#!/bin/sh\necho pre\n"),
+		".post-install": []byte("#!/bin/sh\necho post\n"),
+	}
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0", Arch: testArch, Dependencies: []string{"bar"}, Scripts: scripts},
+		{Name: "bar", Version: "1.0.0", Arch: testArch},
+	}
+	repo := testLocalRepoWithFiles(t, testArch, packages, map[string][]testDirEntry{
+		"foo": {{path: "foo", perms: 0o644, content: []byte("foo")}},
+		"bar": {{path: "bar", perms: 0o644, content: []byte("bar")}},
+	})
+
+	t.Run("parsed", func(t *testing.T) {
+		f, err := os.Open(filepath.Join(repo, testArch, packages[0].Filename()))
+		require.NoError(t, err)
+		defer f.Close()
+
+		pkg, err := ParsePackage(ctx, f, 0)
+		require.NoError(t, err)
+		require.Equal(t, scripts, pkg.Scripts)
+	})
+	t.Run("runner", func(t *testing.T) {
+		runner := &testScriptRunner{}
+		a, src := testAPKWithRepos(t, []string{repo}, WithScriptRunner(runner))
+		runner.run = func(_ *Package, name string, _ []byte) error {
+			_, err := src.Stat("foo")
+			if isPreScript(name) {
+				require.ErrorIs(t, err, fs.ErrNotExist, "%s should run before files are installed", name)
+			} else {
+				require.NoError(t, err, "%s should run after files are installed", name)
+			}
+			return nil
+		}
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+
+		require.Equal(t, []string{
+			"foo .pre-install #!/bin/sh\necho pre\n",
+			"foo .post-install #!/bin/sh\necho post\n",
+		}, runner.calls)
+	})
+	t.Run("runner error", func(t *testing.T) {
+		errSkip := errors.New("refusing to run scripts")
+		runner := &testScriptRunner{run: func(*Package, string, []byte) error { return errSkip }}
+		a, _ := testAPKWithRepos(t, []string{repo}, WithScriptRunner(runner))
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		require.ErrorIs(t, a.FixateWorld(ctx, nil), errSkip)
+	})
+}
@@ -0,0 +1,176 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// DBSnapshot is the state of the installed database at one point, taken by Snapshot.
+type DBSnapshot struct {
+	// contents and modes of the files in lib/apk/db
+	db    map[string][]byte
+	modes map[string]fs.FileMode
+	// paths that the installed packages own
+	files map[string]bool
+	dirs  map[string]bool
+
+	installedFiles map[string]*Package
+}
+
+// Snapshot captures the installed database, including the files that packages own, so that
+// Restore can later return to it. Only the database is copied, not the contents of the
+// installed files.
+func (a *APK) Snapshot(ctx context.Context) (*DBSnapshot, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "Snapshot")
+	defer span.End()
+
+	s := &DBSnapshot{db: map[string][]byte{}, modes: map[string]fs.FileMode{}}
+	entries, err := a.fs.ReadDir(dbDir())
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", dbDir(), err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := filepath.Join(dbDir(), e.Name())
+		fi, err := e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		b, err := a.fs.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		s.db[name], s.modes[name] = b, fi.Mode().Perm()
+	}
+
+	if s.files, s.dirs, err = a.ownedPaths(); err != nil {
+		return nil, err
+	}
+
+	a.installedMu.Lock()
+	s.installedFiles = maps.Clone(a.installedFiles)
+	a.installedMu.Unlock()
+	return s, nil
+}
+
+// Restore returns the installed database to the state in s. The files of packages installed
+// since the snapshot was taken are removed, as are the directories they created once they are
+// empty. Files that those packages overwrote are not brought back.
+func (a *APK) Restore(ctx context.Context, s *DBSnapshot) error {
+	_, span := otel.Tracer("go-apk").Start(ctx, "Restore")
+	defer span.End()
+
+	files, dirs, err := a.ownedPaths()
+	if err != nil {
+		return err
+	}
+	for name := range files {
+		if s.files[name] {
+			continue
+		}
+		if err := a.fs.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing %s: %w", name, err)
+		}
+	}
+
+	// Children sort after their parents, so the reverse order goes deepest first.
+	added := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		added = append(added, dir)
+	}
+	slices.Sort(added)
+	slices.Reverse(added)
+	for _, dir := range added {
+		if s.dirs[dir] {
+			continue
+		}
+		entries, err := a.fs.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading directory %s: %w", dir, err)
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		if err := a.fs.Remove(dir); err != nil {
+			return fmt.Errorf("removing directory %s: %w", dir, err)
+		}
+	}
+
+	current, err := a.fs.ReadDir(dbDir())
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", dbDir(), err)
+	}
+	for _, e := range current {
+		name := filepath.Join(dbDir(), e.Name())
+		if _, ok := s.db[name]; ok || e.IsDir() {
+			continue
+		}
+		if err := a.fs.Remove(name); err != nil {
+			return fmt.Errorf("removing %s: %w", name, err)
+		}
+	}
+	for name, b := range s.db {
+		if err := a.writeFileAtomic(name, b, s.modes[name]); err != nil {
+			return fmt.Errorf("restoring %s: %w", name, err)
+		}
+	}
+
+	a.installedMu.Lock()
+	a.installedFiles = maps.Clone(s.installedFiles)
+	a.installedMu.Unlock()
+	return nil
+}
+
+// dbDir is the directory of the installed database.
+func dbDir() string {
+	return path.Dir(installedFilePath)
+}
+
+// ownedPaths returns the files and directories that installed packages own.
+func (a *APK) ownedPaths() (files, dirs map[string]bool, err error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, nil, err
+	}
+	files, dirs = map[string]bool{}, map[string]bool{}
+	for _, pkg := range installed {
+		for _, f := range pkg.Files {
+			name := strings.TrimSuffix(f.Name, "/")
+			if f.Typeflag == tar.TypeDir {
+				dirs[name] = true
+			} else {
+				files[name] = true
+			}
+		}
+	}
+	return files, dirs, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	a, src := testAPKWithRepos(t, nil)
+
+	base := fakePackage(t, &Package{Name: "base", Version: "1.0.0-r0", Arch: testArch}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/base", 0o755, false, []byte("base"), nil},
+	})
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{base}))
+	before, err := src.ReadFile(installedFilePath)
+	require.NoError(t, err)
+
+	snapshot, err := a.Snapshot(ctx)
+	require.NoError(t, err)
+
+	optional := fakePackage(t, &Package{Name: "optional", Version: "1.0.0-r0", Arch: testArch}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/optional", 0o755, false, []byte("optional"), nil},
+		{"usr/share", 0o755, true, nil, nil},
+		{"usr/share/optional", 0o755, true, nil, nil},
+		{"usr/share/optional/data", 0o644, false, []byte("data"), nil},
+	})
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{optional}))
+	_, err = src.Stat("usr/share/optional/data")
+	require.NoError(t, err)
+
+	require.NoError(t, a.Restore(ctx, snapshot))
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+	require.Equal(t, "base", installed[0].Name)
+	after, err := src.ReadFile(installedFilePath)
+	require.NoError(t, err)
+	require.Equal(t, string(before), string(after))
+
+	for _, name := range []string{"usr/bin/optional", "usr/share/optional/data", "usr/share/optional", "usr/share"} {
+		_, err := src.Stat(name)
+		require.ErrorIs(t, err, os.ErrNotExist, "%s was not removed", name)
+	}
+	b, err := src.ReadFile("usr/bin/base")
+	require.NoError(t, err)
+	require.Equal(t, "base", string(b))
+
+	// The restored state can be installed onto again.
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{optional}))
+	_, err = src.Stat("usr/share/optional/data")
+	require.NoError(t, err)
+}
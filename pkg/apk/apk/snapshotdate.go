@@ -0,0 +1,44 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// defaultSnapshotLayout is how {snapshot} formats the snapshot date, e.g. 20240102T030405Z.
+const defaultSnapshotLayout = "20060102T150405Z"
+
+// snapshotPlaceholder matches {snapshot} and {snapshot:layout} in a repository URL.
+var snapshotPlaceholder = regexp.MustCompile(`\{snapshot(?::([^}]*))?\}`)
+
+// expandSnapshot returns repo with the snapshot placeholders in it replaced by the snapshot date.
+func (a *APK) expandSnapshot(repo string) (string, error) {
+	if !snapshotPlaceholder.MatchString(repo) {
+		return repo, nil
+	}
+	if a.snapshotDate.IsZero() {
+		return "", fmt.Errorf("repository %s refers to a snapshot, but no snapshot date is set", redactURL(repo))
+	}
+	date := a.snapshotDate.UTC()
+	return snapshotPlaceholder.ReplaceAllStringFunc(repo, func(placeholder string) string {
+		layout := snapshotPlaceholder.FindStringSubmatch(placeholder)[1]
+		if layout == "" {
+			layout = defaultSnapshotLayout
+		}
+		return date.Format(layout)
+	}), nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotDate(t *testing.T) {
+	ctx := context.Background()
+	globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+	t.Cleanup(func() { globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{} })
+
+	snapshots := map[string]string{
+		"2024-01-01": testLocalRepo(t, testArch, []*Package{{Name: "foo", Version: "1.0.0-r0", Arch: testArch}}),
+		"2024-02-01": testLocalRepo(t, testArch, []*Package{{Name: "foo", Version: "2.0.0-r0", Arch: testArch}}),
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		date, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/snapshots/"), "/main/")
+		dir, ok := snapshots[date]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(dir, rest))
+	}))
+	defer s.Close()
+	repo := s.URL + "/snapshots/{snapshot:2006-01-02}/main"
+
+	cacheDir := t.TempDir()
+	resolve := func(date time.Time) string {
+		a, _ := testAPKWithRepos(t, []string{repo}, WithSnapshotDate(date), WithCache(cacheDir, false))
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		resolved, _, err := a.ResolveWorld(ctx)
+		require.NoError(t, err)
+		require.Len(t, resolved, 1)
+		return resolved[0].Version
+	}
+	require.Equal(t, "1.0.0-r0", resolve(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)))
+	require.Equal(t, "2.0.0-r0", resolve(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)))
+	// The first snapshot is still served from its own cache entry.
+	require.Equal(t, "1.0.0-r0", resolve(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	for date := range snapshots {
+		dir := filepath.Join(cacheDir, url.QueryEscape(s.URL+"/snapshots/"+date+"/main"), testArch)
+		_, err := os.Stat(dir)
+		require.NoError(t, err, "no cache entry for the snapshot of %s", date)
+	}
+
+	t.Run("no date", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, nil)
+		require.NoError(t, a.SetRepositories(ctx, []string{repo}))
+		_, err := a.GetRepositoryIndexes(ctx, true)
+		require.ErrorContains(t, err, "no snapshot date is set")
+	})
+
+	t.Run("default layout", func(t *testing.T) {
+		a, err := New(WithSnapshotDate(time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600))))
+		require.NoError(t, err)
+		expanded, err := a.expandSnapshot("https://example.com/{snapshot}/main")
+		require.NoError(t, err)
+		require.Equal(t, "https://example.com/20240102T020405Z/main", expanded)
+	})
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+)
+
+// setInitDBTimes applies WithSourceDateEpoch to what InitDB created, including the keys it
+// fetched if withKeys.
+func (a *APK) setInitDBTimes(withKeys bool) error {
+	if a.sourceDateEpoch == nil {
+		return nil
+	}
+	names := make([]string, 0, len(baseDirectories)+len(initDirectories))
+	for _, d := range baseDirectories {
+		names = append(names, d.path)
+	}
+	for _, e := range a.initDBPlan() {
+		names = append(names, e.Path)
+	}
+	if withKeys {
+		entries, err := a.fs.ReadDir(DefaultKeyRingPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("reading %s: %w", DefaultKeyRingPath, err)
+		}
+		for _, e := range entries {
+			names = append(names, path.Join(DefaultKeyRingPath, e.Name()))
+		}
+	}
+	return a.setTimes(names)
+}
+
+// setInstalledTimes applies WithSourceDateEpoch to the files of installed packages, the
+// directories that hold them, and the installed database.
+func (a *APK) setInstalledTimes(installed [][]tar.Header) error {
+	if a.sourceDateEpoch == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	var names []string
+	add := func(name string) {
+		// Adding entries to a directory changes its time too, so include every parent.
+		for name = strings.TrimSuffix(name, "/"); name != "." && name != "/" && name != "" && !seen[name]; name = path.Dir(name) {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, headers := range installed {
+		for _, hdr := range headers {
+			add(hdr.Name)
+		}
+	}
+	entries, err := a.fs.ReadDir(dbDir())
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", dbDir(), err)
+	}
+	for _, e := range entries {
+		add(path.Join(dbDir(), e.Name()))
+	}
+	return a.setTimes(names)
+}
+
+// setTimes sets the access and modification times of names to the WithSourceDateEpoch time.
+// Names that do not exist, such as devices that could not be created, are skipped.
+func (a *APK) setTimes(names []string) error {
+	chtimes, ok := a.fs.(apkfs.ChtimesFS)
+	if !ok {
+		return errors.New("filesystem cannot change file times")
+	}
+	t := *a.sourceDateEpoch
+	for _, name := range names {
+		// Chtimes follows symlinks, so it would change their targets instead. Not every
+		// filesystem's Lstat reports symlinks, so ask Readlink.
+		if _, err := a.fs.Readlink(name); err == nil {
+			continue
+		}
+		if _, err := a.fs.Lstat(name); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("setting times of %s: %w", name, err)
+		}
+		if err := chtimes.Chtimes(name, t, t); err != nil {
+			return fmt.Errorf("setting times of %s: %w", name, err)
+		}
+	}
+	return nil
+}
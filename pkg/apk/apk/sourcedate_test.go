@@ -0,0 +1,98 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
+)
+
+func TestSourceDateEpoch(t *testing.T) {
+	ctx := context.Background()
+	epoch := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	for _, tt := range []struct {
+		name string
+		fs   func(t *testing.T) apkfs.FullFS
+	}{
+		{"memfs", func(*testing.T) apkfs.FullFS { return apkfs.NewMemFS() }},
+		{"dirfs", func(t *testing.T) apkfs.FullFS { return apkfs.DirFS(t.TempDir()) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := tt.fs(t)
+			a, err := New(WithFS(src), WithArch(testArch), WithIgnoreMknodErrors(true), WithSourceDateEpoch(epoch))
+			require.NoError(t, err)
+			require.NoError(t, a.InitDB(ctx))
+
+			pkg := fakePackage(t, &Package{Name: "foo", Version: "1.0.0-r0", Arch: testArch}, []testDirEntry{
+				{"usr", 0o755, true, nil, nil},
+				{"usr/bin", 0o755, true, nil, nil},
+				{"usr/bin/foo", 0o755, false, []byte("foo"), nil},
+				{"usr/share/doc/foo", 0o755, true, nil, nil},
+				{"usr/share/doc/foo/README", 0o644, false, []byte("readme"), nil},
+			})
+			require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{pkg}))
+			require.NoError(t, a.InstallLocalPackage(ctx, filepath.Join(testPrimaryPkgDir, testPkgFilename)))
+			_, err = src.Stat("etc/crontabs/root")
+			require.NoError(t, err)
+
+			var checked int
+			require.NoError(t, fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+				require.NoError(t, err)
+				if name == "." || d.Type()&fs.ModeSymlink != 0 {
+					return nil
+				}
+				fi, err := src.Stat(name)
+				require.NoError(t, err)
+				require.True(t, epoch.Equal(fi.ModTime()), "%s has time %s", name, fi.ModTime())
+				checked++
+				return nil
+			}))
+			require.Greater(t, checked, len(initDirectories))
+
+			f, err := src.Open(scriptsFilePath)
+			require.NoError(t, err)
+			defer f.Close()
+			tr := tar.NewReader(f)
+			for {
+				hdr, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				require.NoError(t, err)
+				require.True(t, epoch.Equal(hdr.ModTime), "script %s has time %s", hdr.Name, hdr.ModTime)
+			}
+		})
+	}
+
+	t.Run("unsupported filesystem", func(t *testing.T) {
+		_, err := New(WithFS(noChtimesFS{apkfs.NewMemFS()}), WithSourceDateEpoch(epoch))
+		require.Error(t, err)
+	})
+}
+
+// noChtimesFS hides the Chtimes of the filesystem it wraps.
+type noChtimesFS struct {
+	apkfs.FullFS
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"chainguard.dev/apko/pkg/apk/expandapk"
+
+	"go.opentelemetry.io/otel"
+)
+
+// streamedPackage is a package read from a stream, expanded and ready to install.
+type streamedPackage struct {
+	pkg *Package
+	exp *expandapk.APKExpanded
+}
+
+// InstallFromStream installs the .apk files in the tar stream r, which need not be part of any
+// repository. The metadata of each package comes from its .PKGINFO. Packages are installed so
+// that those they depend on come first, and any dependency that is not in the stream must
+// already be installed. The packages are recorded in the installed database and added to the
+// world.
+func (a *APK) InstallFromStream(ctx context.Context, r io.Reader) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallFromStream")
+	defer span.End()
+
+	streamed, err := a.expandStream(ctx, r)
+	if err != nil {
+		return err
+	}
+	closeFrom := func(i int) {
+		for _, s := range streamed[i:] {
+			s.exp.Close()
+		}
+	}
+
+	if err := a.checkStreamDependencies(streamed); err != nil {
+		closeFrom(0)
+		return err
+	}
+
+	streamed = dependencyOrder(streamed, func(s streamedPackage) *Package { return s.pkg })
+	names := make([]string, 0, len(streamed))
+	for i, s := range streamed {
+		if err := a.installExpanded(ctx, s.pkg, s.exp); err != nil {
+			closeFrom(i + 1)
+			return fmt.Errorf("installing %s from stream: %w", s.pkg.Name, err)
+		}
+		names = append(names, s.pkg.Name)
+	}
+	return a.addToWorld(ctx, names...)
+}
+
+// expandStream expands every regular file in the tar stream r as an .apk.
+func (a *APK) expandStream(ctx context.Context, r io.Reader) ([]streamedPackage, error) {
+	var streamed []streamedPackage
+	fail := func(err error) ([]streamedPackage, error) {
+		for _, s := range streamed {
+			s.exp.Close()
+		}
+		return nil, err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return streamed, nil
+		}
+		if err != nil {
+			return fail(fmt.Errorf("reading package stream: %w", err))
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		exp, err := expandapk.ExpandApk(ctx, tr, a.workDir)
+		if err != nil {
+			return fail(fmt.Errorf("expanding %s: %w", hdr.Name, err))
+		}
+		pkg, err := packageInfo(exp)
+		if err != nil {
+			exp.Close()
+			return fail(fmt.Errorf("failed to read .PKGINFO for %s: %w", hdr.Name, err))
+		}
+		streamed = append(streamed, streamedPackage{pkg: pkg, exp: exp})
+	}
+}
+
+// checkStreamDependencies returns an error for the dependencies of streamed packages that neither
+// another streamed package nor an installed package satisfies.
+func (a *APK) checkStreamDependencies(streamed []streamedPackage) error {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("error getting installed packages: %w", err)
+	}
+	satisfied := func(name string) bool {
+		for _, s := range streamed {
+			if providesName(s.pkg, name) {
+				return true
+			}
+		}
+		for _, pkg := range installed {
+			if providesName(&pkg.Package, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var errs []error
+	for _, s := range streamed {
+		for _, dep := range s.pkg.Dependencies {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+			if name := resolvePackageNameVersionPin(dep).name; !satisfied(name) {
+				errs = append(errs, fmt.Errorf("package %s depends on %s, which is neither in the stream nor installed", s.pkg.Name, name))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
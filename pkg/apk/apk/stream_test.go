@@ -0,0 +1,101 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testPackageStream returns a tar stream of fake .apk files for the packages, in the given order.
+func testPackageStream(t *testing.T, packages []*Package, entries map[string][]testDirEntry) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, pkg := range packages {
+		fake, ok := fakePackage(t, pkg, entries[pkg.Name]).(*testPackage)
+		require.True(t, ok)
+		b, err := os.ReadFile(fake.file)
+		require.NoError(t, err)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: pkg.Filename(), Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(b))}))
+		_, err = tw.Write(b)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return &buf
+}
+
+func TestInstallFromStream(t *testing.T) {
+	ctx := context.Background()
+	entries := map[string][]testDirEntry{
+		"app":    {{path: "app", perms: 0o755, content: []byte("app")}},
+		"libapp": {{path: "libapp.so", perms: 0o644, content: []byte("libapp")}},
+	}
+
+	t.Run("dependencies first", func(t *testing.T) {
+		stream := testPackageStream(t, []*Package{
+			{Name: "app", Version: "1.0.0", Arch: testArch, Dependencies: []string{"so:libapp.so=1", "musl"}},
+			{Name: "libapp", Version: "1.0.0", Arch: testArch, Provides: []string{"so:libapp.so=1"}},
+		}, entries)
+
+		a, src := testAPKWithRepos(t, nil)
+		require.NoError(t, a.AddInstalledPackage(&Package{Name: "musl", Version: "1.2.4-r0"}, nil))
+		require.NoError(t, a.InstallFromStream(ctx, stream))
+
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		var names []string
+		for _, pkg := range installed {
+			names = append(names, pkg.Name)
+		}
+		require.Equal(t, []string{"musl", "libapp", "app"}, names)
+
+		for _, path := range []string{"app", "libapp.so"} {
+			_, err := src.Stat(path)
+			require.NoError(t, err, path)
+		}
+
+		world, err := a.GetWorld(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"app", "libapp"}, world)
+	})
+	t.Run("missing dependency", func(t *testing.T) {
+		stream := testPackageStream(t, []*Package{
+			{Name: "app", Version: "1.0.0", Arch: testArch, Dependencies: []string{"libapp"}},
+		}, entries)
+
+		a, src := testAPKWithRepos(t, nil)
+		require.ErrorContains(t, a.InstallFromStream(ctx, stream), "depends on libapp")
+		_, err := src.Stat("app")
+		require.Error(t, err, "nothing should be installed")
+	})
+	t.Run("not a package", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "README", Typeflag: tar.TypeReg, Size: 5}))
+		_, err := tw.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+
+		a, _ := testAPKWithRepos(t, nil)
+		require.Error(t, a.InstallFromStream(ctx, &buf))
+	})
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PackageTiming is the wall-clock time spent on a package.
+type PackageTiming struct {
+	Name string
+	// Download is the time spent requesting the package and reading its contents.
+	Download time.Duration
+	// Expand is the time spent decompressing and unpacking the package, without the time spent
+	// waiting for its contents to arrive.
+	Expand time.Duration
+}
+
+// timingRecorder accumulates package timings, packages are fetched concurrently.
+type timingRecorder struct {
+	mu      sync.Mutex
+	timings map[string]*PackageTiming
+}
+
+func (t *timingRecorder) add(name string, download, expand time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.timings == nil {
+		t.timings = map[string]*PackageTiming{}
+	}
+	timing, ok := t.timings[name]
+	if !ok {
+		timing = &PackageTiming{Name: name}
+		t.timings[name] = timing
+	}
+	timing.Download += download
+	timing.Expand += expand
+}
+
+// TimingReport returns how long each package fetched or expanded by this APK took, sorted by
+// package name. Time spent on a package is summed if it was fetched more than once. Packages
+// found in the cache are neither fetched nor expanded, and do not appear in the report.
+func (a *APK) TimingReport() []PackageTiming {
+	a.timings.mu.Lock()
+	defer a.timings.mu.Unlock()
+
+	report := make([]PackageTiming, 0, len(a.timings.timings))
+	for _, timing := range a.timings.timings {
+		report = append(report, *timing)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Name < report[j].Name })
+	return report
+}
+
+// timedReader measures the time spent waiting in Read.
+type timedReader struct {
+	io.ReadCloser
+	elapsed time.Duration
+	onClose func(elapsed time.Duration)
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.ReadCloser.Read(p)
+	r.elapsed += time.Since(start)
+	return n, err
+}
+
+func (r *timedReader) Close() error {
+	if r.onClose != nil {
+		r.onClose(r.elapsed)
+		r.onClose = nil
+	}
+	return r.ReadCloser.Close()
+}
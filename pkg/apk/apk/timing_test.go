@@ -0,0 +1,62 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimingReport(t *testing.T) {
+	ctx := context.Background()
+	packages := []*Package{
+		{Name: "foo", Version: "1.0.0", Arch: testArch, Dependencies: []string{"bar"}},
+		{Name: "bar", Version: "1.0.0", Arch: testArch},
+	}
+	dir := testLocalRepoWithFiles(t, testArch, packages, map[string][]testDirEntry{
+		"foo": {{path: "usr", dir: true, perms: 0o755}, {path: "usr/foo", perms: 0o755, content: []byte("foo")}},
+		"bar": {{path: "usr", dir: true, perms: 0o755}, {path: "usr/bar", perms: 0o755, content: []byte("bar")}},
+	})
+
+	const delay = 20 * time.Millisecond
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".apk") {
+			time.Sleep(delay)
+		}
+		http.ServeFile(w, r, filepath.Join(dir, r.URL.Path))
+	}))
+	defer s.Close()
+
+	a, _ := testAPKWithRepos(t, []string{s.URL})
+	require.Empty(t, a.TimingReport())
+
+	require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	report := a.TimingReport()
+	require.Len(t, report, 2)
+	for i, name := range []string{"bar", "foo"} {
+		require.Equal(t, name, report[i].Name)
+		require.GreaterOrEqual(t, report[i].Download, delay, "%s download", name)
+		require.Positive(t, report[i].Expand, "%s expand", name)
+	}
+}
@@ -19,7 +19,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	apkauth "chainguard.dev/apko/pkg/apk/auth"
 )
 
 type rangeRetryTransport struct {
@@ -144,3 +150,204 @@ func (r *rangeRetryReader) Close() error {
 
 	return r.body.Close()
 }
+
+// authenticate adds credentials from authenticator to req, unless it already has some.
+func authenticate(ctx context.Context, req *http.Request, authenticator apkauth.Authenticator) error {
+	if authenticator == nil || req.Header.Get("Authorization") != "" {
+		return nil
+	}
+	if err := authenticator.AddAuth(ctx, req); err != nil {
+		return fmt.Errorf("adding credentials for %s: %w", req.URL.Redacted(), err)
+	}
+	return nil
+}
+
+// httpClient returns the client to download packages and indexes with, with the configured
+// timeout and URL rewriter applied. When offline, the client fails every request with ErrOffline.
+func (a *APK) httpClient() *http.Client {
+	if a.offline {
+		return &http.Client{Transport: offlineTransport{}}
+	}
+	a.clientMu.RLock()
+	defer a.clientMu.RUnlock()
+	if a.httpTimeout <= 0 && a.urlRewriter == nil && len(a.extraHeaders) == 0 && len(a.repoHeaders) == 0 {
+		return a.client
+	}
+	c := *a.client
+	if a.httpTimeout > 0 {
+		c.Timeout = a.httpTimeout
+	}
+	if a.urlRewriter != nil {
+		c.Transport = &rewriteTransport{wrapped: c.Transport, rewrite: a.urlRewriter}
+	}
+	if len(a.extraHeaders) > 0 || len(a.repoHeaders) > 0 {
+		// Outside of the rewriter, so that repositories match the URLs before they are rewritten.
+		c.Transport = &headerTransport{wrapped: c.Transport, headers: a.extraHeaders, repoHeaders: a.repoHeaders}
+	}
+	return &c
+}
+
+// headerTransport adds headers to every request that does not have them already, with those for
+// the repository that the request is for first.
+type headerTransport struct {
+	wrapped     http.RoundTripper
+	headers     map[string]string
+	repoHeaders map[string]map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	add := func(headers map[string]string) {
+		for k, v := range headers {
+			if r.Header.Get(k) == "" {
+				r.Header.Set(k, v)
+			}
+		}
+	}
+	add(t.repoHeaders[t.repositoryFor(req.URL)])
+	add(t.headers)
+
+	wrapped := t.wrapped
+	if wrapped == nil {
+		wrapped = http.DefaultTransport
+	}
+	return wrapped.RoundTrip(r)
+}
+
+// repositoryFor returns the longest of the repositories with headers that u is within, or "" if
+// there is none.
+func (t *headerTransport) repositoryFor(u *url.URL) string {
+	target := u.String()
+	var match string
+	for repo := range t.repoHeaders {
+		base := strings.TrimSuffix(repo, "/")
+		if (target == base || strings.HasPrefix(target, base+"/")) && len(repo) > len(match) {
+			match = repo
+		}
+	}
+	return match
+}
+
+// rewriteTransport sends every request to the URL returned by rewrite instead.
+type rewriteTransport struct {
+	wrapped http.RoundTripper
+	rewrite func(string) string
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse(t.rewrite(req.URL.String()))
+	if err != nil {
+		return nil, fmt.Errorf("rewriting %s: %w", req.URL.Redacted(), err)
+	}
+
+	r := req.Clone(req.Context())
+	r.URL = u
+	r.Host = ""
+
+	wrapped := t.wrapped
+	if wrapped == nil {
+		wrapped = http.DefaultTransport
+	}
+	return wrapped.RoundTrip(r)
+}
+
+// transportTuning configures the transport of the default client.
+type transportTuning struct {
+	maxIdleConnsPerHost int
+	forceHTTP2          bool
+}
+
+func (t *transportTuning) client() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if t.maxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = t.maxIdleConnsPerHost
+		if transport.MaxIdleConns != 0 && transport.MaxIdleConns < t.maxIdleConnsPerHost {
+			transport.MaxIdleConns = t.maxIdleConnsPerHost
+		}
+	}
+	// The default transport already attempts HTTP/2, so only ever turn it on.
+	if t.forceHTTP2 {
+		transport.ForceAttemptHTTP2 = true
+	}
+	return &http.Client{Transport: transport}
+}
+
+// offlineTransport fails every request, so that cache misses never reach the network.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("%w: %s", ErrOffline, req.URL.Redacted())
+}
+
+// retryPolicy describes how transient HTTP failures are retried.
+type retryPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+}
+
+// client returns an http.Client that retries requests made with wrapped according to the policy.
+// If the policy allows no more than a single attempt, wrapped is returned as-is.
+func (p retryPolicy) client(wrapped *http.Client) *http.Client {
+	if p.attempts <= 1 {
+		return wrapped
+	}
+
+	return &http.Client{
+		Transport: &retryTransport{
+			wrapped: wrapped,
+			policy:  p,
+		},
+	}
+}
+
+// delay returns how long to wait before the given retry (starting at 1), using exponential
+// backoff with up to 50% jitter.
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := p.baseDelay << (retry - 1)
+	if d <= 0 {
+		return 0
+	}
+	return d + rand.N(d/2+1) //nolint:gosec // jitter does not need a secure source
+}
+
+type retryTransport struct {
+	wrapped *http.Client
+	policy  retryPolicy
+}
+
+// RoundTrip sends the request, retrying on network errors and 5xx responses. Client errors such
+// as 403 or 404 are returned immediately.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		r := req
+		if attempt > 1 && req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, fmt.Errorf("%s %s: cannot retry request with body", req.Method, req.URL)
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(ctx)
+			r.Body = body
+		}
+
+		resp, err := t.wrapped.Do(r)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+		if ctx.Err() != nil || attempt >= t.policy.attempts {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(t.policy.delay(attempt)):
+		}
+	}
+}
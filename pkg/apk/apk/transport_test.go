@@ -17,12 +17,23 @@ package apk
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/iotest"
+	"time"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
 )
 
 type testReader struct {
@@ -197,3 +208,216 @@ func TestTransport(t *testing.T) {
 		})
 	}
 }
+
+func TestHTTPTimeout(t *testing.T) {
+	// The server hangs until the client goes away, or for much longer than any test should take.
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer s.Close()
+
+	repo := Repository{URI: s.URL + "/" + testArch}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+
+	fetch := func(ctx context.Context, options ...Option) (time.Duration, error) {
+		a, err := New(append([]Option{WithFS(apkfs.NewMemFS())}, options...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		rc, err := a.FetchPackage(ctx, pkg)
+		if err == nil {
+			rc.Close()
+		}
+		return time.Since(start), err
+	}
+
+	t.Run("client timeout", func(t *testing.T) {
+		took, err := fetch(context.Background(), WithHTTPTimeout(100*time.Millisecond))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected a deadline error, got %v", err)
+		}
+		if took > 5*time.Second {
+			t.Errorf("fetch took %s, expected it to give up after the timeout", took)
+		}
+	})
+	t.Run("context deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		took, err := fetch(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected a deadline error, got %v", err)
+		}
+		if took > 5*time.Second {
+			t.Errorf("fetch took %s, expected it to give up at the deadline", took)
+		}
+	})
+}
+
+func TestURLRewriter(t *testing.T) {
+	var hits []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.Host+r.URL.Path)
+		http.ServeFile(w, r, filepath.Join(testPrimaryPkgDir, filepath.Base(r.URL.Path)))
+	}))
+	defer s.Close()
+
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+
+	// Make sure the package is really fetched, rather than reused from an earlier test.
+	globalApkCache = &apkCache{}
+	t.Cleanup(func() { globalApkCache = &apkCache{} })
+
+	cacheDir := t.TempDir()
+	rewrite := func(u string) string {
+		return strings.Replace(u, "https://dl-cdn.alpinelinux.org", s.URL, 1)
+	}
+	a, err := New(WithFS(apkfs.NewMemFS()), WithCache(cacheDir, false), WithURLRewriter(rewrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.expandPackage(context.Background(), pkg); err != nil {
+		t.Fatal(err)
+	}
+
+	host := strings.TrimPrefix(s.URL, "http://")
+	if want := host + "/alpine/v3.16/main/" + testArch + "/" + testPkgFilename; len(hits) != 1 || hits[0] != want {
+		t.Errorf("expected a single request to %s, got %v", want, hits)
+	}
+
+	cached, err := cacheDirForPackage(cacheDir, pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cached, url.QueryEscape(testAlpineRepos)) {
+		t.Errorf("expected cache path %s to be based on the original URL", cached)
+	}
+	if _, err := os.Stat(cached); err != nil {
+		t.Errorf("expected package to be cached under its original URL: %v", err)
+	}
+}
+
+func TestExtraHeaders(t *testing.T) {
+	var got http.Header
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		if user, pass, ok := r.BasicAuth(); !ok || user != testUser || pass != testPass {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(testPrimaryPkgDir, filepath.Base(r.URL.Path)))
+	}))
+	defer s.Close()
+
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+
+	globalApkCache = &apkCache{}
+	t.Cleanup(func() { globalApkCache = &apkCache{} })
+
+	rewrite := func(u string) string {
+		return strings.Replace(u, "https://dl-cdn.alpinelinux.org", s.URL, 1)
+	}
+	a, err := New(WithFS(apkfs.NewMemFS()), WithURLRewriter(rewrite), WithAuth("dl-cdn.alpinelinux.org", testUser, testPass),
+		WithExtraHeaders(map[string]string{"X-Cdn-Token": "global", "User-Agent": "apk-mirror", "Authorization": "Bearer clobbered"}),
+		// The repository matches the URL as it was before it was rewritten.
+		WithRepositoryHeaders(testAlpineRepos, map[string]string{"X-Cdn-Token": "repository"}),
+		WithRepositoryHeaders("https://dl-cdn.alpinelinux.org/alpine/edge", map[string]string{"X-Other": "other"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.expandPackage(context.Background(), pkg); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, want := range map[string]string{"X-Cdn-Token": "repository", "User-Agent": "apk-mirror", "X-Other": ""} {
+		if v := got.Get(k); v != want {
+			t.Errorf("expected header %s to be %q, got %q", k, want, v)
+		}
+	}
+	if auth := got.Get("Authorization"); !strings.HasPrefix(auth, "Basic ") {
+		t.Errorf("expected the credentials to be kept, got Authorization %q", auth)
+	}
+}
+
+func TestTransportTuning(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(testPrimaryPkgDir, filepath.Base(r.URL.Path)))
+	}))
+	defer s.Close()
+
+	repo := Repository{URI: s.URL + "/" + testArch}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+
+	const concurrency = 8
+	a, err := New(WithFS(apkfs.NewMemFS()), WithTransportTuning(concurrency, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport, ok := a.client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("expected the default client to use an *http.Transport, got %T", a.client.Transport)
+	}
+	if transport.MaxIdleConnsPerHost != concurrency {
+		t.Errorf("MaxIdleConnsPerHost: got %d, want %d", transport.MaxIdleConnsPerHost, concurrency)
+	}
+	var dials atomic.Int32
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return dial(ctx, network, addr)
+	}
+
+	for round := 0; round < 5; round++ {
+		var wg sync.WaitGroup
+		errs := make([]error, concurrency)
+		for i := range concurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rc, err := a.FetchPackage(context.Background(), pkg)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				defer rc.Close()
+				_, errs[i] = io.Copy(io.Discard, rc)
+			}()
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every connection opened for the first round is kept around and reused for the later ones.
+	if got := dials.Load(); got > concurrency {
+		t.Errorf("expected at most %d connections to be opened, got %d", concurrency, got)
+	}
+
+	t.Run("http2", func(t *testing.T) {
+		def := http.DefaultTransport.(*http.Transport).ForceAttemptHTTP2
+		if transport.ForceAttemptHTTP2 != def {
+			t.Errorf("ForceAttemptHTTP2 without forceHTTP2: got %t, want the default %t", transport.ForceAttemptHTTP2, def)
+		}
+		forced, ok := (&transportTuning{forceHTTP2: true}).client().Transport.(*http.Transport)
+		if !ok || !forced.ForceAttemptHTTP2 {
+			t.Errorf("expected forceHTTP2 to attempt HTTP/2")
+		}
+	})
+
+	t.Run("explicit client wins", func(t *testing.T) {
+		client := &http.Client{}
+		a.SetClient(client)
+		if a.client != client {
+			t.Errorf("expected SetClient to replace the tuned client")
+		}
+	})
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+)
+
+// triggerScript is the name of the install script that is run as a trigger.
+const triggerScript = ".trigger"
+
+// Trigger is the .trigger script of a package, which runs once after installing when files
+// were installed into any of the directories it watches.
+type Trigger struct {
+	Package *Package
+	// Paths are the globs of the directories the trigger watches, such as /usr/share/fonts/*.
+	Paths  []string
+	Script []byte
+}
+
+// fires reports whether a file was installed into any of the watched directories.
+func (t Trigger) fires(dirs map[string]struct{}) bool {
+	for _, glob := range t.Paths {
+		for dir := range dirs {
+			if ok, _ := path.Match(glob, dir); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TriggerSet collects the triggers of installed packages, along with the directories files were
+// installed into, until they are run.
+type TriggerSet struct {
+	mu       sync.Mutex
+	triggers []Trigger
+	dirs     map[string]struct{}
+}
+
+// Add adds a trigger to the set. Triggers are kept in the order they were added, which for
+// installs is the install order.
+func (s *TriggerSet) Add(t Trigger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.triggers = append(s.triggers, t)
+}
+
+// Touch records directories, by their path in the filesystem, that files were installed into.
+func (s *TriggerSet) Touch(dirs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dirs == nil {
+		s.dirs = map[string]struct{}{}
+	}
+	for _, dir := range dirs {
+		s.dirs[path.Join("/", dir)] = struct{}{}
+	}
+}
+
+// touchHeaders records the directories that the files in headers were installed into. A
+// directory itself counts as installed into.
+func (s *TriggerSet) touchHeaders(headers []tar.Header) {
+	dirs := make([]string, 0, len(headers))
+	for _, hdr := range headers {
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr.Name)
+		} else {
+			dirs = append(dirs, path.Dir(hdr.Name))
+		}
+	}
+	s.Touch(dirs...)
+}
+
+// Fired returns the triggers that fire for the directories installed into so far, in dependency
+// order: the trigger of a package runs after those of the packages it depends on. Otherwise,
+// and within dependency cycles, triggers keep the order they were added in.
+func (s *TriggerSet) Fired() []Trigger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var fired []Trigger
+	for _, t := range s.triggers {
+		if t.fires(s.dirs) {
+			fired = append(fired, t)
+		}
+	}
+	return dependencyOrder(fired, func(t Trigger) *Package { return t.Package })
+}
+
+// reset forgets all triggers and installed directories.
+func (s *TriggerSet) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.triggers = nil
+	s.dirs = nil
+}
+
+// collectTrigger adds the trigger of pkg, if it has one, to the triggers to run, and records the
+// directories its files were installed into.
+func (a *APK) collectTrigger(pkg *Package, scripts map[string][]byte, installedFiles []tar.Header) {
+	a.triggers.touchHeaders(installedFiles)
+
+	var paths []string
+	for _, value := range pkg.Triggers {
+		paths = append(paths, strings.Fields(value)...)
+	}
+	script, ok := scripts[triggerScript]
+	if len(paths) == 0 || !ok {
+		return
+	}
+	a.triggers.Add(Trigger{Package: pkg, Paths: paths, Script: script})
+}
+
+// RunTriggers runs the triggers of the packages installed since the last call, once each, for
+// which files were installed into a watched directory by any of those packages. They are passed
+// to runner as .trigger scripts, in dependency order. If runner is nil, the runner given with
+// WithScriptRunner is used.
+func (a *APK) RunTriggers(ctx context.Context, runner ScriptRunner) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "RunTriggers")
+	defer span.End()
+
+	if runner == nil {
+		runner = a.scriptRunner
+	}
+	if runner == nil {
+		return errors.New("no script runner to run triggers with")
+	}
+
+	fired := a.triggers.Fired()
+	a.triggers.reset()
+	for _, t := range fired {
+		a.log(ctx).Debugf("running trigger of %s", t.Package.Name)
+		if err := runner.RunScript(ctx, t.Package, triggerScript, t.Script); err != nil {
+			return fmt.Errorf("running trigger of %s: %w", t.Package.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunTriggers(t *testing.T) {
+	ctx := context.Background()
+	trigger := []byte("#!/bin/sh\nfc-cache\n")
+	packages := []*Package{
+		{
+			Name: "fontconfig", Version: "1.0.0", Arch: testArch,
+			Triggers: []string{"/usr/share/fonts/*"},
+			Scripts:  map[string][]byte{triggerScript: trigger, ".post-install": []byte("post")},
+		},
+		{Name: "font-a", Version: "1.0.0", Arch: testArch, Dependencies: []string{"fontconfig"}},
+		{Name: "font-b", Version: "1.0.0", Arch: testArch, Dependencies: []string{"fontconfig"}},
+	}
+	repo := testLocalRepoWithFiles(t, testArch, packages, map[string][]testDirEntry{
+		"fontconfig": {
+			{path: "usr", dir: true, perms: 0o755},
+			{path: "usr/share", dir: true, perms: 0o755},
+			{path: "usr/share/fonts", dir: true, perms: 0o755},
+		},
+		"font-a": {
+			{path: "usr/share/fonts/a", dir: true, perms: 0o755},
+			{path: "usr/share/fonts/a/a.ttf", perms: 0o644, content: []byte("a")},
+		},
+		"font-b": {
+			{path: "usr/share/fonts/b", dir: true, perms: 0o755},
+			{path: "usr/share/fonts/b/b.ttf", perms: 0o644, content: []byte("b")},
+		},
+	})
+
+	t.Run("fires once", func(t *testing.T) {
+		runner := &testScriptRunner{}
+		a, _ := testAPKWithRepos(t, []string{repo}, WithScriptRunner(runner))
+		require.NoError(t, a.SetWorld(ctx, []string{"font-a", "font-b"}))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+		require.Equal(t, []string{"fontconfig .post-install post"}, runner.calls, "the trigger should be deferred")
+
+		runner.calls = nil
+		require.NoError(t, a.RunTriggers(ctx, nil))
+		require.Equal(t, []string{"fontconfig .trigger " + string(trigger)}, runner.calls)
+
+		runner.calls = nil
+		require.NoError(t, a.RunTriggers(ctx, nil))
+		require.Empty(t, runner.calls, "triggers should only run once")
+	})
+	t.Run("not touched", func(t *testing.T) {
+		runner := &testScriptRunner{}
+		a, _ := testAPKWithRepos(t, []string{repo})
+		require.NoError(t, a.SetWorld(ctx, []string{"fontconfig"}))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+		require.NoError(t, a.RunTriggers(ctx, runner))
+		require.Empty(t, runner.calls)
+	})
+	t.Run("no runner", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, []string{repo})
+		require.Error(t, a.RunTriggers(ctx, nil))
+	})
+}
+
+func TestTriggerSetDependencyOrder(t *testing.T) {
+	var s TriggerSet
+	for _, pkg := range []*Package{
+		{Name: "c", Dependencies: []string{"so:libb.so.1", "a>=1"}},
+		{Name: "b", Provides: []string{"so:libb.so.1=1"}, Dependencies: []string{"a"}},
+		{Name: "a"},
+		{Name: "unrelated"},
+		{Name: "untouched"},
+	} {
+		paths := []string{"/usr/lib"}
+		if pkg.Name == "untouched" {
+			paths = []string{"/opt/*"}
+		}
+		s.Add(Trigger{Package: pkg, Paths: paths})
+	}
+	s.Touch("usr/lib")
+
+	var names []string
+	for _, trigger := range s.Fired() {
+		names = append(names, trigger.Package.Name)
+	}
+	require.Equal(t, []string{"a", "b", "c", "unrelated"}, names)
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"slices"
+)
+
+// trusted reports whether packages may be installed from the repository at uri.
+func (a *APK) trusted(uri string) bool {
+	if len(a.trustedRepositories) == 0 {
+		return true
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return slices.Contains(a.trustedRepositories, u.Host) || slices.Contains(a.trustedRepositories, u.Hostname())
+}
+
+// trustedIndexes returns the indexes of indexes from trusted repositories, and whether any were
+// left out.
+func (a *APK) trustedIndexes(indexes []NamedIndex) ([]NamedIndex, bool) {
+	trusted := make([]NamedIndex, 0, len(indexes))
+	for _, index := range indexes {
+		if a.trusted(index.Source()) {
+			trusted = append(trusted, index)
+		}
+	}
+	return trusted, len(trusted) < len(indexes)
+}
+
+// untrustedError explains why directPkgs could not be resolved against the trusted indexes: it
+// returns an UntrustedRepositoryError for each package from an untrusted repository if they
+// resolve with all of indexes, and nil if they do not resolve either way.
+func (a *APK) untrustedError(ctx context.Context, indexes []NamedIndex, directPkgs []string) error {
+	toInstall, _, err := a.newPkgResolver(ctx, indexes).GetPackagesWithDependencies(ctx, directPkgs)
+	if err != nil {
+		return nil
+	}
+	var errs []error
+	for _, pkg := range toInstall {
+		if !a.trusted(pkg.Repository().URI) {
+			errs = append(errs, &UntrustedRepositoryError{Package: pkg.Name, Repository: redactURL(pkg.Repository().URI)})
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedRepositories(t *testing.T) {
+	ctx := context.Background()
+	globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+	t.Cleanup(func() { globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{} })
+
+	serve := func(packages []*Package) *httptest.Server {
+		dir := testLocalRepo(t, testArch, packages)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, filepath.Join(dir, r.URL.Path))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	trusted := serve([]*Package{
+		{Name: "foo", Version: "1.0.0-r0", Arch: testArch, Dependencies: []string{"bar"}},
+		{Name: "baz", Version: "1.0.0-r0", Arch: testArch},
+	})
+	untrusted := serve([]*Package{
+		{Name: "bar", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "baz", Version: "2.0.0-r0", Arch: testArch},
+	})
+	repos := []string{trusted.URL, untrusted.URL}
+	a, _ := testAPKWithRepos(t, repos, WithTrustedRepositories([]string{strings.TrimPrefix(trusted.URL, "http://")}))
+
+	t.Run("dependency from an untrusted repository", func(t *testing.T) {
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		_, _, err := a.ResolveWorld(ctx)
+		require.Error(t, err)
+		var untrustedErr *UntrustedRepositoryError
+		require.True(t, errors.As(err, &untrustedErr), "expected an UntrustedRepositoryError, got %v", err)
+		require.Equal(t, &UntrustedRepositoryError{Package: "bar", Repository: untrusted.URL + "/" + testArch}, untrustedErr)
+		require.ErrorIs(t, err, &ResolutionError{})
+		require.ErrorContains(t, err, "package bar is only available from repository "+untrusted.URL)
+	})
+
+	t.Run("newer version from an untrusted repository", func(t *testing.T) {
+		require.NoError(t, a.SetWorld(ctx, []string{"baz"}))
+		resolved, _, err := a.ResolveWorld(ctx)
+		require.NoError(t, err)
+		require.Len(t, resolved, 1)
+		require.Equal(t, "1.0.0-r0", resolved[0].Version)
+	})
+
+	t.Run("no policy", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, repos)
+		require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+		resolved, _, err := a.ResolveWorld(ctx)
+		require.NoError(t, err)
+		require.Len(t, resolved, 2)
+	})
+}
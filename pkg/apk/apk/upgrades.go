@@ -0,0 +1,105 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"go.opentelemetry.io/otel"
+)
+
+// Upgrade is an installed package that has a newer version in the configured repositories.
+type Upgrade struct {
+	Name string
+	// Current is the installed version.
+	Current string
+	// Candidate is the newest version that is allowed.
+	Candidate string
+	// Package is the candidate in its repository.
+	Package *RepositoryPackage
+}
+
+// AvailableUpgrades returns the installed packages that the configured repositories have newer
+// versions of, sorted by name. The candidate for each is the best version that its world entry
+// allows, so that a package pinned with foo=1.2.3 or foo<2 is only offered upgrades within that
+// range, and one tagged with a repository prefers it. Installed packages that the repositories
+// do not have are left out. Nothing is installed.
+func (a *APK) AvailableUpgrades(ctx context.Context) ([]Upgrade, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "AvailableUpgrades")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+	world, err := a.GetWorld(ctx)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+	constraints := make(map[string]string, len(world))
+	for _, w := range world {
+		constraints[resolvePackageNameVersionPin(w).name] = w
+	}
+
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	resolver := a.newPkgResolver(ctx, indexes)
+
+	var upgrades []Upgrade
+	for _, pkg := range installed {
+		query, ok := constraints[pkg.Name]
+		if !ok {
+			query = pkg.Name
+		}
+		candidates, err := resolver.ResolvePackage(query, nil)
+		if err != nil {
+			// nothing allowed is available
+			continue
+		}
+		for _, candidate := range candidates {
+			// skip other packages that provide the name
+			if candidate.Name != pkg.Name {
+				continue
+			}
+			if newer, err := resolver.isNewer(candidate.Version, pkg.Version); err == nil && newer {
+				upgrades = append(upgrades, Upgrade{Name: pkg.Name, Current: pkg.Version, Candidate: candidate.Version, Package: candidate})
+			}
+			break
+		}
+	}
+
+	sort.Slice(upgrades, func(i, j int) bool { return upgrades[i].Name < upgrades[j].Name })
+	return upgrades, nil
+}
+
+// isNewer reports whether version orders after current with the comparer of the resolver.
+func (p *PkgResolver) isNewer(version, current string) (bool, error) {
+	if p.versionComparer == nil {
+		// Versions that fail to parse are not ordered.
+		if _, err := p.parseVersion(version); err != nil {
+			return false, err
+		}
+		if _, err := p.parseVersion(current); err != nil {
+			return false, err
+		}
+	}
+	return p.compareVersions(version, current) > 0, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAvailableUpgrades(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepo(t, testArch, []*Package{
+		{Name: "foo", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "foo", Version: "2.0.0-r0", Arch: testArch},
+		{Name: "bar", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "pinned", Version: "1.5.0-r0", Arch: testArch},
+		{Name: "pinned", Version: "3.0.0-r0", Arch: testArch},
+	})
+	a, _ := testAPKWithRepos(t, []string{repo})
+	for _, pkg := range []*Package{
+		{Name: "foo", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "bar", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "pinned", Version: "1.0.0-r0", Arch: testArch},
+		{Name: "local", Version: "1.0.0-r0", Arch: testArch},
+	} {
+		require.NoError(t, a.AddInstalledPackage(pkg, nil))
+	}
+	require.NoError(t, a.SetWorld(ctx, []string{"foo", "pinned<2"}))
+
+	upgrades, err := a.AvailableUpgrades(ctx)
+	require.NoError(t, err)
+	require.Len(t, upgrades, 2)
+	require.Equal(t, "foo", upgrades[0].Name)
+	require.Equal(t, "1.0.0-r0", upgrades[0].Current)
+	require.Equal(t, "2.0.0-r0", upgrades[0].Candidate)
+	require.Equal(t, "2.0.0-r0", upgrades[0].Package.Version)
+	require.Equal(t, "pinned", upgrades[1].Name)
+	require.Equal(t, "1.5.0-r0", upgrades[1].Candidate, "the world pin should be respected")
+}
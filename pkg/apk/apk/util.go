@@ -19,11 +19,36 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/url"
+	"path/filepath"
 	"strings"
 
 	"golang.org/x/exp/slices"
+
+	apkfs "chainguard.dev/apko/pkg/apk/fs"
 )
 
+// writeFileAtomic writes data to name through a temporary file in the same directory that is
+// then renamed over name, so that name always holds either its old or its new contents, even if
+// writing is interrupted. Filesystems that cannot rename files are written to directly.
+func (a *APK) writeFileAtomic(name string, data []byte, perm fs.FileMode) error {
+	rfs, ok := a.fs.(apkfs.RenameFS)
+	if !ok {
+		return a.fs.WriteFile(name, data, perm)
+	}
+	tmp := filepath.Join(filepath.Dir(name), fmt.Sprintf(".%s.%d.tmp", filepath.Base(name), rand.Uint64()))
+	if err := a.fs.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := rfs.Rename(tmp, name); err != nil {
+		_ = a.fs.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
 func uniqify[T comparable](s []T) []T {
 	seen := make(map[T]struct{}, len(s))
 	uniq := make([]T, 0, len(s))
@@ -39,6 +64,56 @@ func uniqify[T comparable](s []T) []T {
 	return uniq
 }
 
+// providesName reports whether pkg is, or provides, the package name.
+func providesName(pkg *Package, name string) bool {
+	if pkg.Name == name {
+		return true
+	}
+	for _, p := range pkg.Provides {
+		if resolvePackageNameVersionPin(p).name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dependsOn reports whether a dependency of pkg is satisfied by other, ignoring versions.
+func dependsOn(pkg, other *Package) bool {
+	for _, dep := range pkg.Dependencies {
+		if strings.HasPrefix(dep, "!") {
+			continue
+		}
+		if providesName(other, resolvePackageNameVersionPin(dep).name) {
+			return true
+		}
+	}
+	return false
+}
+
+// dependencyOrder sorts items so that each comes after the items whose packages its package
+// depends on, picking the earliest item that is ready at every step. Otherwise, and within
+// dependency cycles, items keep their order.
+func dependencyOrder[T any](items []T, pkgOf func(T) *Package) []T {
+	ordered := make([]T, 0, len(items))
+	remaining := items
+	for len(remaining) > 0 {
+		next := 0
+	pick:
+		for i, item := range remaining {
+			for j, other := range remaining {
+				if i != j && dependsOn(pkgOf(item), pkgOf(other)) {
+					continue pick
+				}
+			}
+			next = i
+			break
+		}
+		ordered = append(ordered, remaining[next])
+		remaining = append(remaining[:next:next], remaining[next+1:]...)
+	}
+	return ordered
+}
+
 func controlValue(controlTar io.Reader, want ...string) (map[string][]string, error) {
 	tr := tar.NewReader(controlTar)
 	mapping := map[string][]string{}
@@ -86,3 +161,16 @@ func controlValue(controlTar io.Reader, want ...string) (map[string][]string, er
 	}
 	return mapping, nil
 }
+
+// localPath returns the host path of a local repository, index or package location, which is
+// either a path or a file:// URL.
+func localPath(u string) string {
+	if !strings.HasPrefix(u, "file://") {
+		return u
+	}
+	asURL, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return asURL.Path
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// DiscrepancyKind is the kind of problem VerifyInstalledDB found with a path.
+type DiscrepancyKind int
+
+const (
+	// DiscrepancyMissing is a file in the installed database that does not exist.
+	DiscrepancyMissing DiscrepancyKind = iota
+	// DiscrepancyChecksum is a file whose contents do not match the checksum in the installed
+	// database.
+	DiscrepancyChecksum
+	// DiscrepancyOrphaned is a file that no installed package owns.
+	DiscrepancyOrphaned
+)
+
+func (k DiscrepancyKind) String() string {
+	switch k {
+	case DiscrepancyMissing:
+		return "missing"
+	case DiscrepancyChecksum:
+		return "checksum mismatch"
+	case DiscrepancyOrphaned:
+		return "orphaned"
+	default:
+		return fmt.Sprintf("DiscrepancyKind(%d)", int(k))
+	}
+}
+
+// Discrepancy is a difference between the installed database and the filesystem.
+type Discrepancy struct {
+	Kind DiscrepancyKind
+	// Path is the path of the file, relative to the root.
+	Path string
+	// Package is the name of the package that owns the file, or empty if it is orphaned.
+	Package string
+	// Expected and Actual are the checksums of a DiscrepancyChecksum, in the Q1-prefixed form
+	// of the installed database.
+	Expected string
+	Actual   string
+}
+
+func (d Discrepancy) String() string {
+	switch d.Kind {
+	case DiscrepancyOrphaned:
+		return fmt.Sprintf("%s: %s", d.Path, d.Kind)
+	case DiscrepancyChecksum:
+		return fmt.Sprintf("%s (%s): %s, expected %s, got %s", d.Path, d.Package, d.Kind, d.Expected, d.Actual)
+	default:
+		return fmt.Sprintf("%s (%s): %s", d.Path, d.Package, d.Kind)
+	}
+}
+
+// installedEntry is a file in the installed database.
+type installedEntry struct {
+	pkg  string
+	path string
+	// checksum is the Z: value, if any.
+	checksum string
+}
+
+// VerifyInstalledDB checks the filesystem against the installed database, like a fsck: that
+// every file a package owns exists and, where the database records a checksum, has the recorded
+// contents, and that every file on the filesystem is owned by a package. The files apk keeps
+// its own state in, such as etc/apk and lib/apk, and those InitDB creates are not reported as
+// orphaned. Directories are not checked. The discrepancies are sorted by path; none means the
+// database is consistent.
+func (a *APK) VerifyInstalledDB(ctx context.Context) ([]Discrepancy, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "VerifyInstalledDB")
+	defer span.End()
+
+	entries, err := a.readInstalledEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	var discrepancies []Discrepancy
+	owned := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		owned[e.path] = true
+		fi, err := a.fs.Lstat(e.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			discrepancies = append(discrepancies, Discrepancy{Kind: DiscrepancyMissing, Path: e.path, Package: e.pkg})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("checking %s: %w", e.path, err)
+		}
+		if e.checksum == "" {
+			continue
+		}
+		got, err := a.installedChecksum(e.path, fi)
+		if err != nil {
+			return nil, err
+		}
+		if got != "" && got != e.checksum {
+			discrepancies = append(discrepancies, Discrepancy{Kind: DiscrepancyChecksum, Path: e.path, Package: e.pkg, Expected: e.checksum, Actual: got})
+		}
+	}
+
+	state := map[string]bool{}
+	for _, e := range a.initDBPlan() {
+		state[strings.TrimPrefix(e.Path, "/")] = true
+	}
+	stateDirs := make([]string, 0, len(initDirectories))
+	for _, d := range initDirectories {
+		stateDirs = append(stateDirs, strings.TrimPrefix(d.path, "/")+"/")
+	}
+	if err := fs.WalkDir(a.fs, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || owned[p] || state[p] {
+			return nil
+		}
+		for _, dir := range stateDirs {
+			if strings.HasPrefix(p, dir) {
+				return nil
+			}
+		}
+		discrepancies = append(discrepancies, Discrepancy{Kind: DiscrepancyOrphaned, Path: p})
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("walking filesystem: %w", err)
+	}
+
+	sort.SliceStable(discrepancies, func(i, j int) bool { return discrepancies[i].Path < discrepancies[j].Path })
+	return discrepancies, nil
+}
+
+// installedChecksum returns the checksum of the file at name the way the installed database
+// records it: the sha1 of the contents of a regular file, or of the target of a symlink. Other
+// kinds of files have no checksum, and "" is returned.
+func (a *APK) installedChecksum(name string, fi fs.FileInfo) (string, error) {
+	h := sha1.New() //nolint:gosec // this is what apk tools is using
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		target, err := a.fs.Readlink(name)
+		if err != nil {
+			return "", fmt.Errorf("reading link %s: %w", name, err)
+		}
+		h.Write([]byte(target))
+	case fi.Mode().IsRegular():
+		f, err := a.fs.Open(name)
+		if err != nil {
+			return "", fmt.Errorf("opening %s: %w", name, err)
+		}
+		defer f.Close()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", fmt.Errorf("reading %s: %w", name, err)
+		}
+	default:
+		return "", nil
+	}
+	return "Q1" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// readInstalledEntries reads the files in the installed database with their checksums, which
+// ParseInstalled does not keep.
+func (a *APK) readInstalledEntries() ([]installedEntry, error) {
+	f, err := a.fs.Open(installedFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open installed file at %s: %w", installedFilePath, err)
+	}
+	defer f.Close()
+
+	var (
+		entries  []installedEntry
+		pkg, dir string
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		token, val, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			// the blank line between packages
+			pkg, dir = "", ""
+			continue
+		}
+		switch token {
+		case "P":
+			pkg = val
+		case "F":
+			dir = val
+		case "R":
+			entries = append(entries, installedEntry{pkg: pkg, path: path.Join(dir, val)})
+		case "Z":
+			if len(entries) > 0 {
+				entries[len(entries)-1].checksum = val
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", installedFilePath, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyInstalledDB(t *testing.T) {
+	ctx := context.Background()
+	a, src := testAPKWithRepos(t, nil)
+
+	fp := fakePackage(t, &Package{Name: "first", Version: "1.0.0-r0", Arch: testArch}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/first", 0o644, false, []byte("first"), nil},
+		{"etc/kept", 0o644, false, []byte("kept"), nil},
+	})
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{fp}))
+
+	// A package whose database entry records a checksum.
+	sum := sha1.Sum([]byte("original")) //nolint:gosec
+	require.NoError(t, src.MkdirAll("usr", 0o755))
+	require.NoError(t, src.WriteFile("usr/checked", []byte("original"), 0o644))
+	require.NoError(t, a.AddInstalledPackage(&Package{Name: "second", Version: "1.0.0-r0", Arch: testArch}, []tar.Header{
+		{Name: "usr", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/checked", Typeflag: tar.TypeReg, Mode: 0o644, PAXRecords: map[string]string{
+			paxRecordsChecksumKey: hex.EncodeToString(sum[:]),
+		}},
+	}))
+
+	discrepancies, err := a.VerifyInstalledDB(ctx)
+	require.NoError(t, err)
+	require.Empty(t, discrepancies)
+
+	require.NoError(t, src.Remove("etc/first"))
+	require.NoError(t, src.WriteFile("usr/checked", []byte("modified"), 0o644))
+	require.NoError(t, src.WriteFile("etc/stray", []byte("stray"), 0o644))
+
+	discrepancies, err = a.VerifyInstalledDB(ctx)
+	require.NoError(t, err)
+	require.Len(t, discrepancies, 3)
+	require.Equal(t, Discrepancy{Kind: DiscrepancyMissing, Path: "etc/first", Package: "first"}, discrepancies[0])
+	require.Equal(t, Discrepancy{Kind: DiscrepancyOrphaned, Path: "etc/stray"}, discrepancies[1])
+	require.Equal(t, DiscrepancyChecksum, discrepancies[2].Kind)
+	require.Equal(t, "usr/checked", discrepancies[2].Path)
+	require.Equal(t, "second", discrepancies[2].Package)
+	require.NotEqual(t, discrepancies[2].Expected, discrepancies[2].Actual)
+}
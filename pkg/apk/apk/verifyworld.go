@@ -0,0 +1,62 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// VerifyWorldSatisfied returns the entries of the world that the installed packages do not
+// satisfy, in the order of the world. An entry is satisfied by an installed package that has,
+// or provides, its name at a version it allows, and a conflict such as !foo by no installed
+// package that would satisfy foo. Only the world and the installed database are read; repositories are
+// not consulted.
+func (a *APK) VerifyWorldSatisfied(ctx context.Context) ([]string, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "VerifyWorldSatisfied")
+	defer span.End()
+
+	world, err := a.GetWorld(ctx)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+
+	pkgs := make([]*Package, 0, len(installed))
+	for _, pkg := range installed {
+		pkgs = append(pkgs, &pkg.Package)
+	}
+	repo := &Repository{}
+	resolver := NewPkgResolver(ctx, []NamedIndex{NewNamedRepositoryWithIndex("", repo.WithIndex(&APKIndex{Packages: pkgs}))})
+	resolver.SetVersionComparer(a.versionComparer)
+
+	unsatisfied := []string{}
+	for _, entry := range world {
+		constraint, isConflict := strings.CutPrefix(entry, "!")
+		_, err := resolver.ResolvePackage(constraint, nil)
+		if found := err == nil; found == isConflict {
+			unsatisfied = append(unsatisfied, entry)
+		}
+	}
+	return unsatisfied, nil
+}
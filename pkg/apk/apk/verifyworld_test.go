@@ -0,0 +1,51 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyWorldSatisfied(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testAPKWithRepos(t, nil)
+	for _, pkg := range []*Package{
+		{Name: "foo", Version: "1.2.0-r0", Provides: []string{"cmd:foo=1.2.0-r0"}},
+		{Name: "bar", Version: "2.0.0-r1"},
+	} {
+		require.NoError(t, a.AddInstalledPackage(pkg, nil))
+	}
+
+	for _, tt := range []struct {
+		name  string
+		world []string
+		want  []string
+	}{
+		{"satisfied", []string{"foo", "bar>2", "cmd:foo", "foo~1.2", "!baz", "foo@edge"}, []string{}},
+		{"not installed", []string{"foo", "baz", "so:libbaz.so.1"}, []string{"baz", "so:libbaz.so.1"}},
+		{"wrong version", []string{"foo=1.1.0-r0", "bar<2"}, []string{"bar<2", "foo=1.1.0-r0"}},
+		{"conflict", []string{"foo", "!bar"}, []string{"!bar"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, a.SetWorld(ctx, tt.world))
+			got, err := a.VerifyWorldSatisfied(ctx)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
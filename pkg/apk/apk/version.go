@@ -326,11 +326,9 @@ const (
 	versionTilde
 )
 
-func (v versionDependency) satisfies(actualVersion, requiredVersion Version) bool {
-	if v == versionTilde {
-		return includesVersion(actualVersion, requiredVersion)
-	}
-	c := CompareVersions(actualVersion, requiredVersion)
+// allows reports whether c, the result of comparing the actual version to the required version,
+// satisfies v. It does not apply to versionTilde, which is not an ordering.
+func (v versionDependency) allows(c int) bool {
 	switch v {
 	case versionAny:
 		return true
@@ -349,6 +347,34 @@ func (v versionDependency) satisfies(actualVersion, requiredVersion Version) boo
 	}
 }
 
+// VersionComparer orders package versions for the resolver, see WithVersionComparer.
+type VersionComparer interface {
+	// CompareVersions returns 1, 0 or -1 as actual is newer than, the same as or older than
+	// required. Versions are passed as they are, before ParseVersion sees them, to order
+	// packages and to check for downgrades, so they may be ones it rejects. Version
+	// constraints are only checked against versions that ParseVersion accepts.
+	CompareVersions(actual, required string) int
+}
+
+// APKVersionComparer is the default VersionComparer, which orders versions like apk does.
+type APKVersionComparer struct{}
+
+// CompareVersions compares the parsed versions with CompareVersions. A version that does not
+// parse is older than one that does, and two of them are ordered as strings.
+func (APKVersionComparer) CompareVersions(actual, required string) int {
+	actualVersion, actualErr := ParseVersion(actual)
+	requiredVersion, requiredErr := ParseVersion(required)
+	switch {
+	case actualErr != nil && requiredErr != nil:
+		return strings.Compare(actual, required)
+	case actualErr != nil:
+		return less
+	case requiredErr != nil:
+		return greater
+	}
+	return CompareVersions(actualVersion, requiredVersion)
+}
+
 type parsedConstraint struct {
 	name    string
 	version string
@@ -386,7 +412,8 @@ func resolvePackageNameVersionPin(pkgName string) parsedConstraint {
 			p.dep = versionGreaterEqual
 		case "<=":
 			p.dep = versionLessEqual
-		case "~":
+		case "~", "~=", "=~":
+			// apk writes fuzzy matches as ~, and accepts ~= and =~ for them too
 			p.dep = versionTilde
 		default:
 			p.dep = versionAny
@@ -448,6 +475,9 @@ func (p *PkgResolver) filterPackages(pkgs []*repositoryPackage, dq map[*Reposito
 		if _, dqed := dq[pkg.RepositoryPackage]; dqed {
 			continue
 		}
+		if !p.allowedByRepository(pkg) {
+			continue
+		}
 		// do we allow this package?
 
 		// if it has a pinned name, and it is not preferred or allowed, we reject it immediately
@@ -473,7 +503,7 @@ func (p *PkgResolver) filterPackages(pkgs []*repositoryPackage, dq map[*Reposito
 			continue
 		}
 
-		if o.compare.satisfies(actualVersion, requiredVersion) {
+		if p.satisfies(o.compare, pkg.Version, o.version, actualVersion, requiredVersion) {
 			passed = append(passed, pkg)
 			continue
 		}
@@ -490,7 +520,7 @@ func (p *PkgResolver) filterPackages(pkgs []*repositoryPackage, dq map[*Reposito
 				continue
 			}
 
-			if o.compare.satisfies(actualVersion, requiredVersion) {
+			if p.satisfies(o.compare, version, o.version, actualVersion, requiredVersion) {
 				passed = append(passed, pkg)
 				break
 			}
@@ -17,6 +17,7 @@ package apk
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -947,3 +948,90 @@ func TestResolverPackageNameVersionPin(t *testing.T) {
 		})
 	}
 }
+
+func TestAPKVersionComparer(t *testing.T) {
+	ordered := []string{"1.0_rc1", "1.0", "1.0-r1"}
+	for i, older := range ordered {
+		require.Equal(t, equal, APKVersionComparer{}.CompareVersions(older, older), older)
+		for _, newer := range ordered[i+1:] {
+			require.Equal(t, less, APKVersionComparer{}.CompareVersions(older, newer), "%s < %s", older, newer)
+			require.Equal(t, greater, APKVersionComparer{}.CompareVersions(newer, older), "%s > %s", newer, older)
+		}
+	}
+}
+
+// testReverseComparer orders versions backwards and records what it compared.
+type testReverseComparer struct {
+	calls int
+}
+
+func (c *testReverseComparer) CompareVersions(actual, required string) int {
+	c.calls++
+	return -APKVersionComparer{}.CompareVersions(actual, required)
+}
+
+func TestWithVersionComparer(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepo(t, testArch, []*Package{
+		{Name: "foo", Version: "1.0_rc1"},
+		{Name: "foo", Version: "1.0"},
+		{Name: "foo", Version: "1.0-r1"},
+	})
+
+	for _, tt := range []struct {
+		world    string
+		want     string
+		comparer *testReverseComparer
+	}{
+		{world: "foo", want: "1.0-r1"},
+		{world: "foo", want: "1.0_rc1", comparer: &testReverseComparer{}},
+		{world: "foo<1.0", want: "1.0_rc1"},
+		// Backwards, 1.0-r1 is the only version older than 1.0.
+		{world: "foo<1.0", want: "1.0-r1", comparer: &testReverseComparer{}},
+	} {
+		t.Run(fmt.Sprintf("%s custom=%t", tt.world, tt.comparer != nil), func(t *testing.T) {
+			var options []Option
+			if tt.comparer != nil {
+				options = append(options, WithVersionComparer(tt.comparer))
+			}
+			a, _ := testAPKWithRepos(t, []string{repo}, options...)
+			require.NoError(t, a.SetWorld(ctx, []string{tt.world}))
+
+			pkgs, _, err := a.ResolveWorld(ctx)
+			require.NoError(t, err)
+			require.Len(t, pkgs, 1)
+			require.Equal(t, tt.want, pkgs[0].Version)
+			if tt.comparer != nil {
+				require.NotZero(t, tt.comparer.calls, "custom comparer was not consulted")
+			}
+		})
+	}
+}
+
+// testStringComparer orders versions as strings, which ParseVersion need not accept.
+type testStringComparer struct{}
+
+func (testStringComparer) CompareVersions(actual, required string) int {
+	return strings.Compare(actual, required)
+}
+
+func TestWithVersionComparerUnparsed(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepo(t, testArch, []*Package{
+		{Name: "foo", Version: "a2"},
+		{Name: "foo", Version: "b1"},
+	})
+	_, err := ParseVersion("b1")
+	require.Error(t, err, "the versions should be ones ParseVersion rejects")
+
+	a, _ := testAPKWithRepos(t, []string{repo}, WithVersionComparer(testStringComparer{}), WithDowngradePolicy(DowngradeForbid))
+	require.NoError(t, a.SetWorld(ctx, []string{"foo"}))
+	pkgs, _, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	require.Equal(t, "b1", pkgs[0].Version)
+
+	c, err := a.compareInstalledVersion(&RepositoryPackage{Package: &Package{Name: "foo", Version: "a2"}}, "b1")
+	require.NoError(t, err)
+	require.Equal(t, less, c, "a2 should be a downgrade from b1")
+}
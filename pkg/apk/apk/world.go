@@ -15,45 +15,130 @@
 package apk
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 
-	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
 )
 
-// GetWorld -  get list of packages that should be installed, according to /etc/apk/world
-func (a *APK) GetWorld() ([]string, error) {
+// GetWorld returns the sorted list of packages that should be installed, according to /etc/apk/world.
+// With WorldOrderInsertion, they are returned in the order they appear in the file instead.
+// Blank lines and lines starting with # are ignored.
+func (a *APK) GetWorld(ctx context.Context) ([]string, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "GetWorld")
+	defer span.End()
+
 	worldFile, err := a.fs.Open(worldFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("could not open world file in %s at %s: %w", a.fs, worldFilePath, err)
 	}
 	defer worldFile.Close()
-	worldData, err := io.ReadAll(worldFile)
+	lines, err := readConfigLines(worldFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read world file: %w", err)
 	}
-	return strings.Fields(string(worldData)), nil
+	var world []string
+	for _, line := range lines {
+		world = append(world, strings.Fields(line)...)
+	}
+	if a.worldOrdering != WorldOrderAlpha {
+		return uniqify(world), nil
+	}
+	sort.Strings(world)
+	return slices.Compact(world), nil
+}
+
+// readConfigLines reads the meaningful lines of an apk configuration file such as
+// /etc/apk/world or /etc/apk/repositories. Each line is trimmed and has its runs of whitespace
+// collapsed. Blank lines and lines starting with # are dropped.
+func readConfigLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.Join(strings.Fields(scanner.Text()), " ")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
 }
 
-// SetWorld sets the list of world packages intended to be installed.
+// SetWorld sets the list of world packages intended to be installed. Duplicates are dropped, and
+// the rest are written in the order set by WithWorldOrdering.
 // The base directory of /etc/apk must already exist, i.e. this only works on an initialized APK database.
+// With WithValidateWorld, the world is only written if ValidateWorld accepts it.
+// The file is replaced atomically, so it is never left partly written.
 func (a *APK) SetWorld(ctx context.Context, packages []string) error {
-	log := clog.FromContext(ctx)
+	if a.validateWorld {
+		if err := a.ValidateWorld(ctx, packages); err != nil {
+			return err
+		}
+	}
+	a.worldMu.Lock()
+	defer a.worldMu.Unlock()
+	return a.writeWorld(ctx, packages)
+}
+
+// ValidateWorld checks that packages can be resolved against the configured repositories,
+// without writing etc/apk/world. If they cannot, the error lists every unsatisfiable constraint.
+func (a *APK) ValidateWorld(ctx context.Context, packages []string) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "ValidateWorld")
+	defer span.End()
+
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	resolver := a.newPkgResolver(ctx, indexes)
+
+	// Solve each constraint on its own first, so that all of the broken ones are reported.
+	var errs []error
+	for _, pkg := range packages {
+		if _, _, err := resolver.GetPackagesWithDependencies(ctx, []string{pkg}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		// They may still conflict with each other.
+		toInstall, conflicts, err := resolver.GetPackagesWithDependencies(ctx, packages)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, conflict := range conflicts {
+			name := resolver.resolvePackageNameVersionPin(conflict).name
+			if slices.ContainsFunc(toInstall, func(pkg *RepositoryPackage) bool { return pkg.Name == name }) {
+				errs = append(errs, fmt.Errorf("resolved packages conflict with %s", conflict))
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("world is not satisfiable:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// writeWorld writes the list of world packages without validating them.
+func (a *APK) writeWorld(ctx context.Context, packages []string) error {
+	log := a.log(ctx)
 	log.Debug("setting apk world")
 
-	// sort them before writing
-	copied := make([]string, len(packages))
-	copy(copied, packages)
-	sort.Strings(copied)
+	copied := uniqify(packages)
+	if a.worldOrdering == WorldOrderAlpha {
+		sort.Strings(copied)
+	}
 
 	data := strings.Join(copied, "\n") + "\n"
 
 	// #nosec G306 -- apk world must be publicly readable
-	if err := a.fs.WriteFile(filepath.Join("etc", "apk", "world"),
+	if err := a.writeFileAtomic(filepath.Join("etc", "apk", "world"),
 		[]byte(data), 0o644); err != nil {
 		return fmt.Errorf("failed to write apk world: %w", err)
 	}
@@ -15,6 +15,7 @@
 package apk
 
 import (
+	"context"
 	"strings"
 	"testing"
 
@@ -32,7 +33,163 @@ func TestGetWorld(t *testing.T) {
 	require.NoError(t, err, "unable to write world file")
 	a, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
 	require.NoError(t, err, "unable to create APK")
-	pkgs, err := a.GetWorld()
+	pkgs, err := a.GetWorld(context.Background())
 	require.NoError(t, err, "unable to get world packages")
 	require.Equal(t, strings.Join(packages, " "), strings.Join(pkgs, " "), "expected packages %v, got %v", packages, pkgs)
 }
+
+func TestGetWorldAndRepositoriesFromLayout(t *testing.T) {
+	ctx := context.Background()
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, src.WriteFile(worldFilePath, []byte(`# packages from the base image
+zlib
+  busybox
+
+alpine-baselayout  ca-certificates-bundle
+busybox
+`), 0o644))
+	require.NoError(t, src.WriteFile(reposFilePath, []byte(`# main repositories
+https://dl-cdn.alpinelinux.org/alpine/v3.19/main
+
+  https://dl-cdn.alpinelinux.org/alpine/v3.19/community
+@edge   https://dl-cdn.alpinelinux.org/alpine/edge/main
+#https://example.com/disabled
+`), 0o644))
+	a, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
+	require.NoError(t, err)
+
+	world, err := a.GetWorld(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"alpine-baselayout", "busybox", "ca-certificates-bundle", "zlib"}, world)
+
+	repos, err := a.GetRepositories(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"https://dl-cdn.alpinelinux.org/alpine/v3.19/main",
+		"https://dl-cdn.alpinelinux.org/alpine/v3.19/community",
+		"@edge https://dl-cdn.alpinelinux.org/alpine/edge/main",
+	}, repos)
+}
+
+func TestValidateWorld(t *testing.T) {
+	ctx := context.Background()
+	repo := testLocalRepo(t, testArch, []*Package{
+		{Name: "foo", Version: "1.0.0", Dependencies: []string{"libfoo"}},
+		{Name: "libfoo", Version: "1.0.0"},
+		{Name: "bar", Version: "1.0.0", Dependencies: []string{"libmissing"}},
+		{Name: "baz", Version: "1.0.0", Dependencies: []string{"!foo"}},
+	})
+
+	t.Run("satisfiable", func(t *testing.T) {
+		a, src := testAPKWithRepos(t, []string{repo}, WithValidateWorld(true))
+		require.NoError(t, a.ValidateWorld(ctx, []string{"foo", "libfoo=1.0.0"}))
+		require.NoError(t, a.SetWorld(ctx, []string{"foo", "libfoo=1.0.0"}))
+
+		world, err := src.ReadFile(worldFilePath)
+		require.NoError(t, err)
+		require.Equal(t, "foo\nlibfoo=1.0.0\n", string(world))
+	})
+	t.Run("unsatisfiable", func(t *testing.T) {
+		a, src := testAPKWithRepos(t, []string{repo}, WithValidateWorld(true))
+		before, err := src.ReadFile(worldFilePath)
+		require.NoError(t, err)
+
+		err = a.ValidateWorld(ctx, []string{"foo", "bar", "missing", "foo>2"})
+		require.Error(t, err)
+		for _, constraint := range []string{`"bar"`, `"missing"`, `"foo>2"`} {
+			require.ErrorContains(t, err, constraint)
+		}
+		require.NotContains(t, err.Error(), `solving "foo" constraint`)
+
+		require.Error(t, a.SetWorld(ctx, []string{"foo", "missing"}))
+		after, err := src.ReadFile(worldFilePath)
+		require.NoError(t, err)
+		require.Equal(t, before, after, "world should not be written")
+	})
+	t.Run("conflicting", func(t *testing.T) {
+		a, _ := testAPKWithRepos(t, []string{repo})
+		require.NoError(t, a.ValidateWorld(ctx, []string{"baz"}))
+		require.Error(t, a.ValidateWorld(ctx, []string{"foo", "baz"}))
+	})
+}
+
+func TestWorldOrdering(t *testing.T) {
+	ctx := context.Background()
+	packages := []string{"zlib", "busybox", "alpine-baselayout", "busybox", "ca-certificates-bundle"}
+
+	for _, tt := range []struct {
+		name     string
+		options  []Option
+		want     string
+		wantRead []string
+	}{{
+		name:     "default",
+		want:     "alpine-baselayout\nbusybox\nca-certificates-bundle\nzlib\n",
+		wantRead: []string{"alpine-baselayout", "busybox", "ca-certificates-bundle", "zlib"},
+	}, {
+		name:     "alpha",
+		options:  []Option{WithWorldOrdering(WorldOrderAlpha)},
+		want:     "alpine-baselayout\nbusybox\nca-certificates-bundle\nzlib\n",
+		wantRead: []string{"alpine-baselayout", "busybox", "ca-certificates-bundle", "zlib"},
+	}, {
+		name:     "insertion",
+		options:  []Option{WithWorldOrdering(WorldOrderInsertion)},
+		want:     "zlib\nbusybox\nalpine-baselayout\nca-certificates-bundle\n",
+		wantRead: []string{"zlib", "busybox", "alpine-baselayout", "ca-certificates-bundle"},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := apkfs.NewMemFS()
+			require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+			a, err := New(append([]Option{WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors)}, tt.options...)...)
+			require.NoError(t, err)
+
+			require.NoError(t, a.SetWorld(ctx, packages))
+			world, err := src.ReadFile(worldFilePath)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, string(world))
+
+			read, err := a.GetWorld(ctx)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantRead, read)
+		})
+	}
+}
+
+func TestSetWorldAtomic(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name string
+		fs   func(t *testing.T) apkfs.FullFS
+	}{
+		{"memfs", func(*testing.T) apkfs.FullFS { return apkfs.NewMemFS() }},
+		{"dirfs", func(t *testing.T) apkfs.FullFS { return apkfs.DirFS(t.TempDir()) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := tt.fs(t)
+			require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+			a, err := New(WithFS(src))
+			require.NoError(t, err)
+
+			require.NoError(t, a.SetWorld(ctx, []string{"foo", "bar", "a-rather-long-package-name"}))
+			require.NoError(t, a.SetWorld(ctx, []string{"baz"}))
+			require.NoError(t, a.SetRepositories(ctx, []string{"https://example.com/one", "https://example.com/two"}))
+			require.NoError(t, a.SetRepositories(ctx, []string{"https://example.com/three"}))
+
+			world, err := src.ReadFile("etc/apk/world")
+			require.NoError(t, err)
+			require.Equal(t, "baz\n", string(world))
+			repos, err := src.ReadFile("etc/apk/repositories")
+			require.NoError(t, err)
+			require.Equal(t, "https://example.com/three\n", string(repos))
+
+			entries, err := src.ReadDir("etc/apk")
+			require.NoError(t, err)
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			require.ElementsMatch(t, []string{"repositories", "world"}, names, "temporary files were left behind")
+		})
+	}
+}
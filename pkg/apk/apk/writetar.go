@@ -0,0 +1,65 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/apko/pkg/apk/tarball"
+)
+
+// WriteTar writes the whole target filesystem to w as an uncompressed tar archive. Entries are
+// written with each directory before its contents, and the contents of a directory in lexical
+// order, so the same filesystem always gives the same archive. Owners are the numeric ids on
+// the filesystem, named after etc/passwd and etc/group in it where they list them. Every entry
+// gets the time given by WithSourceDateEpoch, or the Unix epoch if it is not set. Hard links
+// after the first name of a file are written as links to it, and device files with their
+// device numbers.
+func (a *APK) WriteTar(ctx context.Context, w io.Writer) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "WriteTar")
+	defer span.End()
+
+	epoch := time.Unix(0, 0).UTC()
+	if a.sourceDateEpoch != nil {
+		epoch = *a.sourceDateEpoch
+	}
+	tc, err := tarball.NewContext(tarball.WithSourceDateEpoch(epoch))
+	if err != nil {
+		return fmt.Errorf("creating tarball context: %w", err)
+	}
+	return tc.WriteTar(ctx, w, a.fs, a.fs)
+}
+
+// LayerDigest returns the sha256 digest, as "sha256:<hex>", of the archive that WriteTar writes,
+// which covers the path, mode, ownership and content of every entry of the target filesystem.
+// Installing the same packages with the same WithSourceDateEpoch always gives the same digest,
+// so it can tell whether two installs make the same layer.
+func (a *APK) LayerDigest(ctx context.Context) (string, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "LayerDigest")
+	defer span.End()
+
+	h := sha256.New()
+	if err := a.WriteTar(ctx, h); err != nil {
+		return "", fmt.Errorf("digesting layer: %w", err)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTar(t *testing.T) {
+	ctx := context.Background()
+	epoch := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	a, src := testAPKWithRepos(t, nil, WithSourceDateEpoch(epoch))
+
+	pkg := fakePackage(t, &Package{Name: "hello", Version: "1.0.0-r0", Arch: testArch}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/hello", 0o755, false, []byte("hello"), nil},
+		{"usr/bin/a-hello", 0o755, false, []byte("a"), nil},
+	})
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{pkg}))
+	require.NoError(t, src.Link("usr/bin/hello", "usr/bin/z-hello"))
+
+	write := func() []byte {
+		var buf bytes.Buffer
+		require.NoError(t, a.WriteTar(ctx, &buf))
+		return buf.Bytes()
+	}
+	b := write()
+	require.Equal(t, b, write(), "the archive should be the same every time")
+
+	var names []string
+	headers := map[string]*tar.Header{}
+	contents := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		headers[hdr.Name] = hdr
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		contents[hdr.Name] = string(data)
+	}
+
+	var usr []string
+	for _, name := range names {
+		if strings.HasPrefix(name, "usr") {
+			usr = append(usr, name)
+		}
+	}
+	require.Equal(t, []string{"usr", "usr/bin", "usr/bin/a-hello", "usr/bin/hello", "usr/bin/z-hello"}, usr)
+	require.Contains(t, names, "lib/apk/db/installed")
+
+	for name, hdr := range headers {
+		require.True(t, epoch.Equal(hdr.ModTime), "time of %s", name)
+		require.Zero(t, hdr.Uid, "uid of %s", name)
+		require.Zero(t, hdr.Gid, "gid of %s", name)
+	}
+	require.Equal(t, "hello", contents["usr/bin/hello"])
+	require.Equal(t, byte(tar.TypeLink), headers["usr/bin/z-hello"].Typeflag)
+	require.Equal(t, "usr/bin/hello", headers["usr/bin/z-hello"].Linkname)
+
+	null := headers["dev/null"]
+	require.NotNil(t, null)
+	require.Equal(t, byte(tar.TypeChar), null.Typeflag)
+	require.Equal(t, int64(1), null.Devmajor)
+	require.Equal(t, int64(3), null.Devminor)
+}
+
+func TestLayerDigest(t *testing.T) {
+	ctx := context.Background()
+	epoch := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	install := func(content string) string {
+		a, _ := testAPKWithRepos(t, nil, WithSourceDateEpoch(epoch))
+		pkg := fakePackage(t, &Package{Name: "hello", Version: "1.0.0-r0", Arch: testArch}, []testDirEntry{
+			{"usr", 0o755, true, nil, nil},
+			{"usr/bin", 0o755, true, nil, nil},
+			{"usr/bin/hello", 0o755, false, []byte(content), nil},
+		})
+		require.NoError(t, a.InstallPackages(ctx, &epoch, []InstallablePackage{pkg}))
+		digest, err := a.LayerDigest(ctx)
+		require.NoError(t, err)
+		return digest
+	}
+
+	digest := install("hello")
+	require.True(t, strings.HasPrefix(digest, "sha256:"), digest)
+	require.Len(t, digest, len("sha256:")+64)
+	require.Equal(t, digest, install("hello"), "the same install should give the same digest")
+	require.NotEqual(t, digest, install("goodbye"))
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth provides ways to add credentials to the requests that fetch
+// packages, indexes and keys from repositories.
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+// Authenticator adds credentials to requests. AddAuth leaves the request
+// unchanged if it has no credentials for the request's host.
+type Authenticator interface {
+	AddAuth(ctx context.Context, req *http.Request) error
+}
+
+// StaticAuth returns an Authenticator that adds HTTP Basic Auth credentials
+// to requests for host domain.
+func StaticAuth(domain, user, pass string) Authenticator {
+	return staticAuth{domain: domain, user: user, pass: pass}
+}
+
+type staticAuth struct {
+	domain, user, pass string
+}
+
+func (s staticAuth) AddAuth(_ context.Context, req *http.Request) error {
+	if req.URL.Host == s.domain {
+		req.SetBasicAuth(s.user, s.pass)
+	}
+	return nil
+}
+
+// BearerAuth returns an Authenticator that adds an "Authorization: Bearer"
+// header with token to requests for host.
+func BearerAuth(host, token string) Authenticator {
+	return bearerAuth{host: host, token: token}
+}
+
+type bearerAuth struct {
+	host, token string
+}
+
+func (b bearerAuth) AddAuth(_ context.Context, req *http.Request) error {
+	if req.URL.Host == b.host {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	return nil
+}
+
+// ChainAuth returns an Authenticator that tries each of auths in order, and
+// stops at the first one that adds credentials to the request, that is, sets
+// its Authorization header.
+func ChainAuth(auths ...Authenticator) Authenticator {
+	return chainAuth(auths)
+}
+
+type chainAuth []Authenticator
+
+func (c chainAuth) AddAuth(ctx context.Context, req *http.Request) error {
+	for _, a := range c {
+		if err := a.AddAuth(ctx, req); err != nil {
+			return err
+		}
+		if req.Header.Get("Authorization") != "" {
+			return nil
+		}
+	}
+	return nil
+}
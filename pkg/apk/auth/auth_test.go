@@ -0,0 +1,53 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainAuth(t *testing.T) {
+	ctx := context.Background()
+	a := ChainAuth(
+		StaticAuth("one.example.com", "user1", "pass1"),
+		StaticAuth("two.example.com", "user2", "pass2"),
+		// never reached for the hosts above
+		StaticAuth("two.example.com", "other", "other"),
+	)
+
+	for _, tt := range []struct {
+		host       string
+		user, pass string
+		ok         bool
+	}{
+		{"one.example.com", "user1", "pass1", true},
+		{"two.example.com", "user2", "pass2", true},
+		{"three.example.com", "", "", false},
+	} {
+		t.Run(tt.host, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+tt.host+"/repo/x86_64/APKINDEX.tar.gz", nil)
+			require.NoError(t, err)
+			require.NoError(t, a.AddAuth(ctx, req))
+			user, pass, ok := req.BasicAuth()
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.user, user)
+			require.Equal(t, tt.pass, pass)
+		})
+	}
+}
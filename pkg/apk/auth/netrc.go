@@ -0,0 +1,174 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// NetrcAuth returns an Authenticator that adds HTTP Basic Auth credentials
+// from the netrc file at path to requests for the machines it lists, or, for
+// other hosts, from its default entry if it has one. Machines match the host
+// of a request with or without its port. The file is read on first use. A
+// missing file adds no credentials. Macros (macdef) are skipped, and so are
+// tokens that are not understood.
+func NetrcAuth(path string) Authenticator {
+	return &netrcAuth{path: path}
+}
+
+type netrcAuth struct {
+	path string
+
+	once     sync.Once
+	machines map[string]netrcEntry
+	def      *netrcEntry
+	err      error
+}
+
+type netrcEntry struct {
+	login, password string
+}
+
+func (n *netrcAuth) AddAuth(_ context.Context, req *http.Request) error {
+	n.once.Do(n.load)
+	if n.err != nil {
+		return n.err
+	}
+
+	e, ok := n.machines[req.URL.Host]
+	if !ok {
+		e, ok = n.machines[req.URL.Hostname()]
+	}
+	if !ok && n.def != nil {
+		e, ok = *n.def, true
+	}
+	if ok && (e.login != "" || e.password != "") {
+		req.SetBasicAuth(e.login, e.password)
+	}
+	return nil
+}
+
+func (n *netrcAuth) load() {
+	f, err := os.Open(n.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		n.err = fmt.Errorf("reading netrc: %w", err)
+		return
+	}
+	defer f.Close()
+	n.machines, n.def, err = parseNetrc(f)
+	if err != nil {
+		n.err = fmt.Errorf("reading netrc %s: %w", n.path, err)
+	}
+}
+
+// parseNetrc parses the machine and default entries of a netrc file. Only the
+// first entry for each machine is kept, as that is the one that applies.
+func parseNetrc(r io.Reader) (map[string]netrcEntry, *netrcEntry, error) {
+	machines := map[string]netrcEntry{}
+	var (
+		def *netrcEntry
+		// the entry being read, and the machine it is for, if not the default
+		cur     *netrcEntry
+		machine string
+		inMacro bool
+	)
+	done := func() {
+		switch {
+		case cur == nil:
+		case machine == "":
+			if def == nil {
+				def = cur
+			}
+		default:
+			if _, ok := machines[machine]; !ok {
+				machines[machine] = *cur
+			}
+		}
+		cur, machine = nil, ""
+	}
+
+	scanner := bufio.NewScanner(r)
+	var fields []string
+	// next returns the next token, which may be on a later line
+	next := func() (string, bool) {
+		for len(fields) == 0 {
+			if !scanner.Scan() {
+				return "", false
+			}
+			line := scanner.Text()
+			if inMacro {
+				// a macro runs to the next empty line
+				inMacro = strings.TrimSpace(line) != ""
+				continue
+			}
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			fields = strings.Fields(line)
+		}
+		token := fields[0]
+		fields = fields[1:]
+		return token, true
+	}
+
+	for {
+		token, ok := next()
+		if !ok {
+			break
+		}
+		switch token {
+		case "machine":
+			done()
+			if v, ok := next(); ok {
+				cur, machine = &netrcEntry{}, v
+			}
+		case "default":
+			done()
+			cur = &netrcEntry{}
+		case "login":
+			if v, ok := next(); ok && cur != nil {
+				cur.login = v
+			}
+		case "password":
+			if v, ok := next(); ok && cur != nil {
+				cur.password = v
+			}
+		case "account":
+			next()
+		case "macdef":
+			done()
+			// the rest of the line is the macro name
+			fields = nil
+			inMacro = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	done()
+	return machines, def, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testNetrc = `# mirror credentials
+machine mirror.example.com login mirror-user password mirror-pass
+
+machine ported.example.com:8080
+  login ported-user
+  password ported-pass
+  account ignored
+
+macdef init
+machine macro.example.com login macro password macro
+
+machine mirror.example.com login shadowed password shadowed
+machine broken.example.com login
+garbage tokens here
+default login default-user password default-pass
+`
+
+func TestNetrcAuth(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "netrc")
+	require.NoError(t, os.WriteFile(path, []byte(testNetrc), 0o600))
+	a := NetrcAuth(path)
+
+	for _, tt := range []struct {
+		host       string
+		user, pass string
+	}{
+		{"mirror.example.com", "mirror-user", "mirror-pass"},
+		{"mirror.example.com:443", "mirror-user", "mirror-pass"},
+		{"ported.example.com:8080", "ported-user", "ported-pass"},
+		{"macro.example.com", "default-user", "default-pass"},
+		{"elsewhere.example.com", "default-user", "default-pass"},
+	} {
+		t.Run(tt.host, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+tt.host+"/os/x86_64/APKINDEX.tar.gz", nil)
+			require.NoError(t, err)
+			require.NoError(t, a.AddAuth(ctx, req))
+			user, pass, ok := req.BasicAuth()
+			require.True(t, ok)
+			require.Equal(t, tt.user, user)
+			require.Equal(t, tt.pass, pass)
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://mirror.example.com/", nil)
+		require.NoError(t, err)
+		require.NoError(t, NetrcAuth(filepath.Join(t.TempDir(), "missing")).AddAuth(ctx, req))
+		_, _, ok := req.BasicAuth()
+		require.False(t, ok)
+	})
+}
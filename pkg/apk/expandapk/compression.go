@@ -0,0 +1,267 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expandapk
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrUnsupportedCompression is returned for apk sections and indexes whose compression no
+// registered Decompressor handles.
+var ErrUnsupportedCompression = errors.New("unsupported compression format")
+
+// Decompressor decompresses one compression format of apk sections and indexes, which are
+// told apart by the magic bytes they start with.
+type Decompressor interface {
+	// Magic returns the bytes that data compressed in the format starts with.
+	Magic() []byte
+	// NewReader returns a reader for the decompressed contents of r, which starts with the
+	// magic bytes. If single is true, r goes on with the next section of an apk after the
+	// compressed stream, so the reader must stop at the end of the stream without reading r
+	// any further. Otherwise, streams concatenated in r are decompressed as a whole.
+	NewReader(r io.Reader, single bool) (io.ReadCloser, error)
+}
+
+var (
+	decompressorsMu sync.RWMutex
+	decompressors   = []Decompressor{gzipDecompressor{}, zstdDecompressor{}}
+)
+
+// RegisterDecompressor adds d to the decompressors that ExpandApk, NewDecompressor and the
+// parsing of indexes choose from, in place of any registered earlier with the same magic
+// bytes. Gzip and zstd are registered from the start. Where the magic bytes of one
+// decompressor start with those of another, the one with the longer magic bytes is used.
+func RegisterDecompressor(d Decompressor) {
+	decompressorsMu.Lock()
+	defer decompressorsMu.Unlock()
+	decompressors = slices.DeleteFunc(slices.Clone(decompressors), func(r Decompressor) bool {
+		return bytes.Equal(r.Magic(), d.Magic())
+	})
+	decompressors = append(decompressors, d)
+}
+
+// magicLen returns how many bytes sniffCompression needs to tell the formats apart.
+func magicLen() int {
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	n := 0
+	for _, d := range decompressors {
+		n = max(n, len(d.Magic()))
+	}
+	return n
+}
+
+// sniffCompression returns the decompressor for data that starts with magic.
+func sniffCompression(magic []byte) (Decompressor, error) {
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	var match Decompressor
+	for _, d := range decompressors {
+		if bytes.HasPrefix(magic, d.Magic()) && (match == nil || len(d.Magic()) > len(match.Magic())) {
+			match = d
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("%w: magic bytes %x", ErrUnsupportedCompression, magic)
+	}
+	return match, nil
+}
+
+// NewDecompressor returns a reader for the decompressed contents of r, which may be compressed
+// in any of the registered formats, gzip and zstd among them. Concatenated streams are
+// decompressed as a whole.
+func NewDecompressor(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(magicLen())
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	d, err := sniffCompression(magic)
+	if err != nil {
+		return nil, err
+	}
+	return d.NewReader(br, false)
+}
+
+// NewStreamDecompressor is like NewDecompressor, but decompresses only the one compressed stream
+// that r starts with, such as a section of an apk or the signature of an index. If r is an
+// io.ByteReader, or returns at most one byte per Read, it is left positioned just after that
+// stream. It returns io.EOF if r is empty.
+func NewStreamDecompressor(r io.Reader) (io.ReadCloser, error) {
+	magic := make([]byte, magicLen())
+	n, err := io.ReadFull(r, magic)
+	if err != nil && (n == 0 || !errors.Is(err, io.ErrUnexpectedEOF)) {
+		return nil, err
+	}
+	d, err := sniffCompression(magic[:n])
+	if err != nil {
+		return nil, err
+	}
+	return d.NewReader(&prefixReader{prefix: magic[:n], r: r}, true)
+}
+
+// prefixReader reads prefix and then r. It is an io.ByteReader, so that decompressors such as
+// gzip do not buffer, and so read past the end of their stream.
+type prefixReader struct {
+	prefix []byte
+	r      io.Reader
+}
+
+func (p *prefixReader) Read(b []byte) (int, error) {
+	if len(p.prefix) > 0 {
+		n := copy(b, p.prefix)
+		p.prefix = p.prefix[n:]
+		return n, nil
+	}
+	return p.r.Read(b)
+}
+
+func (p *prefixReader) ReadByte() (byte, error) {
+	if len(p.prefix) > 0 {
+		c := p.prefix[0]
+		p.prefix = p.prefix[1:]
+		return c, nil
+	}
+	if br, ok := p.r.(io.ByteReader); ok {
+		return br.ReadByte()
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(p.r, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+type gzipDecompressor struct{}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func (gzipDecompressor) Magic() []byte { return gzipMagic }
+
+func (gzipDecompressor) NewReader(r io.Reader, single bool) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("creating gzip reader: %w", err)
+	}
+	zr.Multistream(!single)
+	return zr, nil
+}
+
+type zstdDecompressor struct{}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+func (zstdDecompressor) Magic() []byte { return zstdMagic }
+
+func (zstdDecompressor) NewReader(r io.Reader, single bool) (io.ReadCloser, error) {
+	if single {
+		// The zstd decoder reads ahead, so read exactly one frame before decoding it.
+		magic := make([]byte, len(zstdMagic))
+		if _, err := io.ReadFull(r, magic); err != nil {
+			return nil, fmt.Errorf("reading zstd frame: %w", err)
+		}
+		frame, err := readZstdFrame(r, magic)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(frame)
+	}
+	zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("creating zstd reader: %w", err)
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// readZstdFrame reads exactly one zstd frame from r, whose first magicLen bytes were already
+// read into magic, and returns the whole frame. Unlike a zstd decoder, it never reads past the
+// end of the frame, so the next section of the apk can be read from r afterwards.
+//
+// See https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#frames
+func readZstdFrame(r io.Reader, magic []byte) ([]byte, error) {
+	frame := bytes.NewBuffer(bytes.Clone(magic))
+	read := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, fmt.Errorf("reading zstd frame: %w", err)
+		}
+		frame.Write(b)
+		return b, nil
+	}
+
+	fhd, err := read(1)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		fcsFlag       = fhd[0] >> 6
+		singleSegment = fhd[0]&(1<<5) != 0
+		checksum      = fhd[0]&(1<<2) != 0
+		dictIDFlag    = fhd[0] & 3
+	)
+
+	headerLen := []int{0, 1, 2, 4}[dictIDFlag] + []int{0, 2, 4, 8}[fcsFlag]
+	if !singleSegment {
+		// Window_Descriptor
+		headerLen++
+	} else if fcsFlag == 0 {
+		headerLen++
+	}
+	if _, err := read(headerLen); err != nil {
+		return nil, err
+	}
+
+	for {
+		bh, err := read(3)
+		if err != nil {
+			return nil, err
+		}
+		header := uint32(bh[0]) | uint32(bh[1])<<8 | uint32(bh[2])<<16
+		last := header&1 != 0
+		size := int(header >> 3)
+
+		switch blockType := (header >> 1) & 3; blockType {
+		case 0, 2: // Raw_Block, Compressed_Block
+		case 1: // RLE_Block holds a single byte, repeated size times
+			size = 1
+		default:
+			return nil, fmt.Errorf("reading zstd frame: reserved block type %d", blockType)
+		}
+		if _, err := read(size); err != nil {
+			return nil, err
+		}
+		if last {
+			break
+		}
+	}
+
+	if checksum {
+		// Content_Checksum
+		if _, err := read(4); err != nil {
+			return nil, err
+		}
+	}
+
+	return frame.Bytes(), nil
+}
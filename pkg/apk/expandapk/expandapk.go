@@ -23,7 +23,6 @@ import (
 	"sync"
 
 	"chainguard.dev/apko/pkg/apk/internal/tarfs"
-	"github.com/klauspost/compress/gzip"
 
 	"go.opentelemetry.io/otel"
 )
@@ -78,10 +77,11 @@ func (a *APKExpanded) ControlData() ([]byte, error) {
 		}
 		defer rc.Close()
 
-		zr, err := gzip.NewReader(rc)
+		zr, err := NewDecompressor(rc)
 		if err != nil {
 			return nil, err
 		}
+		defer zr.Close()
 
 		a.controlData, err = io.ReadAll(zr)
 		if err != nil {
@@ -114,24 +114,32 @@ func (a *APKExpanded) PackageData() (*os.File, error) {
 	defer f.Close()
 
 	br := bufio.NewReaderSize(f, bufSize)
-	zr, err := gzip.NewReader(br)
+	zr, err := NewDecompressor(br)
 	if err != nil {
 		return nil, fmt.Errorf("parsing %q: %w", a.PackageFile, err)
 	}
+	defer zr.Close()
 
-	uf, err = os.Create(a.TarFile)
+	// Write to a temporary file first, as other processes may share the cache and must not
+	// open a partially written tar file.
+	uf, err = os.CreateTemp(filepath.Dir(a.TarFile), "*.tmp")
 	if err != nil {
 		return nil, fmt.Errorf("opening tar file %q: %w", a.TarFile, err)
 	}
+	defer os.Remove(uf.Name())
 
 	buf := make([]byte, bufSize)
 	if _, err := io.CopyBuffer(uf, zr, buf); err != nil {
+		uf.Close()
 		return nil, fmt.Errorf("decompressing %q: %w", a.PackageFile, err)
 	}
 
 	if err := uf.Close(); err != nil {
 		return nil, fmt.Errorf("closing %q: %w", a.TarFile, err)
 	}
+	if err := os.Rename(uf.Name(), a.TarFile); err != nil {
+		return nil, fmt.Errorf("renaming %q: %w", a.TarFile, err)
+	}
 
 	return os.Open(a.TarFile)
 }
@@ -236,12 +244,12 @@ func (w *expandApkWriter) Next() error {
 			return fmt.Errorf("expandApkWriter.Next error 2: %v", err)
 		}
 		defer f.Close()
-		gzipRead, err := gzip.NewReader(f)
+		zr, err := NewDecompressor(f)
 		if err != nil {
-			return fmt.Errorf("expandApkWriter.Next error 3: %v", err)
+			return fmt.Errorf("expandApkWriter.Next error 3: %w", err)
 		}
-		defer gzipRead.Close()
-		tarRead := tar.NewReader(gzipRead)
+		defer zr.Close()
+		tarRead := tar.NewReader(zr)
 		hdr, err := tarRead.Next()
 		if err != nil {
 			return fmt.Errorf("expandApkWriter.Next error 4: %v", err)
@@ -313,7 +321,9 @@ func (r *expandApkReader) EnableFastRead() {
 }
 
 // ExpandAPK given a ready to an apk stream, normally a tar stream with gzip compression,
-// expand it into its components.
+// expand it into its components. Each section may be compressed in any of the formats registered
+// with RegisterDecompressor, such as gzip or zstd; any other format results in
+// ErrUnsupportedCompression.
 //
 // An apk is split into either 2 or 3 file streams (2 for unsigned packages, 3 for signed).
 //
@@ -325,7 +335,7 @@ func (r *expandApkReader) EnableFastRead() {
 //
 // Returns an APKExpanded struct containing references to the file. You *must* call APKExpanded.Close()
 // when finished to clean up the various files.
-func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpanded, error) {
+func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (_ *APKExpanded, rerr error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "ExpandApk")
 	defer span.End()
 
@@ -333,6 +343,12 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		// Don't leave partially expanded streams behind.
+		if rerr != nil {
+			os.RemoveAll(dir)
+		}
+	}()
 
 	sw, err := newExpandApkWriter(dir, "stream", "tar.gz")
 	if err != nil {
@@ -340,7 +356,6 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	}
 	exR := newExpandApkReader(source)
 	tr := io.TeeReader(exR, sw)
-	var gzi *gzip.Reader
 	gzipStreams := []string{}
 	hashes := [][]byte{}
 	maxStreamsReached := false
@@ -362,22 +377,26 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 
 		hr := io.TeeReader(tr, h)
 
-		if gzi == nil {
-			gzi, err = gzip.NewReader(hr)
-		} else {
-			err = gzi.Reset(hr)
-		}
-
-		if err == io.EOF {
+		// Sniff the compression of this section from its magic bytes.
+		magic := make([]byte, magicLen())
+		if _, err := io.ReadFull(hr, magic); err == io.EOF {
 			break
 		} else if err != nil {
-			return nil, fmt.Errorf("creating gzip reader: %w", err)
+			return nil, fmt.Errorf("reading compression magic: %w", err)
+		}
+		d, err := sniffCompression(magic)
+		if err != nil {
+			return nil, fmt.Errorf("expandApk section %d: %w", len(gzipStreams), err)
+		}
+		// All but the final section are read one stream at a time.
+		zr, err := d.NewReader(io.MultiReader(bytes.NewReader(magic), hr), !maxStreamsReached)
+		if err != nil {
+			return nil, err
 		}
+		defer zr.Close()
 
 		if !maxStreamsReached {
-			gzi.Multistream(false)
-
-			if _, err := io.Copy(io.Discard, gzi); err != nil {
+			if _, err := io.Copy(io.Discard, zr); err != nil {
 				return nil, fmt.Errorf("expandApk error 3: %w", err)
 			}
 
@@ -391,7 +410,7 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 				return nil, fmt.Errorf("opening tar file: %w", err)
 			}
 			bw := bufio.NewWriterSize(tarfile, 1<<20)
-			tr := io.TeeReader(gzi, bw)
+			tr := io.TeeReader(zr, bw)
 
 			if err := checkSums(ctx, tr); err != nil {
 				return nil, fmt.Errorf("checking sums: %w", err)
@@ -413,9 +432,6 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 		}
 	}
 
-	if err := gzi.Close(); err != nil {
-		return nil, fmt.Errorf("expandApk error 6: %w", err)
-	}
 	if err := sw.CloseFile(); err != nil {
 		return nil, fmt.Errorf("expandApk error 7: %w", err)
 	}
@@ -0,0 +1,248 @@
+package expandapk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func testTarball(t *testing.T, files map[string]string, checksums bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}
+		if checksums {
+			sum := sha1.Sum([]byte(content)) //nolint:gosec // this is what apk tools is using
+			hdr.PAXRecords = map[string]string{paxRecordsChecksumKey: hex.EncodeToString(sum[:])}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testCompress(t *testing.T, format string, b []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch format {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = zw
+	case "fake":
+		buf.Write(fakeMagic)
+		if err := binary.Write(&buf, binary.BigEndian, uint32(len(b))); err != nil {
+			t.Fatal(err)
+		}
+		return append(buf.Bytes(), b...)
+	default:
+		t.Fatalf("unknown format %q", format)
+	}
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExpandApkCompression(t *testing.T) {
+	pkginfo := "pkgname = test\npkgver = 1.0.0-r0\n"
+	// Large and repetitive enough to span several zstd blocks, including RLE ones.
+	big := strings.Repeat("a", 300<<10) + strings.Repeat("0123456789", 1<<10)
+
+	for _, tt := range []struct {
+		control, data string
+	}{
+		{control: "gzip", data: "gzip"},
+		{control: "gzip", data: "zstd"},
+		{control: "zstd", data: "zstd"},
+	} {
+		t.Run(tt.control+"-"+tt.data, func(t *testing.T) {
+			control := testTarball(t, map[string]string{".PKGINFO": pkginfo, ".big": big}, false)
+			data := testTarball(t, map[string]string{"usr/share/hello": "hello world\n"}, true)
+
+			var apk bytes.Buffer
+			apk.Write(testCompress(t, tt.control, control))
+			apk.Write(testCompress(t, tt.data, data))
+
+			exp, err := ExpandApk(context.Background(), &apk, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer exp.Close()
+
+			if exp.Signed {
+				t.Errorf("Signed: got true, want false")
+			}
+
+			got, err := exp.ControlData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, control) {
+				t.Errorf("ControlData() did not round trip")
+			}
+
+			info, err := fs.ReadFile(exp.ControlFS, ".PKGINFO")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(info) != pkginfo {
+				t.Errorf(".PKGINFO: got %q, want %q", info, pkginfo)
+			}
+
+			hello, err := fs.ReadFile(exp.TarFS, "usr/share/hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(hello), "hello world\n"; got != want {
+				t.Errorf("usr/share/hello: got %q, want %q", got, want)
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		control := testTarball(t, map[string]string{".PKGINFO": pkginfo}, false)
+
+		var apk bytes.Buffer
+		apk.Write(testCompress(t, "gzip", control))
+		apk.WriteString("BZh91AY&SY")
+
+		_, err := ExpandApk(context.Background(), &apk, t.TempDir())
+		if !errors.Is(err, ErrUnsupportedCompression) {
+			t.Fatalf("ExpandApk(): got %v, want %v", err, ErrUnsupportedCompression)
+		}
+	})
+}
+
+// fakeMagic starts the streams of fakeDecompressor, which are the magic bytes, the length of
+// the contents as a big-endian uint32 and then the contents as they are.
+var fakeMagic = []byte("FAKE\x00")
+
+type fakeDecompressor struct {
+	used *int
+}
+
+func (fakeDecompressor) Magic() []byte { return fakeMagic }
+
+func (f fakeDecompressor) NewReader(r io.Reader, _ bool) (io.ReadCloser, error) {
+	*f.used++
+	header := make([]byte, len(fakeMagic)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(io.LimitReader(r, int64(binary.BigEndian.Uint32(header[len(fakeMagic):])))), nil
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	saved := decompressors
+	t.Cleanup(func() { decompressors = saved })
+	var used int
+	RegisterDecompressor(fakeDecompressor{used: &used})
+
+	pkginfo := "pkgname = test\npkgver = 1.0.0-r0\n"
+	for _, control := range []string{"fake", "gzip"} {
+		t.Run(control, func(t *testing.T) {
+			used = 0
+			var apk bytes.Buffer
+			apk.Write(testCompress(t, control, testTarball(t, map[string]string{".PKGINFO": pkginfo}, false)))
+			apk.Write(testCompress(t, "fake", testTarball(t, map[string]string{"usr/share/hello": "hello world\n"}, true)))
+
+			exp, err := ExpandApk(context.Background(), &apk, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer exp.Close()
+			if used == 0 {
+				t.Errorf("the registered decompressor was not used")
+			}
+
+			info, err := fs.ReadFile(exp.ControlFS, ".PKGINFO")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(info) != pkginfo {
+				t.Errorf(".PKGINFO: got %q, want %q", info, pkginfo)
+			}
+			hello, err := fs.ReadFile(exp.TarFS, "usr/share/hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(hello), "hello world\n"; got != want {
+				t.Errorf("usr/share/hello: got %q, want %q", got, want)
+			}
+		})
+	}
+
+	t.Run("Split", func(t *testing.T) {
+		sections := [][]byte{
+			testCompress(t, "fake", testTarball(t, map[string]string{".SIGN.RSA.test.rsa.pub": "signature"}, false)),
+			testCompress(t, "gzip", testTarball(t, map[string]string{".PKGINFO": pkginfo}, false)),
+			testCompress(t, "fake", testTarball(t, map[string]string{"usr/share/hello": "hello world\n"}, true)),
+		}
+		parts, err := Split(bytes.NewReader(bytes.Join(sections, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(parts), len(sections); got != want {
+			t.Fatalf("len(Split()): %d != %d", got, want)
+		}
+		for i, part := range parts {
+			got, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, sections[i]) {
+				t.Errorf("Split() part %d did not match its section", i)
+			}
+		}
+	})
+
+	t.Run("NewDecompressor", func(t *testing.T) {
+		zr, err := NewDecompressor(bytes.NewReader(testCompress(t, "fake", []byte("contents"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		b, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "contents" {
+			t.Errorf("got %q, want %q", b, "contents")
+		}
+	})
+}
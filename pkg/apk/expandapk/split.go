@@ -7,8 +7,6 @@ import (
 	"fmt"
 	"io"
 	"strings"
-
-	"github.com/klauspost/compress/gzip"
 )
 
 // Split takes an APK reader and splits it into its constituent parts.
@@ -17,7 +15,8 @@ import (
 // If the length of the returned slice is 2, the first part is the control section.
 // The last part is the data section.
 //
-// These values are the compressed gzip streams, and should be decompressed before use.
+// These values are the compressed streams, and should be decompressed before use. The sections
+// may be compressed in any of the registered formats, see RegisterDecompressor.
 //
 // The signature and control sections are buffered in memory, while the data section is streamed
 // from the input reader.
@@ -29,13 +28,12 @@ func Split(source io.Reader) ([]io.Reader, error) {
 	buf := bytes.Buffer{}
 	tee := &teeByteReader{r: br, w: &buf}
 
-	gzi, err := gzip.NewReader(tee)
+	zr, err := NewStreamDecompressor(tee)
 	if err != nil {
-		return nil, fmt.Errorf("creating gzip reader: %w", err)
+		return nil, fmt.Errorf("creating decompressor: %w", err)
 	}
-	gzi.Multistream(false)
 
-	tr := tar.NewReader(gzi)
+	tr := tar.NewReader(zr)
 	hdr, err := tr.Next()
 	if err != nil {
 		return nil, fmt.Errorf("reading first tar header: %w", err)
@@ -43,9 +41,12 @@ func Split(source io.Reader) ([]io.Reader, error) {
 
 	// Handle optional signature section.
 	if strings.HasPrefix(hdr.Name, ".SIGN.") {
-		if _, err := io.Copy(io.Discard, gzi); err != nil {
+		if _, err := io.Copy(io.Discard, zr); err != nil {
 			return nil, fmt.Errorf("copying signature stream: %w", err)
 		}
+		if err := zr.Close(); err != nil {
+			return nil, fmt.Errorf("closing decompressor after signature: %w", err)
+		}
 
 		parts = append(parts, bytes.NewReader(buf.Bytes()))
 
@@ -53,21 +54,20 @@ func Split(source io.Reader) ([]io.Reader, error) {
 		buf = bytes.Buffer{}
 		tee.w = &buf
 
-		if err := gzi.Reset(tee); err != nil {
-			return nil, fmt.Errorf("resetting gzip reader after signature: %w", err)
+		if zr, err = NewStreamDecompressor(tee); err != nil {
+			return nil, fmt.Errorf("creating decompressor after signature: %w", err)
 		}
-		gzi.Multistream(false)
 	}
 
 	// There should always be a control section.
-	if _, err := io.Copy(io.Discard, gzi); err != nil {
+	if _, err := io.Copy(io.Discard, zr); err != nil {
 		return nil, fmt.Errorf("copying signature stream: %w", err)
 	}
 
 	parts = append(parts, bytes.NewReader(buf.Bytes()))
 
-	if err := gzi.Close(); err != nil {
-		return nil, fmt.Errorf("closing gzip reader: %w", err)
+	if err := zr.Close(); err != nil {
+		return nil, fmt.Errorf("closing decompressor: %w", err)
 	}
 
 	// And the rest is the data section.
@@ -76,7 +76,8 @@ func Split(source io.Reader) ([]io.Reader, error) {
 	return parts, nil
 }
 
-// like io.TeeReader but also implements io.ByteReader for gzip.
+// like io.TeeReader but also implements io.ByteReader, so that decompressors stop at the end
+// of their stream.
 //
 // From gzip.Reader.Multistream:
 //
@@ -16,6 +16,7 @@ package fs
 import (
 	"io"
 	"io/fs"
+	"time"
 )
 
 // FullFS is a filesystem that supports all filesystem operations.
@@ -80,6 +81,20 @@ type OpenReaderAtReadLinkReadnodFS interface {
 	ReadnodFS
 }
 
+// RenameFS is a filesystem that can rename a file, replacing newname if it exists, so that
+// newname always refers to either the old or the new file.
+type RenameFS interface {
+	fs.FS
+	Rename(oldname, newname string) error
+}
+
+// ChtimesFS is a filesystem that can change the access and modification times of a file. Like
+// os.Chtimes, it follows symlinks.
+type ChtimesFS interface {
+	fs.FS
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
 type XattrFS interface {
 	fs.FS
 	SetXattr(path string, attr string, data []byte) error
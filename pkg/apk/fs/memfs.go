@@ -26,6 +26,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -382,6 +383,16 @@ func (m *memFS) Chown(path string, uid, gid int) error {
 	return nil
 }
 
+// Chtimes sets the modification time of name. Access times are not kept.
+func (m *memFS) Chtimes(path string, _, mtime time.Time) error {
+	anode, err := m.getNode(path)
+	if err != nil {
+		return err
+	}
+	anode.modTime = mtime
+	return nil
+}
+
 func (m *memFS) Create(name string) (File, error) {
 	return m.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
 }
@@ -467,6 +478,46 @@ func (m *memFS) Remove(name string) error {
 	return nil
 }
 
+// Rename moves the node at oldname to newname, replacing any file that is there. Directories
+// cannot be replaced.
+func (m *memFS) Rename(oldname, newname string) error {
+	oldParent, err := m.getNode(filepath.Dir(oldname))
+	if err != nil {
+		return err
+	}
+	newParent, err := m.getNode(filepath.Dir(newname))
+	if err != nil {
+		return err
+	}
+	oldBase, newBase := filepath.Base(oldname), filepath.Base(newname)
+
+	oldParent.mu.Lock()
+	anode, ok := oldParent.children[oldBase]
+	oldParent.mu.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	// the new name refers to the node before the old name goes away, so it never is missing
+	newParent.mu.Lock()
+	if existing, ok := newParent.children[newBase]; ok && existing != anode && existing.dir {
+		newParent.mu.Unlock()
+		return fmt.Errorf("cannot replace directory %s: %w", newname, os.ErrExist)
+	}
+	newParent.children[newBase] = anode
+	newParent.mu.Unlock()
+
+	if oldParent == newParent && oldBase == newBase {
+		return nil
+	}
+	oldParent.mu.Lock()
+	if oldParent.children[oldBase] == anode {
+		delete(oldParent.children, oldBase)
+	}
+	oldParent.mu.Unlock()
+	return nil
+}
+
 func (m *memFS) SetXattr(path string, attr string, data []byte) error {
 	node, err := m.getNode(path)
 	if err != nil {
@@ -632,8 +683,12 @@ type node struct {
 	children     map[string]*node
 	mu           sync.Mutex
 	xattrs       map[string][]byte
+	ino          uint64 // assigned on first use by Ino
 }
 
+// lastIno is the last inode number given out by memFileInfo.Ino.
+var lastIno atomic.Uint64
+
 func (n *node) fileInfo(name string) fs.FileInfo {
 	return &memFileInfo{
 		node: n,
@@ -668,3 +723,18 @@ func (m *memFileInfo) Sys() any {
 		Gid:  m.gid,
 	}
 }
+
+// Nlink returns the number of names the file has, for telling hard links apart.
+func (m *memFileInfo) Nlink() uint64 {
+	return uint64(m.linkCount) + 1
+}
+
+// Ino returns a number that identifies the file within the process, shared by its hard links.
+func (m *memFileInfo) Ino() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ino == 0 {
+		m.ino = lastIno.Add(1)
+	}
+	return m.ino
+}
@@ -450,3 +450,23 @@ func TestMemFSConsistentOrdering(t *testing.T) {
 	}
 	// all results should be the same
 }
+
+func TestMemFSRename(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.MkdirAll("a/b", 0o755))
+	require.NoError(t, m.MkdirAll("c", 0o755))
+	require.NoError(t, m.WriteFile("a/b/old", []byte("new content"), 0o644))
+	require.NoError(t, m.WriteFile("c/target", []byte("old content"), 0o644))
+
+	rfs, ok := m.(RenameFS)
+	require.True(t, ok)
+	require.NoError(t, rfs.Rename("a/b/old", "c/target"))
+	_, err := m.Stat("a/b/old")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	b, err := m.ReadFile("c/target")
+	require.NoError(t, err)
+	require.Equal(t, "new content", string(b))
+
+	require.ErrorIs(t, rfs.Rename("a/b/missing", "c/other"), os.ErrNotExist)
+	require.ErrorIs(t, rfs.Rename("c/target", "a/b"), os.ErrExist)
+}
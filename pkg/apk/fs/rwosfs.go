@@ -361,6 +361,29 @@ func (f *dirFS) Remove(name string) error {
 	return nil
 }
 
+// Rename renames oldname to newname, replacing newname if it exists. On a case-insensitive
+// filesystem, the file is copied and the original removed instead, which is not atomic.
+func (f *dirFS) Rename(oldname, newname string) error {
+	if f.caseMap != nil {
+		fi, err := f.Lstat(oldname)
+		if err != nil {
+			return err
+		}
+		b, err := f.ReadFile(oldname)
+		if err != nil {
+			return err
+		}
+		if err := f.WriteFile(newname, b, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		return f.Remove(oldname)
+	}
+	if err := os.Rename(filepath.Join(f.base, oldname), filepath.Join(f.base, newname)); err != nil {
+		return err
+	}
+	return f.overrides.(RenameFS).Rename(oldname, newname)
+}
+
 func (f *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
 	// get those on disk
 	var (
@@ -502,6 +525,17 @@ func (f *dirFS) Chown(path string, uid, gid int) error {
 	}
 	return f.overrides.Chown(path, uid, gid)
 }
+func (f *dirFS) Chtimes(path string, atime, mtime time.Time) error {
+	if f.caseSensitiveOnDisk(path) {
+		if err := os.Chtimes(filepath.Join(f.base, path), atime, mtime); err != nil {
+			return err
+		}
+	}
+	if c, ok := f.overrides.(ChtimesFS); ok {
+		return c.Chtimes(path, atime, mtime)
+	}
+	return nil
+}
 
 func (f *dirFS) Mknod(name string, mode uint32, dev int) error {
 	if f.caseSensitiveOnDisk(name) {
@@ -35,7 +35,17 @@ import (
 
 const xattrTarPAXRecordsPrefix = "SCHILY.xattr."
 
+// linkedFileInfo is implemented by the fs.FileInfo of filesystems that track hard links without
+// a syscall.Stat_t, such as the in-memory one.
+type linkedFileInfo interface {
+	Nlink() uint64
+	Ino() uint64
+}
+
 func hasHardlinks(fi fs.FileInfo) bool {
+	if lfi, ok := fi.(linkedFileInfo); ok {
+		return lfi.Nlink() > 1
+	}
 	if stat := fi.Sys(); stat != nil {
 		si, ok := stat.(*syscall.Stat_t)
 		if !ok {
@@ -55,6 +65,9 @@ func hasHardlinks(fi fs.FileInfo) bool {
 }
 
 func getInodeFromFileInfo(fi fs.FileInfo) (uint64, error) {
+	if lfi, ok := fi.(linkedFileInfo); ok {
+		return lfi.Ino(), nil
+	}
 	if stat := fi.Sys(); stat != nil {
 		si, ok := stat.(*syscall.Stat_t)
 		if !ok {
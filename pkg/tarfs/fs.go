@@ -522,7 +522,7 @@ func (m *memFS) writeHeader(name string, te tarEntry) (bool, error) {
 
 	// At this point we know the files conflict, but it's okay if this file replaces that one.
 	if !sameOrigin && !replaces {
-		return false, fmt.Errorf("conflicting file %q in %q has different origin %q != %q in %q", name, got.pkg.Name, got.pkg.Origin, want.pkg.Origin, want.pkg.Name)
+		return false, &apk.FileConflictError{Path: name, Owner: got.pkg.Name, Conflict: want.pkg.Name}
 	}
 
 	anode := &node{
@@ -653,6 +653,16 @@ func (m *memFS) Chown(path string, uid, gid int) error {
 	return nil
 }
 
+// Chtimes sets the modification time of name. Access times are not kept.
+func (m *memFS) Chtimes(path string, _, mtime time.Time) error {
+	anode, err := m.getNode(path)
+	if err != nil {
+		return err
+	}
+	anode.modTime = mtime
+	return nil
+}
+
 func (m *memFS) Create(name string) (apkfs.File, error) {
 	return m.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
 }
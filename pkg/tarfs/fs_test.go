@@ -17,6 +17,7 @@ package tarfs
 import (
 	"archive/tar"
 	"context"
+	"errors"
 	"path/filepath"
 	"testing"
 
@@ -102,8 +103,12 @@ func TestTarFS(t *testing.T) {
 	file.PAXRecords = map[string]string{
 		"APK-TOOLS.checksum.SHA1": "0000000000000000000000000000000000000000",
 	}
-	if _, err := tfs.WriteHeader(*file, tfs, otherPkg); err == nil {
-		t.Errorf("wanted conflicting checksum err, got nil")
+	_, err = tfs.WriteHeader(*file, tfs, otherPkg)
+	var conflict *apk.FileConflictError
+	if !errors.As(err, &conflict) {
+		t.Errorf("wanted conflicting checksum err, got %v", err)
+	} else if conflict.Owner != pkg.Name || conflict.Conflict != otherPkg.Name {
+		t.Errorf("wanted conflict between %q and %q, got %v", pkg.Name, otherPkg.Name, conflict)
 	}
 
 	otherPkg.Replaces = []string{pkg.Name}